@@ -181,6 +181,10 @@ func makeFullNode(ctx *cli.Context) (*node.Node, ethapi.Backend) {
 	if ctx.IsSet(utils.SyncTargetFlag.Name) && cfg.Eth.SyncMode == downloader.FullSync {
 		utils.RegisterFullSyncTester(stack, eth, ctx.Path(utils.SyncTargetFlag.Name))
 	}
+	// Trace imported transactions if requested
+	if ctx.IsSet(utils.ImportTraceDirFlag.Name) && eth != nil {
+		utils.RegisterImportTracer(ctx, eth.BlockChain())
+	}
 	return stack, backend
 }
 
@@ -140,6 +140,10 @@ var (
 		utils.DeveloperPeriodFlag,
 		utils.DeveloperGasLimitFlag,
 		utils.VMEnableDebugFlag,
+		utils.ImportTraceDirFlag,
+		utils.ImportTraceTracerFlag,
+		utils.ImportTraceConfigFlag,
+		utils.TracerOutputDirFlag,
 		utils.NetworkIdFlag,
 		utils.EthStatsURLFlag,
 		utils.FakePoWFlag,
@@ -22,6 +22,7 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
@@ -53,6 +54,7 @@ import (
 	"github.com/ethereum/go-ethereum/eth/filters"
 	"github.com/ethereum/go-ethereum/eth/gasprice"
 	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/eth/tracers/native"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethdb/remotedb"
 	"github.com/ethereum/go-ethereum/ethstats"
@@ -597,6 +599,27 @@ var (
 		Usage:    "Record information useful for VM and contract debugging",
 		Category: flags.VMCategory,
 	}
+	ImportTraceDirFlag = &flags.DirectoryFlag{
+		Name:     "benchmark.importtrace",
+		Usage:    "Benchmarking only: trace every imported transaction, writing the results into this directory",
+		Category: flags.VMCategory,
+	}
+	ImportTraceTracerFlag = &cli.StringFlag{
+		Name:     "benchmark.importtrace.tracer",
+		Usage:    "Tracer run on every imported transaction",
+		Value:    "txSummaryTracer",
+		Category: flags.VMCategory,
+	}
+	ImportTraceConfigFlag = &cli.StringFlag{
+		Name:     "benchmark.importtrace.config",
+		Usage:    "JSON config of the tracer run on every imported transaction",
+		Category: flags.VMCategory,
+	}
+	TracerOutputDirFlag = &flags.DirectoryFlag{
+		Name:     "tracer.outputdir",
+		Usage:    "Directory tracers may create the output files named in their config in (disabled if unset)",
+		Category: flags.VMCategory,
+	}
 
 	// API options.
 	RPCGlobalGasCapFlag = &cli.Uint64Flag{
@@ -1832,6 +1855,9 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *ethconfig.Config) {
 		// TODO(fjl): force-enable this in --dev mode
 		cfg.EnablePreimageRecording = ctx.Bool(VMEnableDebugFlag.Name)
 	}
+	if ctx.IsSet(TracerOutputDirFlag.Name) {
+		native.SetOutputDir(ctx.String(TracerOutputDirFlag.Name))
+	}
 
 	if ctx.IsSet(RPCGlobalGasCapFlag.Name) {
 		cfg.RPCGasCap = ctx.Uint64(RPCGlobalGasCapFlag.Name)
@@ -2272,9 +2298,36 @@ func MakeChain(ctx *cli.Context, stack *node.Node, readonly bool) (*core.BlockCh
 	if err != nil {
 		Fatalf("Can't create BlockChain: %v", err)
 	}
+	if ctx.IsSet(ImportTraceDirFlag.Name) {
+		RegisterImportTracer(ctx, chain)
+	}
 	return chain, chainDb
 }
 
+// RegisterImportTracer attaches the tracer configured by the benchmarking
+// flags to the transactions imported into the chain.
+func RegisterImportTracer(ctx *cli.Context, chain *core.BlockChain) {
+	var (
+		name   = ctx.String(ImportTraceTracerFlag.Name)
+		dir    = ctx.String(ImportTraceDirFlag.Name)
+		config json.RawMessage
+	)
+	if ctx.IsSet(ImportTraceConfigFlag.Name) {
+		config = json.RawMessage(ctx.String(ImportTraceConfigFlag.Name))
+	}
+	// The import command doesn't go through SetEthConfig, so the directory for
+	// the output files named in the config is set here too
+	if ctx.IsSet(TracerOutputDirFlag.Name) {
+		native.SetOutputDir(ctx.String(TracerOutputDirFlag.Name))
+	}
+	hook, err := tracers.NewImportTracer(name, config, dir)
+	if err != nil {
+		Fatalf("Failed to create import tracer: %v", err)
+	}
+	chain.SetTxTraceHook(hook)
+	log.Warn("Tracing imported transactions, for benchmarking only", "tracer", name, "dir", dir)
+}
+
 // MakeConsolePreloads retrieves the absolute paths for the console JavaScript
 // scripts to preload before starting.
 func MakeConsolePreloads(ctx *cli.Context) []string {
@@ -224,6 +224,7 @@ type BlockChain struct {
 	processor  Processor // Block transaction processor interface
 	forker     *ForkChoice
 	vmConfig   vm.Config
+	txTracer   TxTraceHook // Benchmarking hook tracing imported transactions, nil if disabled
 }
 
 // NewBlockChain returns a fully initialised block chain using information
@@ -1525,6 +1526,22 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 	return bc.insertChain(chain, true, true)
 }
 
+// SetTxTraceHook installs a hook attaching tracers to the transactions of
+// imported blocks, for benchmarking purposes. It must be called before blocks
+// are imported.
+func (bc *BlockChain) SetTxTraceHook(hook TxTraceHook) {
+	bc.txTracer = hook
+}
+
+// processBlock executes the transactions of a block being imported, tracing
+// them with the configured hook if any.
+func (bc *BlockChain) processBlock(block *types.Block, statedb *state.StateDB) (types.Receipts, []*types.Log, uint64, error) {
+	if p, ok := bc.processor.(*StateProcessor); ok && bc.txTracer != nil {
+		return p.process(block, statedb, bc.vmConfig, bc.txTracer)
+	}
+	return bc.processor.Process(block, statedb, bc.vmConfig)
+}
+
 // insertChain is the internal implementation of InsertChain, which assumes that
 // 1) chains are contiguous, and 2) The chain mutex is held.
 //
@@ -1752,7 +1769,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals, setHead bool)
 
 		// Process block using the parent state as reference point
 		pstart := time.Now()
-		receipts, logs, usedGas, err := bc.processor.Process(block, statedb, bc.vmConfig)
+		receipts, logs, usedGas, err := bc.processBlock(block, statedb)
 		if err != nil {
 			bc.reportBlock(block, receipts, err)
 			followupInterrupt.Store(true)
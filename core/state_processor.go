@@ -57,6 +57,16 @@ func NewStateProcessor(config *params.ChainConfig, bc *BlockChain, engine consen
 // returns the amount of gas that was used in the process. If any of the
 // transactions failed to execute due to insufficient gas it will return an error.
 func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, uint64, error) {
+	return p.process(block, statedb, cfg, nil)
+}
+
+// process implements Process, attaching tracers created by the hook to the
+// individual transactions if given.
+func (p *StateProcessor) process(block *types.Block, statedb *state.StateDB, cfg vm.Config, hook TxTraceHook) (types.Receipts, []*types.Log, uint64, error) {
+	// A tracer configured for the whole block takes precedence
+	if cfg.Tracer != nil {
+		hook = nil
+	}
 	var (
 		receipts    types.Receipts
 		usedGas     = new(uint64)
@@ -79,7 +89,14 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 			return nil, nil, 0, fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
 		}
 		statedb.SetTxContext(tx.Hash(), i)
+		if hook != nil {
+			vmenv.Config.Tracer = hook.TraceTx(block, tx, i)
+		}
 		receipt, err := applyTransaction(msg, p.config, gp, statedb, blockNumber, blockHash, tx, usedGas, vmenv)
+		if hook != nil {
+			vmenv.Config.Tracer = nil
+			hook.TxDone(block, tx, i, receipt, err)
+		}
 		if err != nil {
 			return nil, nil, 0, fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
 		}
@@ -44,6 +44,19 @@ type Prefetcher interface {
 	Prefetch(block *types.Block, statedb *state.StateDB, cfg vm.Config, interrupt *atomic.Bool)
 }
 
+// TxTraceHook attaches tracers to the individual transactions processed during
+// block import. It is meant for benchmarking the EVM on real chain data: the
+// tracers only observe execution, their results must never influence it.
+type TxTraceHook interface {
+	// TraceTx returns the tracer to attach to a transaction, or nil to execute
+	// it untraced.
+	TraceTx(block *types.Block, tx *types.Transaction, index int) vm.EVMLogger
+
+	// TxDone is called once the transaction was executed, with its receipt or
+	// the error that rendered the block invalid.
+	TxDone(block *types.Block, tx *types.Transaction, index int, receipt *types.Receipt, err error)
+}
+
 // Processor is an interface for processing blocks using a given initial state.
 type Processor interface {
 	// Process processes the state changes according to the Ethereum rules by running
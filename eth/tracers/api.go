@@ -93,11 +93,12 @@ type Backend interface {
 // API is the collection of tracing APIs exposed over the private debugging endpoint.
 type API struct {
 	backend Backend
+	spool   *resultSpool // Results of async traces being encoded or awaiting retrieval
 }
 
 // NewAPI creates a new API definition for the tracing methods of the Ethereum service.
 func NewAPI(backend Backend) *API {
-	return &API{backend: backend}
+	return &API{backend: backend, spool: newResultSpool("")}
 }
 
 type chainContext struct {
@@ -178,6 +179,12 @@ type TraceConfig struct {
 	Tracer  *string
 	Timeout *string
 	Reexec  *uint64
+	// If set, the trace call returns a handle as soon as execution finishes
+	// and the result is encoded in the background, to be retrieved through
+	// debug_traceResult until it expires after AsyncTTL, which has to be
+	// positive and is cut to an hour.
+	Async    *bool
+	AsyncTTL *string
 	// Config specific to given tracer. Note struct logger
 	// config are historically embedded in main object.
 	TracerConfig json.RawMessage
@@ -943,6 +950,12 @@ func (api *API) TraceCall(ctx context.Context, args ethapi.TransactionArgs, bloc
 	return api.traceTx(ctx, msg, new(Context), vmctx, statedb, traceConfig)
 }
 
+// TracerColumns returns the columns of the tabular output the named tracer
+// produces for the given tracer config, without running a trace.
+func (api *API) TracerColumns(ctx context.Context, name string, config json.RawMessage) ([]ColumnInfo, error) {
+	return DefaultDirectory.Columns(name, new(Context), config)
+}
+
 // traceTx configures a new tracer according to the provided configuration, and
 // executes the given message in the provided environment. The return value will
 // be tracer dependent.
@@ -972,6 +985,16 @@ func (api *API) traceTx(ctx context.Context, message *core.Message, txctx *Conte
 			return nil, err
 		}
 	}
+	// Check the time to live of an async result before tracing
+	var (
+		async = config.Async != nil && *config.Async
+		ttl   time.Duration
+	)
+	if async {
+		if ttl, err = parseResultTTL(config.AsyncTTL); err != nil {
+			return nil, err
+		}
+	}
 	deadlineCtx, cancel := context.WithTimeout(ctx, timeout)
 	go func() {
 		<-deadlineCtx.Done()
@@ -988,9 +1011,38 @@ func (api *API) traceTx(ctx context.Context, message *core.Message, txctx *Conte
 	if _, err = core.ApplyMessage(vmenv, message, new(core.GasPool).AddGas(message.GasLimit)); err != nil {
 		return nil, fmt.Errorf("tracing failed: %w", err)
 	}
+	if async {
+		return api.spool.add(tracer, ttl)
+	}
 	return tracer.GetResult()
 }
 
+// TraceResult returns the result of a trace made in async mode, waiting for
+// its encoding to finish if needed. If a length is given, only that many bytes
+// of the encoded result starting at offset are returned, allowing huge results
+// to be fetched in chunks.
+func (api *API) TraceResult(ctx context.Context, handle string, offset *hexutil.Uint64, length *hexutil.Uint64) (interface{}, error) {
+	if offset == nil && length == nil {
+		data, _, err := api.spool.fetch(ctx, handle, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(data), nil
+	}
+	var from, size uint64
+	if offset != nil {
+		from = uint64(*offset)
+	}
+	if length != nil {
+		size = uint64(*length)
+	}
+	data, total, err := api.spool.fetch(ctx, handle, from, size)
+	if err != nil {
+		return nil, err
+	}
+	return &ResultChunk{Data: string(data), Offset: hexutil.Uint64(from), Size: hexutil.Uint64(total)}, nil
+}
+
 // APIs return the collection of RPC services the tracer package offers.
 func APIs(backend Backend) []rpc.API {
 	// Append all the local APIs and return
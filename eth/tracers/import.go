@@ -0,0 +1,122 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// ImportTracer is a core.TxTraceHook running a tracer on every transaction
+// processed during block import, writing each result into a file named after
+// the block number, transaction index and hash. It is a benchmarking aid:
+// tracing during import avoids the overhead and the cold caches of replaying
+// transactions through the debug API one by one.
+//
+// Results are write-only side artifacts. Tracing failures are logged and never
+// affect block processing. Note that transactions of blocks which end up being
+// rejected are traced as well.
+type ImportTracer struct {
+	name   string          // Name of the tracer to run
+	config json.RawMessage // Config of the tracer to run
+	dir    string          // Directory to write the results into
+	tracer Tracer          // Tracer of the transaction being processed
+}
+
+var _ core.TxTraceHook = (*ImportTracer)(nil)
+
+// importConfig holds the tracer options refused during block import, as they
+// would reach beyond the write-only results: stateTiming wraps the StateDB of
+// the block being processed and deterministic disables the garbage collector
+// of the whole node.
+type importConfig struct {
+	StateTiming   bool `json:"stateTiming"`
+	Deterministic bool `json:"deterministic"`
+}
+
+// NewImportTracer creates a hook running the named tracer with the given
+// config, writing the results into dir.
+func NewImportTracer(name string, config json.RawMessage, dir string) (*ImportTracer, error) {
+	var cfg importConfig
+	if config != nil {
+		// Malformed configs are left to the tracer to reject
+		json.Unmarshal(config, &cfg)
+	}
+	if cfg.StateTiming || cfg.Deterministic {
+		return nil, errors.New("stateTiming and deterministic cannot be used to trace block import")
+	}
+	// Fail early on an unknown tracer or invalid config
+	if _, err := DefaultDirectory.New(name, new(Context), config); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ImportTracer{name: name, config: config, dir: dir}, nil
+}
+
+// TraceTx implements core.TxTraceHook, creating the tracer of a transaction.
+func (t *ImportTracer) TraceTx(block *types.Block, tx *types.Transaction, index int) vm.EVMLogger {
+	txctx := &Context{
+		BlockHash:   block.Hash(),
+		BlockNumber: block.Number(),
+		TxIndex:     index,
+		TxHash:      tx.Hash(),
+	}
+	tracer, err := DefaultDirectory.New(t.name, txctx, t.config)
+	if err != nil {
+		log.Warn("Failed to create import tracer", "tracer", t.name, "err", err)
+		t.tracer = nil
+		return nil
+	}
+	t.tracer = tracer
+	return tracer
+}
+
+// TxDone implements core.TxTraceHook, writing out the result of the tracer of
+// a successfully executed transaction. The tracer of a failed one is stopped
+// and its result discarded.
+func (t *ImportTracer) TxDone(block *types.Block, tx *types.Transaction, index int, receipt *types.Receipt, err error) {
+	tracer := t.tracer
+	t.tracer = nil
+	if tracer == nil {
+		return
+	}
+	if err != nil {
+		// Retrieving the result releases whatever the tracer still holds
+		tracer.Stop(err)
+		tracer.GetResult()
+		return
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		log.Warn("Failed to retrieve import trace result", "number", block.NumberU64(), "index", index, "err", err)
+		return
+	}
+	path := filepath.Join(t.dir, fmt.Sprintf("%d-%d-%s.json", block.NumberU64(), index, tx.Hash().Hex()))
+	if err := os.WriteFile(path, res, 0644); err != nil {
+		log.Warn("Failed to write import trace result", "path", path, "err", err)
+	}
+}
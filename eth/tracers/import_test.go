@@ -0,0 +1,152 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers/logger"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func init() {
+	DefaultDirectory.Register("importTestTracer", func(ctx *Context, cfg json.RawMessage) (Tracer, error) {
+		return logger.NewStructLogger(nil), nil
+	}, false)
+}
+
+// releaseTestTracer is a tracer recording whether it was stopped and whether
+// its result was retrieved.
+type releaseTestTracer struct {
+	*logger.StructLogger
+	stopped  error
+	released bool
+}
+
+func (t *releaseTestTracer) Stop(err error) {
+	t.stopped = err
+	t.StructLogger.Stop(err)
+}
+
+func (t *releaseTestTracer) GetResult() (json.RawMessage, error) {
+	t.released = true
+	return t.StructLogger.GetResult()
+}
+
+// Tests that the import tracer writes a result for every imported transaction
+// without affecting block processing.
+func TestImportTracer(t *testing.T) {
+	accounts := newAccounts(2)
+	genesis := &core.Genesis{
+		Config: params.TestChainConfig,
+		Alloc: core.GenesisAlloc{
+			accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+		},
+	}
+	signer := types.HomesteadSigner{}
+	_, blocks, _ := core.GenerateChainWithGenesis(genesis, ethash.NewFaker(), 3, func(i int, b *core.BlockGen) {
+		for j := 0; j < 2; j++ {
+			tx, _ := types.SignTx(types.NewTransaction(uint64(2*i+j), accounts[1].addr, big.NewInt(1000), params.TxGas, b.BaseFee(), nil), signer, accounts[0].key)
+			b.AddTx(tx)
+		}
+	})
+	chain, err := core.NewBlockChain(rawdb.NewMemoryDatabase(), nil, genesis, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	dir := filepath.Join(t.TempDir(), "traces")
+	hook, err := NewImportTracer("importTestTracer", nil, dir)
+	if err != nil {
+		t.Fatalf("failed to create import tracer: %v", err)
+	}
+	chain.SetTxTraceHook(hook)
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	for _, block := range blocks {
+		for i, tx := range block.Transactions() {
+			blob, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%d-%d-%s.json", block.NumberU64(), i, tx.Hash().Hex())))
+			if err != nil {
+				t.Fatalf("missing trace result: %v", err)
+			}
+			var res logger.ExecutionResult
+			if err := json.Unmarshal(blob, &res); err != nil {
+				t.Fatalf("invalid trace result: %v", err)
+			}
+			if res.Gas != params.TxGas {
+				t.Fatalf("block %d tx %d: gas mismatch: have %d, want %d", block.NumberU64(), i, res.Gas, params.TxGas)
+			}
+		}
+	}
+}
+
+// Tests that the options reaching beyond the trace results are refused.
+func TestImportTracerRefusedOptions(t *testing.T) {
+	for _, config := range []string{`{"stateTiming":true}`, `{"deterministic":true}`} {
+		if _, err := NewImportTracer("importTestTracer", json.RawMessage(config), t.TempDir()); err == nil {
+			t.Errorf("config %s: expected error", config)
+		}
+	}
+	if _, err := NewImportTracer("importTestTracer", json.RawMessage(`{"stateTiming":false}`), t.TempDir()); err != nil {
+		t.Fatalf("failed to create import tracer: %v", err)
+	}
+}
+
+// Tests that the tracer of a failed transaction is stopped and released
+// without writing a result.
+func TestImportTracerFailedTx(t *testing.T) {
+	dir := t.TempDir()
+	hook, err := NewImportTracer("importTestTracer", nil, dir)
+	if err != nil {
+		t.Fatalf("failed to create import tracer: %v", err)
+	}
+	var (
+		block  = types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)})
+		tx     = types.NewTransaction(0, common.Address{}, nil, params.TxGas, nil, nil)
+		tracer = &releaseTestTracer{StructLogger: logger.NewStructLogger(nil)}
+		txErr  = errors.New("nonce too low")
+	)
+	hook.tracer = tracer
+	hook.TxDone(block, tx, 0, nil, txErr)
+
+	if tracer.stopped != txErr {
+		t.Errorf("tracer not stopped with the transaction error: have %v", tracer.stopped)
+	}
+	if !tracer.released {
+		t.Error("tracer not released")
+	}
+	if hook.tracer != nil {
+		t.Error("tracer still held by the hook")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("unexpected trace results: %d", len(entries))
+	}
+}
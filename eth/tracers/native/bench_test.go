@@ -0,0 +1,88 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// benchOpcodes is the synthetic opcode stream fed to the tracers in the
+// CaptureState benchmarks.
+var benchOpcodes = []vm.OpCode{
+	vm.JUMPDEST, vm.PUSH1, vm.PUSH1, vm.ADD, vm.DUP1, vm.PUSH1, vm.MSTORE,
+	vm.PUSH1, vm.SLOAD, vm.PUSH1, vm.PUSH1, vm.KECCAK256, vm.POP, vm.JUMP,
+}
+
+// captureSteps feeds n steps of the synthetic opcode stream to the tracer.
+func captureSteps(tracer tracers.Tracer, gas *uint64, n int) {
+	for i := 0; i < n; i++ {
+		op := benchOpcodes[i%len(benchOpcodes)]
+		tracer.CaptureState(uint64(i%len(benchOpcodes)), op, *gas, 3, nil, nil, 1, nil)
+		*gas -= 3
+	}
+}
+
+// benchmarkCaptureState measures the per step cost of a tracer in a running
+// transaction.
+func benchmarkCaptureState(b *testing.B, tracer tracers.Tracer) {
+	gas := uint64(1 << 62)
+	tracer.CaptureTxStart(gas)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, gas, nil)
+	reserveSteps(tracer, b.N)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	captureSteps(tracer, &gas, b.N)
+}
+
+// reserveSteps makes room for n more rows in the tracer's in-memory samples,
+// so that recording n steps allocates nothing for the rows themselves. The
+// timingTracer reserves its first chunk of rows in CaptureTxStart already.
+func reserveSteps(tracer tracers.Tracer, n int) {
+	switch t := tracer.(type) {
+	case *cycleTracer:
+		t.samples = append(make([]cycleSample, 0, len(t.samples)+n), t.samples...)
+	case *perfTracer:
+		t.samples = append(make([]perfSample, 0, len(t.samples)+n), t.samples...)
+	}
+}
+
+// allocSteps is the number of steps whose allocations are counted.
+const allocSteps = 1000
+
+// testCaptureStateAllocs checks that a tracer doesn't allocate per step once
+// the trace is running.
+func testCaptureStateAllocs(t *testing.T, tracer tracers.Tracer) {
+	gas := uint64(1 << 62)
+	tracer.CaptureTxStart(gas)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, gas, nil)
+	captureSteps(tracer, &gas, 1<<10)
+
+	// All steps are counted in a single run, as AllocsPerRun truncates the
+	// average of several runs. It runs the function once more to warm up.
+	reserveSteps(tracer, 2*allocSteps)
+	allocs := testing.AllocsPerRun(1, func() {
+		captureSteps(tracer, &gas, allocSteps)
+	})
+	if allocs != 0 {
+		t.Fatalf("CaptureState allocated %v times in %d steps", allocs, allocSteps)
+	}
+}
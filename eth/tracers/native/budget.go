@@ -0,0 +1,80 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"fmt"
+	"time"
+)
+
+// budgetCheckInterval is the number of steps between two reads of the clock
+// when a time budget is configured, keeping the check off the hot path.
+const budgetCheckInterval = 4096
+
+// traceBudget bounds the wall clock time a tracer spends recording steps.
+// Unlike Stop, which aborts the execution on behalf of the caller, running out
+// of budget merely turns the tracer into a pass-through, so the transaction
+// still completes with a valid result and the steps recorded so far are kept.
+type traceBudget struct {
+	limit    time.Duration // Time allowed for tracing, zero for no limit
+	deadline time.Time     // Point in time the budget expires
+	steps    int           // Number of steps traced, the expired step once exceeded
+	exceeded bool          // Whether the budget ran out
+}
+
+// newTraceBudget creates a budget of the given number of milliseconds, zero
+// meaning unlimited.
+func newTraceBudget(ms int) (*traceBudget, error) {
+	if ms < 0 {
+		return nil, fmt.Errorf("invalid budgetMs %d", ms)
+	}
+	return &traceBudget{limit: time.Duration(ms) * time.Millisecond}, nil
+}
+
+// start sets off the clock at the beginning of the trace.
+func (b *traceBudget) start() {
+	if b.limit > 0 {
+		b.deadline = time.Now().Add(b.limit)
+	}
+}
+
+// step accounts for a single execution step and reports whether it should be
+// traced. Once the budget is exceeded, all remaining steps are skipped.
+func (b *traceBudget) step() bool {
+	if b.exceeded {
+		return false
+	}
+	if b.limit > 0 && b.steps%budgetCheckInterval == 0 && !time.Now().Before(b.deadline) {
+		b.exceeded = true
+		return false
+	}
+	b.steps++
+	return true
+}
+
+// annotate reports the outcome of the budget in the result metadata.
+func (b *traceBudget) annotate(meta *tableMeta) {
+	if b.limit == 0 {
+		return
+	}
+	exceeded := b.exceeded
+	meta.BudgetExceeded = &exceeded
+	if exceeded {
+		step := b.steps
+		meta.BudgetExpiredStep = &step
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// loopCode is bytecode jumping back to its start until it runs out of gas.
+var loopCode = []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.JUMP)}
+
+func TestTraceBudgetExpiry(t *testing.T) {
+	budget, err := newTraceBudget(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget.start()
+	for i := 0; i < 3*budgetCheckInterval+1; i++ {
+		if !budget.step() {
+			t.Fatalf("step %d skipped within budget", i)
+		}
+	}
+	// Expire the budget, it should be noticed at the next check
+	budget.deadline = time.Now().Add(-time.Second)
+	for i := 0; i < budgetCheckInterval-1; i++ {
+		if !budget.step() {
+			t.Fatalf("step %d skipped before the check", i)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if budget.step() {
+			t.Fatalf("step traced after expiry")
+		}
+	}
+	var meta tableMeta
+	budget.annotate(&meta)
+	if meta.BudgetExceeded == nil || !*meta.BudgetExceeded {
+		t.Fatalf("budget not reported as exceeded")
+	}
+	if meta.BudgetExpiredStep == nil || *meta.BudgetExpiredStep != 4*budgetCheckInterval {
+		t.Fatalf("expired step mismatch: have %v, want %d", meta.BudgetExpiredStep, 4*budgetCheckInterval)
+	}
+	if _, err := newTraceBudget(-1); err == nil {
+		t.Fatalf("negative budget accepted")
+	}
+}
+
+// Tests that a tracer running out of budget returns the steps traced so far,
+// with the metadata describing where tracing stopped.
+func TestTimingTracerBudget(t *testing.T) {
+	for _, tc := range []struct {
+		budgetMs int
+		exceeded bool
+	}{
+		{budgetMs: 1, exceeded: true},
+		{budgetMs: 60_000, exceeded: false},
+	} {
+		tracer := newTestTracer(t, "timingTracer", fmt.Sprintf(`{"budgetMs": %d}`, tc.budgetMs))
+		res, err := runTestTracer(t, tracer, loopCode, nil)
+		if err != nil {
+			t.Fatalf("budget %dms: failed to retrieve trace result: %v", tc.budgetMs, err)
+		}
+		var result tableResult
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("budget %dms: failed to unmarshal result: %v", tc.budgetMs, err)
+		}
+		if result.BudgetExceeded == nil || *result.BudgetExceeded != tc.exceeded {
+			t.Fatalf("budget %dms: exceeded flag mismatch: have %v, want %v", tc.budgetMs, result.BudgetExceeded, tc.exceeded)
+		}
+		rows, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+		if err != nil {
+			t.Fatalf("budget %dms: invalid CSV: %v", tc.budgetMs, err)
+		}
+		if !tc.exceeded {
+			if result.BudgetExpiredStep != nil {
+				t.Fatalf("budget %dms: expired step reported within budget", tc.budgetMs)
+			}
+			continue
+		}
+		if result.BudgetExpiredStep == nil || *result.BudgetExpiredStep != len(rows)-1 {
+			t.Fatalf("budget %dms: expired step %v mismatches %d traced steps", tc.budgetMs, result.BudgetExpiredStep, len(rows)-1)
+		}
+		// The streamed result must carry the same metadata
+		var buf bytes.Buffer
+		if err := tracer.(tracers.ResultEncoder).EncodeResult(&buf); err != nil {
+			t.Fatalf("budget %dms: failed to encode result: %v", tc.budgetMs, err)
+		}
+		if buf.String() != string(res) {
+			t.Fatalf("budget %dms: encoded result mismatch", tc.budgetMs)
+		}
+	}
+}
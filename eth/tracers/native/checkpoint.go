@@ -0,0 +1,246 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// errCheckpointSampling is returned when checkpointing is combined with
+// adaptive sampling, which needs to revisit samples that were already flushed.
+var errCheckpointSampling = errors.New("checkpointSamples cannot be combined with targetSamples")
+
+// checkpointer moves the samples collected by a tracer out of memory in
+// batches, encoding them as CSV into a file and keeping only running
+// aggregates of the measurement columns. This bounds the memory held by a
+// tracer regardless of the length of the trace.
+//
+// The tracer flushes a batch whenever due reports that enough samples were
+// collected, by handing every complete row to write and its measurements to
+// observe, followed by a commit. The result is the location of the file along
+// with the aggregates, instead of the CSV itself.
+type checkpointer struct {
+	name    string               // Name of the tracer, used for the default file name
+	every   int                  // Number of samples per flushed batch
+	sync    bool                 // Whether committed batches are synced to stable storage
+	path    string               // Location of the CSV file, a temp file if empty
+	columns []tracers.ColumnInfo // Columns of the CSV file
+	comma   rune                 // Field delimiter of the CSV file, a comma if zero
+	file    traceWriter
+	csv     *csv.Writer
+	rows    int            // Number of rows written so far
+	stats   []*columnStats // Running aggregates, nil for non-measurement columns
+	err     error          // First error hit while writing the file
+}
+
+// columnStats are the running aggregates of a measurement column.
+type columnStats struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+	Sum int64 `json:"sum"`
+
+	observed int // Number of values observed, fewer than the rows if the column is empty in some
+}
+
+// checkpointResult is the result format of a checkpointed tracer.
+type checkpointResult struct {
+	tableMeta
+	File    string                  `json:"file"`    // Location of the CSV file
+	Rows    int                     `json:"rows"`    // Number of rows in the file
+	Columns map[string]*columnStats `json:"columns"` // Aggregates of the measurement columns
+}
+
+// newCheckpointer creates a checkpointer flushing every given number of
+// samples into path, which has to be within the tracer output directory, or a
+// temp file if empty. Nil is returned if every is zero, disabling checkpoints.
+func newCheckpointer(name string, every int, path string, columns []tracers.ColumnInfo) (*checkpointer, error) {
+	if every < 0 {
+		return nil, fmt.Errorf("invalid checkpointSamples %d", every)
+	}
+	if every == 0 {
+		return nil, nil
+	}
+	if path != "" {
+		var err error
+		if path, err = outputPath(path); err != nil {
+			return nil, err
+		}
+	}
+	c := &checkpointer{
+		name:    name,
+		every:   every,
+		path:    path,
+		sync:    true,
+		columns: columns,
+		stats:   make([]*columnStats, len(columns)),
+	}
+	c.trackStats()
+	return c, nil
+}
+
+// newStreamer creates a checkpointer writing every sample into path as soon as
+// it is complete. Unlike checkpoints, the rows are not synced individually, so
+// the file is only guaranteed to be complete once closed. Nil is returned if
+// path is empty, disabling streaming.
+func newStreamer(path string, columns []tracers.ColumnInfo) *checkpointer {
+	if path == "" {
+		return nil
+	}
+	c := &checkpointer{
+		every:   1,
+		path:    path,
+		columns: columns,
+		stats:   make([]*columnStats, len(columns)),
+	}
+	c.trackStats()
+	return c
+}
+
+// trackStats enables the running aggregates of the measurement columns.
+func (c *checkpointer) trackStats() {
+	for i, column := range c.columns {
+		if column.Type == columnInt && column.Unit != "" {
+			c.stats[i] = new(columnStats)
+		}
+	}
+}
+
+// open creates the CSV file and writes the header.
+func (c *checkpointer) open() {
+	if c.path == "" {
+		file, err := os.CreateTemp("", c.name+"-*.csv")
+		if err != nil {
+			c.err = err
+			return
+		}
+		// The writer creates the file itself, refusing existing ones
+		file.Close()
+		os.Remove(file.Name())
+		c.path = file.Name()
+	}
+	file, err := newTraceWriter(c.path)
+	if err != nil {
+		c.err = fmt.Errorf("failed to create checkpoint file: %w", err)
+		return
+	}
+	c.file = file
+	c.csv = csv.NewWriter(file)
+	if c.comma != 0 {
+		c.csv.Comma = c.comma
+	}
+	if err := c.csv.Write(columnNames(c.columns)); err != nil {
+		c.err = err
+	}
+}
+
+// due reports whether the given number of collected samples fill a batch.
+func (c *checkpointer) due(samples int) bool {
+	return c != nil && samples >= c.every
+}
+
+// write appends a row to the CSV file.
+func (c *checkpointer) write(row []string) {
+	if c.csv == nil || c.err != nil {
+		return
+	}
+	if err := c.csv.Write(row); err != nil {
+		c.err = err
+		return
+	}
+	c.rows++
+}
+
+// observe folds the value of a column of the last written row into the
+// column's aggregates. Columns empty in some rows are only observed in the
+// others.
+func (c *checkpointer) observe(column int, v int64) {
+	stats := c.stats[column]
+	if stats == nil {
+		return
+	}
+	if stats.observed == 0 || v < stats.Min {
+		stats.Min = v
+	}
+	if stats.observed == 0 || v > stats.Max {
+		stats.Max = v
+	}
+	stats.Sum += v
+	stats.observed++
+}
+
+// commit flushes the written rows to stable storage, after which the tracer
+// can release them.
+func (c *checkpointer) commit() {
+	if c.csv == nil || c.err != nil {
+		return
+	}
+	c.csv.Flush()
+	if err := c.csv.Error(); err != nil {
+		c.err = err
+		return
+	}
+	if !c.sync {
+		return
+	}
+	if err := c.file.Sync(); err != nil {
+		c.err = err
+	}
+}
+
+// close commits the remaining rows and closes the file.
+func (c *checkpointer) close() {
+	if c.file == nil {
+		return
+	}
+	c.commit()
+	if err := c.file.Close(); err != nil && c.err == nil {
+		c.err = err
+	}
+	c.file, c.csv = nil, nil
+}
+
+// result closes the file and returns the checkpointed result, with the reason
+// tracing was interrupted if any.
+func (c *checkpointer) result(meta *tableMeta, reason error) (json.RawMessage, error) {
+	c.close()
+	if c.err != nil {
+		return nil, c.err
+	}
+	res := checkpointResult{
+		File:    c.path,
+		Rows:    c.rows,
+		Columns: make(map[string]*columnStats),
+	}
+	if meta != nil {
+		res.tableMeta = *meta
+	}
+	for i, stats := range c.stats {
+		if stats != nil {
+			res.Columns[c.columns[i].Name] = stats
+		}
+	}
+	if reason != nil {
+		res.Interrupted = reason.Error()
+	}
+	return json.Marshal(res)
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// readCheckpointResult decodes a checkpointed result and the CSV file it
+// points to.
+func readCheckpointResult(t *testing.T, res json.RawMessage) (checkpointResult, [][]string) {
+	t.Helper()
+
+	var result checkpointResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result %s: %v", res, err)
+	}
+	file, err := os.Open(result.File)
+	if err != nil {
+		t.Fatalf("failed to open checkpoint file: %v", err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid checkpoint file: %v", err)
+	}
+	if len(rows)-1 != result.Rows {
+		t.Fatalf("row count mismatch: file has %d, result reports %d", len(rows)-1, result.Rows)
+	}
+	return result, rows
+}
+
+// Tests that a checkpointed trace keeps at most a batch of rows in memory and
+// produces the same rows and aggregates as an in-memory trace.
+func TestTimingTracerCheckpoint(t *testing.T) {
+	var (
+		path   = filepath.Join(setOutputDir(t), "timing.csv")
+		tracer = newTestTracer(t, "timingTracer", `{"checkpointSamples": 7, "checkpointFile": "timing.csv"}`).(*timingTracer)
+		start  = uint64(1 << 20)
+		gas    = start
+	)
+	tracer.CaptureTxStart(gas)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, gas, nil)
+	for i := 0; i < 100; i++ {
+		tracer.CaptureState(uint64(i), benchOpcodes[i%len(benchOpcodes)], gas, 3, nil, nil, 1, nil)
+		gas -= 3
+		if tracer.samples.len() > 7 {
+			t.Fatalf("step %d: %d rows held in memory", i, tracer.samples.len())
+		}
+	}
+	tracer.CaptureEnd(nil, start-gas, nil)
+	tracer.CaptureTxEnd(gas)
+
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	result, rows := readCheckpointResult(t, res)
+	if result.File != path {
+		t.Fatalf("checkpoint file mismatch: have %s, want %s", result.File, path)
+	}
+	if !reflect.DeepEqual(rows[0], columnNames(timingColumns)) {
+		t.Fatalf("header mismatch: have %v", rows[0])
+	}
+	if result.Rows != 100 {
+		t.Fatalf("row count mismatch: have %d, want %d", result.Rows, 100)
+	}
+	for i, row := range rows[1:] {
+		if want := benchOpcodes[i%len(benchOpcodes)].String(); row[0] != want {
+			t.Fatalf("row %d: opcode mismatch: have %s, want %s", i, row[0], want)
+		}
+	}
+	var sum int64
+	for _, row := range rows[1:] {
+		cost, _ := strconv.ParseInt(row[2], 10, 64)
+		sum += cost
+	}
+	if stats := result.Columns["cost"]; stats == nil || stats.Min != 3 || stats.Max != 3 || stats.Sum != sum {
+		t.Fatalf("cost aggregates mismatch: have %+v, want sum %d", stats, sum)
+	}
+	if _, ok := result.Columns["frame"]; ok {
+		t.Fatalf("aggregated non-measurement column")
+	}
+}
+
+// Tests that the aggregates of a column filled in only some rows, like the
+// state access time of storage steps, cover just the rows filled.
+func TestTimingTracerCheckpointPartialColumn(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+		byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.POP), byte(vm.STOP),
+	}
+	tracer := newTestTracer(t, "timingTracer", `{"stateTiming": true, "checkpointSamples": 2}`)
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	result, rows := readCheckpointResult(t, res)
+	want := columnStats{Min: math.MaxInt64, Max: math.MinInt64}
+	var filled int
+	for _, row := range rows[1:] {
+		if row[16] == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(row[16], 10, 64)
+		if err != nil {
+			t.Fatalf("invalid state time %q", row[16])
+		}
+		if v < want.Min {
+			want.Min = v
+		}
+		if v > want.Max {
+			want.Max = v
+		}
+		want.Sum += v
+		filled++
+	}
+	if filled != 2 {
+		t.Fatalf("state time filled in %d rows, want 2", filled)
+	}
+	stats := result.Columns["stateTime"]
+	if stats == nil || stats.Min != want.Min || stats.Max != want.Max || stats.Sum != want.Sum {
+		t.Fatalf("state time aggregates mismatch: have %+v, want %+v", stats, want)
+	}
+}
+
+// Tests that checkpoint files can only be named within the output directory,
+// while the temp file used if unnamed needs none.
+func TestCheckpointFileRestricted(t *testing.T) {
+	if _, err := newCheckpointer("timingTracer", 7, "timing.csv", timingColumns); !errors.Is(err, errNoOutputDir) {
+		t.Errorf("checkpoint file accepted without an output directory: %v", err)
+	}
+	if c, err := newCheckpointer("timingTracer", 7, "", timingColumns); err != nil || c.path != "" {
+		t.Errorf("temp checkpoint file refused: %v", err)
+	}
+	setOutputDir(t)
+	for _, name := range []string{filepath.Join(t.TempDir(), "timing.csv"), "../timing.csv"} {
+		if _, err := newCheckpointer("timingTracer", 7, name, timingColumns); err == nil {
+			t.Errorf("checkpoint file %q outside the output directory accepted", name)
+		}
+	}
+}
+
+// Tests that stopping a checkpointed trace mid-batch still flushes the rows
+// collected so far and reports the interruption.
+func TestTimingTracerCheckpointStop(t *testing.T) {
+	var (
+		tracer = newTestTracer(t, "timingTracer", `{"checkpointSamples": 16}`).(*timingTracer)
+		gas    = uint64(1 << 20)
+	)
+	tracer.CaptureTxStart(gas)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, gas, nil)
+	captureSteps(tracer, &gas, 40)
+	tracer.Stop(errors.New("execution timeout"))
+	captureSteps(tracer, &gas, 40)
+
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	result, _ := readCheckpointResult(t, res)
+	defer os.Remove(result.File)
+
+	if result.Interrupted != "execution timeout" {
+		t.Fatalf("interruption reason mismatch: have %q", result.Interrupted)
+	}
+	// The last step before the interruption has no settled cost
+	if result.Rows != 39 {
+		t.Fatalf("row count mismatch: have %d, want %d", result.Rows, 39)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// Column value types reported in tracers.ColumnInfo.
+const (
+	columnInt    = "int"
+	columnFloat  = "float"
+	columnString = "string"
+	columnBool   = "bool"
+)
+
+// columnNames returns the header row of a table with the given columns.
+func columnNames(columns []tracers.ColumnInfo) []string {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+// opcodeNames caches the rendering of every opcode in the tracer outputs.
+var opcodeNames [256]string
+
+func init() {
+	for i := range opcodeNames {
+		name := vm.OpCode(i).String()
+		// Undefined opcodes are described in a sentence, which doesn't survive
+		// CSV parsing and grouping
+		if strings.ContainsAny(name, " ,\"\t\n") {
+			name = fmt.Sprintf("UNKNOWN_0x%02x", i)
+		}
+		opcodeNames[i] = name
+	}
+}
+
+// opcodeName returns the name of an opcode as rendered in the tracer outputs:
+// defined opcodes by name, undefined ones as UNKNOWN_0xNN. Results should be
+// aggregated by the numeric opcode rather than its name.
+func opcodeName(op vm.OpCode) string {
+	return opcodeNames[op]
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// testColumnsMatchHeader runs a short trace and checks that the CSV header
+// emitted by the tracer matches the columns it advertises.
+func testColumnsMatchHeader(t *testing.T, tracer tracers.Tracer) {
+	t.Helper()
+
+	columns := tracer.(tracers.ColumnTracer).Columns()
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	header, err := csv.NewReader(strings.NewReader(tableCSV(t, res))).Read()
+	if err != nil {
+		t.Fatalf("failed to read CSV header: %v", err)
+	}
+	if have, want := header, columnNames(columns); !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	for _, column := range columns {
+		switch column.Type {
+		case columnInt, columnFloat, columnString, columnBool:
+		default:
+			t.Errorf("column %s has invalid type %q", column.Name, column.Type)
+		}
+	}
+}
+
+func TestColumnsMatchHeaders(t *testing.T) {
+	for _, name := range []string{"timingTracer", "memoryTracer", "memoryTransactionTracer"} {
+		t.Run(name, func(t *testing.T) {
+			testColumnsMatchHeader(t, newTestTracer(t, name, ""))
+		})
+	}
+}
+
+func TestDirectoryColumns(t *testing.T) {
+	columns, err := tracers.DefaultDirectory.Columns("timingTracer", new(tracers.Context), nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve columns: %v", err)
+	}
+	if !reflect.DeepEqual(columns, timingColumns) {
+		t.Fatalf("columns mismatch: have %v, want %v", columns, timingColumns)
+	}
+	if _, err := tracers.DefaultDirectory.Columns("callTracer", new(tracers.Context), nil); err == nil {
+		t.Fatalf("non-tabular tracer reported columns")
+	}
+	if _, err := tracers.DefaultDirectory.Columns("noSuchTracer", new(tracers.Context), nil); err == nil {
+		t.Fatalf("unknown tracer reported columns")
+	}
+}
+
+// allOpcodes returns every possible opcode, defined or not.
+func allOpcodes() []vm.OpCode {
+	ops := make([]vm.OpCode, 256)
+	for i := range ops {
+		ops[i] = vm.OpCode(i)
+	}
+	return ops
+}
+
+// testOpcodeColumn checks that a CSV with a row per opcode, in order, renders
+// every opcode as a distinct token in the given column.
+func testOpcodeColumn(t *testing.T, out string, column int) {
+	t.Helper()
+
+	rows, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(rows) != 257 {
+		t.Fatalf("row count mismatch: have %d, want 257", len(rows))
+	}
+	seen := make(map[string]bool)
+	for i, row := range rows[1:] {
+		name := row[column]
+		if name != opcodeName(vm.OpCode(i)) {
+			t.Errorf("opcode %#x rendered as %q, want %q", i, name, opcodeName(vm.OpCode(i)))
+		}
+		if seen[name] {
+			t.Errorf("opcode %#x rendered as duplicate %q", i, name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestOpcodeNames(t *testing.T) {
+	for _, op := range allOpcodes() {
+		name := opcodeName(op)
+		if strings.ContainsAny(name, " ,") {
+			t.Errorf("opcode %#x rendered as %q", int(op), name)
+		}
+		if strings.HasPrefix(name, "UNKNOWN_") {
+			if want := fmt.Sprintf("UNKNOWN_0x%02x", int(op)); name != want {
+				t.Errorf("opcode %#x rendered as %q, want %q", int(op), name, want)
+			}
+		} else if name != op.String() {
+			t.Errorf("opcode %#x rendered as %q, want %q", int(op), name, op.String())
+		}
+	}
+	if have := opcodeName(vm.ADD); have != "ADD" {
+		t.Errorf("ADD rendered as %q", have)
+	}
+	if have := opcodeName(vm.OpCode(0x0c)); have != "UNKNOWN_0x0c" {
+		t.Errorf("undefined opcode rendered as %q", have)
+	}
+}
+
+func TestOpcodeNamesTimingCSV(t *testing.T) {
+	var samples timingRows
+	for _, op := range allOpcodes() {
+		samples.append(timingSample{op: op})
+	}
+	var buf bytes.Buffer
+	if err := writeTimingCSV(&buf, defaultTimingFormat, samples.len(), samples.at, func(v int) int { return v }); err != nil {
+		t.Fatalf("failed to write CSV: %v", err)
+	}
+	testOpcodeColumn(t, buf.String(), 0)
+}
+
+func TestOpcodeNamesOperandCSV(t *testing.T) {
+	tracer := newTestTracer(t, "operandTracer", "").(*operandTracer)
+	for _, op := range allOpcodes() {
+		stats := new(operandStats)
+		stats.steps[0] = 1
+		tracer.stats[op] = stats
+	}
+	var buf bytes.Buffer
+	if err := tracer.writeCSV(&buf); err != nil {
+		t.Fatalf("failed to write CSV: %v", err)
+	}
+	testOpcodeColumn(t, buf.String(), 0)
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package native
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpuPin pins the thread tracing a transaction to a single CPU, so that the
+// counted steps don't migrate between cores differing in frequency and cache
+// state. The previous affinity of the thread is restored when released.
+type cpuPin struct {
+	cpu    int
+	tid    int         // Thread pinned, addressed by id as it may be released from another thread
+	prev   unix.CPUSet // Affinity of the thread before being pinned
+	pinned atomic.Bool
+}
+
+// newCPUPin creates a pin to the given CPU, nil if cpu is nil.
+func newCPUPin(cpu *int) (*cpuPin, error) {
+	if cpu == nil {
+		return nil, nil
+	}
+	if *cpu < 0 || *cpu >= len(unix.CPUSet{})*64 {
+		return nil, fmt.Errorf("invalid pinCPU %d", *cpu)
+	}
+	return &cpuPin{cpu: *cpu}, nil
+}
+
+// pin restricts the calling thread, which must be locked, to the CPU.
+func (p *cpuPin) pin() error {
+	p.tid = unix.Gettid()
+	if err := unix.SchedGetaffinity(p.tid, &p.prev); err != nil {
+		return err
+	}
+	var set unix.CPUSet
+	set.Set(p.cpu)
+	if err := unix.SchedSetaffinity(p.tid, &set); err != nil {
+		return err
+	}
+	p.pinned.Store(true)
+	return nil
+}
+
+// release restores the affinity of the pinned thread, if still pinned.
+func (p *cpuPin) release() error {
+	if !p.pinned.CompareAndSwap(true, false) {
+		return nil
+	}
+	return unix.SchedSetaffinity(p.tid, &p.prev)
+}
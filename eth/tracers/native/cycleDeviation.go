@@ -0,0 +1,124 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"math"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// cycleDeviation accumulates the measured cycles of the steps per opcode, to
+// compare the cycles every opcode takes per gas against the other opcodes of
+// the transaction once traced.
+type cycleDeviation struct {
+	factor float64      // Factor the cycles per gas of an opcode may deviate from the median before flagged
+	steps  [256]int     // Number of measured steps charging gas per opcode
+	cycles [256]int     // Summed cycles per opcode
+	gas    [256]int     // Summed gas charged per opcode
+	ratios [256]float64 // Summed cycles per gas of the steps per opcode
+}
+
+// newCycleDeviation creates an empty accumulator flagging the opcodes deviating
+// by more than factor.
+func newCycleDeviation(factor float64) *cycleDeviation {
+	return &cycleDeviation{factor: factor}
+}
+
+// add accumulates a single step, divided by its own cost as that of SLOAD and
+// SSTORE depends on whether the slot was accessed before. Free steps take
+// cycles regardless, and the cost of the steps entering a call frame includes
+// the gas the frame used, so both are left out.
+func (d *cycleDeviation) add(op vm.OpCode, cycles int, cost int) {
+	if cost <= 0 {
+		return
+	}
+	switch op {
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL, vm.CREATE, vm.CREATE2:
+		return
+	}
+	d.steps[op]++
+	d.cycles[op] += cycles
+	d.gas[op] += cost
+	d.ratios[op] += float64(cycles) / float64(cost)
+}
+
+// deviationReport lists the opcodes whose mean cycles per charged gas deviate
+// from the median of all opcodes of the transaction by more than a factor,
+// the most deviating first.
+type deviationReport struct {
+	Factor  float64         `json:"factor"`             // Deviation from the median tolerated
+	Median  float64         `json:"medianCyclesPerGas"` // Median cycles per gas of the opcodes charging gas
+	Flagged []deviantOpcode `json:"flagged"`
+}
+
+// deviantOpcode is an opcode flagged by the deviation report.
+type deviantOpcode struct {
+	Opcode       string  `json:"opcode"`
+	Count        int     `json:"count"`        // Number of measured steps
+	MeanCycles   float64 `json:"meanCycles"`   // Mean cycles of a step
+	MeanCost     float64 `json:"meanCost"`     // Mean gas charged for a step
+	CyclesPerGas float64 `json:"cyclesPerGas"` // Mean cycles per gas charged of a step
+	Deviation    float64 `json:"deviation"`    // Cycles per gas over the median, below one if cheaper to execute than charged
+}
+
+// report compares the mean cycles per gas of every opcode measured to their
+// median, each opcode weighing the same regardless of its number of steps.
+func (d *cycleDeviation) report() *deviationReport {
+	var opcodes []deviantOpcode
+	for op, steps := range d.steps {
+		if steps == 0 {
+			continue
+		}
+		opcodes = append(opcodes, deviantOpcode{
+			Opcode:       opcodeName(vm.OpCode(op)),
+			Count:        steps,
+			MeanCycles:   float64(d.cycles[op]) / float64(steps),
+			MeanCost:     float64(d.gas[op]) / float64(steps),
+			CyclesPerGas: d.ratios[op] / float64(steps),
+		})
+	}
+	report := &deviationReport{Factor: d.factor, Flagged: []deviantOpcode{}}
+	if len(opcodes) == 0 {
+		return report
+	}
+	ratios := make([]float64, len(opcodes))
+	for i, opcode := range opcodes {
+		ratios[i] = opcode.CyclesPerGas
+	}
+	sort.Float64s(ratios)
+	if mid := len(ratios) / 2; len(ratios)%2 == 1 {
+		report.Median = ratios[mid]
+	} else {
+		report.Median = (ratios[mid-1] + ratios[mid]) / 2
+	}
+	if report.Median == 0 {
+		return report // Nothing counted, so nothing deviates
+	}
+	for _, opcode := range opcodes {
+		opcode.Deviation = opcode.CyclesPerGas / report.Median
+		if opcode.Deviation > d.factor || opcode.Deviation < 1/d.factor {
+			report.Flagged = append(report.Flagged, opcode)
+		}
+	}
+	// Deviating by a factor either way is just as far off
+	sort.SliceStable(report.Flagged, func(i, j int) bool {
+		return math.Abs(math.Log(report.Flagged[i].Deviation)) > math.Abs(math.Log(report.Flagged[j].Deviation))
+	})
+	return report
+}
@@ -0,0 +1,261 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package native
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Olaburns/perf-utils"
+	"golang.org/x/sys/unix"
+)
+
+// raplPMUPath is the sysfs directory of the perf PMU exposing the RAPL energy
+// counters.
+var raplPMUPath = "/sys/bus/event_source/devices/power"
+
+// errRAPLUnavailable is returned when energy is requested but the kernel
+// exposes no RAPL energy counters.
+var errRAPLUnavailable = errors.New("RAPL energy counters unavailable")
+
+// raplEvent is an energy counter of a RAPL domain, like the package or the
+// cores.
+type raplEvent struct {
+	domain string  // Domain counted, the event name without the energy- prefix
+	config uint64  // Event within the type of the PMU
+	scale  float64 // Joules per count
+}
+
+// energyMeter measures the energy consumed by the whole system per RAPL
+// domain, summed over the packages. The counters are system-wide, so unlike
+// the perf event groups they are opened on one CPU of every package instead of
+// on the tracing thread, and their granularity only suits whole transactions.
+type energyMeter struct {
+	typ    uint32 // Type of the PMU
+	cpus   []int  // One CPU of every package to open the counters on
+	events []raplEvent
+
+	lock sync.Mutex // Guards the descriptors, which may be closed by Stop on another goroutine
+	fds  [][]int    // Descriptors of every event, per CPU, nil if closed
+	base []uint64   // Counts of every event when opened
+}
+
+// newEnergyMeter creates a meter of the energy counters of the RAPL PMU at
+// the given sysfs directory.
+func newEnergyMeter(dir string) (*energyMeter, error) {
+	typ, err := readSysfsUint(filepath.Join(dir, "type"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRAPLUnavailable, err)
+	}
+	mask, err := os.ReadFile(filepath.Join(dir, "cpumask"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRAPLUnavailable, err)
+	}
+	cpus, err := parseCPUList(strings.TrimSpace(string(mask)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RAPL cpumask: %v", err)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "events", "energy-*"))
+	if err != nil {
+		return nil, err
+	}
+	m := &energyMeter{typ: uint32(typ), cpus: cpus}
+	for _, name := range names {
+		if filepath.Ext(name) != "" {
+			continue // Scale or unit of an event
+		}
+		event, err := readRAPLEvent(name)
+		if err != nil {
+			return nil, err
+		}
+		m.events = append(m.events, event)
+	}
+	if len(m.events) == 0 {
+		return nil, fmt.Errorf("%w: no energy events in %s", errRAPLUnavailable, dir)
+	}
+	sort.Slice(m.events, func(i, j int) bool { return m.events[i].domain < m.events[j].domain })
+	return m, nil
+}
+
+// readRAPLEvent reads the encoding and the scale of an energy event from its
+// sysfs file, which holds the event number as in "event=0x02".
+func readRAPLEvent(path string) (raplEvent, error) {
+	event := raplEvent{domain: strings.TrimPrefix(filepath.Base(path), "energy-")}
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return event, err
+	}
+	term := strings.TrimSpace(string(blob))
+	if !strings.HasPrefix(term, "event=") {
+		return event, fmt.Errorf("unsupported RAPL event encoding %q in %s", term, path)
+	}
+	if event.config, err = strconv.ParseUint(strings.TrimPrefix(term, "event="), 0, 64); err != nil {
+		return event, fmt.Errorf("invalid RAPL event encoding %q in %s", term, path)
+	}
+	blob, err = os.ReadFile(path + ".scale")
+	if err != nil {
+		return event, err
+	}
+	if event.scale, err = strconv.ParseFloat(strings.TrimSpace(string(blob)), 64); err != nil {
+		return event, fmt.Errorf("invalid RAPL event scale in %s.scale", path)
+	}
+	return event, nil
+}
+
+// readSysfsUint reads a decimal number from a sysfs file.
+func readSysfsUint(path string) (uint64, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(blob)), 10, 32)
+}
+
+// parseCPUList parses a list of CPUs in the kernel's format, comma separated
+// CPUs or ranges of them, as in "0,4-7".
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, item := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU %q", item)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil || to < from {
+				return nil, fmt.Errorf("invalid CPU range %q", item)
+			}
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// open opens the energy counters and records their counts to measure from.
+func (m *energyMeter) open() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.fds = make([][]int, len(m.events))
+	for i, event := range m.events {
+		attr := &unix.PerfEventAttr{
+			Type:   m.typ,
+			Config: event.config,
+			Size:   perf.EventAttrSize,
+		}
+		for _, cpu := range m.cpus {
+			fd, err := unix.PerfEventOpen(attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+			if err != nil {
+				m.closeFds()
+				if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+					return &raplPermissionError{err: err}
+				}
+				return fmt.Errorf("failed to open RAPL event energy-%s: %w", event.domain, err)
+			}
+			m.fds[i] = append(m.fds[i], fd)
+		}
+	}
+	var err error
+	m.base, err = m.readCounts()
+	if err != nil {
+		m.closeFds()
+	}
+	return err
+}
+
+// readCounts returns the count of every event, summed over the packages.
+func (m *energyMeter) readCounts() ([]uint64, error) {
+	var (
+		counts = make([]uint64, len(m.events))
+		buf    = make([]byte, 8)
+	)
+	for i, fds := range m.fds {
+		for _, fd := range fds {
+			if _, err := unix.Read(fd, buf); err != nil {
+				return nil, err
+			}
+			counts[i] += binary.LittleEndian.Uint64(buf)
+		}
+	}
+	return counts, nil
+}
+
+// read returns the joules consumed per domain since the meter was opened.
+func (m *energyMeter) read() (map[string]float64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.fds == nil {
+		return nil, errCounterClosed
+	}
+	counts, err := m.readCounts()
+	if err != nil {
+		return nil, err
+	}
+	joules := make(map[string]float64, len(m.events))
+	for i, event := range m.events {
+		joules[event.domain] = float64(counts[i]-m.base[i]) * event.scale
+	}
+	return joules, nil
+}
+
+// close closes the energy counters, if open. It may be called repeatedly and
+// concurrently with the measurement.
+func (m *energyMeter) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.closeFds()
+}
+
+// closeFds closes the descriptors of the energy counters.
+func (m *energyMeter) closeFds() {
+	for _, fds := range m.fds {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}
+	m.fds = nil
+}
+
+// raplPermissionError is returned when creating a cycleTracer measuring the
+// energy if the kernel doesn't permit opening the system-wide RAPL counters,
+// explaining how to permit them.
+type raplPermissionError struct {
+	err error
+}
+
+func (e *raplPermissionError) Error() string {
+	return fmt.Sprintf("RAPL energy counters not permitted (%v): lower kernel.perf_event_paranoid to 0 or below with sysctl, or grant the node CAP_PERFMON", e.err)
+}
+
+func (e *raplPermissionError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,414 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package native
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	cacheReferencesEvent = perfEvent{name: "cacheReferences", typ: unix.PERF_TYPE_HARDWARE, config: unix.PERF_COUNT_HW_CACHE_REFERENCES}
+	cacheMissesEvent     = perfEvent{name: "cacheMisses", typ: unix.PERF_TYPE_HARDWARE, config: unix.PERF_COUNT_HW_CACHE_MISSES}
+	branchesEvent        = perfEvent{name: "branchInstructions", typ: unix.PERF_TYPE_HARDWARE, config: unix.PERF_COUNT_HW_BRANCH_INSTRUCTIONS}
+	branchMissesEvent    = perfEvent{name: "branchMisses", typ: unix.PERF_TYPE_HARDWARE, config: unix.PERF_COUNT_HW_BRANCH_MISSES}
+
+	// Many CPUs don't expose the stalled cycles, the kernel failing them with
+	// ENOENT
+	stalledFrontendEvent = perfEvent{
+		name:     "stalledCyclesFrontend",
+		typ:      unix.PERF_TYPE_HARDWARE,
+		config:   unix.PERF_COUNT_HW_STALLED_CYCLES_FRONTEND,
+		optional: true,
+	}
+	stalledBackendEvent = perfEvent{
+		name:     "stalledCyclesBackend",
+		typ:      unix.PERF_TYPE_HARDWARE,
+		config:   unix.PERF_COUNT_HW_STALLED_CYCLES_BACKEND,
+		optional: true,
+	}
+
+	llcReadMissesEvent = perfEvent{
+		name:     "llcReadMisses",
+		typ:      unix.PERF_TYPE_HW_CACHE,
+		config:   hwCacheConfig(unix.PERF_COUNT_HW_CACHE_LL, unix.PERF_COUNT_HW_CACHE_OP_READ, unix.PERF_COUNT_HW_CACHE_RESULT_MISS),
+		optional: true,
+	}
+	dtlbLoadsEvent = perfEvent{
+		name:     "dtlbLoads",
+		typ:      unix.PERF_TYPE_HW_CACHE,
+		config:   hwCacheConfig(unix.PERF_COUNT_HW_CACHE_DTLB, unix.PERF_COUNT_HW_CACHE_OP_READ, unix.PERF_COUNT_HW_CACHE_RESULT_ACCESS),
+		optional: true,
+	}
+	dtlbLoadMissesEvent = perfEvent{
+		name:     "dtlbLoadMisses",
+		typ:      unix.PERF_TYPE_HW_CACHE,
+		config:   hwCacheConfig(unix.PERF_COUNT_HW_CACHE_DTLB, unix.PERF_COUNT_HW_CACHE_OP_READ, unix.PERF_COUNT_HW_CACHE_RESULT_MISS),
+		optional: true,
+	}
+
+	// Software events are counted by the kernel, so they are available even
+	// where the hardware counters aren't
+	pageFaultsEvent      = perfEvent{name: "pageFaults", typ: unix.PERF_TYPE_SOFTWARE, config: unix.PERF_COUNT_SW_PAGE_FAULTS}
+	contextSwitchesEvent = perfEvent{name: "contextSwitches", typ: unix.PERF_TYPE_SOFTWARE, config: unix.PERF_COUNT_SW_CONTEXT_SWITCHES}
+	cpuMigrationsEvent   = perfEvent{name: "cpuMigrations", typ: unix.PERF_TYPE_SOFTWARE, config: unix.PERF_COUNT_SW_CPU_MIGRATIONS}
+)
+
+// cycleEvents are the perf events the cycleTracer can count, by their name in
+// the events config.
+var cycleEvents = map[string]perfEvent{
+	"cycles":           cyclesEvent,
+	"instructions":     instructionsEvent,
+	"cache-references": cacheReferencesEvent,
+	"cache-misses":     cacheMissesEvent,
+
+	"branch-instructions": branchesEvent,
+	"branch-misses":       branchMissesEvent,
+
+	"stalled-cycles-frontend": stalledFrontendEvent,
+	"stalled-cycles-backend":  stalledBackendEvent,
+
+	"llc-read-misses":  llcReadMissesEvent,
+	"dtlb-loads":       dtlbLoadsEvent,
+	"dtlb-load-misses": dtlbLoadMissesEvent,
+
+	"page-faults":      pageFaultsEvent,
+	"context-switches": contextSwitchesEvent,
+	"cpu-migrations":   cpuMigrationsEvent,
+}
+
+// cycleRawEvent is a model-specific perf event configured by its encoding, for
+// events without named support.
+type cycleRawEvent struct {
+	Type   uint32 `json:"type"`   // Type of the event, PERF_TYPE_RAW (4) or the type of a dynamic PMU
+	Config string `json:"config"` // Hex encoding of the event within its type
+	Name   string `json:"name"`   // Name of the event's column
+}
+
+// parseRawEvents validates the configured raw events and converts them into
+// perf events.
+func parseRawEvents(raw []cycleRawEvent) ([]perfEvent, error) {
+	events := make([]perfEvent, 0, len(raw))
+	for _, event := range raw {
+		if event.Name == "" {
+			return nil, errors.New("raw perf event without a name")
+		}
+		if _, ok := cycleEvents[event.Name]; ok {
+			return nil, fmt.Errorf("raw perf event %q clashes with a named event", event.Name)
+		}
+		config, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(event.Config), "0x"), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("raw perf event %q: invalid config %q", event.Name, event.Config)
+		}
+		events = append(events, perfEvent{name: event.Name, typ: event.Type, config: config})
+	}
+	return events, nil
+}
+
+// defaultCycleEvents are the events counted if none are configured.
+var defaultCycleEvents = []string{"cycles", "instructions"}
+
+// cycleRatio is a column derived from the counts of two events, emitted if
+// both are counted.
+type cycleRatio struct {
+	name        string // Name of the derived column
+	numerator   string // Config name of the event counted per step of the denominator
+	denominator string
+}
+
+// cycleRatios are the columns derived from the configured events.
+var cycleRatios = []cycleRatio{
+	{name: "ipc", numerator: "instructions", denominator: "cycles"},
+	{name: "cacheMissRate", numerator: "cache-misses", denominator: "cache-references"},
+	{name: "branchMissRate", numerator: "branch-misses", denominator: "branch-instructions"},
+	{name: "frontendStallRatio", numerator: "stalled-cycles-frontend", denominator: "cycles"},
+	{name: "backendStallRatio", numerator: "stalled-cycles-backend", denominator: "cycles"},
+}
+
+// maxCycleEvents is the most perf events a cycleTracer counts at once.
+const maxCycleEvents = 16
+
+// cycleWindow is the time perf events were enabled and the time they were
+// actually counting over one or more measurements, both zero if the counter
+// doesn't report them.
+type cycleWindow struct {
+	enabled uint64
+	running uint64
+}
+
+// add adds the times of another measurement.
+func (w *cycleWindow) add(other cycleWindow) {
+	w.enabled += other.enabled
+	w.running += other.running
+}
+
+// cycleSample is a single recorded step.
+type cycleSample struct {
+	counts [maxCycleEvents]int // Count of every event, in the order of the layout, scaled if multiplexed
+	window cycleWindow         // Times the events were enabled and counting during the step
+	cost   int                 // Gas charged for the step
+	pc     uint64              // Program counter of the step
+	depth  int                 // Call depth of the step
+	op     vm.OpCode
+	ops    []vm.OpCode // Opcodes of the steps measured after the first in the same interval, with a resolution
+	frame  bool        // Whether the row holds the totals of a child call frame rather than a step
+}
+
+// cycleLayout describes the events a cycleTracer counts and the columns of its
+// output. The cycles are always configured, leading the group of events, and
+// followed by the cost; the other events and the derived ratios follow in
+// their configured order.
+type cycleLayout struct {
+	names       []string    // Config names of the counted events, cycles first
+	events      []perfEvent // Counted events, in the order of names
+	ratios      [][2]int    // Indices of the numerator and denominator event of every derived column
+	columns     []tracers.ColumnInfo
+	dropped     []bool   // Events the kernel refused to count, their columns are left empty
+	unavailable []string // Config names of the optional events left out for being unavailable
+	migrations  int      // Index of the event counting the CPU migrations for the migrated column, -1 if not counted
+	companions  int      // Number of trailing events counted for derived columns only, without a count column
+	calibrated  bool     // Whether the cycles are also reported corrected by the overhead
+	overhead    int      // Median cycles of an empty measurement, subtracted from the corrected cycles
+}
+
+// newCycleLayout creates the layout counting the named events, the default
+// events if none are given, followed by the raw events. Optional events are
+// checked with probe and left out, along with their columns, if they can't be
+// counted.
+func newCycleLayout(names []string, raw []perfEvent, probe func(perfEvent) error) (*cycleLayout, error) {
+	if len(names) == 0 {
+		names = defaultCycleEvents
+	}
+	l := &cycleLayout{
+		names:  []string{"cycles"},
+		events: []perfEvent{cyclesEvent},
+	}
+	for _, name := range names {
+		event, ok := cycleEvents[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown perf event %q", name)
+		}
+		if name == "cycles" {
+			continue // Counted anyway, as the group leader
+		}
+		if l.index(name) >= 0 {
+			return nil, fmt.Errorf("duplicate perf event %q", name)
+		}
+		if event.optional && probe(event) != nil {
+			l.unavailable = append(l.unavailable, name)
+			continue
+		}
+		l.names = append(l.names, name)
+		l.events = append(l.events, event)
+	}
+	// Raw events go by the name of their column
+	for _, event := range raw {
+		if l.index(event.name) >= 0 {
+			return nil, fmt.Errorf("duplicate perf event %q", event.name)
+		}
+		l.names = append(l.names, event.name)
+		l.events = append(l.events, event)
+	}
+	if len(l.events) > maxCycleEvents {
+		return nil, fmt.Errorf("too many perf events: have %d, at most %d", len(l.events), maxCycleEvents)
+	}
+	// Count the CPU migrations for the migrated column even if not configured,
+	// as long as there's room left
+	if l.migrations = l.index("cpu-migrations"); l.migrations < 0 && len(l.events) < maxCycleEvents {
+		l.names = append(l.names, "cpu-migrations")
+		l.events = append(l.events, cpuMigrationsEvent)
+		l.migrations, l.companions = len(l.events)-1, 1
+	}
+	l.columns = []tracers.ColumnInfo{
+		{Name: "opcodes", Type: columnString},
+		{Name: "cycles", Type: columnInt, Unit: "cycles"},
+		{Name: "cost", Type: columnInt, Unit: "gas"},
+	}
+	for _, event := range l.events[1:l.reported()] {
+		l.columns = append(l.columns, tracers.ColumnInfo{Name: event.name, Type: columnInt, Unit: event.name})
+	}
+	for _, ratio := range cycleRatios {
+		num, den := l.index(ratio.numerator), l.index(ratio.denominator)
+		if num < 0 || den < 0 {
+			continue
+		}
+		l.ratios = append(l.ratios, [2]int{num, den})
+		l.columns = append(l.columns, tracers.ColumnInfo{Name: ratio.name, Type: columnFloat})
+	}
+	l.columns = append(l.columns,
+		tracers.ColumnInfo{Name: "cyclesPerGas", Type: columnFloat, Unit: "cycles/gas"},
+		tracers.ColumnInfo{Name: "scaling", Type: columnFloat},
+		tracers.ColumnInfo{Name: "migrated", Type: columnBool},
+		tracers.ColumnInfo{Name: "pc", Type: columnInt},
+		tracers.ColumnInfo{Name: "depth", Type: columnInt},
+		tracers.ColumnInfo{Name: "kind", Type: columnString},
+	)
+	// Raw events mustn't shadow other columns, including the corrected cycles
+	// added if calibrating
+	seen := map[string]bool{"correctedCycles": true}
+	for _, column := range l.columns {
+		if seen[column.Name] {
+			return nil, fmt.Errorf("duplicate column %q", column.Name)
+		}
+		seen[column.Name] = true
+	}
+	l.dropped = make([]bool, len(l.events))
+	return l, nil
+}
+
+// index returns the index of the named event among the counted ones, -1 if it
+// isn't counted.
+func (l *cycleLayout) index(name string) int {
+	for i, have := range l.names {
+		if have == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// reported returns the number of events with a count column, which lead the
+// companion events.
+func (l *cycleLayout) reported() int {
+	return len(l.events) - l.companions
+}
+
+// dropCompanions stops counting the companion events, leaving their derived
+// columns empty.
+func (l *cycleLayout) dropCompanions() {
+	n := l.reported()
+	if l.migrations >= n {
+		l.migrations = -1
+	}
+	l.names, l.events, l.dropped = l.names[:n], l.events[:n], l.dropped[:n]
+	l.companions = 0
+}
+
+// drop marks the events at the given indices as refused by the kernel, and
+// all others as counted.
+func (l *cycleLayout) drop(indices []int) {
+	for i := range l.dropped {
+		l.dropped[i] = false
+	}
+	for _, i := range indices {
+		l.dropped[i] = true
+	}
+}
+
+// droppedNames returns the config names of the events refused by the kernel,
+// including the optional ones left out. Companion events aren't configured,
+// so they aren't named.
+func (l *cycleLayout) droppedNames() []string {
+	names := append([]string(nil), l.unavailable...)
+	for i, dropped := range l.dropped[:l.reported()] {
+		if dropped {
+			names = append(names, l.names[i])
+		}
+	}
+	return names
+}
+
+// countColumn returns the column of the count of the i-th event.
+func (l *cycleLayout) countColumn(i int) int {
+	if i == 0 {
+		return 1
+	}
+	return 2 + i
+}
+
+// row formats a single step as a CSV row.
+func (l *cycleLayout) row(s *cycleSample) []string {
+	row := make([]string, len(l.columns))
+	row[0] = intervalOpcodes(s)
+	row[2] = strconv.Itoa(s.cost)
+	for i := 0; i < l.reported(); i++ {
+		if !l.dropped[i] {
+			row[l.countColumn(i)] = strconv.Itoa(s.counts[i])
+		}
+	}
+	for i, ratio := range l.ratios {
+		if !l.dropped[ratio[0]] && !l.dropped[ratio[1]] {
+			row[2+l.reported()+i] = formatRatio(s.counts[ratio[0]], s.counts[ratio[1]])
+		}
+	}
+	extra := 2 + l.reported() + len(l.ratios)
+	if !l.dropped[0] {
+		row[extra] = formatRatio(s.counts[0], s.cost) // Empty for steps charging no gas
+	}
+	// Fraction of the step the events were counting, empty if not reported
+	if s.window.enabled > 0 {
+		row[extra+1] = strconv.FormatFloat(float64(s.window.running)/float64(s.window.enabled), 'f', -1, 64)
+	}
+	// Whether the thread moved to another CPU, making the counts unreliable
+	if l.migrations >= 0 && !l.dropped[l.migrations] {
+		row[extra+2] = strconv.FormatBool(s.counts[l.migrations] > 0)
+	}
+	row[extra+3] = strconv.FormatUint(s.pc, 10)
+	row[extra+4] = strconv.Itoa(s.depth)
+	row[extra+5] = "step"
+	if s.frame {
+		row[extra+5] = "frame"
+	}
+	if l.calibrated && !l.dropped[0] && !s.frame {
+		corrected := s.counts[0] - l.overhead
+		if corrected < 0 {
+			corrected = 0
+		}
+		row[extra+6] = strconv.Itoa(corrected)
+	}
+	return row
+}
+
+// intervalOpcodes returns the opcodes of the steps measured in a row, separated
+// by spaces if measured with a resolution.
+func intervalOpcodes(s *cycleSample) string {
+	if len(s.ops) == 0 {
+		return opcodeName(s.op)
+	}
+	var b strings.Builder
+	b.WriteString(opcodeName(s.op))
+	for _, op := range s.ops {
+		b.WriteByte(' ')
+		b.WriteString(opcodeName(op))
+	}
+	return b.String()
+}
+
+// calibrate adds the column of the cycles corrected by the measured overhead,
+// which is set once calibrated.
+func (l *cycleLayout) calibrate() {
+	l.calibrated = true
+	l.columns = append(l.columns, tracers.ColumnInfo{Name: "correctedCycles", Type: columnInt, Unit: "cycles"})
+}
+
+// formatRatio formats the ratio of two counts, or empty if the denominator
+// wasn't counted at all.
+func formatRatio(num, den int) string {
+	if den == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+}
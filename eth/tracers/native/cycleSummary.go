@@ -0,0 +1,194 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package native
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// cycleKey identifies the steps aggregated together in summary mode.
+type cycleKey struct {
+	pc uint64 // Program counter of the steps, zero unless keyed on it
+	op vm.OpCode
+}
+
+// cycleAggregate accumulates the steps of a single key in summary mode.
+type cycleAggregate struct {
+	count  int                 // Number of measured steps
+	cost   int                 // Summed gas cost
+	totals [maxCycleEvents]int // Summed count of every event, in the order of the layout
+	min    [maxCycleEvents]int // Lowest count of every event in a single step
+	max    [maxCycleEvents]int // Highest count of every event in a single step
+}
+
+// cycleSummary aggregates the measured steps per opcode, or per pc and
+// opcode, keeping the memory use of the cycle tracer independent of the
+// trace length.
+type cycleSummary struct {
+	byPC       bool // Whether the steps are keyed on their pc as well
+	aggregates map[cycleKey]*cycleAggregate
+}
+
+// newCycleSummary creates an empty summary, keyed on the pc as well if byPC
+// is set.
+func newCycleSummary(byPC bool) *cycleSummary {
+	return &cycleSummary{byPC: byPC, aggregates: make(map[cycleKey]*cycleAggregate)}
+}
+
+// add aggregates a single step, readings holding the count of every event.
+func (s *cycleSummary) add(pc uint64, op vm.OpCode, readings []uint64, cost int) {
+	key := cycleKey{op: op}
+	if s.byPC {
+		key.pc = pc
+	}
+	agg, ok := s.aggregates[key]
+	if !ok {
+		agg = new(cycleAggregate)
+		s.aggregates[key] = agg
+	}
+	agg.count++
+	agg.cost += cost
+	for i, count := range readings {
+		agg.totals[i] += int(count)
+		if agg.count == 1 || int(count) < agg.min[i] {
+			agg.min[i] = int(count)
+		}
+		if agg.count == 1 || int(count) > agg.max[i] {
+			agg.max[i] = int(count)
+		}
+	}
+}
+
+// summaryColumns returns the columns of the summary CSV: the executions, the
+// total and mean cycles and the total cost per opcode, preceded by the pc if
+// keyed on it, followed by the total of every other event, the ratios of the
+// totals and the cycles per gas. The lowest and highest cycles of a single step
+// follow, then the lowest, highest and mean count of every other event, as a
+// few outliers may distort the totals.
+func (l *cycleLayout) summaryColumns(byPC bool) []tracers.ColumnInfo {
+	var columns []tracers.ColumnInfo
+	if byPC {
+		columns = append(columns, tracers.ColumnInfo{Name: "pc", Type: columnInt})
+	}
+	columns = append(columns, []tracers.ColumnInfo{
+		{Name: "opcode", Type: columnString},
+		{Name: "count", Type: columnInt},
+		{Name: "totalCycles", Type: columnInt, Unit: "cycles"},
+		{Name: "meanCycles", Type: columnFloat, Unit: "cycles"},
+		{Name: "totalCost", Type: columnInt, Unit: "gas"},
+	}...)
+	for _, event := range l.events[1:l.reported()] {
+		columns = append(columns, tracers.ColumnInfo{Name: eventColumn("total", event.name), Type: columnInt, Unit: event.name})
+	}
+	columns = append(columns, l.columns[2+l.reported():2+l.reported()+len(l.ratios)+1]...)
+	columns = append(columns,
+		tracers.ColumnInfo{Name: "minCycles", Type: columnInt, Unit: "cycles"},
+		tracers.ColumnInfo{Name: "maxCycles", Type: columnInt, Unit: "cycles"},
+	)
+	for _, event := range l.events[1:l.reported()] {
+		columns = append(columns,
+			tracers.ColumnInfo{Name: eventColumn("min", event.name), Type: columnInt, Unit: event.name},
+			tracers.ColumnInfo{Name: eventColumn("max", event.name), Type: columnInt, Unit: event.name},
+			tracers.ColumnInfo{Name: eventColumn("mean", event.name), Type: columnFloat, Unit: event.name},
+		)
+	}
+	return columns
+}
+
+// eventColumn returns the name of a summary column of an event, the event name
+// capitalized after the prefix.
+func eventColumn(prefix, name string) string {
+	return prefix + strings.ToUpper(name[:1]) + name[1:]
+}
+
+// summaryRow formats the aggregate of an opcode as a CSV row, the columns of
+// the events refused by the kernel left empty.
+func (l *cycleLayout) summaryRow(op vm.OpCode, agg *cycleAggregate) []string {
+	stats := 5 + l.reported() + len(l.ratios) // Index of the first min, max or mean column
+	row := make([]string, stats+2+3*(l.reported()-1))
+	row[0] = opcodeName(op)
+	row[1] = strconv.Itoa(agg.count)
+	row[4] = strconv.Itoa(agg.cost)
+	if !l.dropped[0] {
+		row[2] = strconv.Itoa(agg.totals[0])
+		row[3] = formatRatio(agg.totals[0], agg.count)
+	}
+	for i := 1; i < l.reported(); i++ {
+		if !l.dropped[i] {
+			row[4+i] = strconv.Itoa(agg.totals[i])
+		}
+	}
+	for i, ratio := range l.ratios {
+		if !l.dropped[ratio[0]] && !l.dropped[ratio[1]] {
+			row[4+l.reported()+i] = formatRatio(agg.totals[ratio[0]], agg.totals[ratio[1]])
+		}
+	}
+	if !l.dropped[0] {
+		row[stats-1] = formatRatio(agg.totals[0], agg.cost)
+		row[stats] = strconv.Itoa(agg.min[0])
+		row[stats+1] = strconv.Itoa(agg.max[0])
+	}
+	for i := 1; i < l.reported(); i++ {
+		if !l.dropped[i] {
+			col := stats + 2 + 3*(i-1)
+			row[col] = strconv.Itoa(agg.min[i])
+			row[col+1] = strconv.Itoa(agg.max[i])
+			row[col+2] = formatRatio(agg.totals[i], agg.count)
+		}
+	}
+	return row
+}
+
+// writeCycleSummaryCSV writes one row per aggregated key into out, ordered by
+// pc and opcode.
+func writeCycleSummaryCSV(out io.Writer, layout *cycleLayout, summary *cycleSummary) error {
+	keys := make([]cycleKey, 0, len(summary.aggregates))
+	for key := range summary.aggregates {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pc != keys[j].pc {
+			return keys[i].pc < keys[j].pc
+		}
+		return keys[i].op < keys[j].op
+	})
+	w := csv.NewWriter(out)
+	if err := w.Write(columnNames(layout.summaryColumns(summary.byPC))); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		row := layout.summaryRow(key.op, summary.aggregates[key])
+		if summary.byPC {
+			row = append([]string{strconv.FormatUint(key.pc, 10)}, row...)
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package native
+
+import "errors"
+
+// Sources of the cycle counts reported in the cycleTracer's result.
+const (
+	cycleSourcePerf = "perf" // Counted by the perf events
+	cycleSourceTSC  = "tsc"  // Approximated with the timestamp counter
+	cycleSourceNone = "none" // Not counted at all
+)
+
+// errRDTSCPUnsupported is returned when opening a tscCounter on a CPU without
+// the RDTSCP instruction.
+var errRDTSCPUnsupported = errors.New("RDTSCP instruction not supported")
+
+// tscCounter is an eventCounter approximating the cycles with the timestamp
+// counter, for where perf events can't be opened. The counter ticks at the
+// nominal frequency of the CPU, so its readings are reference cycles rather
+// than the core cycles perf counts, and include the time the thread was
+// descheduled. Reading it requires no privileges. Every other event is
+// reported as dropped.
+type tscCounter struct {
+	events  int   // Number of events of the layout, only the first being counted
+	begin   int64 // Counter reading when the measurement started
+	running bool
+}
+
+// newTSCCounter creates a counter of the cycles among the given number of
+// events, nil if the timestamp counter can't be read on this platform.
+func newTSCCounter(events int) eventCounter {
+	if !tscSupported {
+		return nil
+	}
+	return &tscCounter{events: events}
+}
+
+func (c *tscCounter) open() error {
+	if !rdtscpSupported() {
+		return errRDTSCPUnsupported
+	}
+	return nil
+}
+
+// close is a no-op, as the timestamp counter holds no resources. It doesn't
+// touch the measurement either, being called concurrently by Stop.
+func (c *tscCounter) close() error { return nil }
+
+func (c *tscCounter) start() error {
+	c.running = true
+	c.begin = readTSCP()
+	return nil
+}
+
+func (c *tscCounter) stop(counts []uint64) error {
+	end := readTSCP()
+	if !c.running {
+		return errCounterNotRunning
+	}
+	c.running = false
+	counts[0] = uint64(end - c.begin)
+	for i := 1; i < len(counts); i++ {
+		counts[i] = 0
+	}
+	return nil
+}
+
+func (c *tscCounter) dropped() []int {
+	dropped := make([]int, 0, c.events-1)
+	for i := 1; i < c.events; i++ {
+		dropped = append(dropped, i)
+	}
+	return dropped
+}
+
+func (c *tscCounter) times() (enabled, running uint64) { return 0, 0 }
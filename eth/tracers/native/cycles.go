@@ -25,147 +25,938 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/Olaburns/perf-utils"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/log"
+	"golang.org/x/sys/unix"
+	"io"
 	"math/big"
-	"strconv"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 func init() {
 	tracers.DefaultDirectory.Register("cycleTracer", newCycleTracer, false)
+	tracers.DefaultDirectory.RegisterColumns("cycleTracer", cycleTracerColumns)
 }
 
 type cycleTracer struct {
-	opcodes      []vm.OpCode
-	cycles       []int
-	cost         []int
-	cb           func()
-	fd           int
+	samples      []cycleSample          // Recorded steps, the last one is settled by the next step if pending
+	layout       *cycleLayout           // Counted events and the output columns
+	counter      eventCounter           // Counter of the events, opened once per transaction
+	fallback     eventCounter           // Counter of the cycles only if the events can't be counted, nil if unsupported
+	meter        eventCounter           // Counter measuring the current transaction, either of the above
+	source       string                 // Source of the counts of the current transaction
+	readings     []uint64               // Buffer for the counts of the last step
+	scaling      float64                // Ratio of the time the events were enabled to the time they counted, if multiplexed
+	locked       bool                   // Whether the OS thread the counter was opened on is locked
+	opcodes      *opcodeSet             // Opcodes of the steps to measure, nil to measure all
+	resolution   int                    // Number of consecutive steps measured together in a row
+	interval     int                    // Number of steps in the row being measured
+	pin          *cpuPin                // Pin of the tracing thread to a CPU, nil to leave its affinity alone
+	pinErr       error                  // Failure to pin the tracing thread, reported in the result
+	energy       *energyMeter           // Meter of the energy consumed by the transaction, nil unless requested
+	joules       map[string]float64     // Energy consumed by the transaction per RAPL domain, once measured
+	energyErr    error                  // Failure to measure the energy, reported in the result
+	refusals     map[string]string      // Errors the kernel refused the dropped events with, by name
+	exclude      uint64                 // PerfBitExclude* bits of the privilege levels the perf events leave uncounted
+	rdpmc        bool                   // Whether the counters are to be read in user space
+	userRead     bool                   // Whether the counters of the current transaction were read in user space
+	counting     bool                   // Whether the counter opened, steps are left unmeasured otherwise
+	perfErr      error                  // Error failing the result if perf events aren't permitted
+	failures     int                    // Number of failures to start or read the counter
+	errorLog     []string               // Errors of the first maxCycleErrors failures, reported in the result
+	lost         bool                   // Whether the measurement being taken failed, zeroing its counts
+	lostSamples  int                    // Number of measurements whose counts were zeroed by a failure
+	arrayRows    bool                   // Whether the rows are returned in the legacy array format instead of CSV
+	jsonRows     bool                   // Whether the rows are returned as JSON arrays under their column names instead of CSV
+	summary      *cycleSummary          // Per-opcode aggregates in summary mode, nil to record every step
+	deviation    *cycleDeviation        // Cycles per opcode for the deviation report, nil unless requested
+	lastPC       uint64                 // Program counter of the step being measured
+	lastOp       vm.OpCode              // Opcode of the step being measured
+	pending      bool                   // Whether a step is being measured, settled once its cost is known
+	times        cycleWindow            // Times of the meter since opened, as of the last read
+	window       cycleWindow            // Times the events were enabled and counting during the counts just read
+	carry        [maxCycleEvents]uint64 // Counts of the step being measured before it entered a child frame
+	carryWindow  cycleWindow            // Times of the carried counts
+	frames       []cycleFrame           // Child call frames being executed, the innermost last
+	gap          bool                   // Whether the entry of the innermost frame is being measured, until its first step
 	remainingGas int
-	opcodeCosts  *OpcodeCosts
+	startGas     int // Gas the top call started with
+	budget       *traceBudget
+	checkpoint   *checkpointer // Sink the rows are flushed to in batches or streamed to, nil to keep all in memory
+	interrupt    atomic.Bool   // Atomic flag to signal execution interruption
+	reason       error         // Textual reason for the interruption
 }
 
-// newTimingTracer returns a new noop tracer.
-func newCycleTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+type cycleTracerConfig struct {
+	BudgetMs          int      `json:"budgetMs"`          // If non-zero, steps are no longer traced after this many milliseconds
+	CheckpointSamples int      `json:"checkpointSamples"` // If non-zero, rows are flushed to a file in batches of this size
+	CheckpointFile    string   `json:"checkpointFile"`    // File within the tracer output directory to flush the rows to, a temp file if empty
+	OutputFile        string   `json:"outputFile"`        // If set, rows are streamed into this CSV file instead of kept in memory
+	Events            []string `json:"events"`            // Perf events to count besides the cycles, cycles and instructions if empty
+	Output            string   `json:"output"`            // Result encoding of the rows, outputCSV (default), outputJSON or outputArray
+	Summary           bool     `json:"summary"`           // If true, steps are aggregated per opcode instead of recorded individually
+	SummaryByPC       bool     `json:"summaryByPc"`       // If true, the summary aggregates per pc and opcode, regardless of the executing contract
+	PinCPU            *int     `json:"pinCPU"`            // If set, the tracing thread is pinned to this CPU for the transaction
+	Opcodes           []string `json:"opcodes"`           // If non-empty, only steps executing these opcodes are measured and recorded
+	Calibrate         bool     `json:"calibrate"`         // If true, the overhead of a measurement is calibrated on start and subtracted in an extra column
+	ExcludeKernel     *bool    `json:"excludeKernel"`     // Whether events in the kernel are left uncounted, true if unset
+	ExcludeHV         *bool    `json:"excludeHV"`         // Whether events in the hypervisor are left uncounted, true if unset
+	Rdpmc             bool     `json:"rdpmc"`             // If true, the counters are read in user space with rdpmc where permitted, without counting migrations
+	Energy            bool     `json:"energy"`            // If true, the energy the system consumed during the transaction is measured with the RAPL counters
+	Resolution        *int     `json:"resolution"`        // If set, the counters are read every resolution-th measured step, a row covering the steps in between
+	DeviationFactor   float64  `json:"deviationFactor"`   // If non-zero, opcodes whose cycles per gas deviate more from the median are reported
+
+	// Model-specific perf events to count after the named ones, by their encoding
+	RawEvents []cycleRawEvent `json:"rawEvents"`
+}
+
+// outputArray is the legacy result encoding of the cycleTracer, an array of
+// [opcode, cycles, cost] triples.
+const outputArray = "array"
+
+// newCycleTracer returns a tracer recording the CPU cycles and the other perf
+// events of every step, failing early on an invalid config or energy counters
+// that can't be opened.
+func newCycleTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
+	return buildCycleTracer(cfg, true)
+}
+
+// cycleTracerColumns returns the columns of a cycleTracer with the given
+// config. The optional events are probed like by the constructor, leaving out
+// those that can't be counted, as opening and closing them right away has no
+// side effects. The energy counters, which don't add columns, stay unopened.
+func cycleTracerColumns(cfg json.RawMessage) ([]tracers.ColumnInfo, error) {
+	t, err := buildCycleTracer(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	return t.Columns(), nil
+}
+
+// buildCycleTracer creates a cycleTracer from its config, checking that the
+// energy counters can be opened only if openEnergy is set.
+func buildCycleTracer(cfg json.RawMessage, openEnergy bool) (*cycleTracer, error) {
+	var config cycleTracerConfig
+	if cfg != nil {
+		if err := json.Unmarshal(cfg, &config); err != nil {
+			return nil, err
+		}
+	}
+	budget, err := newTraceBudget(config.BudgetMs)
+	if err != nil {
+		return nil, err
+	}
+	exclude := perfExclude(config.ExcludeKernel == nil || *config.ExcludeKernel, config.ExcludeHV == nil || *config.ExcludeHV)
+	raw, err := parseRawEvents(config.RawEvents)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := newCycleLayout(config.Events, raw, func(event perfEvent) error {
+		return probePerfEventExcluding(event, exclude)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.OutputFile != "" && config.CheckpointSamples != 0 {
+		return nil, errors.New("outputFile cannot be combined with checkpointSamples")
+	}
+	toFile := config.CheckpointSamples != 0 || config.OutputFile != ""
+	switch config.Output {
+	case "", outputCSV:
+	case outputJSON:
+		if toFile || config.Summary {
+			return nil, errors.New("json output is only supported for step rows kept in memory")
+		}
+	case outputArray:
+		if toFile {
+			return nil, errors.New("array output cannot be combined with checkpoints or outputFile")
+		}
+	default:
+		return nil, fmt.Errorf("unknown output %q", config.Output)
+	}
+	if config.Summary && config.Output == outputArray {
+		return nil, errors.New("array output cannot be combined with summary")
+	}
+	resolution := 1
+	if config.Resolution != nil {
+		if resolution = *config.Resolution; resolution <= 0 {
+			return nil, fmt.Errorf("invalid resolution %d", resolution)
+		}
+	}
+	// Intervals mix opcodes, which neither format can attribute them to
+	if resolution > 1 && (config.Summary || config.Output == outputArray) {
+		return nil, errors.New("resolution cannot be combined with summary or array output")
+	}
+	if config.DeviationFactor != 0 {
+		if config.DeviationFactor <= 1 {
+			return nil, fmt.Errorf("invalid deviationFactor %v, must exceed 1", config.DeviationFactor)
+		}
+		if resolution > 1 || config.Output == outputArray {
+			return nil, errors.New("deviationFactor cannot be combined with resolution or array output")
+		}
+	}
+	if config.SummaryByPC && !config.Summary {
+		return nil, errors.New("summaryByPc requires summary")
+	}
+	if config.Summary && toFile {
+		return nil, errors.New("checkpointSamples or outputFile cannot be combined with summary")
+	}
+	if config.Calibrate {
+		layout.calibrate()
+	}
+	// The migrations are counted by a software event, which can't be read in
+	// user space and would force the whole group back to system calls
+	if config.Rdpmc {
+		layout.dropCompanions()
+	}
+	opcodes, err := newOpcodeSet(config.Opcodes)
+	if err != nil {
+		return nil, err
+	}
+	pin, err := newCPUPin(config.PinCPU)
+	if err != nil {
+		return nil, err
+	}
+	var energy *energyMeter
+	if config.Energy && openEnergy {
+		if energy, err = newEnergyMeter(raplPMUPath); err != nil {
+			return nil, err
+		}
+		// Fail right away if the counters can't be opened, instead of with
+		// every transaction
+		if err := energy.open(); err != nil {
+			return nil, err
+		}
+		energy.close()
+	}
+	checkpoint, err := newCheckpointer("cycleTracer", config.CheckpointSamples, config.CheckpointFile, layout.columns)
+	if err != nil {
+		return nil, err
+	}
+	if config.OutputFile != "" {
+		path, err := outputPath(config.OutputFile)
+		if err != nil {
+			return nil, err
+		}
+		checkpoint = newStreamer(path, layout.columns)
+	}
+	counter := newPerfEventGroup(exclude, layout.events...)
+	counter.userRead = config.Rdpmc
 	t := &cycleTracer{
-		opcodes:      []vm.OpCode{},
-		cycles:       []int{},
-		cost:         []int{},
+		layout:       layout,
+		rdpmc:        config.Rdpmc,
+		exclude:      exclude,
+		counter:      counter,
+		fallback:     newTSCCounter(len(layout.events)),
+		meter:        counter,
+		readings:     make([]uint64, len(layout.events)),
+		arrayRows:    config.Output == outputArray,
+		jsonRows:     config.Output == outputJSON,
+		opcodes:      opcodes,
+		resolution:   resolution,
+		pin:          pin,
+		energy:       energy,
 		remainingGas: 0,
-		opcodeCosts:  NewOpcodeCosts(),
+		budget:       budget,
+		checkpoint:   checkpoint,
+	}
+	if config.Summary {
+		t.summary = newCycleSummary(config.SummaryByPC)
+	}
+	if config.DeviationFactor != 0 {
+		t.deviation = newCycleDeviation(config.DeviationFactor)
 	}
-
 	return t, nil
 }
 
 // CaptureStart implements the EVMLogger interface to initialize the tracing operation.
 func (t *cycleTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
-	t.startMeasuring()
+	// The perf event only counts the thread it was opened on
+	runtime.LockOSThread()
+	t.locked = true
+	t.startGas = int(gas)
+	if t.pin != nil {
+		// A failure leaves the thread free to migrate, which the result reports
+		t.pinErr = t.pin.pin()
+	}
+	t.meter, t.source, t.counting = t.counter, cycleSourcePerf, true
+	if err := t.counter.open(); err != nil {
+		// Count approximate cycles with the timestamp counter instead, if
+		// possible, leaving the other events uncounted
+		if t.fallback != nil && t.fallback.open() == nil {
+			t.meter, t.source = t.fallback, cycleSourceTSC
+			warnPerfOnce.Do(func() {
+				log.Warn("Perf events unavailable, counting cycles with the timestamp counter", "err", err)
+			})
+		} else {
+			t.source, t.counting = cycleSourceNone, false
+			if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+				t.perfErr = &perfPermissionError{err: err}
+			}
+			warnPerfOnce.Do(func() {
+				log.Warn("Perf events unavailable, CPU events left uncounted", "err", err)
+			})
+		}
+	}
+	t.userRead = false
+	if r, ok := t.meter.(userReader); ok && t.source == cycleSourcePerf {
+		t.userRead = r.userReading()
+	}
+	dropped := t.meter.dropped()
+	t.layout.drop(dropped)
+	t.refusals = nil
+	if r, ok := t.meter.(refusalReporter); ok {
+		for i, err := range r.refusals() {
+			if dropped[i] >= t.layout.reported() {
+				continue // Companion events aren't configured
+			}
+			if t.refusals == nil {
+				t.refusals = make(map[string]string)
+			}
+			t.refusals[t.layout.names[dropped[i]]] = err.Error()
+		}
+	}
+	if t.layout.calibrated && t.counting {
+		t.layout.overhead = t.calibrateOverhead()
+	}
+	t.times.enabled, t.times.running = t.meter.times()
+	if t.energy != nil {
+		t.joules, t.energyErr = nil, t.energy.open()
+	}
+	t.budget.start()
+	if t.checkpoint != nil {
+		t.checkpoint.open()
+		t.abortOnWriteError()
+	}
 }
 
 // CaptureEnd is called after the call finishes to finalize the tracing.
 func (t *cycleTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
-
+	// Settle the last step, usually the STOP, RETURN or REVERT ending the
+	// call, up to the gas the call returns. The gas left at the end of the
+	// transaction includes the refund, so it can't be used. The cost would
+	// include the steps skipped if tracing was interrupted, so the step is
+	// left out then.
+	if t.pending {
+		if t.interrupt.Load() {
+			t.samples = t.samples[:t.settled()]
+			t.pending = false
+		} else {
+			t.read()
+			t.settle(t.remainingGas - (t.startGas - int(gasUsed)))
+		}
+	}
 }
 
 // CaptureState implements the EVMLogger interface to trace a single step of VM execution.
 func (t *cycleTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
-	pv, err2 := perf.StopCPUCycles(t.cb, t.fd)
+	// Once out of budget, only a step resumed after returning from a child
+	// frame is left to settle
+	if t.interrupt.Load() || (t.budget.exceeded && !t.pending) {
+		return
+	}
+	// Steps within the interval being measured are only added to its row,
+	// leaving the counter running
+	if t.pending && t.interval < t.resolution && !t.budget.exceeded && (t.opcodes == nil || t.opcodes[op]) {
+		t.interval++
+		sample := &t.samples[len(t.samples)-1]
+		sample.ops = append(sample.ops, op)
+		return
+	}
+	if t.pending {
+		t.read()
+		t.settle(t.remainingGas - int(gas))
+	} else if t.gap {
+		t.read()
+		t.addToFrame()
+	}
+	t.gap = false
+	t.remainingGas = int(gas)
 
-	if err2 != nil {
-		fmt.Println("StopCPUCycles failed:", err2)
+	// Skip filtered steps without touching the counter, before they count
+	// towards the budget
+	if t.opcodes != nil && !t.opcodes[op] {
+		return
 	}
 
-	cycels := int(pv.Value)
-	if t.remainingGas == 0 {
-		t.remainingGas = int(gas)
+	// The previous step is settled now, so stop here if out of budget,
+	// leaving the counter stopped
+	if !t.budget.step() {
+		return
+	}
+	t.lastPC, t.lastOp, t.pending, t.interval = pc, op, true, 1
+	if t.summary == nil {
+		t.samples = append(t.samples, cycleSample{op: op, pc: pc, depth: depth})
+		if t.checkpoint.due(len(t.samples) - 1) {
+			t.flushRows(len(t.samples) - 1)
+		}
+	}
+	t.startMeasuring()
+}
+
+// cycleCalibrationRuns is the number of empty measurements the overhead
+// calibration takes.
+const cycleCalibrationRuns = 1000
+
+// calibrateOverhead returns the median cycles counted by a measurement of
+// nothing, which is the bias the counter's own start and stop add to every
+// step.
+func (t *cycleTracer) calibrateOverhead() int {
+	runs := make([]int, 0, cycleCalibrationRuns)
+	for i := 0; i < cycleCalibrationRuns; i++ {
+		if t.meter.start() != nil || t.meter.stop(t.readings) != nil {
+			continue
+		}
+		runs = append(runs, int(t.readings[0]))
+	}
+	if len(runs) == 0 {
+		return 0
+	}
+	sort.Ints(runs)
+	return runs[len(runs)/2]
+}
+
+// read stops the measurement of the last step and reads its counts, which are
+// zero if it couldn't be measured. The counts are scaled by the time the
+// events were enabled over the time they were counting during the step, if
+// multiplexed. The counts the step had before entering a child frame are
+// added.
+func (t *cycleTracer) read() {
+	if !t.counting {
+		return
+	}
+	t.window = cycleWindow{}
+	if err := t.meter.stop(t.readings); err != nil {
+		for i := range t.readings {
+			t.readings[i] = 0
+		}
+		if err != errCounterNotRunning {
+			t.fail(err)
+		}
 	} else {
-		gasCost := t.remainingGas - int(gas)
-		t.cost = append(t.cost, gasCost)
-		t.remainingGas = int(gas)
+		// The meter reports its times since opened, the step's are the difference
+		enabled, running := t.meter.times()
+		t.window = cycleWindow{enabled: enabled - t.times.enabled, running: running - t.times.running}
+		t.times = cycleWindow{enabled: enabled, running: running}
+		scaleCounts(t.readings, t.window.enabled, t.window.running)
+	}
+	for i := range t.readings {
+		t.readings[i] += t.carry[i]
+		t.carry[i] = 0
 	}
+	t.window.add(t.carryWindow)
+	t.carryWindow = cycleWindow{}
 
-	t.cycles = append(t.cycles, int(cycels))
-	t.opcodes = append(t.opcodes, op)
-	t.startMeasuring()
+	if t.lost {
+		t.lostSamples++
+		t.lost = false
+	}
+}
+
+// addToFrame adds the counts just read to the totals of the innermost child
+// frame, if any.
+func (t *cycleTracer) addToFrame() {
+	if len(t.frames) == 0 {
+		return
+	}
+	frame := &t.frames[len(t.frames)-1]
+	for i, count := range t.readings {
+		frame.totals[i] += int(count)
+	}
+	frame.window.add(t.window)
+}
+
+// settle records the counts just read and the cost of the step being
+// measured, or aggregates them in summary mode.
+func (t *cycleTracer) settle(cost int) {
+	t.pending = false
+	t.addToFrame()
+	if t.deviation != nil {
+		t.deviation.add(t.lastOp, int(t.readings[0]), cost)
+	}
+	if t.summary != nil {
+		t.summary.add(t.lastPC, t.lastOp, t.readings, cost)
+		return
+	}
+	sample := &t.samples[len(t.samples)-1]
+	for i, count := range t.readings {
+		sample.counts[i] = int(count)
+	}
+	sample.window = t.window
+	sample.cost = cost
+}
+
+// settled returns the number of rows with their counts and cost settled, all
+// but the step being measured.
+func (t *cycleTracer) settled() int {
+	if t.pending && t.summary == nil {
+		return len(t.samples) - 1
+	}
+	return len(t.samples)
+}
+
+// flushRows checkpoints the first n rows, which must have their cost settled,
+// and releases them from memory.
+func (t *cycleTracer) flushRows(n int) {
+	for i := range t.samples[:n] {
+		sample := &t.samples[i]
+		t.checkpoint.write(t.layout.row(sample))
+		t.checkpoint.observe(2, int64(sample.cost))
+		for e := 0; e < t.layout.reported(); e++ {
+			if !t.layout.dropped[e] {
+				t.checkpoint.observe(t.layout.countColumn(e), int64(sample.counts[e]))
+			}
+		}
+	}
+	t.checkpoint.commit()
+	t.abortOnWriteError()
+
+	t.samples = t.samples[:copy(t.samples, t.samples[n:])]
+}
+
+// abortOnWriteError stops tracing once the rows fail to be written to the
+// file, rather than measuring on for rows that would be lost.
+func (t *cycleTracer) abortOnWriteError() {
+	if t.checkpoint.err != nil && !t.interrupt.Load() {
+		t.Stop(t.writeError(t.checkpoint.err))
+	}
+}
+
+// writeError wraps a failure to write the rows to the file.
+func (t *cycleTracer) writeError(err error) error {
+	return fmt.Errorf("failed to write rows to %s: %w", t.checkpoint.path, err)
+}
+
+// Columns implements tracers.ColumnTracer, returning the CSV columns.
+func (t *cycleTracer) Columns() []tracers.ColumnInfo {
+	if t.summary != nil {
+		return t.layout.summaryColumns(t.summary.byPC)
+	}
+	return t.layout.columns
 }
 
 func (t *cycleTracer) startMeasuring() {
-	cb, fd, err := perf.StartCPUCycles()
-	if err != nil {
-		fmt.Println("StopCPUCycles failed:", err)
+	if !t.counting {
+		return
+	}
+	if err := t.meter.start(); err != nil && err != errCounterClosed {
+		t.fail(err)
+	}
+}
+
+// maxCycleErrors is the number of measurement failures a cycleTracer reports
+// the errors of, the others are only counted.
+const maxCycleErrors = 10
+
+// fail records a failure to measure the current step, whose counts are zeroed
+// once read. Only the first failure is logged, the others would only repeat
+// it.
+func (t *cycleTracer) fail(err error) {
+	if t.failures == 0 {
+		log.Warn("Failed to count CPU events of step", "err", err)
+	}
+	t.failures++
+	if len(t.errorLog) < maxCycleErrors {
+		t.errorLog = append(t.errorLog, err.Error())
 	}
-	t.cb = cb
-	t.fd = fd
+	t.lost = true
 }
 
 // CaptureFault implements the EVMLogger interface to trace an execution fault.
 func (t *cycleTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
 }
 
+// cycleFrame is a child call frame being executed. The measurement of the
+// step entering it is paused until it returns, so that the step doesn't absorb
+// the counts of the whole frame. Its row is held back meanwhile and recorded
+// after the rows of the frame, keeping all rows but the last one settled.
+type cycleFrame struct {
+	typ      vm.OpCode
+	gas      uint64              // Gas the frame was entered with
+	pc       uint64              // Program counter of the step entering the frame
+	recorded bool                // Whether a row is recorded for the frame on return
+	totals   [maxCycleEvents]int // Summed counts of the frame's entry and measured steps, including its children
+	window   cycleWindow         // Summed times of the counts in the totals
+
+	// Step entering the frame, resumed on return
+	pending      bool
+	sample       cycleSample // Row of the step, unless in summary mode
+	lastPC       uint64
+	lastOp       vm.OpCode
+	remainingGas int
+	interval     int                    // Number of steps in the row of the step
+	carry        [maxCycleEvents]uint64 // Counts of the step up to entering the frame
+	carryWindow  cycleWindow            // Times of the carried counts
+}
+
 // CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
 func (t *cycleTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
-
+	active := !t.interrupt.Load() && !t.budget.exceeded
+	frame := cycleFrame{
+		typ:          typ,
+		gas:          gas,
+		pc:           t.lastPC,
+		recorded:     active && (t.opcodes == nil || t.opcodes[typ]),
+		pending:      t.pending,
+		lastPC:       t.lastPC,
+		lastOp:       t.lastOp,
+		remainingGas: t.remainingGas,
+		interval:     t.interval,
+	}
+	if t.pending && active {
+		t.read()
+		for i, count := range t.readings {
+			frame.carry[i] = count
+		}
+		frame.carryWindow = t.window
+	}
+	if t.pending && t.summary == nil {
+		frame.sample = t.samples[len(t.samples)-1]
+		t.samples = t.samples[:len(t.samples)-1]
+	}
+	t.frames = append(t.frames, frame)
+	t.pending = false
+
+	// Measure the entry of the frame until its first step, which is all of it
+	// for precompiles
+	if frame.recorded {
+		t.gap = true
+		t.startMeasuring()
+	}
 }
 
 // CaptureExit is called when EVM exits a scope, even if the scope didn't
 // execute any code.
 func (t *cycleTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	if len(t.frames) == 0 {
+		return
+	}
+	frame := &t.frames[len(t.frames)-1]
+	if !t.interrupt.Load() {
+		if t.pending {
+			t.read()
+			t.settle(t.remainingGas - int(frame.gas-gasUsed))
+		} else if t.gap {
+			t.read()
+			t.addToFrame()
+		}
+		t.gap = false
+		if frame.recorded && t.summary == nil {
+			t.samples = append(t.samples, cycleSample{
+				counts: frame.totals,
+				window: frame.window,
+				cost:   int(gasUsed),
+				pc:     frame.pc,
+				depth:  len(t.frames) + 1,
+				op:     frame.typ,
+				frame:  true,
+			})
+		}
+	}
+	t.frames = t.frames[:len(t.frames)-1]
+	if len(t.frames) > 0 {
+		parent := &t.frames[len(t.frames)-1]
+		for i, count := range frame.totals {
+			parent.totals[i] += count
+		}
+		parent.window.add(frame.window)
+	}
+	// Resume measuring the step that entered the frame
+	t.pending, t.lastPC, t.lastOp = frame.pending, frame.lastPC, frame.lastOp
+	t.remainingGas, t.carry, t.carryWindow = frame.remainingGas, frame.carry, frame.carryWindow
+	t.interval = frame.interval
+	if t.pending && t.summary == nil {
+		t.samples = append(t.samples, frame.sample)
+	}
+	if t.pending && !t.interrupt.Load() && !t.budget.exceeded {
+		t.startMeasuring()
+	}
 }
 
 func (*cycleTracer) CaptureTxStart(gasLimit uint64) {}
 
 func (t *cycleTracer) CaptureTxEnd(restGas uint64) {
-	t.cost = append(t.cost, t.remainingGas-int(restGas))
-	perf.StopCPUCycles(t.cb, t.fd)
+	defer t.release()
+
+	// The energy of an interrupted transaction is left unreported, as the
+	// meter is closed already
+	if t.energy != nil && t.energyErr == nil && !t.interrupt.Load() {
+		t.joules, t.energyErr = t.energy.read()
+	}
+	// Write out the remaining rows of the transaction, so that none is held
+	// in memory until the result is retrieved
+	if t.checkpoint != nil {
+		t.flushRows(len(t.samples))
+	}
 }
 
-// GetResult returns an empty json object.
-func (t *cycleTracer) GetResult() (json.RawMessage, error) {
-	csvData, err := CyclesToCSV(t.opcodes, t.cycles, t.cost)
+// release closes the counter and unlocks the OS thread it was opened on. The
+// time the counter was multiplexed is recorded before.
+func (t *cycleTracer) release() {
+	if enabled, running := t.meter.times(); running > 0 && running < enabled {
+		t.scaling = float64(enabled) / float64(running)
+	}
+	t.meter.close()
+	if t.energy != nil {
+		t.energy.close()
+	}
+	t.unpin()
+	if t.locked {
+		runtime.UnlockOSThread()
+		t.locked = false
+	}
+}
 
+// GetResult returns the recorded rows, or those settled up to the
+// interruption along with its reason if the tracer was stopped.
+func (t *cycleTracer) GetResult() (json.RawMessage, error) {
+	if t.perfErr != nil {
+		if t.checkpoint != nil {
+			t.checkpoint.close()
+		}
+		return nil, t.perfErr
+	}
+	if t.checkpoint != nil {
+		// Flush the last partial batch, a step not settled yet is dropped
+		t.flushRows(t.settled())
+		res, err := t.checkpoint.result(t.resultMeta(), t.stopReason())
+		if err != nil {
+			return nil, t.writeError(err)
+		}
+		return res, t.stopReason()
+	}
+	if t.arrayRows {
+		res, err := marshalCycleTriples(t.samples[:t.settled()], t.layout.dropped[0])
+		if err != nil {
+			return nil, err
+		}
+		return res, t.stopReason()
+	}
+	if t.jsonRows {
+		samples := t.samples[:t.settled()]
+		res, err := marshalRowsResult(t.resultMeta(), t.layout.columns, len(samples), func(i int) []string {
+			return t.layout.row(&samples[i])
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res, t.stopReason()
+	}
+	buf := new(bytes.Buffer)
+	if err := t.writeCSV(buf); err != nil {
+		return nil, err
+	}
 	// Encode the slice of slices to JSON
-	jsonBytes, err := json.Marshal(csvData)
+	jsonBytes, err := marshalTableResult(t.resultMeta(), buf.String())
 	if err != nil {
-		fmt.Println(err)
-		return json.RawMessage(`{}`), err
+		return nil, err
+	}
+
+	return jsonBytes, t.stopReason()
+}
+
+// EncodeResult implements tracers.ResultEncoder, streaming the same result as
+// GetResult without building the CSV in memory.
+func (t *cycleTracer) EncodeResult(w io.Writer) error {
+	if t.checkpoint != nil || t.perfErr != nil || t.arrayRows || t.jsonRows {
+		res, err := t.GetResult()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(res)
+		return err
 	}
+	if err := encodeTableResult(w, t.resultMeta(), t.writeCSV); err != nil {
+		return err
+	}
+	return t.stopReason()
+}
+
+// writeCSV writes the rows as CSV into out, or the aggregates in summary mode.
+func (t *cycleTracer) writeCSV(out io.Writer) error {
+	if t.summary != nil {
+		return writeCycleSummaryCSV(out, t.layout, t.summary)
+	}
+	// A step not settled yet, if still tracing, is left out
+	return writeCyclesCSV(out, t.layout, t.samples[:t.settled()])
+}
+
+// refusalReporter is implemented by event counters reporting why the kernel
+// refused to count the events they dropped.
+type refusalReporter interface {
+	refusals() []error // Errors of the events of dropped, in the same order
+}
+
+// userReader is implemented by event counters able to read the counters in
+// user space instead of with system calls.
+type userReader interface {
+	userReading() bool // Whether the open counter is read in user space
+}
+
+// warnPerfOnce limits the warning about unavailable perf events to one per
+// process, instead of one per traced transaction.
+var warnPerfOnce sync.Once
+
+// perfPermissionError is returned by a cycleTracer if the kernel doesn't
+// permit perf events and there's no timestamp counter to fall back to,
+// explaining how to permit them.
+type perfPermissionError struct {
+	err error
+}
+
+func (e *perfPermissionError) Error() string {
+	return fmt.Sprintf("perf events not permitted (%v): lower kernel.perf_event_paranoid to 2 or below with sysctl, or grant the node CAP_PERFMON", e.err)
+}
 
-	return jsonBytes, nil
+func (e *perfPermissionError) Unwrap() error {
+	return e.err
 }
 
-// Stop terminates execution of the tracer at the first opportune moment.
+// resultMeta returns the metadata to report alongside the rows, which always
+// names the source of the counts.
+func (t *cycleTracer) resultMeta() *tableMeta {
+	meta := newTableMeta(nil, t.budget)
+	if meta == nil {
+		meta = new(tableMeta)
+	}
+	meta.CycleSource = t.source
+	if t.resolution > 1 {
+		meta.Resolution = t.resolution
+	}
+	if reason := t.stopReason(); reason != nil {
+		meta.Interrupted = reason.Error()
+	}
+	if t.source == cycleSourcePerf {
+		kernel, hv := t.exclude&unix.PerfBitExcludeKernel != 0, t.exclude&unix.PerfBitExcludeHv != 0
+		meta.ExcludeKernel, meta.ExcludeHV = &kernel, &hv
+		if t.rdpmc {
+			meta.Rdpmc = &t.userRead
+		}
+	}
+	if dropped := t.layout.droppedNames(); len(dropped) > 0 {
+		meta.DroppedEvents = dropped
+	}
+	meta.EventErrors = t.refusals
+	meta.MeasurementErrors, meta.Errors, meta.LostSamples = t.failures, t.errorLog, t.lostSamples
+	// Cycles per gas can only be compared if the cycles were counted
+	if t.deviation != nil && t.counting && !t.layout.dropped[0] {
+		meta.Deviations = t.deviation.report()
+	}
+	if scaling := t.scaling; scaling > 1 {
+		meta.Scaling = scaling
+	}
+	if t.layout.calibrated && t.counting {
+		meta.CycleOverhead = &t.layout.overhead
+	}
+	if t.pin != nil {
+		if t.pinErr != nil {
+			meta.AffinityError = t.pinErr.Error()
+		} else {
+			meta.PinnedCPU = &t.pin.cpu
+		}
+	}
+	if t.energy != nil {
+		meta.Energy = t.joules
+		if t.energyErr != nil {
+			meta.EnergyError = t.energyErr.Error()
+		}
+	}
+	return meta
+}
+
+// Stop terminates execution of the tracer at the first opportune moment. The
+// counters are closed right away, so that no perf descriptor outlives a
+// cancelled trace, and the steps settled so far remain in the result.
 func (t *cycleTracer) Stop(err error) {
+	t.reason = err
+	t.interrupt.Store(true)
+	t.counter.close()
+	if t.fallback != nil {
+		t.fallback.close()
+	}
+	if t.energy != nil {
+		t.energy.close()
+	}
+	t.unpin()
 }
 
-func CyclesToCSV(opcodes []vm.OpCode, cycles, cost []int) (string, error) {
-	// Check if all slices have the same length
-	if len(opcodes) != len(cycles) || len(cycles) != len(cost) {
-		return "", errors.New("all slices must have the same length")
+// unpin restores the affinity of the tracing thread if pinned to a CPU.
+func (t *cycleTracer) unpin() {
+	if t.pin == nil {
+		return
+	}
+	if err := t.pin.release(); err != nil {
+		log.Warn("Failed to restore CPU affinity of tracing thread", "err", err)
 	}
+}
+
+// stopReason returns the reason tracing was interrupted, if it was.
+func (t *cycleTracer) stopReason() error {
+	if !t.interrupt.Load() {
+		return nil
+	}
+	return t.reason
+}
 
-	// Create a buffer to hold the CSV data
+// CyclesToCSV formats the cycles and instructions counted per step as CSV, in
+// the layout of the cycleTracer counting its default events.
+func CyclesToCSV(opcodes []vm.OpCode, cycles, instructions, cost []int) (string, error) {
+	if len(opcodes) != len(cycles) || len(cycles) != len(instructions) || len(instructions) != len(cost) {
+		return "", errors.New("all slices must have the same length")
+	}
+	layout, err := newCycleLayout(nil, nil, probePerfEvent)
+	if err != nil {
+		return "", err
+	}
+	samples := make([]cycleSample, len(opcodes))
+	for i, op := range opcodes {
+		samples[i] = cycleSample{op: op, cost: cost[i]}
+		samples[i].counts[0], samples[i].counts[1] = cycles[i], instructions[i]
+	}
 	buf := &bytes.Buffer{}
-	w := csv.NewWriter(buf)
+	if err := writeCyclesCSV(buf, layout, samples); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// marshalCycleTriples encodes the steps in the legacy array format of
+// [opcode, cycles, cost] triples, the cycles being null if not counted.
+func marshalCycleTriples(samples []cycleSample, uncounted bool) (json.RawMessage, error) {
+	triples := make([][]interface{}, 0, len(samples))
+	for _, sample := range samples {
+		if sample.frame {
+			continue // The legacy format only holds steps
+		}
+		var cycles interface{}
+		if !uncounted {
+			cycles = sample.counts[0]
+		}
+		triples = append(triples, []interface{}{opcodeName(sample.op), cycles, sample.cost})
+	}
+	return json.Marshal(triples)
+}
+
+// writeCyclesCSV writes the samples as CSV into out.
+func writeCyclesCSV(out io.Writer, layout *cycleLayout, samples []cycleSample) error {
+	w := csv.NewWriter(out)
 
 	// Write the headers to the CSV
-	err := w.Write([]string{"opcodes", "cycles", "cost"})
+	err := w.Write(columnNames(layout.columns))
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	// Write data to CSV
-	for i := 0; i < len(opcodes); i++ {
-		row := []string{
-			opcodes[i].String(),
-			strconv.Itoa(cycles[i]),
-			strconv.Itoa(cost[i]),
-		}
-		err = w.Write(row)
+	for i := range samples {
+		err = w.Write(layout.row(&samples[i]))
 		if err != nil {
-			return "", err
+			return err
 		}
 	}
 
@@ -173,10 +964,5 @@ func CyclesToCSV(opcodes []vm.OpCode, cycles, cost []int) (string, error) {
 	w.Flush()
 
 	// Check for any errors during write
-	err = w.Error()
-	if err != nil {
-		return "", err
-	}
-
-	return buf.String(), nil
+	return w.Error()
 }
@@ -0,0 +1,42 @@
+//go:build !linux
+// +build !linux
+
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	tracers.DefaultDirectory.Register("cycleTracer", newCycleTracer, false)
+}
+
+// errCycleTracerUnsupported is returned when creating a cycleTracer on a
+// platform without perf events.
+var errCycleTracerUnsupported = errors.New("cycleTracer requires Linux perf support")
+
+// newCycleTracer fails, as CPU cycles can't be counted on this platform. The
+// tracer is still registered so that callers get a meaningful error instead of
+// an unknown tracer.
+func newCycleTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
+	return nil, errCycleTracerUnsupported
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// Tests that the cycleTracer is registered without perf support, failing with
+// a meaningful error instead of being unknown.
+func TestCycleTracerUnsupported(t *testing.T) {
+	_, err := tracers.DefaultDirectory.New("cycleTracer", new(tracers.Context), nil)
+	if !errors.Is(err, errCycleTracerUnsupported) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errCycleTracerUnsupported)
+	}
+}
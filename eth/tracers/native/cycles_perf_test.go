@@ -0,0 +1,76 @@
+//go:build linux && perf
+// +build linux,perf
+
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Tests the perf event plumbing of the cycleTracer against the real kernel
+// interface. It only runs with the perf build tag, on machines permitting
+// perf events for unprivileged threads.
+func TestCycleTracerPerfIntegration(t *testing.T) {
+	if err := probePerfEvent(cyclesEvent); err != nil {
+		t.Skipf("perf events unavailable: %v", err)
+	}
+	tracer := newTestTracer(t, "cycleTracer", `{"events": ["instructions", "dtlb-loads", "dtlb-load-misses"]}`)
+	res, err := runTestTracer(t, tracer, loopCode, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	// The result is wrapped into metadata if events were dropped or multiplexed
+	var result struct {
+		DroppedEvents []string `json:"droppedEvents"`
+		Scaling       float64  `json:"scaling"`
+		CSV           string   `json:"csv"`
+	}
+	if err := json.Unmarshal(res, &result.CSV); err != nil {
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("failed to decode result: %v", err)
+		}
+		t.Logf("dropped events: %v, scaling: %v", result.DroppedEvents, result.Scaling)
+	}
+	rows, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse CSV: %v", err)
+	}
+	var cycles, instructions int
+	for _, row := range rows[1:] {
+		n, err := strconv.Atoi(row[1])
+		if err != nil {
+			t.Fatalf("invalid cycles %q: %v", row[1], err)
+		}
+		cycles += n
+		if row[3] != "" {
+			n, _ = strconv.Atoi(row[3])
+			instructions += n
+		}
+	}
+	if cycles == 0 {
+		t.Errorf("no cycles counted over %d steps", len(rows)-1)
+	}
+	if instructions == 0 {
+		t.Errorf("no instructions counted over %d steps", len(rows)-1)
+	}
+}
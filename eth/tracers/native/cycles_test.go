@@ -0,0 +1,1750 @@
+//go:build linux
+// +build linux
+
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"golang.org/x/sys/unix"
+)
+
+// newStubCycleTracer creates a cycleTracer measuring with stubEventCounter.
+func newStubCycleTracer(t testing.TB) *cycleTracer {
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	return tracer
+}
+
+// Tests that the cycleTracer itself doesn't allocate per step. The perf
+// counter is stubbed out, as opening perf events is outside of its control.
+func TestCycleTracerCaptureStateAllocs(t *testing.T) {
+	testCaptureStateAllocs(t, newStubCycleTracer(t))
+}
+
+func BenchmarkCycleTracerCaptureState(b *testing.B) {
+	benchmarkCaptureState(b, newStubCycleTracer(b))
+}
+
+func TestCycleTracerColumnsMatchHeader(t *testing.T) {
+	testColumnsMatchHeader(t, newStubCycleTracer(t))
+}
+
+// Tests that the columns of a cycleTracer are listed without opening the
+// energy counters, and match the header of a trace on the same hardware, the
+// events it can't count left out of both.
+func TestCycleTracerDirectoryColumns(t *testing.T) {
+	defer func(path string) { raplPMUPath = path }(raplPMUPath)
+	raplPMUPath = filepath.Join(t.TempDir(), "power")
+
+	events := `"events": ["instructions", "dtlb-loads", "stalled-cycles-frontend"]`
+	columns, err := tracers.DefaultDirectory.Columns("cycleTracer", new(tracers.Context), json.RawMessage(`{`+events+`, "energy": true}`))
+	if err != nil {
+		t.Fatalf("failed to list columns: %v", err)
+	}
+	tracer := newTestTracer(t, "cycleTracer", `{`+events+`}`).(*cycleTracer)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	if tracer.source != cycleSourcePerf {
+		t.Skipf("perf events unavailable, cycles counted by %q", tracer.source)
+	}
+	header, err := csv.NewReader(strings.NewReader(tableCSV(t, res))).Read()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if names := columnNames(columns); !reflect.DeepEqual(names, header) {
+		t.Errorf("columns mismatch: listed %v, emitted %v", names, header)
+	}
+	if _, err := tracers.DefaultDirectory.Columns("cycleTracer", new(tracers.Context), json.RawMessage(`{"events": ["missing"]}`)); err == nil {
+		t.Error("expected error for unknown event")
+	}
+}
+
+func TestOpcodeNamesCyclesCSV(t *testing.T) {
+	ops := allOpcodes()
+	ints := make([]int, len(ops))
+	blob, err := CyclesToCSV(ops, ints, ints, ints)
+	if err != nil {
+		t.Fatalf("failed to write CSV: %v", err)
+	}
+	testOpcodeColumn(t, blob, 0)
+}
+
+// countingEventCounter is a stubEventCounter tracking whether it is open.
+type countingEventCounter struct {
+	stubEventCounter
+	opened, closed int
+}
+
+func (c *countingEventCounter) open() error  { c.opened++; return nil }
+func (c *countingEventCounter) close() error { c.closed++; return nil }
+
+// openFds returns the number of file descriptors open in the process.
+func openFds(t *testing.T) int {
+	t.Helper()
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("failed to list open file descriptors: %v", err)
+	}
+	return len(fds)
+}
+
+// Tests that tracing a long loop doesn't leak a perf event descriptor per
+// step.
+func TestCycleTracerFdLeak(t *testing.T) {
+	before := openFds(t)
+
+	// Make sure perf events are counted at all, opening descriptors
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	tracer.CaptureTxStart(3)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 3, nil)
+	source, during := tracer.source, openFds(t)
+	tracer.CaptureEnd(nil, 0, nil)
+	tracer.CaptureTxEnd(3)
+	tracer.GetResult()
+	if source != cycleSourcePerf {
+		t.Skipf("perf events unavailable, cycles counted by %q", source)
+	}
+	if during <= before {
+		t.Fatalf("no file descriptors opened while tracing: have %d, had %d", during, before)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := runTestTracer(t, newTestTracer(t, "cycleTracer", ""), loopCode, nil); err != nil {
+			t.Fatalf("failed to retrieve trace result: %v", err)
+		}
+	}
+	if after := openFds(t); after > before {
+		t.Errorf("open file descriptors grew: have %d, had %d", after, before)
+	}
+}
+
+// Tests that the last step isn't charged the refund of the transaction, which
+// is included in the gas left at its end.
+func TestCycleTracerRefund(t *testing.T) {
+	tracer := newStubCycleTracer(t)
+	applyTestMessage(t, tracer, refundCode, refundStorage)
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	records, err := csv.NewReader(strings.NewReader(tableCSV(t, res))).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	var costs []string
+	for _, record := range records[1:] {
+		costs = append(costs, record[0]+"/"+record[2])
+	}
+	if want := []string{"PUSH1/3", "PUSH1/3", "SSTORE/5000", "STOP/0"}; !reflect.DeepEqual(costs, want) {
+		t.Fatalf("cost mismatch: have %v, want %v", costs, want)
+	}
+}
+
+// Tests that the counter is opened once per transaction and closed both on its
+// end and when the tracer is stopped.
+func TestCycleTracerCounterClosed(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	counter := new(countingEventCounter)
+	tracer.counter = counter
+	if _, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil); err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	if counter.opened != 1 || counter.closed != 1 {
+		t.Errorf("counter open/close mismatch: opened %d, closed %d, want 1 each", counter.opened, counter.closed)
+	}
+
+	tracer = newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	counter = new(countingEventCounter)
+	tracer.counter = counter
+	tracer.CaptureTxStart(3)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 3, nil)
+	tracer.CaptureState(0, vm.JUMPDEST, 3, 1, nil, nil, 1, nil)
+	tracer.Stop(errors.New("timeout"))
+	if counter.closed != 1 {
+		t.Errorf("counter not closed on stop: closed %d", counter.closed)
+	}
+}
+
+// sequencedEventCounter is a stubEventCounter counting 10*n cycles in the
+// n-th measurement, so that every count identifies the step it was taken of.
+type sequencedEventCounter struct {
+	stubEventCounter
+	started int
+	running bool
+}
+
+func (c *sequencedEventCounter) start() error {
+	c.started++
+	c.running = true
+	return nil
+}
+
+func (c *sequencedEventCounter) stop(counts []uint64) error {
+	if !c.running {
+		return errCounterNotRunning
+	}
+	c.running = false
+	for i := range counts {
+		counts[i] = 10 * uint64(c.started)
+	}
+	return nil
+}
+
+// Tests that a stopped tracer no longer measures, and returns the steps settled
+// up to the interruption along with its reason.
+func TestCycleTracerStop(t *testing.T) {
+	for _, output := range []string{outputCSV, outputJSON} {
+		tracer := newTestTracer(t, "cycleTracer", fmt.Sprintf(`{"output": %q}`, output)).(*cycleTracer)
+		counter := new(sequencedEventCounter)
+		tracer.counter = counter
+		tracer.CaptureTxStart(10)
+		tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 10, nil)
+		tracer.CaptureState(0, vm.PUSH1, 10, 3, nil, nil, 1, nil)
+		tracer.CaptureState(2, vm.POP, 7, 2, nil, nil, 1, nil)
+		tracer.Stop(errors.New("timeout"))
+		tracer.CaptureState(3, vm.STOP, 5, 0, nil, nil, 1, nil)
+		tracer.CaptureEnd(nil, 5, nil)
+		tracer.CaptureTxEnd(5)
+		if counter.started != 2 {
+			t.Errorf("output %s: measurements after stop: started %d, want 2", output, counter.started)
+		}
+		res, err := tracer.GetResult()
+		if err == nil || err.Error() != "timeout" {
+			t.Errorf("output %s: stop reason mismatch: have %v, want timeout", output, err)
+		}
+		var result struct {
+			Interrupted string          `json:"interrupted"`
+			CSV         string          `json:"csv"`
+			Rows        [][]interface{} `json:"rows"`
+		}
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("output %s: failed to decode result %s: %v", output, res, err)
+		}
+		if result.Interrupted != "timeout" {
+			t.Errorf("output %s: interruption mismatch: have %q, want timeout", output, result.Interrupted)
+		}
+		// Only the PUSH1 was settled, the POP being measured when stopped
+		rows := len(result.Rows)
+		if output == outputCSV {
+			rows = len(readTimingRows(t, res)) - 1
+		}
+		if rows != 1 {
+			t.Errorf("output %s: row count mismatch: have %d, want 1", output, rows)
+		}
+	}
+}
+
+// Tests that every step, including the final one, is recorded with the counts
+// measured around it.
+func TestCycleTracerFinalStep(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	tracer.counter = new(sequencedEventCounter)
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	want := []string{"PUSH1", "PUSH1", "ADD", "POP", "STOP"}
+	if len(rows)-1 != len(want) {
+		t.Fatalf("row count mismatch: have %d, want %d", len(rows)-1, len(want))
+	}
+	for i, row := range rows[1:] {
+		if row[0] != want[i] || row[1] != strconv.Itoa(10*(i+1)) {
+			t.Errorf("row %d mismatch: have %s with %s cycles, want %s with %d", i, row[0], row[1], want[i], 10*(i+1))
+		}
+	}
+}
+
+// Tests that the instructions retired are recorded alongside the cycles, and
+// the instructions per cycle derived from both.
+func TestCycleTracerIPC(t *testing.T) {
+	tracer := newStubCycleTracer(t)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if have, want := rows[0], []string{"opcodes", "cycles", "cost", "instructions", "ipc", "cyclesPerGas", "scaling", "migrated", "pc", "depth", "kind"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	for _, row := range rows[1:] {
+		if row[1] != "100" || row[3] != "200" || row[4] != "2" {
+			t.Errorf("%s: counts mismatch: have cycles %s, instructions %s, ipc %s", row[0], row[1], row[3], row[4])
+		}
+	}
+	// Cycles per gas are left empty for steps charging no gas
+	if rows[1][5] != "33.333333333333336" || rows[2][5] != "50" {
+		t.Errorf("cycles per gas mismatch: have %s and %s", rows[1][5], rows[2][5])
+	}
+	if have := tracer.layout.row(&cycleSample{counts: [maxCycleEvents]int{100, 100}, op: vm.STOP})[5]; have != "" {
+		t.Errorf("cycles per gas of free step mismatch: have %q, want empty", have)
+	}
+	if have := formatRatio(10, 0); have != "" {
+		t.Errorf("ipc without cycles mismatch: have %q, want empty", have)
+	}
+}
+
+// droppingEventCounter is a stubEventCounter whose events at the given indices
+// were refused by the kernel.
+type droppingEventCounter struct {
+	stubEventCounter
+	refused []int
+}
+
+func (c droppingEventCounter) dropped() []int { return c.refused }
+
+// Tests that the configured events are counted in their own columns next to
+// the derived miss rate, and that events the kernel refuses are reported in
+// the metadata with their columns left empty.
+func TestCycleTracerEvents(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}
+	tracer := newTestTracer(t, "cycleTracer", `{"events": ["cycles", "cache-misses", "cache-references"]}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if have, want := rows[0], []string{"opcodes", "cycles", "cost", "cacheMisses", "cacheReferences", "cacheMissRate", "cyclesPerGas", "scaling", "migrated", "pc", "depth", "kind"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	for _, row := range rows[1:] {
+		if row[3] != "200" || row[4] != "300" || row[5] != "0.6666666666666666" {
+			t.Errorf("%s: counts mismatch: have misses %s, references %s, miss rate %s", row[0], row[3], row[4], row[5])
+		}
+	}
+	tracer = newTestTracer(t, "cycleTracer", `{"events": ["cache-misses", "cache-references"]}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	testColumnsMatchHeader(t, tracer)
+
+	tracer = newTestTracer(t, "cycleTracer", `{"events": ["cache-misses", "cache-references"]}`).(*cycleTracer)
+	tracer.counter = droppingEventCounter{refused: []int{2}}
+	res, err = runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		DroppedEvents []string `json:"droppedEvents"`
+		CSV           string   `json:"csv"`
+	}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if want := []string{"cache-references"}; !reflect.DeepEqual(result.DroppedEvents, want) {
+		t.Errorf("dropped events mismatch: have %v, want %v", result.DroppedEvents, want)
+	}
+	records, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse CSV: %v", err)
+	}
+	for _, row := range records[1:] {
+		if row[3] != "200" || row[4] != "" || row[5] != "" {
+			t.Errorf("%s: counts mismatch: have misses %s, references %q, miss rate %q", row[0], row[3], row[4], row[5])
+		}
+	}
+
+	for _, cfg := range []string{`{"events": ["bogus"]}`, `{"events": ["cache-misses", "cache-misses"]}`} {
+		if _, err := tracers.DefaultDirectory.New("cycleTracer", new(tracers.Context), json.RawMessage(cfg)); err == nil {
+			t.Errorf("config %s: expected error", cfg)
+		}
+	}
+}
+
+// Tests that branch instructions and misses are counted with their
+// misprediction ratio.
+func TestCycleTracerBranchEvents(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", `{"events": ["branch-instructions", "branch-misses"]}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if have, want := rows[0], []string{"opcodes", "cycles", "cost", "branchInstructions", "branchMisses", "branchMissRate", "cyclesPerGas", "scaling", "migrated", "pc", "depth", "kind"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	for _, row := range rows[1:] {
+		if row[3] != "200" || row[4] != "300" || row[5] != "1.5" {
+			t.Errorf("%s: counts mismatch: have branches %s, misses %s, miss rate %s", row[0], row[3], row[4], row[5])
+		}
+	}
+}
+
+// Tests that the last-level cache read misses are counted where available, and
+// otherwise left out along with their column and reported as dropped.
+func TestCycleLayoutLLCReadMisses(t *testing.T) {
+	if have, want := llcReadMissesEvent.config, uint64(0x10002); have != want {
+		t.Errorf("event config mismatch: have %#x, want %#x", have, want)
+	}
+	available := func(perfEvent) error { return nil }
+	layout, err := newCycleLayout([]string{"llc-read-misses"}, nil, available)
+	if err != nil {
+		t.Fatalf("failed to create layout: %v", err)
+	}
+	if have, want := columnNames(layout.columns), []string{"opcodes", "cycles", "cost", "llcReadMisses", "cyclesPerGas", "scaling", "migrated", "pc", "depth", "kind"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("columns mismatch: have %v, want %v", have, want)
+	}
+	if dropped := layout.droppedNames(); len(dropped) != 0 {
+		t.Errorf("unexpected dropped events: %v", dropped)
+	}
+
+	unavailable := func(perfEvent) error { return errors.New("no such event") }
+	layout, err = newCycleLayout([]string{"instructions", "llc-read-misses"}, nil, unavailable)
+	if err != nil {
+		t.Fatalf("failed to create layout: %v", err)
+	}
+	if have, want := columnNames(layout.columns), []string{"opcodes", "cycles", "cost", "instructions", "ipc", "cyclesPerGas", "scaling", "migrated", "pc", "depth", "kind"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("columns mismatch: have %v, want %v", have, want)
+	}
+	if have, want := layout.droppedNames(), []string{"llc-read-misses"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("dropped events mismatch: have %v, want %v", have, want)
+	}
+}
+
+// multiplexedEventCounter is a stubEventCounter the PMU counted only a third
+// of the time it was enabled.
+type multiplexedEventCounter struct {
+	stubEventCounter
+}
+
+func (multiplexedEventCounter) times() (enabled, running uint64) { return 300, 100 }
+
+// Tests that the stalled cycles are counted along with their share of the
+// cycles where available, and left out with a note in the metadata otherwise.
+func TestCycleTracerStalledCycles(t *testing.T) {
+	events := []string{"stalled-cycles-frontend", "stalled-cycles-backend"}
+	for _, tt := range []struct {
+		probe   func(perfEvent) error
+		columns []string
+		row     []string
+		dropped []string
+	}{
+		{
+			probe:   func(perfEvent) error { return nil },
+			columns: []string{"opcodes", "cycles", "cost", "stalledCyclesFrontend", "stalledCyclesBackend", "frontendStallRatio", "backendStallRatio", "cyclesPerGas", "scaling", "migrated", "pc", "depth", "kind"},
+			row:     []string{"PUSH1", "100", "3", "200", "300", "2", "3"},
+		},
+		{
+			probe:   func(perfEvent) error { return unix.ENOENT },
+			columns: []string{"opcodes", "cycles", "cost", "cyclesPerGas", "scaling", "migrated", "pc", "depth", "kind"},
+			row:     []string{"PUSH1", "100", "3"},
+			dropped: events,
+		},
+	} {
+		tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+		layout, err := newCycleLayout(events, nil, tt.probe)
+		if err != nil {
+			t.Fatalf("failed to create layout: %v", err)
+		}
+		tracer.layout, tracer.readings = layout, make([]uint64, len(layout.events))
+		tracer.counter = stubEventCounter{}
+		res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+		if err != nil {
+			t.Fatalf("failed to retrieve trace result: %v", err)
+		}
+		var result tableResult
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("failed to decode result: %v", err)
+		}
+		if !reflect.DeepEqual(result.DroppedEvents, tt.dropped) {
+			t.Errorf("dropped events mismatch: have %v, want %v", result.DroppedEvents, tt.dropped)
+		}
+		rows := readTimingRows(t, res)
+		if !reflect.DeepEqual(rows[0], tt.columns) {
+			t.Fatalf("header mismatch: have %v, want %v", rows[0], tt.columns)
+		}
+		if have := rows[1][:len(tt.row)]; !reflect.DeepEqual(have, tt.row) {
+			t.Errorf("row mismatch: have %v, want %v", have, tt.row)
+		}
+	}
+}
+
+// migratingEventCounter is a stubEventCounter the thread migrates to another
+// CPU during the second measurement of, its last event counting the
+// migrations.
+type migratingEventCounter struct {
+	stubEventCounter
+	stopped int
+}
+
+func (c *migratingEventCounter) stop(counts []uint64) error {
+	c.stopped++
+	c.stubEventCounter.stop(counts)
+	counts[len(counts)-1] = 0
+	if c.stopped == 2 {
+		counts[len(counts)-1] = 1
+	}
+	return nil
+}
+
+// Tests that steps the thread migrated during are flagged, counting the
+// migrations along with the configured events.
+func TestCycleTracerMigrated(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	tracer.counter = new(migratingEventCounter)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	migrated := len(rows[0]) - 4
+	if rows[0][migrated] != "migrated" {
+		t.Fatalf("migrated column missing from header %v", rows[0])
+	}
+	for i, want := range []string{"false", "true", "false"} {
+		if have := rows[i+1][migrated]; have != want {
+			t.Errorf("%s: migrated mismatch: have %s, want %s", rows[i+1][0], have, want)
+		}
+	}
+
+	// Configured migrations are counted once, in their own column too
+	layout, err := newCycleLayout([]string{"cpu-migrations"}, nil, probePerfEvent)
+	if err != nil {
+		t.Fatalf("failed to create layout: %v", err)
+	}
+	if len(layout.events) != 2 || layout.migrations != 1 || layout.companions != 0 {
+		t.Errorf("configured migrations counted twice: %d events, migrations at %d", len(layout.events), layout.migrations)
+	}
+}
+
+// userReadingEventCounter is a stubEventCounter reading the counters in user
+// space.
+type userReadingEventCounter struct {
+	stubEventCounter
+}
+
+func (userReadingEventCounter) userReading() bool { return true }
+
+// Tests that reading the counters in user space leaves the migrations
+// uncounted, and that the result reports whether the counters were read in
+// user space if requested.
+func TestCycleTracerRdpmc(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}
+	userRead := true
+	for _, tt := range []struct {
+		config  string
+		counter eventCounter
+		want    *bool
+	}{
+		{"", userReadingEventCounter{}, nil},
+		{`{"rdpmc": true}`, stubEventCounter{}, new(bool)},
+		{`{"rdpmc": true}`, userReadingEventCounter{}, &userRead},
+	} {
+		tracer := newTestTracer(t, "cycleTracer", tt.config).(*cycleTracer)
+		if have := tracer.counter.(*perfEventGroup).userRead; have != tracer.rdpmc {
+			t.Errorf("config %s: user reads mismatch: have %v, want %v", tt.config, have, tracer.rdpmc)
+		}
+		if tracer.rdpmc && (tracer.layout.migrations >= 0 || len(tracer.layout.events) != tracer.layout.reported()) {
+			t.Errorf("config %s: migrations counted with user reads", tt.config)
+		}
+		tracer.counter = tt.counter
+		res, err := runTestTracer(t, tracer, code, nil)
+		if err != nil {
+			t.Fatalf("config %s: failed to retrieve trace result: %v", tt.config, err)
+		}
+		var result tableResult
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("config %s: failed to decode result: %v", tt.config, err)
+		}
+		if !reflect.DeepEqual(result.Rdpmc, tt.want) {
+			t.Errorf("config %s: rdpmc mismatch: have %v, want %v", tt.config, result.Rdpmc, tt.want)
+		}
+		rows := readTimingRows(t, res)
+		if migrated := rows[1][len(rows[0])-4]; tracer.rdpmc && migrated != "" {
+			t.Errorf("config %s: migrated column filled with user reads: %s", tt.config, migrated)
+		}
+	}
+}
+
+// failingEventCounter is a stubEventCounter failing every other read.
+type failingEventCounter struct {
+	stubEventCounter
+	stops int
+}
+
+func (c *failingEventCounter) stop(counts []uint64) error {
+	if c.stops++; c.stops%2 == 0 {
+		return fmt.Errorf("read %d failed", c.stops)
+	}
+	return c.stubEventCounter.stop(counts)
+}
+
+// Tests that failures to measure a step are reported in the result, along
+// with the number of steps whose counts were lost, rather than printed.
+func TestCycleTracerMeasurementErrors(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	tracer.counter = new(failingEventCounter)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if result.MeasurementErrors != 1 || result.LostSamples != 1 || !reflect.DeepEqual(result.Errors, []string{"read 2 failed"}) {
+		t.Errorf("errors mismatch: have %d errors %q, %d lost samples, want 1 error \"read 2 failed\", 1 lost sample",
+			result.MeasurementErrors, result.Errors, result.LostSamples)
+	}
+	if rows := readTimingRows(t, res); rows[2][0] != "POP" || rows[2][1] != "0" {
+		t.Errorf("lost step mismatch: have %v, want POP with 0 cycles", rows[2])
+	}
+
+	// Only the first errors are kept, but all are counted
+	tracer = newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	tracer.counter = new(failingEventCounter)
+	res, err = runTestTracer(t, tracer, loopCode, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	result = tableResult{}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if len(result.Errors) != maxCycleErrors || result.Errors[1] != "read 4 failed" {
+		t.Errorf("kept errors mismatch: have %q", result.Errors)
+	}
+	if result.MeasurementErrors <= maxCycleErrors || result.LostSamples != result.MeasurementErrors {
+		t.Errorf("error counts mismatch: have %d errors, %d lost samples", result.MeasurementErrors, result.LostSamples)
+	}
+}
+
+// timesharedEventCounter is a stubEventCounter the PMU counted a third of the
+// time it was enabled during every measurement.
+type timesharedEventCounter struct {
+	stubEventCounter
+	enabled, running uint64
+}
+
+func (c *timesharedEventCounter) stop(counts []uint64) error {
+	c.enabled += 300
+	c.running += 100
+	return c.stubEventCounter.stop(counts)
+}
+
+func (c *timesharedEventCounter) times() (enabled, running uint64) {
+	return c.enabled, c.running
+}
+
+// Tests that the counts of every step are scaled by the time the events were
+// counting during it, which is reported in the scaling column.
+func TestCycleTracerScalingColumn(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	tracer.counter = new(timesharedEventCounter)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	scaling := len(rows[0]) - 5
+	if rows[0][scaling] != "scaling" {
+		t.Fatalf("scaling column missing from header %v", rows[0])
+	}
+	for _, row := range rows[1:] {
+		if row[1] != "300" || row[3] != "600" {
+			t.Errorf("%s: scaled counts mismatch: have cycles %s, instructions %s, want 300, 600", row[0], row[1], row[3])
+		}
+		if want := strconv.FormatFloat(1.0/3, 'f', -1, 64); row[scaling] != want {
+			t.Errorf("%s: scaling mismatch: have %s, want %s", row[0], row[scaling], want)
+		}
+	}
+}
+
+// Tests that the data TLB events are counted, and that the scaling factor is
+// reported if the events were multiplexed.
+func TestCycleTracerDTLBEvents(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	layout, err := newCycleLayout([]string{"dtlb-loads", "dtlb-load-misses"}, nil, func(perfEvent) error { return nil })
+	if err != nil {
+		t.Fatalf("failed to create layout: %v", err)
+	}
+	tracer.layout, tracer.readings = layout, make([]uint64, len(layout.events))
+	tracer.counter = multiplexedEventCounter{}
+
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		Scaling float64 `json:"scaling"`
+		CSV     string  `json:"csv"`
+	}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if result.Scaling != 3 {
+		t.Errorf("scaling mismatch: have %v, want 3", result.Scaling)
+	}
+	records, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse CSV: %v", err)
+	}
+	if have, want := records[0], []string{"opcodes", "cycles", "cost", "dtlbLoads", "dtlbLoadMisses", "cyclesPerGas", "scaling", "migrated", "pc", "depth", "kind"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	for _, row := range records[1:] {
+		if row[3] != "200" || row[4] != "300" {
+			t.Errorf("%s: counts mismatch: have loads %s, misses %s", row[0], row[3], row[4])
+		}
+	}
+}
+
+// Tests that software events are counted per step, also where the hardware
+// counters are unavailable and the cycles are left out.
+func TestCycleTracerSoftwareEvents(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}
+	cfg := `{"events": ["page-faults", "context-switches", "cpu-migrations"]}`
+
+	tracer := newTestTracer(t, "cycleTracer", cfg).(*cycleTracer)
+	tracer.counter = droppingEventCounter{refused: []int{0}}
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		DroppedEvents []string `json:"droppedEvents"`
+		CSV           string   `json:"csv"`
+	}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if want := []string{"cycles"}; !reflect.DeepEqual(result.DroppedEvents, want) {
+		t.Errorf("dropped events mismatch: have %v, want %v", result.DroppedEvents, want)
+	}
+	records, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse CSV: %v", err)
+	}
+	if have, want := records[0], []string{"opcodes", "cycles", "cost", "pageFaults", "contextSwitches", "cpuMigrations", "cyclesPerGas", "scaling", "migrated", "pc", "depth", "kind"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	for _, row := range records[1:] {
+		if row[1] != "" || row[3] != "200" || row[4] != "300" || row[5] != "400" {
+			t.Errorf("%s: counts mismatch: have %v", row[0], row[1:])
+		}
+	}
+
+	// Software events need no hardware support, so count them for real if
+	// perf events are permitted at all
+	if err := probePerfEvent(pageFaultsEvent); err != nil {
+		t.Skipf("perf events unavailable: %v", err)
+	}
+	if res, err = runTestTracer(t, newTestTracer(t, "cycleTracer", cfg), code, nil); err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	result.CSV = ""
+	if err := json.Unmarshal(res, &result.CSV); err != nil {
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("failed to decode result: %v", err)
+		}
+	}
+	if records, err = csv.NewReader(strings.NewReader(result.CSV)).ReadAll(); err != nil {
+		t.Fatalf("failed to parse CSV: %v", err)
+	}
+	for _, row := range records[1:] {
+		for i, count := range row[3:6] {
+			if _, err := strconv.Atoi(count); err != nil {
+				t.Errorf("%s: %s not counted: %q", row[0], records[0][3+i], count)
+			}
+		}
+	}
+}
+
+// Tests that raw perf events are counted in columns named after them, and that
+// the kernel's refusal of each is reported.
+func TestCycleTracerRawEvents(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}
+	cfg := `{"events": ["page-faults"], "rawEvents": [{"type": 4, "config": "0x5301D1", "name": "l3MissLoads"}, {"type": 4, "config": "c0", "name": "uopsRetired"}]}`
+	tracer := newTestTracer(t, "cycleTracer", cfg).(*cycleTracer)
+	for i, want := range []perfEvent{{name: "l3MissLoads", typ: 4, config: 0x5301d1}, {name: "uopsRetired", typ: 4, config: 0xc0}} {
+		if have := tracer.layout.events[2+i]; have != want {
+			t.Errorf("raw event %d mismatch: have %+v, want %+v", i, have, want)
+		}
+	}
+	tracer.counter = stubEventCounter{}
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if have, want := rows[0][:6], []string{"opcodes", "cycles", "cost", "pageFaults", "l3MissLoads", "uopsRetired"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	if have, want := rows[1][4:6], []string{"300", "400"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("raw counts mismatch: have %v, want %v", have, want)
+	}
+	for _, cfg := range []string{
+		`{"rawEvents": [{"type": 4, "config": "0xzz", "name": "bogus"}]}`,
+		`{"rawEvents": [{"type": 4, "config": "0xc0"}]}`,
+		`{"rawEvents": [{"type": 4, "config": "0xc0", "name": "instructions"}]}`,
+		`{"rawEvents": [{"type": 4, "config": "0xc0", "name": "cost"}]}`,
+		`{"rawEvents": [{"type": 4, "config": "0xc0", "name": "uops"}, {"type": 4, "config": "0xc1", "name": "uops"}]}`,
+	} {
+		if _, err := newCycleTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("expected error for config %s", cfg)
+		}
+	}
+
+	// An event of a type no PMU has is refused, with the error reported
+	if err := probePerfEvent(pageFaultsEvent); err != nil {
+		t.Skipf("perf events unavailable: %v", err)
+	}
+	cfg = `{"events": ["page-faults"], "rawEvents": [{"type": 65535, "config": "0x1", "name": "missing"}]}`
+	if res, err = runTestTracer(t, newTestTracer(t, "cycleTracer", cfg), code, nil); err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if result.EventErrors["missing"] == "" {
+		t.Errorf("refusal of raw event not reported: %v", result.EventErrors)
+	}
+	if len(result.DroppedEvents) == 0 || result.DroppedEvents[len(result.DroppedEvents)-1] != "missing" {
+		t.Errorf("raw event not dropped: %v", result.DroppedEvents)
+	}
+}
+
+// deniedEventCounter is an eventCounter the kernel doesn't permit to open,
+// counting the measurements attempted regardless.
+type deniedEventCounter struct {
+	stubEventCounter
+	attempts int
+}
+
+func (c *deniedEventCounter) open() error  { return unix.EACCES }
+func (c *deniedEventCounter) start() error { c.attempts++; return errCounterClosed }
+
+// Tests that a cycleTracer not permitted to open perf events stops measuring
+// and fails its result with an explanation.
+func TestCycleTracerPerfNotPermitted(t *testing.T) {
+	for _, config := range []string{"", `{"checkpointSamples": 2}`} {
+		tracer := newTestTracer(t, "cycleTracer", config).(*cycleTracer)
+		counter := new(deniedEventCounter)
+		tracer.counter, tracer.fallback = counter, nil
+
+		res, err := runTestTracer(t, tracer, loopCode, nil)
+		var perr *perfPermissionError
+		if !errors.As(err, &perr) || !errors.Is(err, unix.EACCES) {
+			t.Fatalf("config %s: error mismatch: have %v, want permission error", config, err)
+		}
+		if res != nil {
+			t.Errorf("config %s: result returned without permission: %s", config, res)
+		}
+		if !strings.Contains(err.Error(), "CAP_PERFMON") {
+			t.Errorf("config %s: error lacks remedy: %v", config, err)
+		}
+		if counter.attempts != 0 {
+			t.Errorf("config %s: measurements attempted without permission: %d", config, counter.attempts)
+		}
+		if err := tracer.EncodeResult(io.Discard); !errors.As(err, &perr) {
+			t.Errorf("config %s: encoded error mismatch: have %v, want permission error", config, err)
+		}
+	}
+}
+
+// Tests that the legacy array output encodes every step as an [opcode,
+// cycles, cost] triple.
+func TestCycleTracerArrayOutput(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", `{"output": "array"}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var triples [][]interface{}
+	if err := json.Unmarshal(res, &triples); err != nil {
+		t.Fatalf("failed to decode result %s: %v", res, err)
+	}
+	if len(triples) != 3 {
+		t.Fatalf("step count mismatch: have %d, want 3", len(triples))
+	}
+	for i, want := range [][]interface{}{{"PUSH1", 100.0, 3.0}, {"POP", 100.0, 2.0}} {
+		if !reflect.DeepEqual(triples[i], want) {
+			t.Errorf("step %d mismatch: have %v, want %v", i, triples[i], want)
+		}
+	}
+	for _, cfg := range []string{`{"output": "xml"}`, `{"output": "array", "checkpointSamples": 10}`} {
+		if _, err := newCycleTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("expected error for config %s", cfg)
+		}
+	}
+}
+
+// Tests that the json output returns the rows under their column names, with
+// numeric values as JSON numbers.
+func TestCycleTracerJSONOutput(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", `{"output": "json"}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		CycleSource string          `json:"cycleSource"`
+		Columns     []string        `json:"columns"`
+		Rows        [][]interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result %s: %v", res, err)
+	}
+	if result.CycleSource != cycleSourcePerf {
+		t.Errorf("metadata missing from result %s", res)
+	}
+	if want := columnNames(tracer.Columns()); !reflect.DeepEqual(result.Columns, want) {
+		t.Errorf("columns mismatch: have %v, want %v", result.Columns, want)
+	}
+	if len(result.Rows) != 3 {
+		t.Fatalf("row count mismatch: have %d, want 3", len(result.Rows))
+	}
+	want := []interface{}{"PUSH1", 100.0, 3.0, 200.0, 2.0, 100.0 / 3, nil, true, 0.0, 1.0, "step"}
+	if !reflect.DeepEqual(result.Rows[0], want) {
+		t.Errorf("row mismatch: have %v, want %v", result.Rows[0], want)
+	}
+	for _, cfg := range []string{`{"output": "json", "checkpointSamples": 10}`, `{"output": "json", "summary": true}`} {
+		if _, err := newCycleTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("expected error for config %s", cfg)
+		}
+	}
+}
+
+// Tests that the summary mode aggregates the steps per opcode.
+func TestCycleTracerSummary(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.PUSH1), 3, byte(vm.POP), byte(vm.POP), byte(vm.STOP)}
+	tracer := newTestTracer(t, "cycleTracer", `{"summary": true}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	header := []string{
+		"opcode", "count", "totalCycles", "meanCycles", "totalCost", "totalInstructions", "ipc", "cyclesPerGas",
+		"minCycles", "maxCycles", "minInstructions", "maxInstructions", "meanInstructions",
+	}
+	if !reflect.DeepEqual(rows[0], header) {
+		t.Fatalf("header mismatch: have %v, want %v", rows[0], header)
+	}
+	// The cost of the final STOP is settled with the gas the test reports to
+	// CaptureTxEnd, so it isn't checked
+	want := [][]string{
+		{"STOP", "1", "100", "100", "", "200", "2", "", "100", "100", "200", "200", "200"},
+		{"ADD", "1", "100", "100", "3", "200", "2", "33.333333333333336", "100", "100", "200", "200", "200"},
+		{"POP", "2", "200", "100", "4", "400", "2", "50", "100", "100", "200", "200", "200"},
+		{"PUSH1", "3", "300", "100", "9", "600", "2", "33.333333333333336", "100", "100", "200", "200", "200"},
+	}
+	if len(rows)-1 != len(want) {
+		t.Fatalf("row count mismatch: have %d, want %d", len(rows)-1, len(want))
+	}
+	for i, row := range rows[1:] {
+		if want[i][4] == "" {
+			want[i][4], want[i][7] = row[4], row[7]
+		}
+		if !reflect.DeepEqual(row, want[i]) {
+			t.Errorf("row %d mismatch: have %v, want %v", i, row, want[i])
+		}
+	}
+	for _, cfg := range []string{`{"summary": true, "checkpointSamples": 10}`, `{"summary": true, "output": "array"}`} {
+		if _, err := newCycleTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("expected error for config %s", cfg)
+		}
+	}
+}
+
+// Tests that the summary tracks the lowest, highest and mean count of every
+// event per opcode, which all match for a single step.
+func TestCycleTracerSummaryStats(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.PUSH1), 3, byte(vm.POP), byte(vm.POP), byte(vm.STOP)}
+	tracer := newTestTracer(t, "cycleTracer", `{"summary": true}`).(*cycleTracer)
+	tracer.counter = new(sequencedEventCounter)
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	stats := len(rows[0]) - 5
+	if have, want := rows[0][stats:], []string{"minCycles", "maxCycles", "minInstructions", "maxInstructions", "meanInstructions"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	// The n-th step counts 10*n of every event: PUSH1 are the 1st, 2nd and
+	// 4th, ADD the 3rd, POP the 5th and 6th and STOP the 7th
+	want := map[string][]string{
+		"STOP":  {"70", "70", "70", "70", "70"},
+		"ADD":   {"30", "30", "30", "30", "30"},
+		"POP":   {"50", "60", "50", "60", "55"},
+		"PUSH1": {"10", "40", "10", "40", "23.333333333333332"},
+	}
+	for _, row := range rows[1:] {
+		if have := row[stats:]; !reflect.DeepEqual(have, want[row[0]]) {
+			t.Errorf("%s: stats mismatch: have %v, want %v", row[0], have, want[row[0]])
+		}
+		if row[3] != row[len(row)-1] {
+			t.Errorf("%s: mean cycles %s differ from mean instructions %s", row[0], row[3], row[len(row)-1])
+		}
+	}
+}
+
+func TestCycleTracerSummaryColumnsMatchHeader(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", `{"summary": true}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	testColumnsMatchHeader(t, tracer)
+}
+
+// Tests that the summary mode doesn't allocate per step.
+func TestCycleTracerSummaryCaptureStateAllocs(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", `{"summary": true}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	testCaptureStateAllocs(t, tracer)
+}
+
+// Tests that every recorded step is complete for executions without any
+// steps, like plain transfers, and for reverted ones.
+func TestCycleTracerStepsComplete(t *testing.T) {
+	for _, tt := range []struct {
+		code []byte
+		ops  []string
+	}{
+		{nil, nil},
+		{revertCode, []string{"PUSH1", "PUSH1", "REVERT"}},
+	} {
+		res, err := runTestTracer(t, newStubCycleTracer(t), tt.code, nil)
+		if err != nil {
+			t.Fatalf("%x: failed to retrieve trace result: %v", tt.code, err)
+		}
+		rows := readTimingRows(t, res)
+		if len(rows)-1 != len(tt.ops) {
+			t.Fatalf("%x: row count mismatch: have %d, want %d", tt.code, len(rows)-1, len(tt.ops))
+		}
+		for i, row := range rows[1:] {
+			if row[0] != tt.ops[i] || row[1] != "100" || row[2] == "" {
+				t.Errorf("%x: row %d mismatch: have %v, want %s", tt.code, i, row, tt.ops[i])
+			}
+		}
+	}
+}
+
+// Tests that every row carries the pc and call depth of its step.
+func TestCycleTracerPCDepth(t *testing.T) {
+	callee := common.HexToAddress("0xc0de")
+	res, err := runTestTracer(t, newStubCycleTracer(t), callCode(callee), map[common.Address][]byte{callee: {byte(vm.PUSH1), 1, byte(vm.STOP)}})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	pc, depth := len(rows[0])-3, len(rows[0])-2
+	var inner [][]string
+	for _, row := range rows[1:] {
+		if row[len(row)-1] != "step" {
+			continue
+		}
+		if row[depth] == "2" {
+			inner = append(inner, row)
+		} else if row[depth] != "1" {
+			t.Errorf("%s: invalid depth %s", row[0], row[depth])
+		}
+	}
+	if len(inner) != 2 || inner[0][0] != "PUSH1" || inner[0][pc] != "0" || inner[1][0] != "STOP" || inner[1][pc] != "2" {
+		t.Errorf("callee steps mismatch: have %v", inner)
+	}
+	// The caller's code ends with an implicit STOP
+	if last := rows[len(rows)-1]; last[0] != "STOP" || last[pc] != strconv.Itoa(len(callCode(callee))) {
+		t.Errorf("last step mismatch: have %v", last)
+	}
+}
+
+// Tests that with a resolution, the counter is read every resolution-th step,
+// a row holding the opcodes, counts and cost of the steps in between. A filtered
+// step ends the interval early, and a child frame is measured in rows of its
+// own, the interval entering it resuming on return.
+func TestCycleTracerResolution(t *testing.T) {
+	callee := common.HexToAddress("0xc0de")
+	for _, tt := range []struct {
+		config string
+		code   []byte
+		ops    []string
+		cycles []string
+		costs  []string // Costs of the leading rows, the last step is charged the unused gas
+	}{
+		{
+			config: `{"resolution": 2}`,
+			code:   []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.PUSH1), 2, byte(vm.POP), byte(vm.STOP)},
+			ops:    []string{"PUSH1 POP", "PUSH1 POP", "STOP"},
+			cycles: []string{"100", "100", "100"},
+			costs:  []string{"5", "5"},
+		},
+		{
+			config: `{"resolution": 2, "opcodes": ["PUSH1", "STOP"]}`,
+			code:   []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.PUSH1), 2, byte(vm.POP), byte(vm.STOP)},
+			ops:    []string{"PUSH1", "PUSH1", "STOP"},
+			cycles: []string{"100", "100", "100"},
+			costs:  []string{"3", "3"},
+		},
+		{
+			config: `{"resolution": 3}`,
+			code:   callCode(callee),
+			ops:    []string{"PUSH1 PUSH1 PUSH1", "PUSH1 PUSH1 PUSH20", "PUSH1 STOP", "CALL", "GAS CALL POP", "STOP"},
+			// The frame adds its entry, the interval its counts before the call
+			cycles: []string{"100", "100", "100", "200", "200", "100"},
+		},
+	} {
+		tracer := newTestTracer(t, "cycleTracer", tt.config).(*cycleTracer)
+		tracer.counter = stubEventCounter{}
+		res, err := runTestTracer(t, tracer, tt.code, map[common.Address][]byte{callee: {byte(vm.PUSH1), 1, byte(vm.STOP)}})
+		if err != nil {
+			t.Fatalf("config %s: failed to retrieve trace result: %v", tt.config, err)
+		}
+		var result tableResult
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("config %s: failed to decode result: %v", tt.config, err)
+		}
+		if result.Resolution < 2 {
+			t.Errorf("config %s: resolution missing from result", tt.config)
+		}
+		rows := readTimingRows(t, res)[1:]
+		var ops, cycles, costs []string
+		for _, row := range rows {
+			ops, cycles, costs = append(ops, row[0]), append(cycles, row[1]), append(costs, row[2])
+		}
+		if !reflect.DeepEqual(ops, tt.ops) {
+			t.Errorf("config %s: opcodes mismatch: have %q, want %q", tt.config, ops, tt.ops)
+		}
+		if !reflect.DeepEqual(cycles, tt.cycles) {
+			t.Errorf("config %s: cycles mismatch: have %v, want %v", tt.config, cycles, tt.cycles)
+		}
+		if costs = costs[:len(tt.costs)]; len(costs) > 0 && !reflect.DeepEqual(costs, tt.costs) {
+			t.Errorf("config %s: costs mismatch: have %v, want %v", tt.config, costs, tt.costs)
+		}
+	}
+	for _, config := range []string{
+		`{"resolution": 0}`,
+		`{"resolution": 2, "summary": true}`,
+		`{"resolution": 2, "output": "array"}`,
+	} {
+		if _, err := tracers.DefaultDirectory.New("cycleTracer", new(tracers.Context), json.RawMessage(config)); err == nil {
+			t.Errorf("config %s: expected error", config)
+		}
+	}
+}
+
+// Tests that the summary keyed on the pc aggregates the steps per bytecode
+// location.
+func TestCycleTracerSummaryByPC(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", `{"summary": true, "summaryByPc": true}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	res, err := runTestTracer(t, tracer, loopCode, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if have, want := rows[0][:3], []string{"pc", "opcode", "count"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	want := [][]string{{"0", "JUMPDEST"}, {"1", "PUSH1"}, {"3", "JUMP"}}
+	if len(rows)-1 != len(want) {
+		t.Fatalf("row count mismatch: have %d, want one per instruction (%d)", len(rows)-1, len(want))
+	}
+	for i, row := range rows[1:] {
+		if row[0] != want[i][0] || row[1] != want[i][1] || row[2] == "1" {
+			t.Errorf("row %d mismatch: have %v, want %v executed repeatedly", i, row, want[i])
+		}
+	}
+	tracer = newTestTracer(t, "cycleTracer", `{"summary": true, "summaryByPc": true}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	testColumnsMatchHeader(t, tracer)
+	if _, err := newCycleTracer(nil, json.RawMessage(`{"summaryByPc": true}`)); err == nil {
+		t.Error("expected error for summaryByPc without summary")
+	}
+}
+
+// affinityEventCounter is a stubEventCounter recording the CPU affinity of the
+// thread it is opened on.
+type affinityEventCounter struct {
+	stubEventCounter
+	set unix.CPUSet
+}
+
+func (c *affinityEventCounter) open() error {
+	return unix.SchedGetaffinity(0, &c.set)
+}
+
+// Tests that the tracing thread is pinned to the configured CPU for the
+// transaction only, and that a failure to pin it is reported in the result.
+func TestCycleTracerPinCPU(t *testing.T) {
+	// Stay on the thread the tracer locks, to check its affinity afterwards
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var before unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &before); err != nil {
+		t.Skipf("CPU affinity unavailable: %v", err)
+	}
+	cpu := -1
+	for i := 0; i < len(before)*64 && cpu < 0; i++ {
+		if before.IsSet(i) {
+			cpu = i
+		}
+	}
+	tracer := newTestTracer(t, "cycleTracer", fmt.Sprintf(`{"pinCPU": %d}`, cpu)).(*cycleTracer)
+	counter := new(affinityEventCounter)
+	tracer.counter = counter
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		PinnedCPU     *int   `json:"pinnedCpu"`
+		AffinityError string `json:"affinityError"`
+	}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if result.PinnedCPU == nil || *result.PinnedCPU != cpu || result.AffinityError != "" {
+		t.Errorf("pinned CPU mismatch: have %v (%q), want %d", result.PinnedCPU, result.AffinityError, cpu)
+	}
+	if counter.set.Count() != 1 || !counter.set.IsSet(cpu) {
+		t.Errorf("thread not pinned while tracing: %d CPUs allowed", counter.set.Count())
+	}
+	var after unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &after); err != nil || after != before {
+		t.Errorf("affinity not restored: have %d CPUs, had %d", after.Count(), before.Count())
+	}
+
+	// Pinning to a CPU that doesn't exist fails, but doesn't fail the trace
+	tracer = newTestTracer(t, "cycleTracer", `{"pinCPU": 1023}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	if res, err = runTestTracer(t, tracer, []byte{byte(vm.STOP)}, nil); err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	result.PinnedCPU, result.AffinityError = nil, ""
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if result.PinnedCPU != nil || result.AffinityError == "" {
+		t.Errorf("affinity failure not reported: have %s", res)
+	}
+	if _, err := newCycleTracer(nil, json.RawMessage(`{"pinCPU": -1}`)); err == nil {
+		t.Error("expected error for negative pinCPU")
+	}
+}
+
+// Tests that the cycles are approximated with the timestamp counter where perf
+// events can't be opened, the other events being reported as dropped.
+func TestCycleTracerTSCFallback(t *testing.T) {
+	if !tscSupported || !rdtscpSupported() {
+		t.Skip("RDTSCP unsupported")
+	}
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	tracer.counter = new(deniedEventCounter)
+	tracer.fallback = newTSCCounter(len(tracer.layout.events))
+
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		CycleSource   string   `json:"cycleSource"`
+		DroppedEvents []string `json:"droppedEvents"`
+	}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if result.CycleSource != cycleSourceTSC {
+		t.Errorf("source mismatch: have %q, want %q", result.CycleSource, cycleSourceTSC)
+	}
+	if want := []string{"instructions"}; !reflect.DeepEqual(result.DroppedEvents, want) {
+		t.Errorf("dropped events mismatch: have %v, want %v", result.DroppedEvents, want)
+	}
+	for _, row := range readTimingRows(t, res)[1:] {
+		if cycles, err := strconv.Atoi(row[1]); err != nil || cycles <= 0 || row[3] != "" {
+			t.Errorf("%s: counts mismatch: have cycles %q, instructions %q", row[0], row[1], row[3])
+		}
+	}
+}
+
+// Tests that only the steps of the configured opcodes are measured and
+// recorded.
+func TestCycleTracerOpcodes(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	tracer := newTestTracer(t, "cycleTracer", `{"opcodes": ["ADD", "POP"]}`).(*cycleTracer)
+	counter := new(sequencedEventCounter)
+	tracer.counter = counter
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	want := [][]string{{"ADD", "10", "3"}, {"POP", "20", "2"}}
+	if len(rows)-1 != len(want) {
+		t.Fatalf("row count mismatch: have %d, want %d", len(rows)-1, len(want))
+	}
+	for i, row := range rows[1:] {
+		if !reflect.DeepEqual(row[:3], want[i]) {
+			t.Errorf("row %d mismatch: have %v, want %v", i, row[:3], want[i])
+		}
+	}
+	if counter.started != len(want) {
+		t.Errorf("measurement count mismatch: have %d, want %d", counter.started, len(want))
+	}
+	if _, err := newCycleTracer(nil, json.RawMessage(`{"opcodes": ["SHA3"]}`)); err == nil {
+		t.Error("expected error for unknown opcode")
+	}
+}
+
+// Tests that the calibrated overhead of a measurement is reported and
+// subtracted from the cycles in an extra column.
+func TestCycleTracerCalibrate(t *testing.T) {
+	tracer := newTestTracer(t, "cycleTracer", `{"calibrate": true}`).(*cycleTracer)
+	tracer.counter = new(sequencedEventCounter)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		CycleOverhead *int `json:"cycleOverhead"`
+	}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	// The calibration measures 10 to 10*cycleCalibrationRuns cycles
+	overhead := 10 * (cycleCalibrationRuns/2 + 1)
+	if result.CycleOverhead == nil || *result.CycleOverhead != overhead {
+		t.Fatalf("overhead mismatch: have %v, want %d", result.CycleOverhead, overhead)
+	}
+	rows := readTimingRows(t, res)
+	column := len(rows[0]) - 1
+	if rows[0][column] != "correctedCycles" {
+		t.Fatalf("header mismatch: have %v", rows[0])
+	}
+	for i, row := range rows[1:] {
+		cycles := 10 * (cycleCalibrationRuns + i + 1)
+		if row[1] != strconv.Itoa(cycles) || row[column] != strconv.Itoa(cycles-overhead) {
+			t.Errorf("row %d mismatch: have %s raw and %s corrected cycles, want %d and %d", i, row[1], row[column], cycles, cycles-overhead)
+		}
+	}
+	tracer = newTestTracer(t, "cycleTracer", `{"calibrate": true}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	testColumnsMatchHeader(t, tracer)
+}
+
+// Tests that a step entering a child frame is measured without the frame,
+// whose totals are recorded in a frame row on return instead. The step's own
+// row follows the frame's rows.
+func TestCycleTracerFrames(t *testing.T) {
+	callee, identity := common.HexToAddress("0xc0de"), common.BytesToAddress([]byte{4})
+	code := append(callCode(callee), callCode(identity)...)
+	res, err := runTestTracer(t, newStubCycleTracer(t), code, map[common.Address][]byte{callee: {byte(vm.PUSH1), 1, byte(vm.STOP)}})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	depth, kind := len(rows[0])-2, len(rows[0])-1
+	var have [][]string
+	for _, row := range rows[1:] {
+		if row[0] == "CALL" || row[depth] == "2" {
+			have = append(have, []string{row[0], row[1], row[depth], row[kind]})
+		}
+	}
+	// Every measurement of the stub counts 100 cycles: the calls are measured
+	// up to entering and from returning, the frames from entry to return
+	want := [][]string{
+		{"PUSH1", "100", "2", "step"},
+		{"STOP", "100", "2", "step"},
+		{"CALL", "300", "2", "frame"},
+		{"CALL", "200", "1", "step"},
+		{"CALL", "100", "2", "frame"},
+		{"CALL", "200", "1", "step"},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("call rows mismatch:\nhave %v\nwant %v", have, want)
+	}
+
+	// Checkpointing flushes the frame's rows while the step entering it is
+	// still being measured
+	tracer := newTestTracer(t, "cycleTracer", `{"checkpointSamples": 2}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	if res, err = runTestTracer(t, tracer, code, map[common.Address][]byte{callee: {byte(vm.PUSH1), 1, byte(vm.STOP)}}); err != nil {
+		t.Fatalf("failed to retrieve checkpointed trace result: %v", err)
+	}
+	if _, flushed := readCheckpointResult(t, res); !reflect.DeepEqual(flushed, rows) {
+		t.Errorf("checkpointed rows mismatch:\nhave %v\nwant %v", flushed, rows)
+	}
+}
+
+// Tests that the privilege levels left uncounted are configurable, and echoed
+// in the result metadata when counting with perf events.
+func TestCycleTracerExclude(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}
+	for _, tt := range []struct {
+		config      string
+		kernel, hv  bool
+		wantExclude uint64
+	}{
+		{"", true, true, unix.PerfBitExcludeKernel | unix.PerfBitExcludeHv},
+		{`{"excludeKernel": false}`, false, true, unix.PerfBitExcludeHv},
+		{`{"excludeKernel": true, "excludeHV": false}`, true, false, unix.PerfBitExcludeKernel},
+		{`{"excludeKernel": false, "excludeHV": false}`, false, false, 0},
+	} {
+		tracer := newTestTracer(t, "cycleTracer", tt.config).(*cycleTracer)
+		if have := tracer.counter.(*perfEventGroup).exclude; have != tt.wantExclude {
+			t.Errorf("config %s: exclude bits mismatch: have %#x, want %#x", tt.config, have, tt.wantExclude)
+		}
+		tracer.counter = stubEventCounter{}
+		res, err := runTestTracer(t, tracer, code, nil)
+		if err != nil {
+			t.Fatalf("config %s: failed to retrieve trace result: %v", tt.config, err)
+		}
+		var result tableResult
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("config %s: failed to decode result: %v", tt.config, err)
+		}
+		if result.ExcludeKernel == nil || *result.ExcludeKernel != tt.kernel {
+			t.Errorf("config %s: excludeKernel mismatch: have %v, want %v", tt.config, result.ExcludeKernel, tt.kernel)
+		}
+		if result.ExcludeHV == nil || *result.ExcludeHV != tt.hv {
+			t.Errorf("config %s: excludeHV mismatch: have %v, want %v", tt.config, result.ExcludeHV, tt.hv)
+		}
+	}
+	// Cycles counted with the timestamp counter include every privilege level
+	tracer := newTestTracer(t, "cycleTracer", "").(*cycleTracer)
+	tracer.counter = new(deniedEventCounter)
+	if tracer.fallback == nil {
+		t.Skip("timestamp counter unavailable")
+	}
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if result.CycleSource != cycleSourceTSC || result.ExcludeKernel != nil || result.ExcludeHV != nil {
+		t.Errorf("unexpected metadata counting with %q: excludeKernel %v, excludeHV %v", result.CycleSource, result.ExcludeKernel, result.ExcludeHV)
+	}
+}
+
+// Tests that rows are streamed into the output file, with only its location,
+// size and aggregates returned, and that a failure to write aborts the trace.
+func TestCycleTracerOutputFile(t *testing.T) {
+	var (
+		dir    = setOutputDir(t)
+		path   = filepath.Join(dir, "cycles.csv")
+		tracer = newTestTracer(t, "cycleTracer", `{"outputFile": "cycles.csv"}`).(*cycleTracer)
+		code   = []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	)
+	tracer.counter = stubEventCounter{}
+	executeTestTracer(t, tracer, code, nil)
+	if len(tracer.samples) != 0 {
+		t.Errorf("streamed tracer holds %d rows in memory", len(tracer.samples))
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	result, rows := readCheckpointResult(t, res)
+	if result.File != path {
+		t.Errorf("output file mismatch: have %s, want %s", result.File, path)
+	}
+	if result.Rows != 5 || len(rows) != 6 {
+		t.Errorf("row count mismatch: have %d rows reported and %d lines, want 5 and 6", result.Rows, len(rows))
+	}
+	if stats := result.Columns["cycles"]; stats == nil || stats.Sum != 500 {
+		t.Errorf("cycles aggregates mismatch: have %+v, want a sum of 500", stats)
+	}
+	for _, cfg := range []string{
+		`{"outputFile": "cycles.csv", "checkpointSamples": 10}`,
+		`{"outputFile": "cycles.csv", "summary": true}`,
+		`{"outputFile": "cycles.csv", "output": "json"}`,
+		`{"outputFile": "cycles.csv", "output": "array"}`,
+	} {
+		if _, err := newCycleTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("expected error for config %s", cfg)
+		}
+	}
+
+	// Files outside the output directory are refused, existing ones aren't
+	// overwritten
+	for _, name := range []string{filepath.Join(t.TempDir(), "cycles.csv"), "../cycles.csv"} {
+		if _, err := newCycleTracer(nil, json.RawMessage(fmt.Sprintf(`{"outputFile": %q}`, name))); err == nil {
+			t.Errorf("output file %q outside the output directory accepted", name)
+		}
+	}
+	tracer = newTestTracer(t, "cycleTracer", `{"outputFile": "cycles.csv"}`).(*cycleTracer)
+	tracer.counter = stubEventCounter{}
+	executeTestTracer(t, tracer, code, nil)
+	if _, err := tracer.GetResult(); err == nil {
+		t.Error("expected error creating an existing output file")
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 6 {
+		t.Errorf("existing output file overwritten: %q", data)
+	}
+
+	// Failing to create the file aborts the trace before the first step
+	tracer = newTestTracer(t, "cycleTracer", `{"outputFile": "missing/cycles.csv"}`).(*cycleTracer)
+	counter := new(sequencedEventCounter)
+	tracer.counter = counter
+	executeTestTracer(t, tracer, code, nil)
+	if counter.started != 0 {
+		t.Errorf("steps measured without an output file: started %d", counter.started)
+	}
+	if _, err := tracer.GetResult(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected error creating the output file, have %v", err)
+	}
+
+	// Failing to write a row aborts the trace at the next step
+	tracer = newTestTracer(t, "cycleTracer", `{"outputFile": "failing.csv"}`).(*cycleTracer)
+	counter = new(sequencedEventCounter)
+	tracer.counter = counter
+	tracer.CaptureTxStart(10)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 10, nil)
+	tracer.CaptureState(0, vm.PUSH1, 10, 3, nil, nil, 1, nil)
+	tracer.checkpoint.err = errors.New("no space left on device")
+	tracer.CaptureState(2, vm.POP, 7, 2, nil, nil, 1, nil)
+	tracer.CaptureState(3, vm.STOP, 5, 0, nil, nil, 1, nil)
+	tracer.CaptureEnd(nil, 5, nil)
+	tracer.CaptureTxEnd(5)
+	if counter.started != 2 {
+		t.Errorf("steps measured after the write failure: started %d, want 2", counter.started)
+	}
+	if _, err := tracer.GetResult(); err == nil || !strings.Contains(err.Error(), "no space left on device") {
+		t.Errorf("expected write error, have %v", err)
+	}
+}
+
+// writeRAPLPMU writes a sysfs directory of a RAPL PMU with the given files,
+// by path relative to it.
+func writeRAPLPMU(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Tests that the energy counters are read from the sysfs directory of the
+// RAPL PMU, and that a missing or empty PMU is reported as unavailable.
+func TestNewEnergyMeter(t *testing.T) {
+	dir := writeRAPLPMU(t, map[string]string{
+		"type":                      "9",
+		"cpumask":                   "0,2-3",
+		"events/energy-pkg":         "event=0x02",
+		"events/energy-pkg.scale":   "2.3283064365386962890625e-10",
+		"events/energy-pkg.unit":    "Joules",
+		"events/energy-cores":       "event=0x01",
+		"events/energy-cores.scale": "0.5",
+	})
+	meter, err := newEnergyMeter(dir)
+	if err != nil {
+		t.Fatalf("failed to create energy meter: %v", err)
+	}
+	if meter.typ != 9 || !reflect.DeepEqual(meter.cpus, []int{0, 2, 3}) {
+		t.Errorf("PMU mismatch: have type %d on CPUs %v, want 9 on [0 2 3]", meter.typ, meter.cpus)
+	}
+	want := []raplEvent{
+		{domain: "cores", config: 1, scale: 0.5},
+		{domain: "pkg", config: 2, scale: 2.3283064365386962890625e-10},
+	}
+	if !reflect.DeepEqual(meter.events, want) {
+		t.Errorf("events mismatch: have %+v, want %+v", meter.events, want)
+	}
+
+	for _, tt := range []struct {
+		name        string
+		files       map[string]string
+		unavailable bool
+	}{
+		{"no PMU", nil, true},
+		{"no energy events", map[string]string{"type": "9", "cpumask": "0"}, true},
+		{"invalid cpumask", map[string]string{"type": "9", "cpumask": "0-x", "events/energy-pkg": "event=0x02"}, false},
+		{"invalid encoding", map[string]string{"type": "9", "cpumask": "0", "events/energy-pkg": "umask=0x02"}, false},
+		{"missing scale", map[string]string{"type": "9", "cpumask": "0", "events/energy-pkg": "event=0x02"}, false},
+	} {
+		_, err := newEnergyMeter(writeRAPLPMU(t, tt.files))
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		} else if have := errors.Is(err, errRAPLUnavailable); have != tt.unavailable {
+			t.Errorf("%s: unavailability mismatch: have %v, want %v: %v", tt.name, have, tt.unavailable, err)
+		}
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	for _, tt := range []struct {
+		list string
+		want []int
+	}{
+		{"0", []int{0}},
+		{"0,28", []int{0, 28}},
+		{"0-2,8", []int{0, 1, 2, 8}},
+	} {
+		have, err := parseCPUList(tt.list)
+		if err != nil {
+			t.Errorf("%q: failed to parse: %v", tt.list, err)
+		} else if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%q: CPUs mismatch: have %v, want %v", tt.list, have, tt.want)
+		}
+	}
+	for _, list := range []string{"", "a", "3-1", "0-"} {
+		if _, err := parseCPUList(list); err == nil {
+			t.Errorf("%q: expected error", list)
+		}
+	}
+}
+
+// Tests that a cycleTracer measuring the energy fails to be created without
+// the RAPL PMU, and otherwise reports the joules consumed per domain.
+func TestCycleTracerEnergy(t *testing.T) {
+	defer func(path string) { raplPMUPath = path }(raplPMUPath)
+	raplPMUPath = filepath.Join(t.TempDir(), "power")
+	if _, err := tracers.DefaultDirectory.New("cycleTracer", new(tracers.Context), json.RawMessage(`{"energy": true}`)); !errors.Is(err, errRAPLUnavailable) {
+		t.Errorf("error mismatch without RAPL PMU: have %v, want %v", err, errRAPLUnavailable)
+	}
+	raplPMUPath = "/sys/bus/event_source/devices/power"
+	tracer, err := tracers.DefaultDirectory.New("cycleTracer", new(tracers.Context), json.RawMessage(`{"energy": true}`))
+	if err != nil {
+		t.Skipf("RAPL energy counters unavailable: %v", err)
+	}
+	tracer.(*cycleTracer).counter = stubEventCounter{}
+	res, err := runTestTracer(t, tracer, loopCode, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if result.EnergyError != "" || len(result.Energy) == 0 {
+		t.Fatalf("energy not measured: %v", result.EnergyError)
+	}
+	for domain, joules := range result.Energy {
+		if joules < 0 {
+			t.Errorf("domain %s: negative energy %v", domain, joules)
+		}
+	}
+}
+
+// Tests that the deviation report flags the opcodes whose mean cycles per gas
+// deviate from the median by more than the factor either way, the most
+// deviating first.
+func TestCycleDeviationReport(t *testing.T) {
+	d := newCycleDeviation(4)
+	for _, step := range []struct {
+		op           vm.OpCode
+		cycles, cost int
+	}{
+		{vm.PUSH1, 20, 3},
+		{vm.PUSH1, 40, 3},      // 10 per gas on average
+		{vm.ADD, 30, 3},        // 10 per gas
+		{vm.POP, 20, 2},        // 10 per gas
+		{vm.SLOAD, 2100, 2100}, // 1 per gas
+		{vm.MUL, 1000, 5},      // 200 per gas
+		{vm.STOP, 50, 0},       // Free, left out
+		{vm.CALL, 10, 30000},   // Charged the gas of the callee, left out
+	} {
+		d.add(step.op, step.cycles, step.cost)
+	}
+	report := d.report()
+	if report.Factor != 4 || report.Median != 10 {
+		t.Errorf("report mismatch: have factor %v, median %v, want 4, 10", report.Factor, report.Median)
+	}
+	want := []deviantOpcode{
+		{Opcode: "MUL", Count: 1, MeanCycles: 1000, MeanCost: 5, CyclesPerGas: 200, Deviation: 20},
+		{Opcode: "SLOAD", Count: 1, MeanCycles: 2100, MeanCost: 2100, CyclesPerGas: 1, Deviation: 0.1},
+	}
+	if !reflect.DeepEqual(report.Flagged, want) {
+		t.Errorf("flagged mismatch: have %+v, want %+v", report.Flagged, want)
+	}
+	// A warm access is divided by its own cost rather than the cold one
+	d.add(vm.SLOAD, 1000, 100)
+	report = d.report()
+	want = []deviantOpcode{{Opcode: "MUL", Count: 1, MeanCycles: 1000, MeanCost: 5, CyclesPerGas: 200, Deviation: 20}}
+	if !reflect.DeepEqual(report.Flagged, want) {
+		t.Errorf("flagged mismatch: have %+v, want %+v", report.Flagged, want)
+	}
+}
+
+// Tests that the cycleTracer returns the deviation report alongside the rows
+// if requested.
+func TestCycleTracerDeviation(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	for _, config := range []string{`{"deviationFactor": 1.2}`, `{"deviationFactor": 1.2, "summary": true}`} {
+		tracer := newTestTracer(t, "cycleTracer", config).(*cycleTracer)
+		tracer.counter = stubEventCounter{}
+		res, err := runTestTracer(t, tracer, code, nil)
+		if err != nil {
+			t.Fatalf("config %s: failed to retrieve trace result: %v", config, err)
+		}
+		var result tableResult
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("config %s: failed to decode result: %v", config, err)
+		}
+		if result.Deviations == nil {
+			t.Fatalf("config %s: deviation report missing", config)
+		}
+		// Every step counts 100 cycles: PUSH1 and ADD take 33 per gas and POP
+		// 50, while STOP, charged no gas, is left out
+		var flagged []string
+		for _, opcode := range result.Deviations.Flagged {
+			flagged = append(flagged, opcode.Opcode)
+		}
+		if want := []string{"POP"}; !reflect.DeepEqual(flagged, want) {
+			t.Errorf("config %s: flagged mismatch: have %v, want %v", config, flagged, want)
+		}
+		if median := result.Deviations.Median; median != 100.0/3 {
+			t.Errorf("config %s: median mismatch: have %v, want %v", config, median, 100.0/3)
+		}
+	}
+	if res, err := runTestTracer(t, newStubCycleTracer(t), code, nil); err != nil || strings.Contains(string(res), "deviations") {
+		t.Errorf("deviation report included unrequested: %s, %v", res, err)
+	}
+	for _, config := range []string{
+		`{"deviationFactor": 1}`,
+		`{"deviationFactor": -2}`,
+		`{"deviationFactor": 2, "resolution": 2}`,
+		`{"deviationFactor": 2, "output": "array"}`,
+	} {
+		if _, err := tracers.DefaultDirectory.New("cycleTracer", new(tracers.Context), json.RawMessage(config)); err == nil {
+			t.Errorf("config %s: expected error", config)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// jsonStringWriter escapes everything written through it as the contents of a
+// JSON string, exactly as encoding/json would, allowing large string results
+// to be streamed instead of materialized before marshalling.
+type jsonStringWriter struct {
+	w       io.Writer
+	pending []byte // Incomplete UTF-8 sequence held back from the last write
+}
+
+// Write escapes p and writes it to the underlying writer. A multi-byte rune
+// split across writes is held back until it is complete.
+func (w *jsonStringWriter) Write(p []byte) (int, error) {
+	data := append(w.pending, p...)
+
+	// Find the last rune start and hold it back if incomplete
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	w.pending = append(w.pending[:0:0], data[cut:]...)
+	if err := w.write(data[:cut]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// write escapes a chunk of complete runes.
+func (w *jsonStringWriter) write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	enc, err := json.Marshal(string(p))
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(enc[1 : len(enc)-1])
+	return err
+}
+
+// encodeJSONString writes the output of fn into w as a JSON string, producing
+// the same bytes as marshalling the output with encoding/json.
+func encodeJSONString(w io.Writer, fn func(io.Writer) error) error {
+	if _, err := io.WriteString(w, `"`); err != nil {
+		return err
+	}
+	sw := &jsonStringWriter{w: w}
+	if err := fn(sw); err != nil {
+		return err
+	}
+	if err := sw.write(sw.pending); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, `"`)
+	return err
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func TestEncodeJSONString(t *testing.T) {
+	input := "a,b\n\"quoted\"\t<html>&é世\U0001F600\xff\n"
+	for split := 1; split <= 7; split++ {
+		var buf bytes.Buffer
+		err := encodeJSONString(&buf, func(w io.Writer) error {
+			// Write in small chunks, splitting multi-byte runes
+			for data := []byte(input); len(data) > 0; {
+				n := split
+				if n > len(data) {
+					n = len(data)
+				}
+				if _, err := w.Write(data[:n]); err != nil {
+					return err
+				}
+				data = data[n:]
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("split %d: failed to encode: %v", split, err)
+		}
+		want, _ := json.Marshal(input)
+		if buf.String() != string(want) {
+			t.Fatalf("split %d: encoding mismatch: have %s, want %s", split, buf.String(), want)
+		}
+	}
+}
+
+func TestEncodeResultMatchesGetResult(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	for _, name := range []string{"timingTracer", "memoryTransactionTracer"} {
+		t.Run(name, func(t *testing.T) {
+			tracer := newTestTracer(t, name, "")
+			want, err := runTestTracer(t, tracer, code, nil)
+			if err != nil {
+				t.Fatalf("failed to retrieve trace result: %v", err)
+			}
+			var buf bytes.Buffer
+			if err := tracer.(tracers.ResultEncoder).EncodeResult(&buf); err != nil {
+				t.Fatalf("failed to encode trace result: %v", err)
+			}
+			if buf.String() != string(want) {
+				t.Fatalf("result mismatch: have %s, want %s", buf.String(), want)
+			}
+		})
+	}
+}
+
+func TestMemoryTracerEncodeResult(t *testing.T) {
+	for _, cfg := range []string{"", `{"targetSamples": 4}`} {
+		tracer := newTestTracer(t, "memoryTracer", cfg)
+		executeTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}, nil)
+
+		var buf bytes.Buffer
+		if err := tracer.(tracers.ResultEncoder).EncodeResult(&buf); err != nil {
+			t.Fatalf("failed to encode trace result: %v", err)
+		}
+		var blob string
+		if cfg == "" {
+			if err := json.Unmarshal(buf.Bytes(), &blob); err != nil {
+				t.Fatalf("invalid result %s: %v", buf.String(), err)
+			}
+		} else {
+			var res tableResult
+			if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+				t.Fatalf("invalid result %s: %v", buf.String(), err)
+			}
+			blob = res.CSV
+		}
+		if want := "heapAlloc,"; len(blob) < len(want) || blob[:len(want)] != want {
+			t.Fatalf("result missing header: %q", blob)
+		}
+	}
+}
@@ -17,18 +17,18 @@
 package native
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/eth/tracers"
+	"io"
 	"io/ioutil"
-	"log"
 	"math/big"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 )
 
 func init() {
@@ -38,74 +38,125 @@ func init() {
 // memoryTracer is a go implementation of the Tracer interface which
 // performs no action. It's mostly useful for testing purposes.
 type memoryTracer struct {
-	opCounter   int
-	resolution  int
+	sampler     *adaptiveSampler
+	budget      *traceBudget
+	config      memoryTracerConfig
 	csvFileName string
+	file        traceWriter // Append-only sink the samples are streamed into
+	buf         []byte      // Scratch space for encoding a row
+	memStats    runtime.MemStats
+	pending     []memStatsRow // Step samples held back while the resolution is adapting
+	err         error         // First error hit while writing the samples
 }
 
+type memoryTracerConfig struct {
+	TargetSamples int `json:"targetSamples"` // If non-zero, the resolution adapts to keep at most this many step samples
+	BudgetMs      int `json:"budgetMs"`      // If non-zero, steps are no longer sampled after this many milliseconds
+}
+
+// memoryColumns are the columns of the memory tracer's CSV output.
+var memoryColumns = []tracers.ColumnInfo{
+	{Name: "heapAlloc", Type: columnInt, Unit: "bytes"},
+	{Name: "heapSys", Type: columnInt, Unit: "bytes"},
+	{Name: "heapIdle", Type: columnInt, Unit: "bytes"},
+	{Name: "heapInuse", Type: columnInt, Unit: "bytes"},
+	{Name: "stackInUse", Type: columnInt, Unit: "bytes"},
+	{Name: "stackSys", Type: columnInt, Unit: "bytes"},
+}
+
+// memStatsRow is a single sample of the heap and stack statistics.
+type memStatsRow [6]uint64
+
 // newmemoryTracer returns a new noop tracer.
-func newMemoryTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+func newMemoryTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
+	var config memoryTracerConfig
+	if cfg != nil {
+		if err := json.Unmarshal(cfg, &config); err != nil {
+			return nil, err
+		}
+	}
+	if config.TargetSamples < 0 {
+		return nil, fmt.Errorf("invalid targetSamples %d", config.TargetSamples)
+	}
+	budget, err := newTraceBudget(config.BudgetMs)
+	if err != nil {
+		return nil, err
+	}
 	return &memoryTracer{
-		opCounter:   0,
-		resolution:  1,
+		sampler:     newAdaptiveSampler(1, config.TargetSamples),
+		budget:      budget,
+		config:      config,
 		csvFileName: "memoryStats.csv",
 	}, nil
 }
 
 // CaptureStart implements the EVMLogger interface to initialize the tracing operation.
 func (t *memoryTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
-	err := createCSV(t.csvFileName)
+	t.budget.start()
+	// The file of the previous transaction is replaced, its name isn't
+	// configurable
+	os.Remove(t.csvFileName)
+	file, err := newTraceWriter(t.csvFileName)
 	if err != nil {
-		log.Fatalf("Failed to create CSV: %v", err)
+		t.err = fmt.Errorf("failed to create CSV: %w", err)
+		return
 	}
+	t.file = file
+	t.write([]byte(strings.Join(columnNames(memoryColumns), ",") + "\n"))
 }
 
-func createCSV(filename string) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+// Columns implements tracers.ColumnTracer, returning the CSV columns.
+func (t *memoryTracer) Columns() []tracers.ColumnInfo {
+	return memoryColumns
+}
 
-	headers := []string{"heapAlloc", "heapSys", "heapIdle", "heapInuse", "stackInUse", "stackSys"}
-	err = writer.Write(headers) // writing header
-	if err != nil {
-		return err
+// readMemStats samples the current memory statistics.
+func (t *memoryTracer) readMemStats() memStatsRow {
+	runtime.ReadMemStats(&t.memStats)
+	return memStatsRow{
+		t.memStats.HeapAlloc,
+		t.memStats.HeapSys,
+		t.memStats.HeapIdle,
+		t.memStats.HeapInuse,
+		t.memStats.StackInuse,
+		t.memStats.StackSys,
 	}
-
-	return nil
 }
 
-func addMemStatsToCSV(filename string) error {
-	var mem runtime.MemStats
-	runtime.ReadMemStats(&mem)
-
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
-	if err != nil {
-		return err
+// writeMemStats appends a memory statistics sample to the output file. The
+// row is encoded into a reused buffer, as the values never need CSV quoting.
+func (t *memoryTracer) writeMemStats(row memStatsRow) {
+	t.buf = t.buf[:0]
+	for i, v := range row {
+		if i > 0 {
+			t.buf = append(t.buf, ',')
+		}
+		t.buf = strconv.AppendUint(t.buf, v, 10)
 	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	t.buf = append(t.buf, '\n')
+	t.write(t.buf)
+}
 
-	stats := []string{
-		strconv.Itoa(int(mem.HeapAlloc)),
-		strconv.Itoa(int(mem.HeapSys)),
-		strconv.Itoa(int(mem.HeapIdle)),
-		strconv.Itoa(int(mem.HeapInuse)),
-		strconv.Itoa(int(mem.StackInuse)),
-		strconv.Itoa(int(mem.StackSys)),
+// write appends a single encoded row to the output file, retaining the first
+// error.
+func (t *memoryTracer) write(row []byte) {
+	if t.file == nil || t.err != nil {
+		return
 	}
-	err = writer.Write(stats) // writing stats
-	if err != nil {
-		return err
+	if _, err := t.file.Write(row); err != nil {
+		t.err = fmt.Errorf("failed to add memory stats to CSV: %w", err)
 	}
+}
 
-	return nil
+// closeFile flushes the pending rows and closes the output file.
+func (t *memoryTracer) closeFile() {
+	if t.file == nil {
+		return
+	}
+	if err := t.file.Close(); err != nil && t.err == nil {
+		t.err = fmt.Errorf("failed to close CSV: %w", err)
+	}
+	t.file = nil
 }
 
 func getCSVAsStringAndDelete(filename string) (string, error) {
@@ -144,21 +195,28 @@ func WriteToFile(filename, content string) error {
 
 // CaptureEnd is called after the call finishes to finalize the tracing.
 func (t *memoryTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
-	err = addMemStatsToCSV(t.csvFileName)
-	if err != nil {
-		log.Fatalf("Failed to add memory stats to CSV: %v", err)
+	for _, row := range t.pending {
+		t.writeMemStats(row)
 	}
+	t.pending = nil
+	t.writeMemStats(t.readMemStats())
+	t.closeFile()
 }
 
 // CaptureState implements the EVMLogger interface to trace a single step of VM execution.
 func (t *memoryTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
-	if 0 == t.opCounter%t.resolution {
-		err := addMemStatsToCSV(t.csvFileName)
-		if err != nil {
-			log.Fatalf("Failed to add memory stats to CSV: %v", err)
-		}
+	if !t.budget.step() || !t.sampler.step() {
+		return
+	}
+	if t.config.TargetSamples == 0 {
+		t.writeMemStats(t.readMemStats())
+		return
+	}
+	// The final resolution is unknown until the end, so hold the samples back
+	t.pending = append(t.pending, t.readMemStats())
+	if t.sampler.full(len(t.pending)) {
+		t.pending = decimateSamples(t.pending, 0)
 	}
-	t.opCounter = t.opCounter + 1
 }
 
 // CaptureFault implements the EVMLogger interface to trace an execution fault.
@@ -183,10 +241,18 @@ func (*memoryTracer) CaptureTxEnd(restGas uint64) {
 
 // GetResult returns an empty json object.
 func (t *memoryTracer) GetResult() (json.RawMessage, error) {
+	t.closeFile()
+	if t.err != nil {
+		os.Remove(t.csvFileName)
+		return nil, t.err
+	}
 	csvString, err := getCSVAsStringAndDelete(t.csvFileName)
+	if err != nil {
+		return nil, err
+	}
 
 	// Encode the slice of slices to JSON
-	jsonBytes, err := json.Marshal(csvString)
+	jsonBytes, err := marshalTableResult(newTableMeta(t.sampler, t.budget), csvString)
 	if err != nil {
 		return json.RawMessage(`{}`), err
 	}
@@ -194,6 +260,26 @@ func (t *memoryTracer) GetResult() (json.RawMessage, error) {
 	return jsonBytes, nil
 }
 
+// EncodeResult implements tracers.ResultEncoder, streaming the same result as
+// GetResult straight from the output file.
+func (t *memoryTracer) EncodeResult(w io.Writer) error {
+	t.closeFile()
+	defer os.Remove(t.csvFileName)
+	if t.err != nil {
+		return t.err
+	}
+	file, err := os.Open(t.csvFileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return encodeTableResult(w, newTableMeta(t.sampler, t.budget), func(w io.Writer) error {
+		_, err := io.Copy(w, file)
+		return err
+	})
+}
+
 // Stop terminates execution of the tracer at the first opportune moment.
 func (t *memoryTracer) Stop(err error) {
 }
@@ -8,9 +8,11 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/eth/tracers"
+	"io"
 	"math/big"
 	"runtime"
 	"strconv"
+	"time"
 )
 
 // Copyright 2021 The go-ethereum Authors
@@ -43,10 +45,198 @@ type memoryTransactionTracer struct {
 	stackInUseList []int
 	stackSysList   []int
 	memStats       runtime.MemStats
+	format         memorySizeFormat // Unit and precision the sizes are reported in
+	jsonRows       bool             // Whether the rows are returned as JSON arrays under their column names instead of CSV
+
+	// Cumulative GC activity as of every sample
+	numGCList        []int
+	pauseTotalNsList []int
+	lastGCList       []int
+
+	// Cumulative allocations as of every sample, which unlike the heap
+	// statistics don't shrink when a GC runs
+	totalAllocList []int
+	mallocsList    []int
+	freesList      []int
+
+	heapObjectsList []int // Number of allocated heap objects as of every sample
+
+	sampler     *adaptiveSampler // Picks the steps sampled in between the start and end
+	opCountList []int            // Number of opcodes executed as of every sample
+
+	start    time.Time // Time of CaptureStart, the samples are timed relative to
+	timeList []int     // Nanoseconds since CaptureStart as of every sample
+
+	// Location of every sample taken at an opcode, -1 and empty for the samples
+	// taken at the transaction and call frame boundaries
+	pcList []int
+	opList []string
+
+	// Phase of the execution every sample was taken in and its call frame
+	frames       []memoryFrame // Call frames currently executing, the innermost last
+	phaseList    []string
+	depthList    []int
+	callTypeList []string
+	calleeList   []common.Address
+}
+
+// memoryFrame is a call frame of the memoryTransactionTracer, which the samples
+// taken while it executes are tagged with.
+type memoryFrame struct {
+	typ    vm.OpCode      // Opcode the frame was entered by
+	callee common.Address // Address of the code executing in the frame
+}
+
+// Phases of the execution the samples of the memoryTransactionTracer are taken
+// in, listed in the phase column.
+const (
+	memorySampleStart = "tx_start" // Start of the transaction
+	memorySampleEnd   = "tx_end"   // End of the transaction
+	memorySampleEnter = "enter"    // Entry of a call frame
+	memorySampleExit  = "exit"     // Return from a call frame
+	memorySampleStep  = "step"     // Every resolution-th opcode
+	memorySampleFault = "fault"    // An opcode failing, reverts included
+)
+
+type memoryTransactionTracerConfig struct {
+	Unit      string `json:"unit"`      // Unit of the sizes, "b", "kb" or "mb" as floats, bytes as integers if unset
+	Precision *int   `json:"precision"` // If set, the number of decimals of the sizes, as many as needed otherwise
+
+	Resolution *int   `json:"resolution"` // If set, the statistics are read every resolution-th opcode, defaultMemoryResolution otherwise
+	Format     string `json:"format"`     // Result encoding of the rows, outputCSV (default) or outputJSON
+}
+
+// defaultMemoryResolution is the number of opcodes between two samples taken
+// during execution if no resolution is configured. Reading the memory
+// statistics stops the world, so only a small fraction of the steps is sampled.
+const defaultMemoryResolution = 1000
+
+// memoryUnit is a unit the sizes of the memoryTransactionTracer are reported
+// in.
+type memoryUnit struct {
+	name  string // Unit of the columns
+	bytes int    // Bytes in the unit
+}
+
+// memoryUnits are the units of the memoryTransactionTracer by config name.
+var memoryUnits = map[string]memoryUnit{
+	"b":  {name: "bytes", bytes: 1},
+	"kb": {name: "KiB", bytes: 1 << 10},
+	"mb": {name: "MiB", bytes: 1 << 20},
+}
+
+// memorySizeFormat formats the sizes of the memoryTransactionTracer, as
+// integer bytes unless a unit or precision is configured.
+type memorySizeFormat struct {
+	float     bool // Whether the sizes are formatted as floats in the unit
+	unit      memoryUnit
+	precision int // Number of decimals of the floats, -1 for as many as needed
+}
+
+// defaultMemorySizeFormat formats the sizes as integer bytes.
+var defaultMemorySizeFormat = memorySizeFormat{unit: memoryUnits["b"]}
+
+// newMemorySizeFormat returns the format of the configured unit and precision.
+func newMemorySizeFormat(config memoryTransactionTracerConfig) (memorySizeFormat, error) {
+	if config.Unit == "" && config.Precision == nil {
+		return defaultMemorySizeFormat, nil
+	}
+	format := memorySizeFormat{float: true, unit: memoryUnits["b"], precision: -1}
+	if config.Unit != "" {
+		unit, ok := memoryUnits[config.Unit]
+		if !ok {
+			return format, fmt.Errorf("unknown unit %q", config.Unit)
+		}
+		format.unit = unit
+	}
+	if config.Precision != nil {
+		if *config.Precision < 0 {
+			return format, fmt.Errorf("invalid precision %d", *config.Precision)
+		}
+		format.precision = *config.Precision
+	}
+	return format, nil
 }
 
-// newmemoryTransactionTracer returns a new noop tracer.
-func newMemoryTransactionTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+// format formats a size in bytes.
+func (f memorySizeFormat) format(size int) string {
+	if !f.float {
+		return strconv.Itoa(size)
+	}
+	return strconv.FormatFloat(float64(size)/float64(f.unit.bytes), 'f', f.precision, 64)
+}
+
+// columns returns the columns of the CSV output with the sizes in the format.
+func (f memorySizeFormat) columns() []tracers.ColumnInfo {
+	if !f.float {
+		return memoryTransactionColumns
+	}
+	columns := make([]tracers.ColumnInfo, len(memoryTransactionColumns))
+	for i, column := range memoryTransactionColumns {
+		if column.Unit == "bytes" {
+			column = tracers.ColumnInfo{Name: column.Name, Type: columnFloat, Unit: f.unit.name}
+		}
+		columns[i] = column
+	}
+	return columns
+}
+
+// memoryTransactionColumns are the columns of the memory transaction
+// tracer's CSV output.
+var memoryTransactionColumns = []tracers.ColumnInfo{
+	{Name: "heapAllocList", Type: columnInt, Unit: "bytes"},
+	{Name: "heapSysList", Type: columnInt, Unit: "bytes"},
+	{Name: "heapIdleList", Type: columnInt, Unit: "bytes"},
+	{Name: "heapInuseList", Type: columnInt, Unit: "bytes"},
+	{Name: "stackInUseList", Type: columnInt, Unit: "bytes"},
+	{Name: "stackSysList", Type: columnInt, Unit: "bytes"},
+	{Name: "numGCList", Type: columnInt},
+	{Name: "pauseTotalNsList", Type: columnInt, Unit: "ns"},
+	{Name: "lastGCList", Type: columnInt, Unit: "ns"},
+	{Name: "totalAllocList", Type: columnInt, Unit: "bytes"},
+	{Name: "mallocsList", Type: columnInt},
+	{Name: "freesList", Type: columnInt},
+	{Name: "totalAllocDeltaList", Type: columnInt, Unit: "bytes"},
+	{Name: "mallocsDeltaList", Type: columnInt},
+	{Name: "freesDeltaList", Type: columnInt},
+	{Name: "heapObjectsList", Type: columnInt},
+	{Name: "opCountList", Type: columnInt, Unit: "opcodes"},
+	{Name: "timeList", Type: columnInt, Unit: "ns"},
+	{Name: "pcList", Type: columnInt},
+	{Name: "opList", Type: columnString},
+	{Name: "phaseList", Type: columnString},
+	{Name: "depthList", Type: columnInt},
+	{Name: "callTypeList", Type: columnString},
+	{Name: "calleeList", Type: columnString},
+}
+
+// newMemoryTransactionTracer returns a tracer sampling the memory statistics of
+// the process at the start and end of the transaction, and every resolution-th
+// opcode in between. The resolution defaults to defaultMemoryResolution as
+// every sample runs runtime.ReadMemStats, which stops the world; lower it for a
+// finer view of where memory grows, at the cost of slowing execution down.
+func newMemoryTransactionTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
+	var config memoryTransactionTracerConfig
+	if cfg != nil {
+		if err := json.Unmarshal(cfg, &config); err != nil {
+			return nil, err
+		}
+	}
+	format, err := newMemorySizeFormat(config)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Format {
+	case "", outputCSV, outputJSON:
+	default:
+		return nil, fmt.Errorf("unknown format %q", config.Format)
+	}
+	resolution := defaultMemoryResolution
+	if config.Resolution != nil {
+		if resolution = *config.Resolution; resolution <= 0 {
+			return nil, fmt.Errorf("invalid resolution %d", resolution)
+		}
+	}
 	return &memoryTransactionTracer{
 		heapAllocList:  []int{},
 		heapSysList:    []int{},
@@ -54,15 +244,51 @@ func newMemoryTransactionTracer(ctx *tracers.Context, _ json.RawMessage) (tracer
 		heapInuseList:  []int{},
 		stackInUseList: []int{},
 		stackSysList:   []int{},
+		format:         format,
+		jsonRows:       config.Format == outputJSON,
+
+		numGCList:        []int{},
+		pauseTotalNsList: []int{},
+		lastGCList:       []int{},
+
+		totalAllocList: []int{},
+		mallocsList:    []int{},
+		freesList:      []int{},
+
+		heapObjectsList: []int{},
+
+		sampler:     newAdaptiveSampler(resolution, 0),
+		opCountList: []int{},
+
+		timeList: []int{},
+
+		pcList: []int{},
+		opList: []string{},
+
+		phaseList:    []string{},
+		depthList:    []int{},
+		callTypeList: []string{},
+		calleeList:   []common.Address{},
 	}, nil
 }
 
 // CaptureStart implements the EVMLogger interface to initialize the tracing operation.
 func (t *memoryTransactionTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
-	t.addHeapProfile()
+	t.start = time.Now()
+	typ := vm.CALL
+	if create {
+		typ = vm.CREATE
+	}
+	t.frames = append(t.frames[:0], memoryFrame{typ: typ, callee: to})
+	t.addHeapProfile(memorySampleStart, 0, -1, "")
 }
 
-func (t *memoryTransactionTracer) addHeapProfile() {
+// addHeapProfile samples the memory statistics in the given phase, after ops
+// opcodes were executed and at op at pc if sampled at a step or fault. The
+// sample is tagged with the innermost call frame.
+func (t *memoryTransactionTracer) addHeapProfile(phase string, ops int, pc int, op string) {
+	// Reading the statistics stops the world, so the sample is timed before
+	elapsed := time.Since(t.start)
 	heapAlloc, heapSys, heapIdle, heapInuse, stackInUse, stackSys := t.getHeapAndStackMetrics()
 
 	t.heapAllocList = append(t.heapAllocList, heapAlloc)
@@ -71,6 +297,25 @@ func (t *memoryTransactionTracer) addHeapProfile() {
 	t.heapInuseList = append(t.heapInuseList, heapInuse)
 	t.stackInUseList = append(t.stackInUseList, stackInUse)
 	t.stackSysList = append(t.stackSysList, stackSys)
+
+	// The GC statistics come from the same read of the memory statistics
+	t.numGCList = append(t.numGCList, int(t.memStats.NumGC))
+	t.pauseTotalNsList = append(t.pauseTotalNsList, int(t.memStats.PauseTotalNs))
+	t.lastGCList = append(t.lastGCList, int(t.memStats.LastGC))
+	t.totalAllocList = append(t.totalAllocList, int(t.memStats.TotalAlloc))
+	t.mallocsList = append(t.mallocsList, int(t.memStats.Mallocs))
+	t.freesList = append(t.freesList, int(t.memStats.Frees))
+	t.heapObjectsList = append(t.heapObjectsList, int(t.memStats.HeapObjects))
+	t.opCountList = append(t.opCountList, ops)
+	t.timeList = append(t.timeList, int(elapsed))
+	t.pcList = append(t.pcList, pc)
+	t.opList = append(t.opList, op)
+
+	frame := t.frames[len(t.frames)-1]
+	t.phaseList = append(t.phaseList, phase)
+	t.depthList = append(t.depthList, len(t.frames))
+	t.callTypeList = append(t.callTypeList, frame.typ.String())
+	t.calleeList = append(t.calleeList, frame.callee)
 }
 
 func (t *memoryTransactionTracer) getHeapAndStackMetrics() (int, int, int, int, int, int) {
@@ -84,44 +329,85 @@ func (t *memoryTransactionTracer) getHeapAndStackMetrics() (int, int, int, int,
 		int(t.memStats.StackSys)
 }
 
-// WriteToFile writes the content to the specified filename
+// Columns implements tracers.ColumnTracer, returning the CSV columns.
+func (t *memoryTransactionTracer) Columns() []tracers.ColumnInfo {
+	return t.format.columns()
+}
 
 // CaptureEnd is called after the call finishes to finalize the tracing.
 func (t *memoryTransactionTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
-	t.addHeapProfile()
+	t.addHeapProfile(memorySampleEnd, t.sampler.steps, -1, "")
 }
 
 // CaptureState implements the EVMLogger interface to trace a single step of VM execution.
 func (t *memoryTransactionTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
-
+	// Opcodes failing before they are executed are reported here, not counted
+	if err != nil {
+		t.addHeapProfile(memorySampleFault, t.sampler.steps, int(pc), opcodeName(op))
+		return
+	}
+	// The step is sampled before the opcode is executed, the state before the
+	// first one already was by CaptureStart
+	if t.sampler.step() && t.sampler.steps > 1 {
+		t.addHeapProfile(memorySampleStep, t.sampler.steps-1, int(pc), opcodeName(op))
+	}
 }
 
 // CaptureFault implements the EVMLogger interface to trace an execution fault.
 func (t *memoryTransactionTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
+	t.addHeapProfile(memorySampleFault, t.sampler.steps, int(pc), opcodeName(op))
 }
 
 // CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
 func (t *memoryTransactionTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	t.frames = append(t.frames, memoryFrame{typ: typ, callee: to})
+	t.addHeapProfile(memorySampleEnter, t.sampler.steps, -1, "")
 }
 
 // CaptureExit is called when EVM exits a scope, even if the scope didn't
 // execute any code.
 func (t *memoryTransactionTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	t.addHeapProfile(memorySampleExit, t.sampler.steps, -1, "")
+	t.frames = t.frames[:len(t.frames)-1]
 }
 
 func (*memoryTransactionTracer) CaptureTxStart(gasLimit uint64) {}
 
 func (*memoryTransactionTracer) CaptureTxEnd(restGas uint64) {}
 
-// GetResult returns an empty json object.
+// checkLengths verifies that all sample lists have the same length.
+func (t *memoryTransactionTracer) checkLengths() error {
+	if len(t.heapAllocList) != len(t.stackInUseList) || len(t.heapAllocList) != len(t.heapSysList) ||
+		len(t.heapAllocList) != len(t.heapIdleList) || len(t.heapAllocList) != len(t.heapInuseList) || len(t.heapAllocList) != len(t.stackSysList) ||
+		len(t.heapAllocList) != len(t.numGCList) || len(t.heapAllocList) != len(t.pauseTotalNsList) || len(t.heapAllocList) != len(t.lastGCList) ||
+		len(t.heapAllocList) != len(t.totalAllocList) || len(t.heapAllocList) != len(t.mallocsList) || len(t.heapAllocList) != len(t.freesList) ||
+		len(t.heapAllocList) != len(t.heapObjectsList) || len(t.heapAllocList) != len(t.opCountList) ||
+		len(t.heapAllocList) != len(t.timeList) || len(t.heapAllocList) != len(t.pcList) || len(t.heapAllocList) != len(t.opList) ||
+		len(t.heapAllocList) != len(t.phaseList) || len(t.heapAllocList) != len(t.depthList) || len(t.heapAllocList) != len(t.callTypeList) ||
+		len(t.heapAllocList) != len(t.calleeList) {
+		return fmt.Errorf("all lists must have the same length")
+	}
+	return nil
+}
+
+// GetResult returns the samples as a CSV string, or as JSON rows if configured.
 func (t *memoryTransactionTracer) GetResult() (json.RawMessage, error) {
 	// Check that all lists have the same length
-	if len(t.heapAllocList) != len(t.stackInUseList) || len(t.heapAllocList) != len(t.heapSysList) ||
-		len(t.heapAllocList) != len(t.heapIdleList) || len(t.heapAllocList) != len(t.heapInuseList) || len(t.heapAllocList) != len(t.stackSysList) {
-		return nil, fmt.Errorf("all lists must have the same length")
+	if err := t.checkLengths(); err != nil {
+		return nil, err
+	}
+	if t.jsonRows {
+		row := memoryRows(t.format, t.heapAllocList, t.heapSysList, t.heapIdleList, t.heapInuseList, t.stackInUseList, t.stackSysList,
+			t.numGCList, t.pauseTotalNsList, t.lastGCList, t.totalAllocList, t.mallocsList, t.freesList, t.heapObjectsList, t.opCountList, t.timeList,
+			t.pcList, t.opList, t.phaseList, t.depthList, t.callTypeList, t.calleeList)
+		return marshalRowsResult(nil, t.format.columns(), len(t.heapAllocList), row)
 	}
 
-	csvString, err := ListsToCSV(t.heapAllocList, t.heapSysList, t.heapIdleList, t.heapInuseList, t.stackInUseList, t.stackSysList)
+	buf := &bytes.Buffer{}
+	err := writeListsCSV(buf, t.format, t.heapAllocList, t.heapSysList, t.heapIdleList, t.heapInuseList, t.stackInUseList, t.stackSysList,
+		t.numGCList, t.pauseTotalNsList, t.lastGCList, t.totalAllocList, t.mallocsList, t.freesList, t.heapObjectsList, t.opCountList, t.timeList,
+		t.pcList, t.opList, t.phaseList, t.depthList, t.callTypeList, t.calleeList)
+	csvString := buf.String()
 
 	if err != nil {
 		return nil, fmt.Errorf("Can not create csv")
@@ -135,36 +421,66 @@ func (t *memoryTransactionTracer) GetResult() (json.RawMessage, error) {
 	return jsonBytes, nil
 }
 
+// EncodeResult implements tracers.ResultEncoder, streaming the same result as
+// GetResult without building the CSV in memory.
+func (t *memoryTransactionTracer) EncodeResult(w io.Writer) error {
+	if err := t.checkLengths(); err != nil {
+		return err
+	}
+	if t.jsonRows {
+		res, err := t.GetResult()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(res)
+		return err
+	}
+	return encodeJSONString(w, func(w io.Writer) error {
+		return writeListsCSV(w, t.format, t.heapAllocList, t.heapSysList, t.heapIdleList, t.heapInuseList, t.stackInUseList, t.stackSysList,
+			t.numGCList, t.pauseTotalNsList, t.lastGCList, t.totalAllocList, t.mallocsList, t.freesList, t.heapObjectsList, t.opCountList, t.timeList,
+			t.pcList, t.opList, t.phaseList, t.depthList, t.callTypeList, t.calleeList)
+	})
+}
+
 // Stop terminates execution of the tracer at the first opportune moment.
 func (t *memoryTransactionTracer) Stop(err error) {
 }
 
-func ListsToCSV(heapAllocList, heapSysList, heapIdleList, heapInuseList, stackInUseList, stackSysList []int) (string, error) {
-	// Create a buffer to hold the CSV data
+// ListsToCSV formats the samples as CSV, with the sizes in integer bytes.
+func ListsToCSV(heapAllocList, heapSysList, heapIdleList, heapInuseList, stackInUseList, stackSysList, numGCList, pauseTotalNsList, lastGCList,
+	totalAllocList, mallocsList, freesList, heapObjectsList, opCountList, timeList, pcList []int, opList []string,
+	phaseList []string, depthList []int, callTypeList []string, calleeList []common.Address) (string, error) {
 	buf := &bytes.Buffer{}
-	w := csv.NewWriter(buf)
+	if err := writeListsCSV(buf, defaultMemorySizeFormat, heapAllocList, heapSysList, heapIdleList, heapInuseList, stackInUseList, stackSysList,
+		numGCList, pauseTotalNsList, lastGCList, totalAllocList, mallocsList, freesList, heapObjectsList, opCountList, timeList, pcList, opList,
+		phaseList, depthList, callTypeList, calleeList); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeListsCSV writes the samples as CSV into out, with the sizes in the given
+// format.
+func writeListsCSV(out io.Writer, format memorySizeFormat, heapAllocList, heapSysList, heapIdleList, heapInuseList, stackInUseList, stackSysList,
+	numGCList, pauseTotalNsList, lastGCList, totalAllocList, mallocsList, freesList, heapObjectsList, opCountList, timeList, pcList []int, opList []string,
+	phaseList []string, depthList []int, callTypeList []string, calleeList []common.Address) error {
+	w := csv.NewWriter(out)
 
 	// Write the headers to the CSV
-	err := w.Write([]string{"heapAllocList", "heapSysList", "heapIdleList", "heapInuseList", "stackInUseList", "stackSysList"})
+	err := w.Write(columnNames(format.columns()))
 	if err != nil {
-		return "", err
+		return err
 	}
+	row := memoryRows(format, heapAllocList, heapSysList, heapIdleList, heapInuseList, stackInUseList, stackSysList,
+		numGCList, pauseTotalNsList, lastGCList, totalAllocList, mallocsList, freesList, heapObjectsList, opCountList, timeList, pcList, opList,
+		phaseList, depthList, callTypeList, calleeList)
 
 	// Assume all slices have the same length
 	for i := 0; i < len(heapAllocList); i++ {
-		// Convert integers to strings
-		row := []string{
-			strconv.Itoa(heapAllocList[i]),
-			strconv.Itoa(heapSysList[i]),
-			strconv.Itoa(heapIdleList[i]),
-			strconv.Itoa(heapInuseList[i]),
-			strconv.Itoa(stackInUseList[i]),
-			strconv.Itoa(stackSysList[i]),
-		}
 		// Write the row to the CSV
-		err = w.Write(row)
+		err = w.Write(row(i))
 		if err != nil {
-			return "", err
+			return err
 		}
 	}
 
@@ -172,10 +488,48 @@ func ListsToCSV(heapAllocList, heapSysList, heapIdleList, heapInuseList, stackIn
 	w.Flush()
 
 	// Check for any errors during write.
-	err = w.Error()
-	if err != nil {
-		return "", err
-	}
+	return w.Error()
+}
 
-	return buf.String(), nil
+// memoryRows returns a function rendering the i-th sample as a row, with the
+// sizes in the given format. The allocations since the previous sample follow
+// the cumulative ones, empty for the first sample.
+func memoryRows(format memorySizeFormat, heapAllocList, heapSysList, heapIdleList, heapInuseList, stackInUseList, stackSysList,
+	numGCList, pauseTotalNsList, lastGCList, totalAllocList, mallocsList, freesList, heapObjectsList, opCountList, timeList, pcList []int, opList []string,
+	phaseList []string, depthList []int, callTypeList []string, calleeList []common.Address) func(i int) []string {
+	return func(i int) []string {
+		row := []string{
+			format.format(heapAllocList[i]),
+			format.format(heapSysList[i]),
+			format.format(heapIdleList[i]),
+			format.format(heapInuseList[i]),
+			format.format(stackInUseList[i]),
+			format.format(stackSysList[i]),
+			strconv.Itoa(numGCList[i]),
+			strconv.Itoa(pauseTotalNsList[i]),
+			strconv.Itoa(lastGCList[i]),
+			format.format(totalAllocList[i]),
+			strconv.Itoa(mallocsList[i]),
+			strconv.Itoa(freesList[i]),
+			"", "", "",
+			strconv.Itoa(heapObjectsList[i]),
+			strconv.Itoa(opCountList[i]),
+			strconv.Itoa(timeList[i]),
+			"",
+			opList[i],
+			phaseList[i],
+			strconv.Itoa(depthList[i]),
+			callTypeList[i],
+			calleeList[i].Hex(),
+		}
+		if pcList[i] >= 0 {
+			row[18] = strconv.Itoa(pcList[i])
+		}
+		if i > 0 {
+			row[12] = format.format(totalAllocList[i] - totalAllocList[i-1])
+			row[13] = strconv.Itoa(mallocsList[i] - mallocsList[i-1])
+			row[14] = strconv.Itoa(freesList[i] - freesList[i-1])
+		}
+		return row
+	}
 }
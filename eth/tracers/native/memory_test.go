@@ -0,0 +1,417 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func BenchmarkMemoryTracerCaptureState(b *testing.B) {
+	tracer := newTestTracer(b, "memoryTracer", "").(*memoryTracer)
+	tracer.csvFileName = filepath.Join(b.TempDir(), "memoryStats.csv")
+	benchmarkCaptureState(b, tracer)
+}
+
+func BenchmarkMemoryTransactionTracerCaptureState(b *testing.B) {
+	benchmarkCaptureState(b, newTestTracer(b, "memoryTransactionTracer", ""))
+}
+
+// Tests that the sizes are formatted in the configured unit and precision,
+// and as integer bytes by default.
+func TestMemorySizeFormat(t *testing.T) {
+	two := 2
+	for _, tt := range []struct {
+		config memoryTransactionTracerConfig
+		size   int
+		want   string
+		unit   string
+	}{
+		{memoryTransactionTracerConfig{}, 1536, "1536", "bytes"},
+		{memoryTransactionTracerConfig{Unit: "b"}, 1536, "1536", "bytes"},
+		{memoryTransactionTracerConfig{Unit: "kb"}, 1536, "1.5", "KiB"},
+		{memoryTransactionTracerConfig{Unit: "kb", Precision: &two}, 1000, "0.98", "KiB"},
+		{memoryTransactionTracerConfig{Unit: "mb", Precision: &two}, 3 << 19, "1.50", "MiB"},
+		{memoryTransactionTracerConfig{Precision: &two}, 1536, "1536.00", "bytes"},
+	} {
+		format, err := newMemorySizeFormat(tt.config)
+		if err != nil {
+			t.Fatalf("%+v: failed to create format: %v", tt.config, err)
+		}
+		if have := format.format(tt.size); have != tt.want {
+			t.Errorf("%+v: size mismatch: have %s, want %s", tt.config, have, tt.want)
+		}
+		if have := format.columns()[0].Unit; have != tt.unit {
+			t.Errorf("%+v: unit mismatch: have %s, want %s", tt.config, have, tt.unit)
+		}
+	}
+	negative := -1
+	for _, config := range []memoryTransactionTracerConfig{{Unit: "gb"}, {Unit: "kb", Precision: &negative}} {
+		if _, err := newMemorySizeFormat(config); err == nil {
+			t.Errorf("%+v: expected error", config)
+		}
+	}
+}
+
+// Tests that the memoryTransactionTracer reports the sizes in the configured
+// unit and precision.
+func TestMemoryTransactionTracerUnit(t *testing.T) {
+	tracer := newTestTracer(t, "memoryTransactionTracer", `{"unit": "kb", "precision": 2}`)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if len(rows) != 3 {
+		t.Fatalf("row count mismatch: have %d, want 3", len(rows))
+	}
+	for _, row := range rows[1:] {
+		for i, value := range row[:6] {
+			if dot := strings.IndexByte(value, '.'); dot < 0 || len(value)-dot != 3 {
+				t.Errorf("%s: size %s not formatted with 2 decimals", rows[0][i], value)
+			}
+		}
+	}
+	testColumnsMatchHeader(t, newTestTracer(t, "memoryTransactionTracer", `{"unit": "mb"}`))
+}
+
+// Tests that every sample carries the cumulative GC activity as of the same
+// read of the memory statistics.
+func TestMemoryTransactionTracerGC(t *testing.T) {
+	tracer := newTestTracer(t, "memoryTransactionTracer", `{"unit": "mb"}`)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 0, nil)
+	runtime.GC()
+	tracer.CaptureEnd(nil, 0, nil)
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if have, want := rows[0][6:9], []string{"numGCList", "pauseTotalNsList", "lastGCList"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	var stats [2][3]int
+	for i, row := range rows[1:] {
+		for j, value := range row[6:9] {
+			if stats[i][j], err = strconv.Atoi(value); err != nil {
+				t.Fatalf("%s: invalid value %s", rows[0][6+j], value)
+			}
+		}
+	}
+	if stats[1][0] <= stats[0][0] || stats[1][1] < stats[0][1] || stats[1][2] <= stats[0][2] {
+		t.Errorf("GC between samples not reflected: have %v, then %v", stats[0], stats[1])
+	}
+}
+
+// memorySink keeps allocations of the tests alive.
+var memorySink [][]byte
+
+// Tests that every sample carries the cumulative allocations, and the
+// allocations since the previous sample, which the GC doesn't hide.
+func TestMemoryTransactionTracerAllocations(t *testing.T) {
+	tracer := newTestTracer(t, "memoryTransactionTracer", "")
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 0, nil)
+	for i := 0; i < 1000; i++ {
+		memorySink = append(memorySink, make([]byte, 1024))
+	}
+	memorySink = nil
+	runtime.GC()
+	tracer.CaptureEnd(nil, 0, nil)
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	want := []string{"totalAllocList", "mallocsList", "freesList", "totalAllocDeltaList", "mallocsDeltaList", "freesDeltaList"}
+	if have := rows[0][9:15]; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	if have := rows[1][12:15]; !reflect.DeepEqual(have, []string{"", "", ""}) {
+		t.Errorf("first sample deltas not empty: %v", have)
+	}
+	for i := 0; i < 3; i++ {
+		first, _ := strconv.Atoi(rows[1][9+i])
+		second, _ := strconv.Atoi(rows[2][9+i])
+		if delta := rows[2][12+i]; delta != strconv.Itoa(second-first) {
+			t.Errorf("%s: delta mismatch: have %s, want %d", rows[0][12+i], delta, second-first)
+		}
+	}
+	if delta, _ := strconv.Atoi(rows[2][12]); delta < 1000*1024 {
+		t.Errorf("allocated bytes missing: have %d, want at least %d", delta, 1000*1024)
+	}
+	if delta, _ := strconv.Atoi(rows[2][13]); delta < 1000 {
+		t.Errorf("allocations missing: have %d, want at least 1000", delta)
+	}
+}
+
+// Tests that every sample carries the number of allocated heap objects.
+func TestMemoryTransactionTracerHeapObjects(t *testing.T) {
+	tracer := newTestTracer(t, "memoryTransactionTracer", "")
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 0, nil)
+	for i := 0; i < 10000; i++ {
+		memorySink = append(memorySink, make([]byte, 16))
+	}
+	tracer.CaptureEnd(nil, 0, nil)
+	memorySink = nil
+
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if rows[0][15] != "heapObjectsList" {
+		t.Fatalf("heapObjectsList column missing from header %v", rows[0])
+	}
+	first, _ := strconv.Atoi(rows[1][15])
+	second, _ := strconv.Atoi(rows[2][15])
+	if second-first < 10000 {
+		t.Errorf("live objects missing: have %d, then %d, want at least 10000 more", first, second)
+	}
+}
+
+// Tests that the statistics are sampled every resolution-th opcode in between
+// the start and end, with the number of executed opcodes alongside.
+func TestMemoryTransactionTracerResolution(t *testing.T) {
+	code := []byte{
+		byte(vm.JUMPDEST), byte(vm.JUMPDEST), byte(vm.JUMPDEST), byte(vm.JUMPDEST),
+		byte(vm.JUMPDEST), byte(vm.JUMPDEST), byte(vm.JUMPDEST), byte(vm.STOP),
+	}
+	tracer := newTestTracer(t, "memoryTransactionTracer", `{"resolution": 3}`)
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if rows[0][16] != "opCountList" {
+		t.Fatalf("opCountList column missing from header %v", rows[0])
+	}
+	var ops []string
+	for _, row := range rows[1:] {
+		ops = append(ops, row[16])
+	}
+	if want := []string{"0", "3", "6", "8"}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("sampled opcodes mismatch: have %v, want %v", ops, want)
+	}
+	// The default resolution leaves short transactions with the two samples
+	res, err = runTestTracer(t, newTestTracer(t, "memoryTransactionTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	if rows := readTimingRows(t, res); len(rows) != 3 {
+		t.Errorf("row count mismatch: have %d, want 3", len(rows))
+	}
+	for _, cfg := range []string{`{"resolution": 0}`, `{"resolution": -1}`} {
+		if _, err := tracers.DefaultDirectory.New("memoryTransactionTracer", new(tracers.Context), json.RawMessage(cfg)); err == nil {
+			t.Errorf("config %s accepted", cfg)
+		}
+	}
+}
+
+// Tests that every sample, including the start and end ones, is timestamped
+// relative to CaptureStart.
+func TestMemoryTransactionTracerTime(t *testing.T) {
+	tracer := newTestTracer(t, "memoryTransactionTracer", `{"resolution": 1}`)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if rows[0][17] != "timeList" {
+		t.Fatalf("timeList column missing from header %v", rows[0])
+	}
+	if len(rows) != 5 {
+		t.Fatalf("row count mismatch: have %d, want 5", len(rows))
+	}
+	last := 0
+	for _, row := range rows[1:] {
+		elapsed, err := strconv.Atoi(row[17])
+		if err != nil {
+			t.Fatalf("invalid time %q: %v", row[17], err)
+		}
+		if elapsed < last {
+			t.Errorf("time went backwards: %d after %d", elapsed, last)
+		}
+		last = elapsed
+	}
+}
+
+// Tests that the samples taken during execution carry the pc and opcode they
+// were taken at, left empty for the start and end samples.
+func TestMemoryTransactionTracerLocation(t *testing.T) {
+	tracer := newTestTracer(t, "memoryTransactionTracer", `{"resolution": 1}`)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if have, want := rows[0][18:20], []string{"pcList", "opList"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	var locations [][]string
+	for _, row := range rows[1:] {
+		locations = append(locations, row[18:20])
+	}
+	want := [][]string{{"", ""}, {"2", "POP"}, {"3", "STOP"}, {"", ""}}
+	if !reflect.DeepEqual(locations, want) {
+		t.Errorf("sample locations mismatch: have %v, want %v", locations, want)
+	}
+}
+
+// Tests that the json format returns the rows under their column names, with
+// numeric values as JSON numbers, and that it is encoded the same way.
+func TestMemoryTransactionTracerJSONFormat(t *testing.T) {
+	tracer := newTestTracer(t, "memoryTransactionTracer", `{"format": "json", "resolution": 1, "unit": "kb"}`)
+	res, err := runTestTracer(t, tracer, []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		Columns []string        `json:"columns"`
+		Rows    [][]interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to decode result %s: %v", res, err)
+	}
+	columns := tracer.(tracers.ColumnTracer).Columns()
+	if want := columnNames(columns); !reflect.DeepEqual(result.Columns, want) {
+		t.Errorf("columns mismatch: have %v, want %v", result.Columns, want)
+	}
+	if len(result.Rows) != 4 {
+		t.Fatalf("row count mismatch: have %d, want 4", len(result.Rows))
+	}
+	for i, row := range result.Rows {
+		for j, value := range row {
+			switch {
+			case columns[j].Type == columnString:
+				if _, ok := value.(string); !ok {
+					t.Errorf("row %d: %s value %v not a string", i, result.Columns[j], value)
+				}
+			case value == nil:
+				// Deltas of the first sample and locations of the start and end ones
+				if !(i == 0 && j >= 12 && j < 15) && !((i == 0 || i == 3) && j == 18) {
+					t.Errorf("row %d: %s unexpectedly null", i, result.Columns[j])
+				}
+			default:
+				if _, ok := value.(float64); !ok {
+					t.Errorf("row %d: %s value %v not a number", i, result.Columns[j], value)
+				}
+			}
+		}
+	}
+	if have := result.Rows[1][18:20]; !reflect.DeepEqual(have, []interface{}{2.0, "POP"}) {
+		t.Errorf("sample location mismatch: have %v, want [2 POP]", have)
+	}
+	var buf bytes.Buffer
+	if err := tracer.(tracers.ResultEncoder).EncodeResult(&buf); err != nil {
+		t.Fatalf("failed to encode trace result: %v", err)
+	}
+	if buf.String() != string(res) {
+		t.Errorf("result mismatch: have %s, want %s", buf.String(), res)
+	}
+	if _, err := tracers.DefaultDirectory.New("memoryTransactionTracer", new(tracers.Context), json.RawMessage(`{"format": "xml"}`)); err == nil {
+		t.Errorf("unknown format accepted")
+	}
+}
+
+// Tests that a sample is taken on entering and returning from every call
+// frame, and that all samples are tagged with the frame they were taken in.
+func TestMemoryTransactionTracerFrames(t *testing.T) {
+	callee := common.HexToAddress("0xc0ffee")
+	tracer := newTestTracer(t, "memoryTransactionTracer", "")
+	res, err := runTestTracer(t, tracer, callCode(callee), map[common.Address][]byte{callee: {byte(vm.STOP)}})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if have, want := rows[0][20:24], []string{"phaseList", "depthList", "callTypeList", "calleeList"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("row count mismatch: have %d, want 5", len(rows))
+	}
+	caller := rows[1][23]
+	want := [][]string{
+		{"tx_start", "1", "CALL", caller},
+		{"enter", "2", "CALL", callee.Hex()},
+		{"exit", "2", "CALL", callee.Hex()},
+		{"tx_end", "1", "CALL", caller},
+	}
+	for i, row := range rows[1:] {
+		if have := row[20:24]; !reflect.DeepEqual(have, want[i]) {
+			t.Errorf("sample %d: frame mismatch: have %v, want %v", i, have, want[i])
+		}
+	}
+	// The call is entered by the 8th opcode and returns after the callee's one
+	if have := []string{rows[2][16], rows[3][16]}; !reflect.DeepEqual(have, []string{"8", "9"}) {
+		t.Errorf("opcodes executed at the call boundaries mismatch: have %v, want [8 9]", have)
+	}
+}
+
+// Tests that every sample is labelled with the phase it was taken in, faults
+// sampled at the failing opcode whether or not it was executed.
+func TestMemoryTransactionTracerPhase(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+		want [][]string // Phase, pc and opcode of every sample
+	}{
+		{
+			name: "steps",
+			code: []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)},
+			want: [][]string{{"tx_start", "", ""}, {"step", "2", "POP"}, {"step", "3", "STOP"}, {"tx_end", "", ""}},
+		},
+		{
+			name: "revert",
+			code: revertCode,
+			want: [][]string{{"tx_start", "", ""}, {"step", "2", "PUSH1"}, {"step", "4", "REVERT"}, {"fault", "4", "REVERT"}, {"tx_end", "", ""}},
+		},
+		{
+			name: "underflow",
+			code: []byte{byte(vm.JUMPDEST), byte(vm.POP)},
+			want: [][]string{{"tx_start", "", ""}, {"fault", "1", "POP"}, {"tx_end", "", ""}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := runTestTracer(t, newTestTracer(t, "memoryTransactionTracer", `{"resolution": 1}`), test.code, nil)
+			if err != nil {
+				t.Fatalf("failed to retrieve trace result: %v", err)
+			}
+			rows := readTimingRows(t, res)
+			if rows[0][20] != "phaseList" {
+				t.Fatalf("phaseList column missing from header %v", rows[0])
+			}
+			var have [][]string
+			for _, row := range rows[1:] {
+				have = append(have, []string{row[20], row[18], row[19]})
+			}
+			if !reflect.DeepEqual(have, test.want) {
+				t.Errorf("sample phases mismatch: have %v, want %v", have, test.want)
+			}
+		})
+	}
+}
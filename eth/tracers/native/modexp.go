@@ -0,0 +1,231 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math/big"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	tracers.DefaultDirectory.Register("modexpTracer", newModexpTracer, false)
+}
+
+// modexpAddress is the address of the MODEXP precompile.
+var modexpAddress = common.BytesToAddress([]byte{5})
+
+// modexpColumns are the columns of the modexp tracer's CSV output. The
+// declared lengths are taken verbatim from the input and may exceed 64 bits.
+var modexpColumns = []tracers.ColumnInfo{
+	{Name: "baseLen", Type: columnInt, Unit: "bytes"},
+	{Name: "expLen", Type: columnInt, Unit: "bytes"},
+	{Name: "modLen", Type: columnInt, Unit: "bytes"},
+	{Name: "gas", Type: columnInt, Unit: "gas"},
+	{Name: "time", Type: columnInt, Unit: "ns"},
+}
+
+// modexpCall is a single invocation of the MODEXP precompile.
+type modexpCall struct {
+	baseLen, expLen, modLen *big.Int
+	gas                     uint64
+	time                    int64
+}
+
+// modexpResult is the result of the modexpTracer.
+type modexpResult struct {
+	Invocations int     `json:"invocations"` // Number of MODEXP invocations
+	NsPerGas    float64 `json:"nsPerGas"`    // Least squares fit of the time over the gas charged, through the origin
+	CSV         string  `json:"csv"`         // Per-invocation table
+}
+
+// modexpTracer records the declared operand lengths of every MODEXP precompile
+// invocation next to the gas it was charged and the time it took, for
+// validating the precompile's pricing formula.
+type modexpTracer struct {
+	noopTracer
+	activePrecompiles []common.Address // Updated on CaptureStart based on given rules
+	calls             []modexpCall
+	pending           *modexpCall // Invocation in progress, precompiles never nest
+	start             time.Time
+
+	interrupt atomic.Bool // Atomic flag to signal execution interruption
+	reason    error       // Textual reason for the interruption
+}
+
+// newModexpTracer returns a new modexp tracer.
+func newModexpTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+	return &modexpTracer{}, nil
+}
+
+// modexpLengths parses the base, exponent and modulus lengths prefixing a
+// MODEXP input. Missing bytes of a short input are read as zero, like the
+// precompile does.
+func modexpLengths(input []byte) (baseLen, expLen, modLen *big.Int) {
+	word := func(i int) *big.Int {
+		var buf [32]byte
+		if start := i * 32; start < len(input) {
+			copy(buf[:], input[start:])
+		}
+		return new(big.Int).SetBytes(buf[:])
+	}
+	return word(0), word(1), word(2)
+}
+
+// isModexp returns whether addr is the MODEXP precompile under the active rules.
+func (t *modexpTracer) isModexp(addr common.Address) bool {
+	if addr != modexpAddress {
+		return false
+	}
+	for _, p := range t.activePrecompiles {
+		if p == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// enter starts timing an invocation if the callee is the MODEXP precompile.
+func (t *modexpTracer) enter(to common.Address, input []byte) {
+	if t.interrupt.Load() || !t.isModexp(to) {
+		return
+	}
+	baseLen, expLen, modLen := modexpLengths(input)
+	t.pending = &modexpCall{baseLen: baseLen, expLen: expLen, modLen: modLen}
+	t.start = time.Now()
+}
+
+// exit completes the invocation in progress, if any.
+func (t *modexpTracer) exit(gasUsed uint64) {
+	if t.pending == nil {
+		return
+	}
+	t.pending.time = time.Since(t.start).Nanoseconds()
+	t.pending.gas = gasUsed
+	t.calls = append(t.calls, *t.pending)
+	t.pending = nil
+}
+
+// CaptureStart implements the EVMLogger interface to initialize the tracing operation.
+func (t *modexpTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	// Update list of precompiles based on current block
+	rules := env.ChainConfig().Rules(env.Context.BlockNumber, env.Context.Random != nil, env.Context.Time)
+	t.activePrecompiles = vm.ActivePrecompiles(rules)
+	if !create {
+		t.enter(to, input)
+	}
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *modexpTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	t.exit(gasUsed)
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *modexpTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	switch typ {
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+		t.enter(to, input)
+	}
+}
+
+// CaptureExit is called when EVM exits a scope, even if the scope didn't
+// execute any code.
+func (t *modexpTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	t.exit(gasUsed)
+}
+
+// Columns implements tracers.ColumnTracer, returning the CSV columns.
+func (t *modexpTracer) Columns() []tracers.ColumnInfo {
+	return modexpColumns
+}
+
+// nsPerGas fits the time of the invocations as proportional to their gas.
+func (t *modexpTracer) nsPerGas() float64 {
+	var gt, gg float64
+	for _, call := range t.calls {
+		g := float64(call.gas)
+		gt += g * float64(call.time)
+		gg += g * g
+	}
+	if gg == 0 {
+		return 0
+	}
+	return gt / gg
+}
+
+// GetResult returns the per-invocation table and the fitted summary.
+func (t *modexpTracer) GetResult() (json.RawMessage, error) {
+	buf := new(bytes.Buffer)
+	if err := writeModexpCSV(buf, t.calls); err != nil {
+		return nil, err
+	}
+	res, err := json.Marshal(modexpResult{
+		Invocations: len(t.calls),
+		NsPerGas:    t.nsPerGas(),
+		CSV:         buf.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, t.stopReason()
+}
+
+// writeModexpCSV writes the invocations as CSV into out.
+func writeModexpCSV(out io.Writer, calls []modexpCall) error {
+	w := csv.NewWriter(out)
+	if err := w.Write(columnNames(modexpColumns)); err != nil {
+		return err
+	}
+	for _, call := range calls {
+		row := []string{
+			call.baseLen.String(),
+			call.expLen.String(),
+			call.modLen.String(),
+			strconv.FormatUint(call.gas, 10),
+			strconv.FormatInt(call.time, 10),
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *modexpTracer) Stop(err error) {
+	t.reason = err
+	t.interrupt.Store(true)
+}
+
+// stopReason returns the reason tracing was interrupted, if it was.
+func (t *modexpTracer) stopReason() error {
+	if !t.interrupt.Load() {
+		return nil
+	}
+	return t.reason
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+func TestModexpLengths(t *testing.T) {
+	huge := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	tests := []struct {
+		input                   []byte
+		baseLen, expLen, modLen *big.Int
+	}{
+		// Empty input, all lengths zero
+		{nil, big.NewInt(0), big.NewInt(0), big.NewInt(0)},
+		// Truncated first word, the missing bytes are zero
+		{[]byte{0, 0, 1}, new(big.Int).Lsh(big.NewInt(1), 29*8), big.NewInt(0), big.NewInt(0)},
+		// Regular prefix followed by operands
+		{
+			append(common.FromHex("0x"+strings.Repeat("00", 31)+"01"+strings.Repeat("00", 31)+"02"+strings.Repeat("00", 31)+"03"), 1, 2, 3),
+			big.NewInt(1), big.NewInt(2), big.NewInt(3),
+		},
+		// Declared lengths far beyond any input
+		{
+			common.FromHex("0x" + strings.Repeat("ff", 96)),
+			huge, huge, huge,
+		},
+	}
+	for i, tt := range tests {
+		baseLen, expLen, modLen := modexpLengths(tt.input)
+		if baseLen.Cmp(tt.baseLen) != 0 || expLen.Cmp(tt.expLen) != 0 || modLen.Cmp(tt.modLen) != 0 {
+			t.Errorf("test %d: lengths mismatch: have %v/%v/%v, want %v/%v/%v", i, baseLen, expLen, modLen, tt.baseLen, tt.expLen, tt.modLen)
+		}
+	}
+}
+
+// Tests that the modexp tracer records every invocation of the precompile
+// with the gas it was charged.
+func TestModexpTracer(t *testing.T) {
+	code := []byte{
+		// Lengths of a 1 byte base, exponent and modulus, then the operands
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.MSTORE),
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 32, byte(vm.MSTORE),
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 64, byte(vm.MSTORE),
+		byte(vm.PUSH1), 3, byte(vm.PUSH1), 96, byte(vm.MSTORE8),
+		byte(vm.PUSH1), 5, byte(vm.PUSH1), 97, byte(vm.MSTORE8),
+		byte(vm.PUSH1), 7, byte(vm.PUSH1), 98, byte(vm.MSTORE8),
+		byte(vm.PUSH1), 1, // retSize
+		byte(vm.PUSH1), 128, // retOffset
+		byte(vm.PUSH1), 99, // argsSize
+		byte(vm.PUSH1), 0, // argsOffset
+		byte(vm.PUSH1), 5, // address
+		byte(vm.GAS), byte(vm.STATICCALL), byte(vm.POP),
+	}
+	code = append(code, callCode(modexpAddress)...)
+
+	res, err := runTestTracer(t, newTestTracer(t, "modexpTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result modexpResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	if result.Invocations != 2 {
+		t.Fatalf("invocation count mismatch: have %d, want 2", result.Invocations)
+	}
+	rows, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	want := [][]string{{"1", "1", "1", "200"}, {"0", "0", "0", "200"}}
+	for i, row := range rows[1:] {
+		if strings.Join(row[:4], ",") != strings.Join(want[i], ",") {
+			t.Errorf("row %d mismatch: have %v, want %v", i, row[:4], want[i])
+		}
+	}
+	if result.NsPerGas < 0 {
+		t.Errorf("invalid fit: %v", result.NsPerGas)
+	}
+}
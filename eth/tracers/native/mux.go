@@ -17,8 +17,11 @@
 package native
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"math/big"
+	"strconv"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
@@ -34,6 +37,19 @@ func init() {
 type muxTracer struct {
 	names   []string
 	tracers []tracers.Tracer
+	frames  bool // Whether callTracer frames should be annotated with frame ids
+}
+
+// frameNumberer is implemented by tracers whose output refers to call frames
+// by their number in order of entry, the top-level call being frame 0. If any
+// such tracer runs in a muxTracer, the frames emitted by the callTracer are
+// annotated with the same numbers so that the outputs can be joined.
+//
+// Only the timingTracer numbers the frames of its rows. The rows of the
+// cycleTracer carry the call depth alone and those of the perfTracer no call
+// context at all, so neither can be joined with the callTracer frames.
+type frameNumberer interface {
+	numbersFrames()
 }
 
 // newMuxTracer returns a new mux tracer.
@@ -46,16 +62,20 @@ func newMuxTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, er
 	}
 	objects := make([]tracers.Tracer, 0, len(config))
 	names := make([]string, 0, len(config))
+	frames := false
 	for k, v := range config {
 		t, err := tracers.DefaultDirectory.New(k, ctx, v)
 		if err != nil {
 			return nil, err
 		}
+		if _, ok := t.(frameNumberer); ok {
+			frames = true
+		}
 		objects = append(objects, t)
 		names = append(names, k)
 	}
 
-	return &muxTracer{names: names, tracers: objects}, nil
+	return &muxTracer{names: names, tracers: objects, frames: frames}, nil
 }
 
 // CaptureStart implements the EVMLogger interface to initialize the tracing operation.
@@ -121,6 +141,11 @@ func (t *muxTracer) GetResult() (json.RawMessage, error) {
 		if err != nil {
 			return nil, err
 		}
+		if t.frames && t.names[i] == "callTracer" {
+			if r, err = annotateFrameIds(r); err != nil {
+				return nil, err
+			}
+		}
 		resObject[t.names[i]] = r
 	}
 	res, err := json.Marshal(resObject)
@@ -136,3 +161,77 @@ func (t *muxTracer) Stop(err error) {
 		t.Stop(err)
 	}
 }
+
+// annotateFrameIds adds a frameId field to every frame of a callTracer result,
+// numbering them in order of entry. The callTracer lists the subcalls of each
+// frame in the order they were made, so a pre-order walk of the call tree
+// reproduces the order in which the EVM entered the frames.
+func annotateFrameIds(res json.RawMessage) (json.RawMessage, error) {
+	var next int
+	return annotateFrame(res, &next)
+}
+
+// annotateFrame numbers the given frame and recursively all its subcalls. The
+// frameId is spliced in as the first field of the raw object, leaving the
+// fields of the callTracer in their order.
+func annotateFrame(raw json.RawMessage, next *int) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, errors.New("call frame is not an object")
+	}
+	var (
+		open  = dec.InputOffset() // End of the opening brace
+		empty = !dec.More()
+
+		calls                json.RawMessage
+		callsStart, callsEnd int64 // Span of the calls value, including the colon
+	)
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		start := dec.InputOffset()
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if key == "calls" {
+			calls, callsStart, callsEnd = value, start, dec.InputOffset()
+		}
+	}
+	out := make([]byte, 0, len(raw)+16)
+	out = append(out, raw[:open]...)
+	out = append(out, `"frameId":`...)
+	out = strconv.AppendInt(out, int64(*next), 10)
+	if !empty {
+		out = append(out, ',')
+	}
+	*next++
+
+	if calls == nil {
+		return append(out, raw[open:]...), nil
+	}
+	var subcalls []json.RawMessage
+	if err := json.Unmarshal(calls, &subcalls); err != nil {
+		return nil, err
+	}
+	out = append(out, raw[open:callsStart]...)
+	out = append(out, ":["...)
+	for i, call := range subcalls {
+		annotated, err := annotateFrame(call, next)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			out = append(out, ',')
+		}
+		out = append(out, annotated...)
+	}
+	out = append(out, ']')
+	return append(out, raw[callsEnd:]...), nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Tests that running the timingTracer next to the callTracer annotates the
+// call tree with frame ids matching the frame column of the timing rows, for
+// nested and reverting calls.
+func TestMuxFrameIds(t *testing.T) {
+	var (
+		b = common.HexToAddress("0xb")
+		c = common.HexToAddress("0xc")
+	)
+	// The entry contract calls b, which calls the reverting c, then calls c
+	// directly: frames are 0 (entry), 1 (b), 2 (c via b) and 3 (c).
+	code := append(callCode(b), callCode(c)...)
+	code = append(code, byte(vm.STOP))
+	contracts := map[common.Address][]byte{
+		b: append(callCode(c), byte(vm.STOP)),
+		c: revertCode,
+	}
+	tracer := newTestTracer(t, "muxTracer", `{"callTracer": {}, "timingTracer": {}}`)
+	res, err := runTestTracer(t, tracer, code, contracts)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var results struct {
+		CallTracer   json.RawMessage `json:"callTracer"`
+		TimingTracer string          `json:"timingTracer"`
+	}
+	if err := json.Unmarshal(res, &results); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	// Collect the frame ids assigned to the call tree in pre-order
+	type frame struct {
+		FrameId *int           `json:"frameId"`
+		To      common.Address `json:"to"`
+		Error   string         `json:"error"`
+		Calls   []frame        `json:"calls"`
+	}
+	var (
+		root   frame
+		walk   func(f frame)
+		ids    []int
+		callee = make(map[int]common.Address)
+	)
+	if err := json.Unmarshal(results.CallTracer, &root); err != nil {
+		t.Fatalf("failed to unmarshal call trace: %v", err)
+	}
+	walk = func(f frame) {
+		if f.FrameId == nil {
+			t.Fatalf("frame to %x missing frameId", f.To)
+		}
+		ids = append(ids, *f.FrameId)
+		callee[*f.FrameId] = f.To
+		for _, call := range f.Calls {
+			walk(call)
+		}
+	}
+	walk(root)
+	if len(ids) != 4 {
+		t.Fatalf("frame count mismatch: have %d, want 4", len(ids))
+	}
+	for i, id := range ids {
+		if id != i {
+			t.Fatalf("frame %d numbered %d", i, id)
+		}
+	}
+	if callee[1] != b || callee[2] != c || callee[3] != c {
+		t.Fatalf("frames attributed to wrong callees: %v", callee)
+	}
+	if root.Calls[0].Calls[0].Error == "" || root.Calls[1].Error == "" {
+		t.Fatalf("reverting frames not marked as failed")
+	}
+	// Every frame executed code, so every frame must show up in the timing rows,
+	// and the REVERT opcodes must be attributed to the frames of c
+	rows, err := csv.NewReader(strings.NewReader(results.TimingTracer)).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse timing rows: %v", err)
+	}
+	var (
+		column  = indexOf(rows[0], "frame")
+		seen    = make(map[int]bool)
+		reverts []int
+	)
+	for _, row := range rows[1:] {
+		id, err := strconv.Atoi(row[column])
+		if err != nil {
+			t.Fatalf("invalid frame id %q: %v", row[column], err)
+		}
+		seen[id] = true
+		if row[0] == vm.REVERT.String() {
+			reverts = append(reverts, id)
+		}
+	}
+	if len(seen) != 4 {
+		t.Fatalf("timing rows cover %d frames, want 4", len(seen))
+	}
+	if len(reverts) != 2 || reverts[0] != 2 || reverts[1] != 3 {
+		t.Fatalf("reverts attributed to frames %v, want [2 3]", reverts)
+	}
+}
+
+// Tests that frame ids are spliced into the callTracer frames in pre-order,
+// keeping the fields of each frame in the order the callTracer emitted them.
+func TestAnnotateFrameIds(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`{}`, `{"frameId":0}`},
+		{
+			`{"type":"CALL","to":"0x1"}`,
+			`{"frameId":0,"type":"CALL","to":"0x1"}`,
+		},
+		{
+			`{"type":"CALL","to":"0x1","calls":[{"type":"CALL","to":"0x2","calls":[{"type":"CREATE"}]},{"type":"STATICCALL","to":"0x3"}],"value":"0x0"}`,
+			`{"frameId":0,"type":"CALL","to":"0x1","calls":[{"frameId":1,"type":"CALL","to":"0x2","calls":[{"frameId":2,"type":"CREATE"}]},{"frameId":3,"type":"STATICCALL","to":"0x3"}],"value":"0x0"}`,
+		},
+	}
+	for i, tt := range tests {
+		have, err := annotateFrameIds(json.RawMessage(tt.in))
+		if err != nil {
+			t.Fatalf("test %d: failed to annotate frames: %v", i, err)
+		}
+		if string(have) != tt.want {
+			t.Errorf("test %d: annotation mismatch:\nhave %s\nwant %s", i, have, tt.want)
+		}
+	}
+}
+
+// indexOf returns the position of a column in a header row, or -1.
+func indexOf(header []string, column string) int {
+	for i, name := range header {
+		if name == column {
+			return i
+		}
+	}
+	return -1
+}
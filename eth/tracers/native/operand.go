@@ -0,0 +1,259 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math/big"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	tracers.DefaultDirectory.Register("operandTracer", newOperandTracer, false)
+}
+
+// operandClasses is the number of operand bit-length classes, each spanning
+// 64 bits: ≤64, ≤128, ≤192 and ≤256.
+const operandClasses = 4
+
+// arithmeticOperands maps the arithmetic opcodes to the number of stack
+// operands they consume.
+var arithmeticOperands = map[vm.OpCode]int{
+	vm.ADD:        2,
+	vm.MUL:        2,
+	vm.SUB:        2,
+	vm.DIV:        2,
+	vm.SDIV:       2,
+	vm.MOD:        2,
+	vm.SMOD:       2,
+	vm.ADDMOD:     3,
+	vm.MULMOD:     3,
+	vm.EXP:        2,
+	vm.SIGNEXTEND: 2,
+}
+
+// operandColumns are the columns of the operand tracer's CSV output, without
+// the latency column added with timing.
+var operandColumns = []tracers.ColumnInfo{
+	{Name: "opcode", Type: columnString},
+	{Name: "bits", Type: columnInt, Unit: "bits"},
+	{Name: "steps", Type: columnInt},
+	{Name: "operands", Type: columnInt},
+}
+
+// operandLatencyColumn is the column of the mean step latency.
+var operandLatencyColumn = tracers.ColumnInfo{Name: "meanTime", Type: columnInt, Unit: "ns"}
+
+type operandTracerConfig struct {
+	Timing bool `json:"timing"` // If true, the mean latency of the steps is reported per class
+}
+
+// operandStats is the distribution of the operand sizes of an opcode.
+type operandStats struct {
+	steps    [operandClasses]int   // Steps by the class of their widest operand
+	operands [operandClasses]int   // Operands by their own class
+	time     [operandClasses]int64 // Summed step latency by the class of the widest operand
+}
+
+// operandTracer records the bit lengths of the operands of the arithmetic
+// opcodes, whose flat gas prices ignore that most values fit in 64 bits. For
+// every opcode and bit-length class, it reports how many steps had their
+// widest operand in that class and how many operands fell into it.
+type operandTracer struct {
+	noopTracer
+	config  operandTracerConfig
+	stats   map[vm.OpCode]*operandStats
+	pending *operandStats // Stats to charge the latency of the last step to, if timed
+	class   int           // Operand class of the last step
+	start   time.Time     // Start of the last step
+
+	interrupt atomic.Bool // Atomic flag to signal execution interruption
+	reason    error       // Textual reason for the interruption
+}
+
+// newOperandTracer returns a new operand tracer.
+func newOperandTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
+	var config operandTracerConfig
+	if cfg != nil {
+		if err := json.Unmarshal(cfg, &config); err != nil {
+			return nil, err
+		}
+	}
+	return &operandTracer{
+		config: config,
+		stats:  make(map[vm.OpCode]*operandStats),
+	}, nil
+}
+
+// operandClass returns the bit-length class of a value, zero counting as the
+// narrowest.
+func operandClass(bits int) int {
+	if bits == 0 {
+		return 0
+	}
+	return (bits - 1) / 64
+}
+
+// CaptureState implements the EVMLogger interface to trace a single step of VM execution.
+func (t *operandTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	t.settle()
+	if err != nil || t.interrupt.Load() {
+		return
+	}
+	n, ok := arithmeticOperands[op]
+	if !ok {
+		return
+	}
+	// The stack is only peeked, it is validated before the step is captured
+	// but a malformed one mustn't crash the tracer either
+	stack := scope.Stack.Data()
+	if len(stack) < n {
+		return
+	}
+	stats := t.stats[op]
+	if stats == nil {
+		stats = new(operandStats)
+		t.stats[op] = stats
+	}
+	widest := 0
+	for _, operand := range stack[len(stack)-n:] {
+		class := operandClass(operand.BitLen())
+		stats.operands[class]++
+		if class > widest {
+			widest = class
+		}
+	}
+	stats.steps[widest]++
+
+	if t.config.Timing {
+		t.pending, t.class = stats, widest
+		t.start = time.Now()
+	}
+}
+
+// settle charges the time since the last timed step to its stats. A step ends
+// when the next one is captured or the current call frame is left.
+func (t *operandTracer) settle() {
+	if t.pending == nil {
+		return
+	}
+	t.pending.time[t.class] += time.Since(t.start).Nanoseconds()
+	t.pending = nil
+}
+
+// CaptureFault implements the EVMLogger interface to trace an execution fault.
+func (t *operandTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
+	t.settle()
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *operandTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	t.settle()
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *operandTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	t.settle()
+}
+
+// CaptureExit is called when EVM exits a scope, even if the scope didn't
+// execute any code.
+func (t *operandTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	t.settle()
+}
+
+// Columns implements tracers.ColumnTracer, returning the CSV columns.
+func (t *operandTracer) Columns() []tracers.ColumnInfo {
+	if !t.config.Timing {
+		return operandColumns
+	}
+	return append(append([]tracers.ColumnInfo{}, operandColumns...), operandLatencyColumn)
+}
+
+// GetResult returns the operand size distributions as CSV, one row per opcode
+// and bit-length class that was seen.
+func (t *operandTracer) GetResult() (json.RawMessage, error) {
+	buf := new(bytes.Buffer)
+	if err := t.writeCSV(buf); err != nil {
+		return nil, err
+	}
+	res, err := marshalTableResult(nil, buf.String())
+	if err != nil {
+		return nil, err
+	}
+	return res, t.stopReason()
+}
+
+// writeCSV writes the distributions as CSV into out, ordered by opcode.
+func (t *operandTracer) writeCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	if err := w.Write(columnNames(t.Columns())); err != nil {
+		return err
+	}
+	for op := 0; op < 256; op++ {
+		stats := t.stats[vm.OpCode(op)]
+		if stats == nil {
+			continue
+		}
+		for class := 0; class < operandClasses; class++ {
+			if stats.steps[class] == 0 && stats.operands[class] == 0 {
+				continue
+			}
+			row := []string{
+				opcodeName(vm.OpCode(op)),
+				strconv.Itoa((class + 1) * 64),
+				strconv.Itoa(stats.steps[class]),
+				strconv.Itoa(stats.operands[class]),
+			}
+			if t.config.Timing {
+				var mean int64
+				if stats.steps[class] > 0 {
+					mean = stats.time[class] / int64(stats.steps[class])
+				}
+				row = append(row, strconv.FormatInt(mean, 10))
+			}
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *operandTracer) Stop(err error) {
+	t.reason = err
+	t.interrupt.Store(true)
+}
+
+// stopReason returns the reason tracing was interrupted, if it was.
+func (t *operandTracer) stopReason() error {
+	if !t.interrupt.Load() {
+		return nil
+	}
+	return t.reason
+}
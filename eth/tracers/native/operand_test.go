@@ -0,0 +1,93 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Tests that the operand tracer classifies the operands of arithmetic steps
+// by their bit length.
+func TestOperandTracer(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP),
+		byte(vm.PUSH1), 3, byte(vm.PUSH9), 1, 0, 0, 0, 0, 0, 0, 0, 0, byte(vm.MUL), byte(vm.POP),
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.NOT), byte(vm.PUSH1), 0, byte(vm.ADDMOD), byte(vm.POP),
+		byte(vm.STOP),
+	}
+	for _, timing := range []bool{false, true} {
+		cfg := `{"timing": false}`
+		if timing {
+			cfg = `{"timing": true}`
+		}
+		res, err := runTestTracer(t, newTestTracer(t, "operandTracer", cfg), code, nil)
+		if err != nil {
+			t.Fatalf("failed to retrieve trace result: %v", err)
+		}
+		var out string
+		if err := json.Unmarshal(res, &out); err != nil {
+			t.Fatalf("failed to unmarshal result: %v", err)
+		}
+		rows, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+		if err != nil {
+			t.Fatalf("invalid CSV: %v", err)
+		}
+		want := [][]string{
+			{"ADD", "64", "1", "2"},
+			{"MUL", "64", "0", "1"},
+			{"MUL", "128", "1", "1"},
+			{"ADDMOD", "64", "0", "2"},
+			{"ADDMOD", "256", "1", "1"},
+		}
+		for i, row := range rows[1:] {
+			if timing {
+				if len(row) != 5 || row[4] == "" {
+					t.Fatalf("timing %v: missing latency in row %v", timing, row)
+				}
+				row = row[:4]
+			}
+			rows[i+1] = row
+		}
+		if !reflect.DeepEqual(rows[1:], want) {
+			t.Fatalf("timing %v: rows mismatch: have %v, want %v", timing, rows[1:], want)
+		}
+	}
+}
+
+// Tests that the operand tracer skips steps without enough stack operands.
+func TestOperandTracerShortStack(t *testing.T) {
+	tracer := newTestTracer(t, "operandTracer", "")
+	tracer.CaptureState(0, vm.ADD, 0, 3, &vm.ScopeContext{Stack: new(vm.Stack)}, nil, 1, nil)
+
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var out string
+	if err := json.Unmarshal(res, &out); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	if out != "opcode,bits,steps,operands\n" {
+		t.Fatalf("unexpected rows: %q", out)
+	}
+}
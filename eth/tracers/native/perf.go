@@ -0,0 +1,358 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	tracers.DefaultDirectory.Register("perfTracer", newPerfTracer, false)
+}
+
+// eventCounter counts CPU events, like the cycles, between start and stop. The
+// counter is opened once on the tracing thread and reused for every
+// measurement until closed.
+type eventCounter interface {
+	open() error
+	start() error
+	stop(counts []uint64) error // Fills in the count of every event
+	close() error
+	dropped() []int                   // Indices of the events the kernel refused to count when opened
+	times() (enabled, running uint64) // Times the counter was enabled and counting since opened
+}
+
+var (
+	// errCounterNotRunning is returned when stopping a measurement that
+	// failed to start.
+	errCounterNotRunning = errors.New("cycle counter not running")
+
+	// errCounterClosed is returned when starting a measurement on a counter
+	// that isn't open.
+	errCounterClosed = errors.New("cycle counter closed")
+)
+
+// perfTracer records both the time and the CPU cycles of every step in a
+// single pass, so that the two can be related per row. It measures the time
+// like the timingTracer and the cycles like the cycleTracer. Where cycles
+// can't be counted, the cycles column is left empty.
+type perfTracer struct {
+	timingClock               // Source of the step times
+	samples      []perfSample // Recorded steps, the last one's cost is settled by the next step
+	counter      eventCounter // Counter of the CPU cycles, nil if unsupported
+	cycles       [1]uint64    // Buffer for the counted cycles
+	measuring    bool         // Whether the last step's time and cycles are being measured
+	start        int          // Clock reading when the last step started
+	recorded     bool         // Whether the last step was recorded, its cost is settled by the next one
+	remainingGas int
+	startGas     int // Gas the top call started with
+	budget       *traceBudget
+	checkpoint   *checkpointer // Sink the rows are flushed to in batches, nil to keep all in memory
+	interrupt    atomic.Bool   // Atomic flag to signal execution interruption
+	reason       error         // Textual reason for the interruption
+}
+
+type perfTracerConfig struct {
+	BudgetMs          int    `json:"budgetMs"`          // If non-zero, steps are no longer traced after this many milliseconds
+	CheckpointSamples int    `json:"checkpointSamples"` // If non-zero, rows are flushed to a file in batches of this size
+	CheckpointFile    string `json:"checkpointFile"`    // File within the tracer output directory to flush the rows to, a temp file if empty
+	Clock             string `json:"clock"`             // Timestamp source, clockMonotonic (default), clockTSC or clockCPU
+}
+
+// perfColumns are the columns of the perf tracer's CSV output.
+var perfColumns = []tracers.ColumnInfo{
+	{Name: "opcodes", Type: columnString},
+	{Name: "pc", Type: columnInt},
+	{Name: "time", Type: columnInt, Unit: "ns"},
+	{Name: "cycles", Type: columnInt, Unit: "cycles"},
+	{Name: "cost", Type: columnInt, Unit: "gas"},
+}
+
+// perfSample is a single recorded step.
+type perfSample struct {
+	pc      uint64 // Program counter of the step
+	time    int    // Time the step took, in the unit of the tracer's clock
+	cycles  int    // CPU cycles the step took
+	cost    int    // Gas charged for the step
+	op      vm.OpCode
+	counted bool // Whether the cycles were counted
+}
+
+// newPerfTracer returns a tracer recording the time and CPU cycles of every
+// step.
+func newPerfTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
+	var config perfTracerConfig
+	if cfg != nil {
+		if err := json.Unmarshal(cfg, &config); err != nil {
+			return nil, err
+		}
+	}
+	budget, err := newTraceBudget(config.BudgetMs)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, err := newCheckpointer("perfTracer", config.CheckpointSamples, config.CheckpointFile, perfColumns)
+	if err != nil {
+		return nil, err
+	}
+	clock, err := newTimingClock(config.Clock)
+	if err != nil {
+		return nil, err
+	}
+	return &perfTracer{
+		timingClock: clock,
+		counter:     newCycleCounter(),
+		budget:      budget,
+		checkpoint:  checkpoint,
+	}, nil
+}
+
+// CaptureStart implements the EVMLogger interface to initialize the tracing operation.
+func (t *perfTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	// Both the perf event and the thread's CPU time only measure the thread
+	// they were started on
+	runtime.LockOSThread()
+	t.startGas = int(gas)
+	if t.counter != nil {
+		t.counter.open() // A failure leaves the cycles of all steps empty
+	}
+	t.budget.start()
+	if t.checkpoint != nil {
+		t.checkpoint.open()
+	}
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *perfTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	t.settle()
+
+	// Charge the last step up to the gas the call returns, unless it was not
+	// recorded or its cost was settled on expiry. The gas left at the end of
+	// the transaction includes the refund, so it can't be used.
+	if t.recorded {
+		t.samples[len(t.samples)-1].cost = t.remainingGas - (t.startGas - int(gasUsed))
+		t.recorded = false
+	}
+	runtime.UnlockOSThread()
+}
+
+// CaptureState implements the EVMLogger interface to trace a single step of VM execution.
+func (t *perfTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if t.budget.exceeded || t.interrupt.Load() {
+		return
+	}
+	t.settle()
+	if t.recorded {
+		t.samples[len(t.samples)-1].cost = t.remainingGas - int(gas)
+	}
+	t.remainingGas = int(gas)
+	t.recorded = false
+
+	// The cost of the previous step is known now, so stop here if out of budget
+	if !t.budget.step() {
+		return
+	}
+	t.samples = append(t.samples, perfSample{op: op, pc: pc})
+	t.recorded = true
+	if t.checkpoint.due(len(t.samples) - 1) {
+		t.flushRows(len(t.samples) - 1)
+	}
+	t.measure()
+}
+
+// measure starts measuring the last recorded step. The counter is started
+// before the clock is read, keeping its overhead out of the step time.
+func (t *perfTracer) measure() {
+	if t.counter != nil {
+		t.counter.start() // A failure leaves the cycles of the step empty
+	}
+	t.measuring = true
+	t.start = t.now()
+}
+
+// settle completes the time and cycles of the last recorded step, if being
+// measured.
+func (t *perfTracer) settle() {
+	if !t.measuring {
+		return
+	}
+	t.measuring = false
+
+	now := t.now()
+	sample := &t.samples[len(t.samples)-1]
+	sample.time = now - t.start
+	if t.counter != nil {
+		if err := t.counter.stop(t.cycles[:]); err == nil {
+			sample.cycles, sample.counted = int(t.cycles[0]), true
+		}
+	}
+}
+
+// flushRows checkpoints the first n rows, which must be settled, and releases
+// them from memory.
+func (t *perfTracer) flushRows(n int) {
+	for i := range t.samples[:n] {
+		sample := &t.samples[i]
+		t.checkpoint.write(t.row(sample))
+		t.checkpoint.observe(2, int64(t.nanos(sample.time)))
+		if sample.counted {
+			t.checkpoint.observe(3, int64(sample.cycles))
+		}
+		t.checkpoint.observe(4, int64(sample.cost))
+	}
+	t.checkpoint.commit()
+
+	t.samples = t.samples[:copy(t.samples, t.samples[n:])]
+}
+
+// Columns implements tracers.ColumnTracer, returning the CSV columns.
+func (t *perfTracer) Columns() []tracers.ColumnInfo {
+	return perfColumns
+}
+
+// CaptureFault implements the EVMLogger interface to trace an execution fault.
+func (t *perfTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *perfTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+
+// CaptureExit is called when EVM exits a scope, even if the scope didn't
+// execute any code.
+func (t *perfTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (*perfTracer) CaptureTxStart(gasLimit uint64) {}
+
+func (t *perfTracer) CaptureTxEnd(restGas uint64) {
+	if t.counter != nil {
+		t.counter.close()
+	}
+	if t.checkpoint != nil {
+		t.flushRows(len(t.samples))
+		t.checkpoint.close()
+	}
+}
+
+// GetResult returns the recorded steps, or the data recorded up to the
+// interruption along with its reason if the tracer was stopped.
+func (t *perfTracer) GetResult() (json.RawMessage, error) {
+	meta := t.resultMeta()
+	if t.checkpoint != nil {
+		t.flushRows(len(t.samples))
+		return t.checkpoint.result(meta, t.stopReason())
+	}
+	buf := new(bytes.Buffer)
+	if err := t.writeCSV(buf); err != nil {
+		return nil, err
+	}
+	res, err := marshalTableResult(meta, buf.String())
+	if err != nil {
+		return nil, err
+	}
+	return res, t.stopReason()
+}
+
+// EncodeResult implements tracers.ResultEncoder, streaming the same result as
+// GetResult without building the CSV in memory.
+func (t *perfTracer) EncodeResult(w io.Writer) error {
+	if t.checkpoint != nil {
+		res, err := t.GetResult()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(res)
+		return err
+	}
+	if err := encodeTableResult(w, t.resultMeta(), t.writeCSV); err != nil {
+		return err
+	}
+	return t.stopReason()
+}
+
+// resultMeta returns the metadata reported alongside the CSV, if any.
+func (t *perfTracer) resultMeta() *tableMeta {
+	meta := newTableMeta(nil, t.budget)
+	if t.clock == "" {
+		return meta
+	}
+	if meta == nil {
+		meta = new(tableMeta)
+	}
+	t.annotate(meta)
+	return meta
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *perfTracer) Stop(err error) {
+	t.reason = err
+	t.interrupt.Store(true)
+	if t.counter != nil {
+		t.counter.close()
+	}
+}
+
+// stopReason returns the reason tracing was interrupted, if it was.
+func (t *perfTracer) stopReason() error {
+	if !t.interrupt.Load() {
+		return nil
+	}
+	return t.reason
+}
+
+// writeCSV writes the samples as CSV into out.
+func (t *perfTracer) writeCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	if err := w.Write(columnNames(perfColumns)); err != nil {
+		return err
+	}
+	for i := range t.samples {
+		if err := w.Write(t.row(&t.samples[i])); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// row formats a single step as a CSV row, the cycles empty if not counted.
+func (t *perfTracer) row(s *perfSample) []string {
+	var cycles string
+	if s.counted {
+		cycles = strconv.Itoa(s.cycles)
+	}
+	return []string{
+		opcodeName(s.op),
+		strconv.FormatUint(s.pc, 10),
+		strconv.Itoa(t.nanos(s.time)),
+		cycles,
+		strconv.Itoa(s.cost),
+	}
+}
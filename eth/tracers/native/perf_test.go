@@ -0,0 +1,124 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// stubEventCounter is an eventCounter reporting fixed counts without touching
+// the perf subsystem, isolating the tracer's own overhead in benchmarks. The
+// i-th event counts 100*(i+1).
+type stubEventCounter struct{}
+
+func (stubEventCounter) open() error                      { return nil }
+func (stubEventCounter) start() error                     { return nil }
+func (stubEventCounter) close() error                     { return nil }
+func (stubEventCounter) dropped() []int                   { return nil }
+func (stubEventCounter) times() (enabled, running uint64) { return 0, 0 }
+
+func (stubEventCounter) stop(counts []uint64) error {
+	for i := range counts {
+		counts[i] = 100 * uint64(i+1)
+	}
+	return nil
+}
+
+// newStubPerfTracer creates a perfTracer counting cycles with the given
+// counter, nil to leave the cycles uncounted.
+func newStubPerfTracer(t testing.TB, counter eventCounter) *perfTracer {
+	tracer := newTestTracer(t, "perfTracer", "").(*perfTracer)
+	tracer.counter = counter
+	return tracer
+}
+
+func TestPerfTracerCaptureStateAllocs(t *testing.T) {
+	testCaptureStateAllocs(t, newStubPerfTracer(t, stubEventCounter{}))
+}
+
+func BenchmarkPerfTracerCaptureState(b *testing.B) {
+	benchmarkCaptureState(b, newStubPerfTracer(b, stubEventCounter{}))
+}
+
+func TestPerfTracerColumnsMatchHeader(t *testing.T) {
+	testColumnsMatchHeader(t, newStubPerfTracer(t, stubEventCounter{}))
+}
+
+// Tests that every row carries both the time and the cycles of its step, the
+// cycles being empty where they can't be counted.
+func TestPerfTracer(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	for _, tt := range []struct {
+		counter eventCounter
+		cycles  string
+	}{
+		{stubEventCounter{}, "100"},
+		{nil, ""},
+	} {
+		res, err := runTestTracer(t, newStubPerfTracer(t, tt.counter), code, nil)
+		if err != nil {
+			t.Fatalf("failed to retrieve trace result: %v", err)
+		}
+		rows := readTimingRows(t, res)
+		if len(rows) != 5 {
+			t.Fatalf("row count mismatch: have %d, want 5", len(rows))
+		}
+		for i, row := range rows[1:] {
+			if want := []string{"PUSH1", "PUSH1", "ADD", "STOP"}[i]; row[0] != want {
+				t.Errorf("row %d: opcode mismatch: have %s, want %s", i, row[0], want)
+			}
+			if want := []string{"0", "2", "4", "5"}[i]; row[1] != want {
+				t.Errorf("row %d: pc mismatch: have %s, want %s", i, row[1], want)
+			}
+			if ns, err := strconv.Atoi(row[2]); err != nil || ns < 0 {
+				t.Errorf("row %d: invalid time %q", i, row[2])
+			}
+			if row[3] != tt.cycles {
+				t.Errorf("row %d: cycles mismatch: have %q, want %q", i, row[3], tt.cycles)
+			}
+		}
+		if rows[1][4] != "3" || rows[3][4] != "3" {
+			t.Errorf("cost mismatch: have %v", rows[1:])
+		}
+	}
+	if _, err := newPerfTracer(nil, json.RawMessage(`{"clock": "sundial"}`)); err == nil {
+		t.Errorf("expected error for unknown clock")
+	}
+}
+
+// Tests that the last step isn't charged the refund of the transaction, which
+// is included in the gas left at its end.
+func TestPerfTracerRefund(t *testing.T) {
+	tracer := newStubPerfTracer(t, stubEventCounter{})
+	applyTestMessage(t, tracer, refundCode, refundStorage)
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var costs []string
+	for _, row := range readTimingRows(t, res)[1:] {
+		costs = append(costs, row[0]+"/"+row[4])
+	}
+	if want := []string{"PUSH1/3", "PUSH1/3", "SSTORE/5000", "STOP/0"}; !reflect.DeepEqual(costs, want) {
+		t.Fatalf("cost mismatch: have %v, want %v", costs, want)
+	}
+}
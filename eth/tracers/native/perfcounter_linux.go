@@ -0,0 +1,399 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package native
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/Olaburns/perf-utils"
+	"golang.org/x/sys/unix"
+)
+
+// perfEvent is a hardware or software event countable by the perf subsystem.
+type perfEvent struct {
+	name     string // Name of the event's column
+	typ      uint32 // Type of the event, one of the PERF_TYPE_* constants
+	config   uint64 // Event within its type
+	optional bool   // Whether the event is probed when configured and left out if unavailable
+}
+
+// hwCacheConfig encodes the config of a PERF_TYPE_HW_CACHE event from the
+// cache, the operation on it and its result.
+func hwCacheConfig(cache, op, result uint64) uint64 {
+	return cache | op<<8 | result<<16
+}
+
+var (
+	cyclesEvent       = perfEvent{name: "cycles", typ: unix.PERF_TYPE_HARDWARE, config: unix.PERF_COUNT_HW_CPU_CYCLES}
+	instructionsEvent = perfEvent{name: "instructions", typ: unix.PERF_TYPE_HARDWARE, config: unix.PERF_COUNT_HW_INSTRUCTIONS}
+)
+
+// perfEventGroup counts events of the thread it was opened on with a group
+// of perf events, whose leader is the first event opened. The group is
+// enabled, disabled and read as a whole, so that all counts cover the same
+// interval. It is reset and read for every measurement instead of being
+// reopened.
+//
+// Events the kernel refuses to count, for example for lack of hardware
+// counters, are left out of the group. If that is the first event, the next
+// one leads the group, so that software events are still counted where
+// hardware events are unavailable.
+//
+// If reading in user space, the group is mapped into memory and keeps counting
+// while open. The counters are then read with rdpmc instead of a system call,
+// and a measurement is the difference of the counts at start and stop. Where
+// the kernel doesn't permit it, for example for software events, the group
+// falls back to reading the leader.
+type perfEventGroup struct {
+	events  []perfEvent
+	exclude uint64     // PerfBitExclude* bits of the privilege levels left uncounted
+	lock    sync.Mutex // Guards the descriptors, which may be closed by Stop on another goroutine
+	fds     []int      // Descriptors of the opened events, the leader first, empty if closed
+	opened  []int      // Indices of the events of the descriptors
+	refused []int      // Indices of the events the kernel refused to count
+	reasons []error    // Errors the refused events failed to open with, in the same order
+	running bool
+	enabled uint64 // Time the group was enabled since opened, as of the last read
+	active  uint64 // Time the group was counting since opened, as of the last read
+	buf     []byte // Read buffer for the number of events, times enabled and running and the counts
+
+	userRead bool            // Whether to read the counters in user space, where permitted
+	pages    []*perfUserPage // User pages of the opened events if read in user space, empty otherwise
+	bases    []uint64        // Counts of the opened events at start, if read in user space
+	base     cycleWindow     // Times of the leader at start, if read in user space
+}
+
+// userOnly excludes the kernel and the hypervisor from counting, leaving the
+// events of user space only.
+const userOnly = unix.PerfBitExcludeKernel | unix.PerfBitExcludeHv
+
+// perfExclude returns the PerfBitExclude* bits leaving the kernel and the
+// hypervisor uncounted as requested.
+func perfExclude(kernel, hv bool) uint64 {
+	var bits uint64
+	if kernel {
+		bits |= unix.PerfBitExcludeKernel
+	}
+	if hv {
+		bits |= unix.PerfBitExcludeHv
+	}
+	return bits
+}
+
+// newPerfEventGroup returns a counter of the given events of the current
+// thread, leaving the privilege levels of the exclude bits uncounted.
+func newPerfEventGroup(exclude uint64, events ...perfEvent) *perfEventGroup {
+	return &perfEventGroup{
+		events:  events,
+		exclude: exclude,
+		buf:     make([]byte, 8*(3+len(events))),
+	}
+}
+
+// newCycleCounter returns a counter of the CPU cycles of the current thread
+// in user space.
+func newCycleCounter() eventCounter {
+	return newPerfEventGroup(userOnly, cyclesEvent)
+}
+
+// probePerfEvent checks whether the event can be counted in user space on the
+// calling thread, opening and closing it right away.
+func probePerfEvent(event perfEvent) error {
+	return probePerfEventExcluding(event, userOnly)
+}
+
+// probePerfEventExcluding checks whether the event can be counted on the
+// calling thread with the privilege levels of the exclude bits left
+// uncounted.
+func probePerfEventExcluding(event perfEvent, exclude uint64) error {
+	attr := &unix.PerfEventAttr{
+		Type:   event.typ,
+		Config: event.config,
+		Size:   perf.EventAttrSize,
+		Bits:   unix.PerfBitDisabled | exclude,
+	}
+	fd, err := unix.PerfEventOpen(attr, unix.Gettid(), -1, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	return unix.Close(fd)
+}
+
+// open opens the disabled group of perf events counting the calling thread,
+// unless already open.
+func (g *perfEventGroup) open() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if len(g.fds) > 0 {
+		return nil
+	}
+	g.refused, g.reasons = g.refused[:0], g.reasons[:0]
+	g.enabled, g.active = 0, 0
+
+	var (
+		leader = -1
+		failed error // Error opening the first refused event
+	)
+	for i, event := range g.events {
+		attr := &unix.PerfEventAttr{
+			Type:        event.typ,
+			Config:      event.config,
+			Size:        perf.EventAttrSize,
+			Bits:        g.exclude,
+			Read_format: unix.PERF_FORMAT_GROUP | unix.PERF_FORMAT_TOTAL_TIME_RUNNING | unix.PERF_FORMAT_TOTAL_TIME_ENABLED,
+		}
+		// Only the leader starts disabled, the members follow it
+		if leader < 0 {
+			attr.Bits |= unix.PerfBitDisabled
+		}
+		fd, err := unix.PerfEventOpen(attr, unix.Gettid(), -1, leader, unix.PERF_FLAG_FD_CLOEXEC)
+		if err != nil {
+			if failed == nil {
+				failed = err
+			}
+			g.refused = append(g.refused, i)
+			g.reasons = append(g.reasons, err)
+			continue
+		}
+		if leader < 0 {
+			leader = fd
+		}
+		g.fds = append(g.fds, fd)
+		g.opened = append(g.opened, i)
+	}
+	if leader < 0 {
+		return failed
+	}
+	if g.userRead && pmcSupported {
+		g.mapPages()
+	}
+	return nil
+}
+
+// mapPages maps the user pages of the opened events and enables the group for
+// good, so that the counters can be read in user space. If the kernel doesn't
+// permit reading any of them, the group is disabled and unmapped again, to be
+// read with system calls instead.
+func (g *perfEventGroup) mapPages() {
+	for _, fd := range g.fds {
+		page, err := mmapUserPage(fd)
+		if err != nil {
+			g.unmapPages()
+			return
+		}
+		g.pages = append(g.pages, page)
+	}
+	// The counters are only assigned once the events are scheduled
+	if err := unix.IoctlSetInt(g.fds[0], unix.PERF_EVENT_IOC_ENABLE, unix.PERF_IOC_FLAG_GROUP); err != nil {
+		g.unmapPages()
+		return
+	}
+	for _, page := range g.pages {
+		if !page.readable() {
+			unix.IoctlSetInt(g.fds[0], unix.PERF_EVENT_IOC_DISABLE, unix.PERF_IOC_FLAG_GROUP)
+			g.unmapPages()
+			return
+		}
+	}
+	g.bases = make([]uint64, len(g.pages))
+}
+
+// unmapPages unmaps the user pages of the opened events.
+func (g *perfEventGroup) unmapPages() {
+	for _, page := range g.pages {
+		page.unmap()
+	}
+	g.pages = g.pages[:0]
+}
+
+// userReading reports whether the open group is read in user space.
+func (g *perfEventGroup) userReading() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return len(g.pages) > 0
+}
+
+// dropped returns the indices of the events the kernel refused to count when
+// the group was last opened.
+func (g *perfEventGroup) dropped() []int {
+	return g.refused
+}
+
+// refusals returns the errors the events of dropped failed to open with, in
+// the same order.
+func (g *perfEventGroup) refusals() []error {
+	return g.reasons
+}
+
+// start resets and enables the group.
+func (g *perfEventGroup) start() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if len(g.fds) == 0 {
+		return errCounterClosed
+	}
+	if len(g.pages) > 0 {
+		for i, page := range g.pages {
+			count, enabled, running := page.read(readPMC, userTime)
+			g.bases[i] = count
+			if i == 0 {
+				g.base = cycleWindow{enabled: enabled, running: running}
+			}
+		}
+		g.running = true
+		return nil
+	}
+	if err := unix.IoctlSetInt(g.fds[0], unix.PERF_EVENT_IOC_RESET, unix.PERF_IOC_FLAG_GROUP); err != nil {
+		return err
+	}
+	if err := unix.IoctlSetInt(g.fds[0], unix.PERF_EVENT_IOC_ENABLE, unix.PERF_IOC_FLAG_GROUP); err != nil {
+		return err
+	}
+	g.running = true
+	return nil
+}
+
+// stop disables the group and reads the counts of all events since start in
+// a single read of the leader, in the order of the events.
+func (g *perfEventGroup) stop(counts []uint64) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.running {
+		return errCounterNotRunning
+	}
+	g.running = false
+	if len(g.pages) > 0 {
+		g.readPages(counts)
+		return nil
+	}
+	if err := unix.IoctlSetInt(g.fds[0], unix.PERF_EVENT_IOC_DISABLE, unix.PERF_IOC_FLAG_GROUP); err != nil {
+		return err
+	}
+	n, err := unix.Read(g.fds[0], g.buf)
+	if err != nil {
+		return err
+	}
+	g.enabled, g.active, err = unpackGroupRead(g.buf[:n], g.opened, counts)
+	return err
+}
+
+// readPages reads the counts of all events since start from their user pages,
+// in the order of the events, and adds the times of the leader meanwhile to
+// the times since opened.
+func (g *perfEventGroup) readPages(counts []uint64) {
+	for i := range counts {
+		counts[i] = 0
+	}
+	for i, page := range g.pages {
+		count, enabled, running := page.read(readPMC, userTime)
+		counts[g.opened[i]] = count - g.bases[i]
+		if i == 0 {
+			g.enabled += enabled - g.base.enabled
+			g.active += running - g.base.running
+		}
+	}
+}
+
+// unpackGroupRead unpacks the result of reading a group of perf events with
+// PERF_FORMAT_GROUP, PERF_FORMAT_TOTAL_TIME_ENABLED and
+// PERF_FORMAT_TOTAL_TIME_RUNNING. The layout is the number of events, the
+// times enabled and running, followed by the count of every event in the
+// order they were added to the group:
+//
+//	struct read_format {
+//		u64 nr;
+//		u64 time_enabled;
+//		u64 time_running;
+//		u64 values[nr];
+//	};
+//
+// The count of the i-th event read is stored at index opened[i] of counts,
+// the counts of events not in the group are zeroed.
+func unpackGroupRead(buf []byte, opened []int, counts []uint64) (enabled, running uint64, err error) {
+	for i := range counts {
+		counts[i] = 0
+	}
+	if len(buf) < 24 {
+		return 0, 0, fmt.Errorf("short perf group read: %d bytes", len(buf))
+	}
+	if nr := binary.LittleEndian.Uint64(buf); nr != uint64(len(opened)) {
+		return 0, 0, fmt.Errorf("perf group read %d events, want %d", nr, len(opened))
+	}
+	if want := 8 * (3 + len(opened)); len(buf) < want {
+		return 0, 0, fmt.Errorf("short perf group read: %d bytes, want %d", len(buf), want)
+	}
+	for i, event := range opened {
+		counts[event] = binary.LittleEndian.Uint64(buf[8*(3+i):])
+	}
+	return binary.LittleEndian.Uint64(buf[8:]), binary.LittleEndian.Uint64(buf[16:]), nil
+}
+
+// scaleCounts extrapolates the counts of a measurement to the whole time the
+// events were enabled, if the PMU multiplexed them with other events and they
+// were only counting part of it. Counts never scheduled at all are left zero.
+func scaleCounts(counts []uint64, enabled, running uint64) {
+	if running == 0 || running >= enabled {
+		return
+	}
+	scale := float64(enabled) / float64(running)
+	for i, count := range counts {
+		counts[i] = uint64(float64(count) * scale)
+	}
+}
+
+// times returns the time the group was enabled and the time it was actually
+// counting since opened. The latter falls short if the PMU had to multiplex
+// the group with other events. Resetting the counts doesn't reset the times.
+func (g *perfEventGroup) times() (enabled, running uint64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.enabled, g.active
+}
+
+// close closes the group, if open. It may be called repeatedly and
+// concurrently with the measurements.
+func (g *perfEventGroup) close() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.closeFds()
+}
+
+// closeFds unmaps and closes the descriptors of the opened events, the leader
+// last.
+func (g *perfEventGroup) closeFds() error {
+	g.unmapPages()
+
+	var err error
+	for i := len(g.fds) - 1; i >= 0; i-- {
+		if cerr := unix.Close(g.fds[i]); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	g.fds, g.opened, g.running = g.fds[:0], g.opened[:0], false
+	return err
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package native
+
+import (
+	"encoding/binary"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Tests that the counts read from a perf event group are unpacked to the
+// events they belong to, skipping the events left out of the group.
+func TestUnpackGroupRead(t *testing.T) {
+	var buf []byte
+	for _, v := range []uint64{3, 1000, 750, 11, 22, 33} {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	counts := []uint64{9, 9, 9, 9}
+	enabled, running, err := unpackGroupRead(buf, []int{0, 2, 3}, counts)
+	if err != nil {
+		t.Fatalf("failed to unpack: %v", err)
+	}
+	if enabled != 1000 || running != 750 {
+		t.Errorf("times mismatch: have enabled %d, running %d, want 1000, 750", enabled, running)
+	}
+	if want := []uint64{11, 0, 22, 33}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts mismatch: have %v, want %v", counts, want)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		buf    []byte
+		opened []int
+	}{
+		{"short header", buf[:16], []int{0, 2, 3}},
+		{"event count mismatch", buf, []int{0, 1}},
+		{"short values", buf[:40], []int{0, 2, 3}},
+	} {
+		if _, _, err := unpackGroupRead(tt.buf, tt.opened, counts); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+// Tests that the counts of a group read are extrapolated to the time the
+// group was enabled if it was multiplexed.
+func TestScaleCounts(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		enabled, running uint64
+		values, want     []uint64
+	}{
+		{"counting throughout", 1000, 1000, []uint64{11, 22}, []uint64{11, 22}},
+		{"multiplexed", 1000, 250, []uint64{11, 22}, []uint64{44, 88}},
+		{"never scheduled", 1000, 0, []uint64{0, 0}, []uint64{0, 0}},
+		{"times not reported", 0, 0, []uint64{11, 22}, []uint64{11, 22}},
+	} {
+		var buf []byte
+		for _, v := range append([]uint64{2, tt.enabled, tt.running}, tt.values...) {
+			buf = binary.LittleEndian.AppendUint64(buf, v)
+		}
+		counts := make([]uint64, 2)
+		enabled, running, err := unpackGroupRead(buf, []int{0, 1}, counts)
+		if err != nil {
+			t.Fatalf("%s: failed to unpack: %v", tt.name, err)
+		}
+		scaleCounts(counts, enabled, running)
+		if !reflect.DeepEqual(counts, tt.want) {
+			t.Errorf("%s: counts mismatch: have %v, want %v", tt.name, counts, tt.want)
+		}
+	}
+}
+
+// Tests that counts and times are read from a perf event's user page following
+// the kernel's protocol, sign extending the counter and extrapolating the
+// times, and retrying if the kernel updated the page meanwhile.
+func TestPerfUserPageRead(t *testing.T) {
+	tsc := func() uint64 { return 7 }
+	for _, tt := range []struct {
+		name                    string
+		page                    unix.PerfEventMmapPage
+		count, enabled, running uint64
+	}{
+		{
+			name: "counting",
+			page: unix.PerfEventMmapPage{
+				Index: 2, Offset: 1000, Pmc_width: 48, Capabilities: capUserRDPMC | capUserTime,
+				Time_enabled: 500, Time_running: 400, Time_offset: 10, Time_mult: 3, Time_shift: 1,
+			},
+			// The counter reads -16 in 48 bits, and the times advance by
+			// the offset and the timestamp 7 scaled by 3/2, 10 + 10
+			count: 984, enabled: 520, running: 420,
+		},
+		{
+			name: "not scheduled",
+			page: unix.PerfEventMmapPage{
+				Index: 0, Offset: 1000, Pmc_width: 48, Capabilities: capUserRDPMC | capUserTime,
+				Time_enabled: 500, Time_running: 400, Time_offset: 10, Time_mult: 3, Time_shift: 1,
+			},
+			count: 1000, enabled: 520, running: 400,
+		},
+		{
+			name: "no user reads",
+			page: unix.PerfEventMmapPage{
+				Index: 2, Offset: 1000, Pmc_width: 48,
+				Time_enabled: 500, Time_running: 400, Time_offset: 10, Time_mult: 3, Time_shift: 1,
+			},
+			count: 1000, enabled: 500, running: 400,
+		},
+	} {
+		page := &perfUserPage{page: &tt.page}
+		rdpmc := func(counter uint32) uint64 {
+			if counter != 1 {
+				t.Errorf("%s: read counter %d, want 1", tt.name, counter)
+			}
+			return 1<<48 - 16
+		}
+		count, enabled, running := page.read(rdpmc, tsc)
+		if count != tt.count || enabled != tt.enabled || running != tt.running {
+			t.Errorf("%s: read mismatch: have count %d, enabled %d, running %d, want %d, %d, %d",
+				tt.name, count, enabled, running, tt.count, tt.enabled, tt.running)
+		}
+	}
+	// An update of the page while reading it discards the torn read
+	page := &perfUserPage{page: &unix.PerfEventMmapPage{Index: 1, Offset: 1000, Pmc_width: 48, Capabilities: capUserRDPMC}}
+	reads := 0
+	rdpmc := func(uint32) uint64 {
+		if reads++; reads == 1 {
+			page.page.Lock++
+			page.page.Offset = 2000
+		}
+		return 5
+	}
+	if count, _, _ := page.read(rdpmc, tsc); count != 2005 || reads != 2 {
+		t.Errorf("torn read mismatch: have count %d after %d reads, want 2005 after 2", count, reads)
+	}
+}
+
+// BenchmarkPerfEventGroup compares measuring the cycles with system calls to
+// reading the counter in user space.
+func BenchmarkPerfEventGroup(b *testing.B) {
+	for _, userRead := range []bool{false, true} {
+		name := "read"
+		if userRead {
+			name = "rdpmc"
+		}
+		b.Run(name, func(b *testing.B) {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+
+			group := newPerfEventGroup(userOnly, cyclesEvent)
+			group.userRead = userRead
+			if err := group.open(); err != nil {
+				b.Skipf("perf events unavailable: %v", err)
+			}
+			defer group.close()
+			if userRead && !group.userReading() {
+				b.Skip("user space reads not permitted")
+			}
+			counts := make([]uint64, 1)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := group.start(); err != nil {
+					b.Fatalf("failed to start: %v", err)
+				}
+				if err := group.stop(counts); err != nil {
+					b.Fatalf("failed to stop: %v", err)
+				}
+			}
+		})
+	}
+}
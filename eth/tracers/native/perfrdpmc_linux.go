@@ -0,0 +1,126 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package native
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Bits of the capabilities of a perf event's user page.
+const (
+	capUserRDPMC = 1 << 2 // The counter can be read with RDPMC
+	capUserTime  = 1 << 3 // The times can be extrapolated from the timestamp counter
+)
+
+// perfUserPage is the first page of a perf event mapped into memory, through
+// which the kernel exposes the state needed to read the counter in user space
+// without a system call.
+type perfUserPage struct {
+	data []byte // Mapped memory, nil if not mapped by mmapUserPage
+	page *unix.PerfEventMmapPage
+}
+
+// mmapUserPage maps the user page of the perf event of the descriptor.
+func mmapUserPage(fd int) (*perfUserPage, error) {
+	data, err := unix.Mmap(fd, 0, unix.Getpagesize(), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &perfUserPage{data: data, page: (*unix.PerfEventMmapPage)(unsafe.Pointer(&data[0]))}, nil
+}
+
+// readable reports whether the kernel lets user space read the counter, and
+// the event is currently scheduled on a hardware counter.
+func (p *perfUserPage) readable() bool {
+	return atomic.LoadUint64(&p.page.Capabilities)&capUserRDPMC != 0 && atomic.LoadUint32(&p.page.Index) != 0
+}
+
+// read returns the count of the event and the times it was enabled and
+// counting since opened, reading the hardware counter with rdpmc and the
+// timestamp counter with rdtsc. The page is read under the seqlock the kernel
+// updates it with, retrying if it changed meanwhile:
+//
+//	do {
+//		seq = pc->lock;
+//		...
+//		idx = pc->index;
+//		count = pc->offset;
+//		if (pc->cap_user_rdpmc && idx)
+//			count += rdpmc(idx - 1);
+//	} while (pc->lock != seq);
+//
+// An event not scheduled on a counter reads its count as of the last time it
+// was.
+func (p *perfUserPage) read(rdpmc func(uint32) uint64, rdtsc func() uint64) (count, enabled, running uint64) {
+	var (
+		caps, cycles uint64
+		index, mult  uint32
+		shift        uint16
+		offset       uint64
+	)
+	for {
+		seq := atomic.LoadUint32(&p.page.Lock)
+
+		enabled, running = p.page.Time_enabled, p.page.Time_running
+		caps = p.page.Capabilities
+		if caps&capUserTime != 0 {
+			cycles = rdtsc()
+			offset, mult, shift = p.page.Time_offset, p.page.Time_mult, p.page.Time_shift
+		}
+		index = p.page.Index
+		count = uint64(p.page.Offset)
+		if caps&capUserRDPMC != 0 && index != 0 {
+			// The counter is only pmc_width bits wide, sign extend it
+			width := 64 - p.page.Pmc_width
+			count += uint64(int64(rdpmc(index-1)<<width) >> width)
+		}
+		if atomic.LoadUint32(&p.page.Lock) == seq {
+			break
+		}
+	}
+	// Extrapolate the times from the last update of the page until now
+	if caps&capUserTime != 0 {
+		quot, rem := cycles>>shift, cycles&(1<<shift-1)
+		delta := offset + quot*uint64(mult) + (rem*uint64(mult))>>shift
+		enabled += delta
+		if index != 0 {
+			running += delta
+		}
+	}
+	return count, enabled, running
+}
+
+// unmap unmaps the page, if mapped.
+func (p *perfUserPage) unmap() error {
+	if p.data == nil {
+		return nil
+	}
+	data := p.data
+	p.data, p.page = nil, nil
+	return unix.Munmap(data)
+}
+
+// userTime returns the timestamp counter the user page times extrapolate from.
+func userTime() uint64 {
+	return uint64(readTSC())
+}
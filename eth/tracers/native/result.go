@@ -0,0 +1,219 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// tableMeta describes how the rows of a tabular tracer's CSV were recorded,
+// if options altering them are configured.
+type tableMeta struct {
+	Resolution        int   `json:"resolution,omitempty"`        // Final distance between sampled steps with adaptive sampling, or steps per row of the cycleTracer
+	BudgetExceeded    *bool `json:"budgetExceeded,omitempty"`    // Whether the time budget ran out, with a budget
+	BudgetExpiredStep *int  `json:"budgetExpiredStep,omitempty"` // First step left untraced, if the budget ran out
+
+	Interrupted string `json:"interrupted,omitempty"` // Reason tracing was stopped early, the rows covering the steps up to then
+
+	Clock        string  `json:"clock,omitempty"`        // Timestamp source of the time column, if configured
+	TscFrequency float64 `json:"tscFrequency,omitempty"` // Measured ticks per second the timestamp counter readings were converted with
+	InvariantTsc *bool   `json:"invariantTsc,omitempty"` // Whether the CPU guarantees a constant timestamp counter rate
+
+	Percentiles map[string]map[string]float64 `json:"percentiles,omitempty"` // Step time distribution per opcode, if requested
+	OverheadNs  float64                       `json:"overheadNs,omitempty"`  // Measured tracer overhead included in every step time, if calibrated
+	Slowest     []slowStep                    `json:"slowest,omitempty"`     // Slowest steps of the trace, if requested
+	TotalSteps  *int                          `json:"totalSteps,omitempty"`  // Number of timed steps including those not kept, with a threshold
+	TotalTime   float64                       `json:"totalTime,omitempty"`   // Summed time of all timed steps in the unit of the time column, with a threshold
+	Truncated   bool                          `json:"truncated,omitempty"`   // Whether the oldest rows were dropped to bound the number of rows
+	DroppedRows int                           `json:"droppedRows,omitempty"` // Number of rows dropped by the truncation
+
+	DroppedEvents []string          `json:"droppedEvents,omitempty"` // Configured perf events the kernel refused to count, their columns empty or left out
+	EventErrors   map[string]string `json:"eventErrors,omitempty"`   // Errors the kernel refused the dropped perf events with, by name
+	Scaling       float64           `json:"scaling,omitempty"`       // Ratio of the time the perf events were enabled to the time they counted, if multiplexed
+	CycleSource   string            `json:"cycleSource,omitempty"`   // Source of the cycle counts: cycleSourcePerf, cycleSourceTSC or cycleSourceNone
+	CycleOverhead *int              `json:"cycleOverhead,omitempty"` // Median cycles counted by an empty measurement, if calibrated
+	ExcludeKernel *bool             `json:"excludeKernel,omitempty"` // Whether the perf events left the kernel uncounted, if counted with perf events
+	ExcludeHV     *bool             `json:"excludeHV,omitempty"`     // Whether the perf events left the hypervisor uncounted, if counted with perf events
+	Rdpmc         *bool             `json:"rdpmc,omitempty"`         // Whether the perf events were read in user space with rdpmc, if requested
+	PinnedCPU     *int              `json:"pinnedCpu,omitempty"`     // CPU the tracing thread was pinned to, if requested and pinned
+	AffinityError string            `json:"affinityError,omitempty"` // Why the tracing thread couldn't be pinned to the requested CPU
+
+	MeasurementErrors int      `json:"measurementErrors,omitempty"` // Number of failures to start or read the perf counters
+	Errors            []string `json:"errors,omitempty"`            // Errors of the first measurement failures, up to maxCycleErrors
+	LostSamples       int      `json:"lostSamples,omitempty"`       // Number of measurements whose counts were zeroed by a failure
+
+	Deviations *deviationReport `json:"deviations,omitempty"` // Opcodes whose cycles per gas deviate from the transaction's median, if requested
+
+	Energy      map[string]float64 `json:"energy,omitempty"`      // Joules the system consumed per RAPL domain during the transaction, if requested
+	EnergyError string             `json:"energyError,omitempty"` // Why the energy consumed couldn't be measured, if requested
+
+	TxHash      *common.Hash `json:"txHash,omitempty"`      // Hash of the traced transaction, unless a dangling call
+	BlockNumber *uint64      `json:"blockNumber,omitempty"` // Number of the block containing the transaction
+	TxIndex     *int         `json:"txIndex,omitempty"`     // Index of the transaction within its block
+}
+
+// tableResult is the result format of the tabular tracers when they report
+// metadata alongside the CSV. Without metadata, the CSV is returned as a bare
+// JSON string.
+type tableResult struct {
+	tableMeta
+	CSV string `json:"csv"`
+}
+
+// newTableMeta collects the result metadata of a tracer from its sampler and
+// budget, either of which may be nil. Nil is returned if no option requiring
+// metadata is configured.
+func newTableMeta(sampler *adaptiveSampler, budget *traceBudget) *tableMeta {
+	var (
+		adaptive = sampler != nil && sampler.target > 0
+		limited  = budget != nil && budget.limit > 0
+	)
+	if !adaptive && !limited {
+		return nil
+	}
+	meta := new(tableMeta)
+	if adaptive {
+		meta.Resolution = sampler.resolution
+	}
+	if limited {
+		budget.annotate(meta)
+	}
+	return meta
+}
+
+// txContext returns the transaction context to report in the result metadata,
+// or nil if the tracer isn't tracing a transaction of a block.
+func txContext(ctx *tracers.Context) *tracers.Context {
+	if ctx == nil || ctx.TxHash == (common.Hash{}) || ctx.BlockNumber == nil {
+		return nil
+	}
+	return ctx
+}
+
+// annotateContext adds the transaction context to the metadata.
+func (m *tableMeta) annotateContext(ctx *tracers.Context) {
+	number, index := ctx.BlockNumber.Uint64(), ctx.TxIndex
+	m.TxHash = &ctx.TxHash
+	m.BlockNumber = &number
+	m.TxIndex = &index
+}
+
+// marshalTableResult encodes the CSV, wrapped into a tableResult if there is
+// metadata to report.
+func marshalTableResult(meta *tableMeta, csv string) (json.RawMessage, error) {
+	if meta == nil {
+		return json.Marshal(csv)
+	}
+	return json.Marshal(tableResult{tableMeta: *meta, CSV: csv})
+}
+
+// encodeTableResult streams the CSV written by fn into w, producing the same
+// bytes as marshalTableResult.
+func encodeTableResult(w io.Writer, meta *tableMeta, fn func(io.Writer) error) error {
+	if meta == nil {
+		return encodeJSONString(w, fn)
+	}
+	head, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// Reopen the metadata object to append the CSV as its last field
+	head = bytes.TrimSuffix(head, []byte("}"))
+	if len(head) > 1 {
+		head = append(head, ',')
+	}
+	head = append(head, `"csv":`...)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	if err := encodeJSONString(w, fn); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "}")
+	return err
+}
+
+// marshalRowsResult encodes n rows as a JSON object holding the column names
+// and an array of rows, next to the metadata if any. The row function renders
+// the i-th row as it would appear in the CSV. Values of numeric columns are
+// emitted as JSON numbers, or null if empty.
+func marshalRowsResult(meta *tableMeta, columns []tracers.ColumnInfo, n int, row func(i int) []string) (json.RawMessage, error) {
+	buf := []byte("{")
+	if meta != nil {
+		head, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		// Reopen the metadata object to append the rows as its last fields
+		if head = bytes.TrimSuffix(head, []byte("}")); len(head) > 1 {
+			buf = append(head, ',')
+		}
+	}
+	names, err := json.Marshal(columnNames(columns))
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, `"columns":`...)
+	buf = append(buf, names...)
+	buf = append(buf, `,"rows":[`...)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONRow(buf, columns, row(i))
+	}
+	return append(buf, "]}"...), nil
+}
+
+// appendJSONRow appends a row as a JSON array, typing the values after their
+// columns.
+func appendJSONRow(buf []byte, columns []tracers.ColumnInfo, row []string) []byte {
+	buf = append(buf, '[')
+	for i, value := range row {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		switch {
+		case columns[i].Type == columnString:
+			buf = appendJSONString(buf, value)
+		case value == "":
+			buf = append(buf, "null"...)
+		default:
+			buf = append(buf, value...)
+		}
+	}
+	return append(buf, ']')
+}
+
+// appendJSONString appends s as a JSON string. Plain ASCII, which all values
+// but error messages are, is copied as is instead of going through the encoder.
+func appendJSONString(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x7f || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			enc, _ := json.Marshal(s)
+			return append(buf, enc...)
+		}
+	}
+	buf = append(buf, '"')
+	buf = append(buf, s...)
+	return append(buf, '"')
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+// adaptiveSampler decides which execution steps a sampling tracer records.
+//
+// With a zero target, every resolution-th step is sampled. With a non-zero
+// target the resolution starts at one and doubles whenever the number of
+// collected samples reaches the target, after which the caller has to drop
+// every second sample (see decimateSamples). This keeps the final number of
+// samples between target/2 and target regardless of the transaction length,
+// while retaining an evenly spaced coverage of the whole execution.
+type adaptiveSampler struct {
+	resolution int // Current distance between two sampled steps
+	target     int // Maximum number of samples to keep, zero for a fixed resolution
+	steps      int // Number of steps seen so far
+}
+
+// newAdaptiveSampler creates a sampler with the given fixed resolution, or an
+// adaptive one if target is positive.
+func newAdaptiveSampler(resolution int, target int) *adaptiveSampler {
+	if target > 0 {
+		resolution = 1
+	}
+	return &adaptiveSampler{resolution: resolution, target: target}
+}
+
+// step advances the sampler by one execution step and reports whether the
+// step should be sampled.
+func (s *adaptiveSampler) step() bool {
+	sample := s.steps%s.resolution == 0
+	s.steps++
+	return sample
+}
+
+// full is called after storing a sample with the number of samples now held.
+// If the target has been reached, the resolution is doubled and true is
+// returned, in which case the caller must decimate the collected samples.
+func (s *adaptiveSampler) full(samples int) bool {
+	if s.target == 0 || samples < s.target {
+		return false
+	}
+	s.resolution *= 2
+	return true
+}
+
+// decimateSamples drops every second sample after the first keep entries,
+// retaining the ones taken at even multiples of the previous resolution. The
+// samples are compacted in place and the shortened slice is returned.
+func decimateSamples[T any](samples []T, keep int) []T {
+	n := keep
+	for i := keep; i < len(samples); i += 2 {
+		samples[n] = samples[i]
+		n++
+	}
+	var zero T
+	for i := n; i < len(samples); i++ {
+		samples[i] = zero // Release references held by dropped samples
+	}
+	return samples[:n]
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecimateSamples(t *testing.T) {
+	tests := []struct {
+		samples []int
+		keep    int
+		want    []int
+	}{
+		{samples: []int{}, keep: 0, want: []int{}},
+		{samples: []int{0}, keep: 0, want: []int{0}},
+		{samples: []int{0, 1, 2, 3}, keep: 0, want: []int{0, 2}},
+		{samples: []int{0, 1, 2, 3, 4}, keep: 0, want: []int{0, 2, 4}},
+		{samples: []int{-1, 0, 1, 2, 3}, keep: 1, want: []int{-1, 0, 2}},
+		{samples: []int{-1}, keep: 1, want: []int{-1}},
+	}
+	for i, tt := range tests {
+		if have := decimateSamples(tt.samples, tt.keep); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that the adaptive sampler keeps the sample count within [target/2, target]
+// for arbitrary trace lengths, and that the retained samples stay evenly spaced
+// over the whole execution at the final resolution.
+func TestAdaptiveSamplerBounds(t *testing.T) {
+	for _, target := range []int{2, 7, 10, 64, 5000} {
+		for _, steps := range []int{0, 1, 6, 7, 8, 100, 1023, 1024, 1025, 99999} {
+			var (
+				sampler = newAdaptiveSampler(1, target)
+				samples []int
+			)
+			for step := 0; step < steps; step++ {
+				if !sampler.step() {
+					continue
+				}
+				samples = append(samples, step)
+				if sampler.full(len(samples)) {
+					samples = decimateSamples(samples, 0)
+				}
+			}
+			if len(samples) > target {
+				t.Errorf("target %d, steps %d: too many samples: %d", target, steps, len(samples))
+			}
+			if steps >= target && len(samples) < target/2 {
+				t.Errorf("target %d, steps %d: too few samples: %d", target, steps, len(samples))
+			}
+			if steps < target && len(samples) != steps {
+				t.Errorf("target %d, steps %d: short trace decimated to %d samples", target, steps, len(samples))
+			}
+			for i, step := range samples {
+				if step != i*sampler.resolution {
+					t.Fatalf("target %d, steps %d: sample %d taken at step %d, want %d", target, steps, i, step, i*sampler.resolution)
+				}
+			}
+			// The last sample must be within one resolution of the end
+			if steps > 0 && samples[len(samples)-1] < steps-sampler.resolution {
+				t.Errorf("target %d, steps %d: coverage ends at step %d with resolution %d", target, steps, samples[len(samples)-1], sampler.resolution)
+			}
+		}
+	}
+}
+
+func TestFixedResolutionSampler(t *testing.T) {
+	var (
+		sampler = newAdaptiveSampler(3, 0)
+		samples []int
+	)
+	for step := 0; step < 10; step++ {
+		if sampler.step() {
+			samples = append(samples, step)
+		}
+		if sampler.full(len(samples)) {
+			t.Fatalf("fixed resolution sampler requested decimation")
+		}
+	}
+	if want := []int{0, 3, 6, 9}; !reflect.DeepEqual(samples, want) {
+		t.Fatalf("have %v, want %v", samples, want)
+	}
+}
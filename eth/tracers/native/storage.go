@@ -28,10 +28,12 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/eth/tracers"
+	"io"
 	"math/big"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 func init() {
@@ -42,19 +44,69 @@ func init() {
 // performs no action. It's mostly useful for testing purposes.
 type storageTracer struct {
 	PIOMetrics []*ProcIO
-	resolution int
-	opCounter  int
+	sampler    *adaptiveSampler
+	budget     *traceBudget
+	checkpoint *checkpointer // Sink the samples are flushed to in batches, nil to keep all in memory
+	config     storageTracerConfig
+	err        error       // First error hit while reading the process statistics
+	interrupt  atomic.Bool // Atomic flag to signal execution interruption
+	reason     error       // Textual reason for the interruption
+}
+
+type storageTracerConfig struct {
+	TargetSamples     int    `json:"targetSamples"`     // If non-zero, the resolution adapts to keep at most this many step samples
+	BudgetMs          int    `json:"budgetMs"`          // If non-zero, steps are no longer sampled after this many milliseconds
+	CheckpointSamples int    `json:"checkpointSamples"` // If non-zero, samples are flushed to a file in batches of this size
+	CheckpointFile    string `json:"checkpointFile"`    // File within the tracer output directory to flush the samples to, a temp file if empty
 }
 
 // newstorageTracer returns a new noop tracer.
-func newStorageTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+func newStorageTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
+	var config storageTracerConfig
+	if cfg != nil {
+		if err := json.Unmarshal(cfg, &config); err != nil {
+			return nil, err
+		}
+	}
+	if config.TargetSamples < 0 {
+		return nil, fmt.Errorf("invalid targetSamples %d", config.TargetSamples)
+	}
+	budget, err := newTraceBudget(config.BudgetMs)
+	if err != nil {
+		return nil, err
+	}
+	// Decimation revisits samples, which is impossible once flushed
+	if config.CheckpointSamples != 0 && config.TargetSamples != 0 {
+		return nil, errCheckpointSampling
+	}
+	checkpoint, err := newCheckpointer("storageTracer", config.CheckpointSamples, config.CheckpointFile, storageColumns)
+	if err != nil {
+		return nil, err
+	}
 	return &storageTracer{
 		PIOMetrics: []*ProcIO{},
-		resolution: 1,
-		opCounter:  0,
+		sampler:    newAdaptiveSampler(1, config.TargetSamples),
+		budget:     budget,
+		checkpoint: checkpoint,
+		config:     config,
 	}, nil
 }
 
+// storageColumns are the columns of the storage tracer's CSV output.
+var storageColumns = []tracers.ColumnInfo{
+	{Name: "Rchar", Type: columnInt, Unit: "bytes"},
+	{Name: "Wchar", Type: columnInt, Unit: "bytes"},
+	{Name: "Syscr", Type: columnInt, Unit: "syscalls"},
+	{Name: "Syscw", Type: columnInt, Unit: "syscalls"},
+	{Name: "ReadBytes", Type: columnInt, Unit: "bytes"},
+	{Name: "WriteBytes", Type: columnInt, Unit: "bytes"},
+}
+
+// Columns implements tracers.ColumnTracer, returning the CSV columns.
+func (t *storageTracer) Columns() []tracers.ColumnInfo {
+	return storageColumns
+}
+
 type ProcIO struct {
 	Rchar               int64
 	Wchar               int64
@@ -70,7 +122,10 @@ func (t *storageTracer) readProcessStats() {
 	pidStr := strconv.Itoa(pid)
 	pMetrics, err := ReadProcIO(pidStr)
 	if err != nil {
-		fmt.Errorf("Can not read metrics %v", err)
+		if t.err == nil {
+			t.err = fmt.Errorf("can not read metrics: %w", err)
+		}
+		return
 	}
 	t.PIOMetrics = append(t.PIOMetrics, pMetrics)
 }
@@ -123,6 +178,10 @@ func ReadProcIO(pid string) (*ProcIO, error) {
 
 // CaptureStart implements the EVMLogger interface to initialize the tracing operation.
 func (t *storageTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.budget.start()
+	if t.checkpoint != nil {
+		t.checkpoint.open()
+	}
 	t.readProcessStats()
 }
 
@@ -133,10 +192,17 @@ func (t *storageTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
 
 // CaptureState implements the EVMLogger interface to trace a single step of VM execution.
 func (t *storageTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
-	if 0 == t.opCounter%t.resolution {
-		t.readProcessStats()
+	if t.interrupt.Load() || !t.budget.step() || !t.sampler.step() {
+		return
+	}
+	t.readProcessStats()
+	if t.checkpoint.due(len(t.PIOMetrics)) {
+		t.flushSamples()
+	}
+	// The first entry is the CaptureStart sample, which is always kept
+	if t.sampler.full(len(t.PIOMetrics) - 1) {
+		t.PIOMetrics = decimateSamples(t.PIOMetrics, 1)
 	}
-	t.opCounter = t.opCounter + 1
 }
 
 // CaptureFault implements the EVMLogger interface to trace an execution fault.
@@ -158,10 +224,19 @@ func (*storageTracer) CaptureTxEnd(restGas uint64) {}
 
 // GetResult returns an empty json object.
 func (t *storageTracer) GetResult() (json.RawMessage, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.checkpoint != nil {
+		t.flushSamples()
+		return t.checkpoint.result(newTableMeta(t.sampler, t.budget), t.stopReason())
+	}
 	csvString, err := procIOToCSV(t.PIOMetrics)
-
+	if err != nil {
+		return nil, err
+	}
 	// Encode the slice of slices to JSON
-	jsonBytes, err := json.Marshal(csvString)
+	jsonBytes, err := marshalTableResult(newTableMeta(t.sampler, t.budget), csvString)
 	if err != nil {
 		fmt.Println(err)
 		return json.RawMessage(`{}`), err
@@ -170,45 +245,96 @@ func (t *storageTracer) GetResult() (json.RawMessage, error) {
 	return jsonBytes, nil
 }
 
+// EncodeResult implements tracers.ResultEncoder, streaming the same result as
+// GetResult without building the CSV in memory.
+func (t *storageTracer) EncodeResult(w io.Writer) error {
+	if t.err != nil {
+		return t.err
+	}
+	if t.checkpoint != nil {
+		res, err := t.GetResult()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(res)
+		return err
+	}
+	return encodeTableResult(w, newTableMeta(t.sampler, t.budget), func(w io.Writer) error {
+		return writeProcIOCSV(w, t.PIOMetrics)
+	})
+}
+
 // Stop terminates execution of the tracer at the first opportune moment.
 func (t *storageTracer) Stop(err error) {
+	t.reason = err
+	t.interrupt.Store(true)
+}
+
+// stopReason returns the reason tracing was interrupted, if it was.
+func (t *storageTracer) stopReason() error {
+	if !t.interrupt.Load() {
+		return nil
+	}
+	return t.reason
+}
+
+// flushSamples checkpoints the collected samples and releases them from
+// memory.
+func (t *storageTracer) flushSamples() {
+	for i, procIO := range t.PIOMetrics {
+		t.checkpoint.write(procIORow(procIO))
+		for col, v := range procIOValues(procIO) {
+			t.checkpoint.observe(col, v)
+		}
+		t.PIOMetrics[i] = nil
+	}
+	t.checkpoint.commit()
+	t.PIOMetrics = t.PIOMetrics[:0]
 }
 
 func procIOToCSV(procIOs []*ProcIO) (string, error) {
-	// Create a buffer to write our output to
 	b := &bytes.Buffer{}
+	if err := writeProcIOCSV(b, procIOs); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
 
-	// Create a CSV writer that writes to our buffer
-	writer := csv.NewWriter(b)
+// writeProcIOCSV writes the IO samples as CSV into out.
+func writeProcIOCSV(out io.Writer, procIOs []*ProcIO) error {
+	// Create a CSV writer that writes to the output
+	writer := csv.NewWriter(out)
 
 	// Write the header to the CSV file
-	if err := writer.Write([]string{"Rchar", "Wchar", "Syscr", "Syscw", "ReadBytes", "WriteBytes"}); err != nil {
-		return "", err
+	if err := writer.Write(columnNames(storageColumns)); err != nil {
+		return err
 	}
 
 	// Iterate through the input and write each ProcIO's data to the CSV writer
 	for _, procIO := range procIOs {
-		record := []string{
-			strconv.FormatInt(procIO.Rchar, 10),
-			strconv.FormatInt(procIO.Wchar, 10),
-			strconv.FormatInt(procIO.Syscr, 10),
-			strconv.FormatInt(procIO.Syscw, 10),
-			strconv.FormatInt(procIO.ReadBytes, 10),
-			strconv.FormatInt(procIO.WriteBytes, 10),
-		}
-		if err := writer.Write(record); err != nil {
-			return "", err
+		if err := writer.Write(procIORow(procIO)); err != nil {
+			return err
 		}
 	}
 
-	// Flush any remaining data from the writer to the buffer
+	// Flush any remaining data from the writer to the output
 	writer.Flush()
 
 	// Check for any error that occurred during the write
-	if err := writer.Error(); err != nil {
-		return "", err
-	}
+	return writer.Error()
+}
 
-	// Convert the buffer's contents to a string and return it
-	return b.String(), nil
+// procIOValues returns the values of a sample in the order of storageColumns.
+func procIOValues(procIO *ProcIO) [6]int64 {
+	return [6]int64{procIO.Rchar, procIO.Wchar, procIO.Syscr, procIO.Syscw, procIO.ReadBytes, procIO.WriteBytes}
+}
+
+// procIORow formats a single sample as a CSV row.
+func procIORow(procIO *ProcIO) []string {
+	values := procIOValues(procIO)
+	row := make([]string, len(values))
+	for i, v := range values {
+		row[i] = strconv.FormatInt(v, 10)
+	}
+	return row
 }
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func BenchmarkStorageTracerCaptureState(b *testing.B) {
+	benchmarkCaptureState(b, newTestTracer(b, "storageTracer", ""))
+}
+
+func TestStorageTracerColumnsMatchHeader(t *testing.T) {
+	testColumnsMatchHeader(t, newTestTracer(t, "storageTracer", ""))
+}
+
+func TestStorageTracerCheckpointSampling(t *testing.T) {
+	_, err := newStorageTracer(nil, json.RawMessage(`{"checkpointSamples": 10, "targetSamples": 10}`))
+	if err != errCheckpointSampling {
+		t.Fatalf("error mismatch: have %v, want %v", err, errCheckpointSampling)
+	}
+}
@@ -25,9 +25,16 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/params"
+	"io"
+	"math"
 	"math/big"
+	"runtime"
+	runtimemetrics "runtime/metrics"
 	"strconv"
-	"time"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 )
 
 func init() {
@@ -35,114 +42,1211 @@ func init() {
 }
 
 type timingTracer struct {
-	opcodes      []vm.OpCode
-	timings      []int
-	cost         []int
-	time         time.Time
-	remainingGas int
-	opcodeCosts  *OpcodeCosts
+	samples            timingRows // Recorded steps, the last one's cost is settled by the next step
+	maxRows            int        // Number of most recent rows kept, zero to keep all
+	ringHead           int        // Index of the oldest row kept, with maxRows
+	ringTail           int        // Index following the newest row kept, with maxRows
+	truncated          int        // Number of rows overwritten by newer ones, with maxRows
+	remainingGas       int
+	startGas           int           // Gas the top call started with
+	stepCost           int           // Gas charged for the last recorded step, including the gas forwarded to a frame it enters
+	frames             []timingFrame // Stack of active call frames
+	nextFrameId        int           // Id assigned to the next entered call frame
+	budget             *traceBudget
+	sampler            *adaptiveSampler
+	recorded           bool                    // Whether the last step was recorded, its cost is settled by the next one
+	lastRow            int                     // Index of the last recorded step's row
+	calls              bool                    // Whether call boundary rows are recorded
+	precompiles        bool                    // Whether rows are recorded for precompile calls
+	activePrecompiles  []common.Address        // Updated on CaptureStart based on given rules
+	stateTiming        bool                    // Whether the storage accesses of SLOAD and SSTORE steps are timed
+	env                *vm.EVM                 // EVM whose StateDB is decorated while tracing, nil if not timing the state
+	stateDB            vm.StateDB              // Undecorated StateDB of env, restored on CaptureEnd
+	gc                 []runtimemetrics.Sample // Reading of the completed GC cycles, nil unless flagging steps
+	gcCycles           uint64                  // Completed GC cycles when the last step was settled
+	format             timingFormat            // Layout of the CSV output
+	jsonRows           bool                    // Whether the rows are returned as JSON arrays instead of CSV
+	summary            *timingSummary          // Per-opcode aggregates in summary mode, nil to record every step
+	histogram          *timingHistogram        // Per-opcode step time buckets in histogram mode, nil to record every step
+	hotspots           timingHotspots          // Per-location aggregates in hotspots mode, nil to record every step
+	lastHotspot        *timingAggregate        // Aggregate of the last recorded step in hotspots mode
+	lastOp             vm.OpCode               // Opcode of the last recorded step
+	percentiles        *timingPercentiles      // Step times per opcode, nil if no percentiles are requested
+	slowest            *slowSteps              // Slowest steps, nil if not requested
+	opcodes            *opcodeSet              // Opcodes of the steps to record, nil to record all
+	contract           *common.Address         // Code address of the frames to record, nil to record all
+	maxDepth           int                     // Call depth of the deepest steps to record, counting from 1
+	firstOccurrences   int                     // Number of steps to record per opcode, zero to record all
+	occurrences        [256]int                // Steps passing the filters per opcode, with firstOccurrences
+	stepIndex          int                     // Index of the next step among all executed steps
+	minDuration        int                     // Time in nanoseconds a step must exceed to be kept, zero to keep all
+	totalSteps         int                     // Number of timed steps, including those not kept
+	totalTime          int                     // Summed time of all timed steps, in the unit of the tracer's clock
+	timingClock                                // Source of the step times
+	calibrate          bool                    // Whether to measure the tracer's overhead on start
+	overhead           float64                 // Measured overhead included in every step time, in nanoseconds
+	checkpoint         *checkpointer           // Sink the rows are flushed to in batches, nil to keep all in memory
+	metrics            *timingMetrics          // Step times to publish into the metrics registry, nil if not enabled
+	txCtx              *tracers.Context        // Context of the traced transaction, nil for a dangling call
+	deterministic      bool                    // Whether the garbage collector is disabled and the OS thread locked while tracing
+	holdsDeterministic atomic.Bool             // Whether the tracer holds the deterministic mode
+	gcPercent          int                     // Garbage collector setting restored on release of the deterministic mode
+	threadLocked       bool                    // Whether the OS thread was locked by the deterministic mode
+	deterministicErr   error                   // Error failing the result if the deterministic mode was held elsewhere
+	interrupt          atomic.Bool             // Atomic flag to signal execution interruption
+	reason             error                   // Textual reason for the interruption
+}
+
+type timingTracerConfig struct {
+	BudgetMs          int                    `json:"budgetMs"`          // If non-zero, steps are no longer traced after this many milliseconds
+	CheckpointSamples int                    `json:"checkpointSamples"` // If non-zero, rows are flushed to a file in batches of this size
+	CheckpointFile    string                 `json:"checkpointFile"`    // File within the tracer output directory to flush the rows to, a temp file if empty
+	Clock             string                 `json:"clock"`             // Timestamp source, clockMonotonic (default), clockTSC or clockCPU
+	Output            string                 `json:"output"`            // Result encoding of the rows, outputCSV (default) or outputJSON
+	Unit              string                 `json:"unit"`              // Unit of the time column, one of timeUnits, nanoseconds if empty
+	Delimiter         string                 `json:"delimiter"`         // Field delimiter of the CSV output, a comma if empty
+	Resolution        *int                   `json:"resolution"`        // If set, only every resolution-th step is recorded
+	Summary           bool                   `json:"summary"`           // If true, steps are aggregated per opcode instead of recorded individually
+	Histogram         *timingHistogramConfig `json:"histogram"`         // If set, step times are counted in buckets per opcode instead of recorded individually
+	Calls             bool                   `json:"calls"`             // If true, rows are recorded when entering and exiting call frames
+	Precompiles       bool                   `json:"precompiles"`       // If true, a row is recorded for every precompile call
+	StateTiming       bool                   `json:"stateTiming"`       // If true, the time SLOAD and SSTORE steps spend accessing the StateDB is recorded
+	GC                bool                   `json:"gc"`                // If true, steps during which a garbage collection cycle completed are flagged
+	FirstOccurrences  int                    `json:"firstOccurrences"`  // If non-zero, only the first this many steps of every opcode are recorded
+	Deterministic     bool                   `json:"deterministic"`     // If true, the garbage collector is disabled and the OS thread locked while tracing
+	Metrics           bool                   `json:"metrics"`           // If true, the step times are published as per-opcode timers of the metrics registry
+	Hotspots          bool                   `json:"hotspots"`          // If true, steps are aggregated per code address, pc and opcode instead of recorded individually
+	Percentiles       []float64              `json:"percentiles"`       // Percentiles of the step times to report per opcode
+	Calibrate         bool                   `json:"calibrate"`         // If true, the tracer's own overhead per step is measured and reported
+	TopN              int                    `json:"topN"`              // If non-zero, the given number of slowest steps is reported
+	OutputFile        string                 `json:"outputFile"`        // If set, rows are streamed into this CSV file instead of kept in memory
+	Opcodes           []string               `json:"opcodes"`           // If non-empty, only steps executing these opcodes are recorded
+	Contract          *common.Address        `json:"contract"`          // If set, only steps executing this contract's code are recorded
+	MinDurationNs     int                    `json:"minDurationNs"`     // If non-zero, only steps taking longer than this many nanoseconds are kept
+	MaxDepth          *int                   `json:"maxDepth"`          // If set, only steps nested at most this many calls deep are recorded, 0 for the top-level frame only
+	MaxRows           int                    `json:"maxRows"`           // If non-zero, only this many of the most recent rows are kept in memory
+}
+
+// timeUnits maps the configurable units of the time column to their length in
+// nanoseconds.
+var timeUnits = map[string]int{
+	"ns": 1,
+	"us": 1000,
+	"ms": 1000000,
+}
+
+const (
+	outputCSV  = "csv"  // The rows as a CSV string
+	outputJSON = "json" // The column names and an array of rows with typed values
+)
+
+// timingColumns are the columns of the timing tracer's CSV output.
+var timingColumns = []tracers.ColumnInfo{
+	{Name: "opcodes", Type: columnString},
+	{Name: "time", Type: columnInt, Unit: "ns"},
+	{Name: "cost", Type: columnInt, Unit: "gas"},
+	{Name: "codeCtx", Type: columnString},
+	{Name: "frame", Type: columnInt},
+	{Name: "pc", Type: columnInt},
+	{Name: "depth", Type: columnInt},
+	{Name: "childTime", Type: columnInt, Unit: "ns"},
+	{Name: "err", Type: columnString},
+	{Name: "nsPerGas", Type: columnFloat, Unit: "ns/gas"},
+	{Name: "gasRemaining", Type: columnInt, Unit: "gas"},
+	{Name: "memSize", Type: columnInt, Unit: "bytes"},
+	{Name: "stackLen", Type: columnInt},
+	{Name: "kind", Type: columnString},
+	{Name: "callee", Type: columnString},
+	{Name: "inputSize", Type: columnInt, Unit: "bytes"},
+	{Name: "stateTime", Type: columnInt, Unit: "ns"},
+	{Name: "gcDuringStep", Type: columnBool},
+	{Name: "stepIndex", Type: columnInt},
+}
+
+// timingRowKind tells the steps and the call boundaries apart in the output.
+type timingRowKind uint8
+
+const (
+	rowStep       timingRowKind = iota // An executed step
+	rowEnter                           // A call frame being entered, by the step before
+	rowExit                            // A call frame returning, timed from its entry
+	rowPrecompile                      // A precompile call, timed from entry to return
+)
+
+// timingRowKinds are the labels of the row kinds in the kind column.
+var timingRowKinds = [...]string{
+	rowStep:       "step",
+	rowEnter:      "enter",
+	rowExit:       "exit",
+	rowPrecompile: "precompile",
+}
+
+// timingFormat is the layout of the timing tracer's CSV output.
+type timingFormat struct {
+	columns []tracers.ColumnInfo // Columns of the CSV
+	scale   int                  // Length of a unit of the time column in nanoseconds
+	comma   rune                 // Field delimiter of the CSV, a comma if zero
+	gc      bool                 // Whether the steps are flagged for garbage collection
+}
+
+// parseDelimiter validates the configured CSV field delimiter, returning zero
+// for the default comma. The delimiter must be a single printable character
+// or a tab, and can't be one the CSV encoding reserves for quoting or rows.
+func parseDelimiter(delimiter string) (rune, error) {
+	if delimiter == "" {
+		return 0, nil
+	}
+	r, size := utf8.DecodeRuneInString(delimiter)
+	if size != len(delimiter) || r == utf8.RuneError {
+		return 0, fmt.Errorf("invalid delimiter %q, must be a single character", delimiter)
+	}
+	if r == '"' || r == '\r' || r == '\n' || (r != '\t' && !unicode.IsPrint(r)) {
+		return 0, fmt.Errorf("invalid delimiter %q", delimiter)
+	}
+	return r, nil
+}
+
+// newWriter returns a CSV writer into out using the format's delimiter.
+func (f timingFormat) newWriter(out io.Writer) *csv.Writer {
+	w := csv.NewWriter(out)
+	if f.comma != 0 {
+		w.Comma = f.comma
+	}
+	return w
+}
+
+// defaultTimingFormat is the layout of the CSV without any option configured.
+var defaultTimingFormat = timingFormat{columns: timingColumns, scale: 1}
+
+// newTimingFormat returns the CSV layout for the given time unit, which must be
+// empty or one of timeUnits. With an explicit unit, the time columns are named
+// after it and values of coarser units are fractional.
+func newTimingFormat(unit string) (timingFormat, error) {
+	if unit == "" {
+		return defaultTimingFormat, nil
+	}
+	scale, ok := timeUnits[unit]
+	if !ok {
+		return timingFormat{}, fmt.Errorf("unknown time unit %q", unit)
+	}
+	columns := append([]tracers.ColumnInfo{}, timingColumns...)
+	for i, column := range columns {
+		if column.Unit != "ns" {
+			continue
+		}
+		column.Name += "_" + unit
+		column.Unit = unit
+		if scale > 1 {
+			column.Type = columnFloat
+		}
+		columns[i] = column
+	}
+	return timingFormat{columns: columns, scale: scale}, nil
+}
+
+// timingSample is a single recorded step. Times are in nanoseconds or in ticks
+// of the timestamp counter, depending on the tracer's clock.
+//
+// The fields are ordered by size to avoid padding, as millions of samples may
+// be held in memory.
+type timingSample struct {
+	time      int    // Time the step took, excluding child frames
+	childTime int    // Time spent in the child frames entered by the step
+	stateTime int    // Time the step spent accessing the state
+	cost      int    // Gas charged for the step
+	gas       uint64 // Gas remaining before the step
+	pc        uint64 // Program counter of the step
+	frameId   int    // Id of the call frame the step ran in
+	index     int    // Index of the step among all executed steps
+	memSize   int    // Size of the frame's memory before the step expanded it
+	err       string // Error the step failed with, if any
+	depth     uint16 // Call depth of the step, at most 1025
+	stackLen  uint16 // Number of items on the frame's stack before the step, at most 1024
+	op        vm.OpCode
+
+	initCode   bool // Whether the step ran as initcode
+	dropped    bool // Whether the step was too fast to be kept, pending release
+	stateTimed bool // Whether the step is a storage step with its state accesses timed
+	gc         bool // Whether a garbage collection cycle completed during the step
+
+	// Call boundary rows reuse the columns above for the call type, the frame
+	// entered or exited, its gas and its time, and add the call details
+	kind      timingRowKind
+	callee    common.Address
+	inputSize int
+}
+
+// timingFrame is an entry of the timing tracer's call frame stack.
+type timingFrame struct {
+	id       int            // Frame number in order of entry, joinable with callTracer frames
+	address  common.Address // Address of the code the frame executes
+	initCode bool           // Whether the frame runs constructor code
+	step     timingStep     // Last recorded step of the frame, if its time is still running
+	entered  int            // Clock reading when the step entered a child frame
+
+	// Details of the call that entered the frame, for call boundary rows
+	typ        vm.OpCode
+	input      int
+	gas        uint64
+	started    int  // Clock reading when the frame was entered
+	precompile bool // Whether the frame runs a precompile, which executes no steps
+}
+
+// timingStep is a recorded step whose time is not settled yet. A step lasts
+// until the next step or the end of its frame, with the clock paused while a
+// child frame it entered is executing.
+type timingStep struct {
+	active bool
+	op     vm.OpCode
+	pc     uint64
+	depth  int
+	row    int // Index of the step's row, unused when steps are aggregated
+	start  int // Clock reading when the step started or resumed
+	time   int // Time accumulated before the step was last paused
+	child  int // Time spent in child frames
+	state  int // Time spent accessing the state, for timed storage steps
+
+	hotspot *timingAggregate // Aggregate of the step's location in hotspots mode
 }
 
 // newTimingTracer returns a new noop tracer.
-func newTimingTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+func newTimingTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
+	var config timingTracerConfig
+	if cfg != nil {
+		if err := json.Unmarshal(cfg, &config); err != nil {
+			return nil, err
+		}
+	}
+	budget, err := newTraceBudget(config.BudgetMs)
+	if err != nil {
+		return nil, err
+	}
+	format, err := newTimingFormat(config.Unit)
+	if err != nil {
+		return nil, err
+	}
+	if format.comma, err = parseDelimiter(config.Delimiter); err != nil {
+		return nil, err
+	}
+	format.gc = config.GC
+	resolution := 1
+	if config.Resolution != nil {
+		if resolution = *config.Resolution; resolution <= 0 {
+			return nil, fmt.Errorf("invalid resolution %d", resolution)
+		}
+	}
+	maxDepth := math.MaxInt
+	if config.MaxDepth != nil {
+		if *config.MaxDepth < 0 {
+			return nil, fmt.Errorf("invalid maxDepth %d", *config.MaxDepth)
+		}
+		maxDepth = *config.MaxDepth + 1 // The top-level frame is at depth 1
+	}
+	if config.FirstOccurrences < 0 {
+		return nil, fmt.Errorf("invalid firstOccurrences %d", config.FirstOccurrences)
+	}
+	if config.MaxRows < 0 {
+		return nil, fmt.Errorf("invalid maxRows %d", config.MaxRows)
+	}
+	if config.MinDurationNs < 0 {
+		return nil, fmt.Errorf("invalid minDurationNs %d", config.MinDurationNs)
+	}
+	percentiles, err := newTimingPercentiles(config.Percentiles)
+	if err != nil {
+		return nil, err
+	}
+	slowest, err := newSlowSteps(config.TopN)
+	if err != nil {
+		return nil, err
+	}
+	opcodes, err := newOpcodeSet(config.Opcodes)
+	if err != nil {
+		return nil, err
+	}
+	histogram, err := newTimingHistogram(config.Histogram)
+	if err != nil {
+		return nil, err
+	}
+	var modes int
+	for _, enabled := range []bool{config.Summary, histogram != nil, config.Hotspots} {
+		if enabled {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return nil, errors.New("only one of summary, histogram and hotspots can be configured")
+	}
+	if modes > 0 && (config.Calls || config.Precompiles || config.StateTiming || config.GC) {
+		return nil, errors.New("calls, precompiles, stateTiming or gc cannot be combined with summary, histogram or hotspots")
+	}
+	if modes > 0 && (config.CheckpointSamples != 0 || config.OutputFile != "") {
+		return nil, errCheckpointSummary
+	}
+	if config.OutputFile != "" && config.CheckpointSamples != 0 {
+		return nil, errors.New("outputFile cannot be combined with checkpointSamples")
+	}
+	checkpoint, err := newCheckpointer("timingTracer", config.CheckpointSamples, config.CheckpointFile, format.columns)
+	if err != nil {
+		return nil, err
+	}
+	if config.OutputFile != "" {
+		path, err := outputPath(config.OutputFile)
+		if err != nil {
+			return nil, err
+		}
+		checkpoint = newStreamer(path, format.columns)
+	}
+	if checkpoint != nil {
+		checkpoint.comma = format.comma
+	}
+	if config.MaxRows != 0 && (modes > 0 || checkpoint != nil) {
+		return nil, errors.New("maxRows is only supported for step rows kept in memory")
+	}
+	switch config.Output {
+	case "", outputCSV:
+	case outputJSON:
+		if modes > 0 || checkpoint != nil {
+			return nil, errors.New("json output is only supported for step rows kept in memory")
+		}
+		if format.comma != 0 {
+			return nil, errors.New("delimiter cannot be combined with json output")
+		}
+	default:
+		return nil, fmt.Errorf("unknown output %q", config.Output)
+	}
+	clock, err := newTimingClock(config.Clock)
+	if err != nil {
+		return nil, err
+	}
 	t := &timingTracer{
-		opcodes:      []vm.OpCode{},
-		timings:      []int{},
-		remainingGas: 0,
-		opcodeCosts:  NewOpcodeCosts(),
+		maxRows:          config.MaxRows,
+		firstOccurrences: config.FirstOccurrences,
+		budget:           budget,
+		sampler:          newAdaptiveSampler(resolution, 0),
+		format:           format,
+		jsonRows:         config.Output == outputJSON,
+		percentiles:      percentiles,
+		slowest:          slowest,
+		histogram:        histogram,
+		opcodes:          opcodes,
+		contract:         config.Contract,
+		maxDepth:         maxDepth,
+		minDuration:      config.MinDurationNs,
+		calls:            config.Calls,
+		precompiles:      config.Precompiles,
+		stateTiming:      config.StateTiming,
+		calibrate:        config.Calibrate,
+		deterministic:    config.Deterministic,
+		checkpoint:       checkpoint,
+		timingClock:      clock,
+		txCtx:            txContext(ctx),
+	}
+	if config.Summary {
+		t.summary = new(timingSummary)
+	}
+	if config.Hotspots {
+		t.hotspots = make(timingHotspots)
+	}
+	if config.GC {
+		t.gc = []runtimemetrics.Sample{{Name: gcCyclesMetric}}
+	}
+	if config.Metrics {
+		t.metrics = new(timingMetrics)
 	}
-
 	return t, nil
 }
 
 // CaptureStart implements the EVMLogger interface to initialize the tracing operation.
 func (t *timingTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
-	t.time = time.Now()
+	if t.deterministic {
+		t.acquireDeterministic()
+	}
+	if t.cpu {
+		// The thread's CPU time is only consistent if execution stays on it
+		runtime.LockOSThread()
+	}
+	t.frames = append(t.frames[:0], timingFrame{id: 0, address: to, initCode: create})
+	t.nextFrameId = 1
+	t.startGas = int(gas)
+	if t.calibrate {
+		t.overhead = calibrateOverhead(t.clock)
+	}
+	if t.precompiles && env != nil {
+		// Update list of precompiles based on current block
+		rules := env.ChainConfig().Rules(env.Context.BlockNumber, env.Context.Random != nil, env.Context.Time)
+		t.activePrecompiles = vm.ActivePrecompiles(rules)
+	}
+	if t.gc != nil {
+		t.gcCycles = t.readGCCycles()
+	}
+	if t.stateTiming && env != nil {
+		t.env, t.stateDB = env, env.StateDB
+		env.StateDB = &timingStateDB{StateDB: env.StateDB, tracer: t}
+	}
+	t.budget.start()
+	if t.checkpoint != nil {
+		t.checkpoint.open()
+	}
 }
 
 // CaptureEnd is called after the call finishes to finalize the tracing.
 func (t *timingTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	t.settleTime(t.frame(), t.now())
 
+	// Charge the last step up to the gas the call returns, unless it was not
+	// recorded or its cost was settled on expiry. The gas left at the end of
+	// the transaction includes the refund, so it can't be used.
+	if t.recorded {
+		t.settleCost(t.remainingGas - (t.startGas - int(gasUsed)))
+		t.recorded = false
+	}
+	if t.env != nil {
+		t.env.StateDB = t.stateDB
+		t.env, t.stateDB = nil, nil
+	}
+	if t.cpu {
+		runtime.UnlockOSThread()
+	}
+	// The top call is done, so release the deterministic mode without waiting
+	// for the end of the transaction, which not every caller reports
+	t.unlockThread()
 }
 
 // CaptureState implements the EVMLogger interface to trace a single step of VM execution.
 func (t *timingTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
-	elapsedTime := time.Since(t.time)
-	if t.remainingGas == 0 {
-		t.remainingGas = int(gas)
-	} else {
-		gasCost := t.remainingGas - int(gas)
-		t.cost = append(t.cost, gasCost)
-		t.remainingGas = int(gas)
+	if t.budget.exceeded || t.interrupt.Load() {
+		return
 	}
+	index := t.stepIndex
+	t.stepIndex++
 
-	t.timings = append(t.timings, int(elapsedTime.Nanoseconds()))
-	t.opcodes = append(t.opcodes, op)
-	t.time = time.Now()
+	frame := t.frame()
+	if frame.step.active {
+		t.settleTime(frame, t.now())
+	}
+	if t.recorded {
+		t.settleCost(t.remainingGas - int(gas))
+	}
+	t.remainingGas = int(gas)
+	t.recorded = false
+
+	// Skip filtered steps before they count towards the budget or resolution
+	if t.opcodes != nil && !t.opcodes[op] {
+		return
+	}
+	if t.contract != nil && frame.address != *t.contract {
+		return
+	}
+	if depth > t.maxDepth {
+		return
+	}
+	if t.firstOccurrences > 0 {
+		if t.occurrences[op] == t.firstOccurrences {
+			return
+		}
+		t.occurrences[op]++
+	}
+	// The cost of the previous step is known now, so stop here if out of budget
+	if !t.budget.step() {
+		return
+	}
+	if !t.sampler.step() {
+		return
+	}
+	t.recorded = true
+	t.stepCost = int(cost)
+	frame.step = timingStep{active: true, op: op, pc: pc, depth: depth}
+	switch {
+	case t.summary != nil:
+		t.summary[op].count++
+		t.lastOp = op
+	case t.histogram != nil:
+		// Only the time of the step is counted once settled
+	case t.hotspots != nil:
+		key := hotspotKey{code: frame.address, pc: pc, op: op}
+		if scope != nil && scope.Contract.CodeAddr != nil {
+			key.code = *scope.Contract.CodeAddr
+		}
+		frame.step.hotspot = t.hotspots.aggregate(key)
+		frame.step.hotspot.count++
+		t.lastHotspot = frame.step.hotspot
+	default:
+		sample := timingSample{
+			op:       op,
+			initCode: frame.initCode,
+			frameId:  frame.id,
+			pc:       pc,
+			depth:    uint16(depth),
+			gas:      gas,
+			index:    index,
+		}
+		if t.stateTiming && timesState(op) {
+			sample.stateTimed = true
+		}
+		if scope != nil {
+			sample.memSize = scope.Memory.Len()
+			sample.stackLen = uint16(len(scope.Stack.Data()))
+		}
+		if err != nil {
+			sample.err = err.Error()
+		}
+		frame.step.row = t.appendRow(sample)
+		t.lastRow = frame.step.row
+		if t.checkpoint.due(t.samples.len() - 1) {
+			if n := t.settledRows(); n > 0 {
+				t.flushRows(n)
+			}
+		}
+	}
+	frame.step.start = t.now()
 }
 
-// CaptureFault implements the EVMLogger interface to trace an execution fault.
+// opcodeSet is a set of opcodes, indexed by their value.
+type opcodeSet [256]bool
+
+// newOpcodeSet parses a set of opcode names, returning nil for an empty list.
+func newOpcodeSet(names []string) (*opcodeSet, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	set := new(opcodeSet)
+	for _, name := range names {
+		// StringToOp maps unknown names to STOP
+		op := vm.StringToOp(name)
+		if op == vm.STOP && name != "STOP" {
+			return nil, fmt.Errorf("unknown opcode %q", name)
+		}
+		set[op] = true
+	}
+	return set, nil
+}
+
+// calibrationSteps is the number of steps the overhead calibration traces.
+const calibrationSteps = 10000
+
+// calibrateOverhead measures the mean time the timing tracer records for a step
+// that does no work, which is the bias its own bookkeeping adds to every step
+// time, in nanoseconds.
+func calibrateOverhead(clock string) float64 {
+	t, err := newTimingTracer(nil, json.RawMessage(fmt.Sprintf(`{"clock": %q}`, clock)))
+	if err != nil {
+		return 0
+	}
+	tracer := t.(*timingTracer)
+	gas := uint64(calibrationSteps + 1)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, gas, nil)
+	for i := 0; i < calibrationSteps; i++ {
+		tracer.CaptureState(uint64(i), vm.JUMPDEST, gas, 1, nil, nil, 1, nil)
+		gas--
+	}
+	tracer.CaptureEnd(nil, 0, nil)
+
+	var total int
+	for i := 0; i < tracer.samples.len(); i++ {
+		total += tracer.nanos(tracer.samples.at(i).time)
+	}
+	return float64(total) / float64(tracer.samples.len())
+}
+
+// settleTime completes the time of the pending step of a frame.
+func (t *timingTracer) settleTime(frame *timingFrame, now int) {
+	step := &frame.step
+	if !step.active {
+		return
+	}
+	step.active = false
+
+	elapsed := step.time + now - step.start
+	if t.percentiles != nil {
+		t.percentiles.add(step.op, elapsed)
+	}
+	if t.slowest != nil {
+		t.slowest.add(slowStepEntry{op: step.op, pc: step.pc, depth: step.depth, time: elapsed})
+	}
+	if t.metrics != nil {
+		t.metrics.add(step.op, t.nanos(elapsed))
+	}
+	if t.summary != nil {
+		t.summary[step.op].addTime(elapsed, t.nanos(elapsed))
+		return
+	}
+	if t.histogram != nil {
+		t.histogram.add(step.op, t.nanos(elapsed))
+		return
+	}
+	if t.hotspots != nil {
+		step.hotspot.addTime(elapsed, t.nanos(elapsed))
+		return
+	}
+	if sample := t.row(step.row); sample != nil {
+		sample.time = elapsed
+		sample.childTime = step.child
+		sample.stateTime = step.state
+	}
+	if t.gc != nil {
+		// The cycles are read once the step is timed, keeping the read out
+		// of the step times
+		cycles := t.readGCCycles()
+		if sample := t.row(step.row); sample != nil {
+			sample.gc = cycles != t.gcCycles
+		}
+		t.gcCycles = cycles
+	}
+
+	// With a threshold, the step is dropped if its cost is settled too
+	if t.minDuration > 0 {
+		t.totalSteps++
+		t.totalTime += elapsed
+		if !t.recorded || step.row != t.lastRow {
+			t.dropFast(step.row)
+		}
+	}
+}
+
+// dropFast drops a settled row if its step didn't exceed the threshold. The
+// dropped rows at the end are released, the ones followed by kept rows are
+// only skipped in the output.
+func (t *timingTracer) dropFast(row int) {
+	sample := t.row(row)
+	if sample == nil || t.nanos(sample.time) > t.minDuration {
+		return
+	}
+	sample.dropped = true
+	if t.maxRows > 0 {
+		for t.ringTail > t.ringHead && t.row(t.ringTail-1).dropped {
+			t.ringTail--
+		}
+		return
+	}
+	n := t.samples.len()
+	for n > 0 && t.samples.at(n-1).dropped {
+		n--
+	}
+	t.samples.truncate(n)
+}
+
+// keptRows returns the number of rows without the dropped ones, along with
+// an accessor of the rows in order. The rows are compacted in place, unless
+// they form a ring, which is copied if rows were dropped.
+func (t *timingTracer) keptRows() (int, func(int) *timingSample) {
+	if t.maxRows > 0 {
+		head := t.ringHead
+		if t.minDuration == 0 {
+			return t.ringTail - head, func(i int) *timingSample { return t.row(head + i) }
+		}
+		kept := new(timingRows)
+		for i := head; i < t.ringTail; i++ {
+			if sample := t.row(i); !sample.dropped {
+				kept.append(*sample)
+			}
+		}
+		return kept.len(), kept.at
+	}
+	if t.minDuration > 0 {
+		t.samples.compact()
+	}
+	return t.samples.len(), t.samples.at
+}
+
+// settledRows returns the number of leading rows whose cost and time are both
+// settled. The rows following a step that entered a child frame are held
+// back until the child returns.
+func (t *timingTracer) settledRows() int {
+	n := t.samples.len()
+	if t.recorded && t.lastRow < n {
+		n = t.lastRow // The cost of the last step is settled by the next one
+	}
+	for _, frame := range t.frames {
+		if frame.step.active && frame.step.row < n {
+			n = frame.step.row
+		}
+	}
+	return n
+}
+
+// settleCost records the gas cost of the last recorded step.
+func (t *timingTracer) settleCost(cost int) {
+	if t.histogram != nil {
+		return
+	}
+	if t.summary != nil {
+		t.summary[t.lastOp].cost += cost
+		return
+	}
+	if t.hotspots != nil {
+		t.lastHotspot.cost += cost
+		return
+	}
+	row := t.lastRow
+	if sample := t.row(row); sample != nil {
+		sample.cost = cost
+	}
+
+	// With a threshold, the step is dropped if its time is settled too
+	if t.minDuration > 0 {
+		for _, frame := range t.frames {
+			if frame.step.active && frame.step.row == row {
+				return
+			}
+		}
+		t.dropFast(row)
+	}
+}
+
+// gcCyclesMetric is the runtime metric counting the completed garbage
+// collection cycles.
+const gcCyclesMetric = "/gc/cycles/total:gc-cycles"
+
+// readGCCycles returns the number of garbage collection cycles completed by
+// the runtime. Unlike runtime.ReadMemStats, reading it doesn't stop the world.
+func (t *timingTracer) readGCCycles() uint64 {
+	runtimemetrics.Read(t.gc)
+	if t.gc[0].Value.Kind() != runtimemetrics.KindUint64 {
+		return 0
+	}
+	return t.gc[0].Value.Uint64()
+}
+
+// resultMeta returns the metadata reported alongside the CSV, if any.
+func (t *timingTracer) resultMeta() *tableMeta {
+	meta := newTableMeta(nil, t.budget)
+	if t.clock == "" && t.percentiles == nil && t.slowest == nil && !t.calibrate && t.txCtx == nil && t.minDuration == 0 && t.truncated == 0 {
+		return meta
+	}
+	if meta == nil {
+		meta = new(tableMeta)
+	}
+	t.annotate(meta)
+	if t.percentiles != nil {
+		meta.Percentiles = t.percentiles.result(t.format, t.nanos)
+	}
+	if t.calibrate {
+		meta.OverheadNs = t.overhead
+	}
+	if t.slowest != nil {
+		meta.Slowest = t.slowest.result(t.format, t.nanos)
+	}
+	if t.txCtx != nil {
+		meta.annotateContext(t.txCtx)
+	}
+	if t.minDuration > 0 {
+		meta.TotalSteps = &t.totalSteps
+		meta.TotalTime = float64(t.nanos(t.totalTime)) / float64(t.format.scale)
+	}
+	if t.truncated > 0 {
+		meta.Truncated = true
+		meta.DroppedRows = t.truncated
+	}
+	return meta
+}
+
+// flushRows checkpoints the first n rows, which must be settled, and releases
+// them from memory.
+func (t *timingTracer) flushRows(n int) {
+	for i := 0; i < n; i++ {
+		sample := t.samples.at(i)
+		if sample.dropped {
+			continue
+		}
+		t.checkpoint.write(t.format.row(sample, t.nanos))
+		t.checkpoint.observe(1, int64(t.nanos(sample.time)))
+		t.checkpoint.observe(2, int64(sample.cost))
+		t.checkpoint.observe(7, int64(t.nanos(sample.childTime)))
+		t.checkpoint.observe(10, int64(sample.gas))
+		t.checkpoint.observe(11, int64(sample.memSize))
+		t.checkpoint.observe(15, int64(sample.inputSize))
+		if sample.stateTimed {
+			t.checkpoint.observe(16, int64(t.nanos(sample.stateTime)))
+		}
+	}
+	t.checkpoint.commit()
+
+	t.samples.shift(n)
+	for i := range t.frames {
+		t.frames[i].step.row -= n
+	}
+	t.lastRow -= n
+}
+
+// CaptureFault implements the EVMLogger interface to trace an execution fault,
+// which is raised by the last step of the current frame.
 func (t *timingTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
+	if frame := t.frame(); frame.step.active && !t.aggregated() {
+		if sample := t.row(frame.step.row); sample != nil {
+			sample.err = err.Error()
+		}
+	}
+}
+
+// appendRow adds a row, returning its index. With maxRows, the rows form a
+// ring in which the oldest row is overwritten once it is full.
+func (t *timingTracer) appendRow(sample timingSample) int {
+	if t.maxRows == 0 {
+		return t.samples.append(sample)
+	}
+	if t.ringTail-t.ringHead == t.maxRows {
+		if !t.samples.at(t.ringHead % t.maxRows).dropped {
+			t.truncated++
+		}
+		t.ringHead++
+	}
+	row := t.ringTail
+	if slot := row % t.maxRows; slot < t.samples.len() {
+		*t.samples.at(slot) = sample
+	} else {
+		t.samples.append(sample)
+	}
+	t.ringTail++
+	return row
+}
+
+// row returns the row at the given index, or nil if it was overwritten.
+func (t *timingTracer) row(i int) *timingSample {
+	if t.maxRows == 0 {
+		return t.samples.at(i)
+	}
+	if i < t.ringHead {
+		return nil
+	}
+	return t.samples.at(i % t.maxRows)
 }
 
 // CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
 func (t *timingTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	// The gas delta to the next step would span the frame, so the step
+	// entering it is settled with its own cost, and the frame's steps are
+	// charged from the gas it was given
+	if t.recorded {
+		t.settleCost(entryCost(t.stepCost, typ, gas, value))
+		t.recorded = false
+	}
+	t.remainingGas = int(gas)
+
+	// Pause the clock of the step entering the frame
+	if parent := t.frame(); parent.step.active {
+		now := t.now()
+		parent.step.time += now - parent.step.start
+		parent.entered = now
+	}
+	t.frames = append(t.frames, timingFrame{
+		id:       t.nextFrameId,
+		address:  to,
+		initCode: typ == vm.CREATE || typ == vm.CREATE2,
+		typ:      typ,
+		input:    len(input),
+		gas:      gas,
+	})
+	t.nextFrameId++
+
+	frame := &t.frames[len(t.frames)-1]
+	frame.precompile = t.precompiles && t.isPrecompiled(to)
+	if t.timesFrame(frame) {
+		if !frame.precompile {
+			t.appendRow(frame.boundary(rowEnter, len(t.frames)))
+		}
+		frame.started = t.now()
+	}
+}
 
+// entryCost returns the gas charged for a step entering a call frame by itself.
+// The cost of the CALL family includes the gas forwarded to the frame, apart
+// from the stipend of a value transfer, which the caller isn't charged. The
+// gas CREATE and CREATE2 forward is taken outside of their cost.
+func entryCost(cost int, typ vm.OpCode, gas uint64, value *big.Int) int {
+	switch typ {
+	case vm.CALL, vm.CALLCODE:
+		if value != nil && value.Sign() != 0 {
+			gas -= params.CallStipend
+		}
+		return cost - int(gas)
+	case vm.DELEGATECALL, vm.STATICCALL:
+		return cost - int(gas)
+	}
+	return cost
+}
+
+// timesFrame reports whether rows are to be recorded for the frame, which is
+// timed from its entry.
+func (t *timingTracer) timesFrame(frame *timingFrame) bool {
+	return (t.calls || frame.precompile) && !t.budget.exceeded && !t.interrupt.Load()
+}
+
+// isPrecompiled returns whether the addr is a precompile.
+func (t *timingTracer) isPrecompiled(addr common.Address) bool {
+	for _, p := range t.activePrecompiles {
+		if p == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// boundary returns a call boundary row of the frame at the given depth.
+func (f *timingFrame) boundary(kind timingRowKind, depth int) timingSample {
+	return timingSample{
+		kind:      kind,
+		op:        f.typ,
+		initCode:  f.initCode,
+		frameId:   f.id,
+		depth:     uint16(depth),
+		gas:       f.gas,
+		callee:    f.address,
+		inputSize: f.input,
+	}
 }
 
 // CaptureExit is called when EVM exits a scope, even if the scope didn't
 // execute any code.
 func (t *timingTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	if len(t.frames) == 0 {
+		return
+	}
+	child := &t.frames[len(t.frames)-1]
+	var parent *timingFrame
+	if len(t.frames) > 1 {
+		parent = &t.frames[len(t.frames)-2]
+	}
+	// The last step of the frame is charged up to the gas it returns
+	if t.recorded {
+		t.settleCost(t.remainingGas - int(child.gas-gasUsed))
+		t.recorded = false
+	}
+	// Only read the clock if a step or the frame is timed, which is never the
+	// case in frames that are filtered out
+	if child.step.active || (parent != nil && parent.step.active) || t.timesFrame(child) {
+		now := t.now()
+		t.settleTime(child, now)
+
+		if t.timesFrame(child) {
+			kind := rowExit
+			if child.precompile {
+				kind = rowPrecompile
+			}
+			row := child.boundary(kind, len(t.frames))
+			row.time = now - child.started
+			row.cost = int(gasUsed)
+			row.gas = child.gas - gasUsed
+			if err != nil {
+				row.err = err.Error()
+			}
+			t.appendRow(row)
+		}
+
+		// Resume the clock of the step that entered the frame
+		if parent != nil && parent.step.active {
+			parent.step.child += now - parent.entered
+			parent.step.start = now
+		}
+	}
+	t.frames = t.frames[:len(t.frames)-1]
 }
 
-func (*timingTracer) CaptureTxStart(gasLimit uint64) {}
+// frame returns the currently executing call frame.
+func (t *timingTracer) frame() *timingFrame {
+	if len(t.frames) == 0 {
+		t.frames = append(t.frames, timingFrame{})
+	}
+	return &t.frames[len(t.frames)-1]
+}
+
+// Columns implements tracers.ColumnTracer, returning the CSV columns.
+func (t *timingTracer) Columns() []tracers.ColumnInfo {
+	if t.summary != nil {
+		return t.format.summaryColumns()
+	}
+	if t.histogram != nil {
+		return t.histogram.columns()
+	}
+	if t.hotspots != nil {
+		return t.format.hotspotColumns()
+	}
+	return t.format.columns
+}
+
+// aggregated reports whether the steps are aggregated instead of recorded as
+// individual rows.
+func (t *timingTracer) aggregated() bool {
+	return t.summary != nil || t.histogram != nil || t.hotspots != nil
+}
+
+// numbersFrames implements frameNumberer, the frame column of the timing rows
+// can be joined with the frameId of the callTracer frames in a muxTracer.
+func (*timingTracer) numbersFrames() {}
+
+// CaptureTxStart preallocates the first chunk of samples for the maximum
+// number of steps the gas limit allows, so that it doesn't grow while steps
+// are timed. Longer traces allocate further chunks of fixed size, bounding the
+// memory claimed upfront for transactions which don't use most of a large
+// limit.
+func (t *timingTracer) CaptureTxStart(gasLimit uint64) {
+	if t.aggregated() || t.checkpoint != nil || t.samples.len() > 0 {
+		return // The samples held in memory are few already
+	}
+	// Every step but a final STOP costs at least a gas
+	steps := gasLimit/uint64(t.sampler.resolution) + 1
+	if steps > sampleChunkSize {
+		steps = sampleChunkSize
+	}
+	if t.maxRows > 0 && steps > uint64(t.maxRows) {
+		steps = uint64(t.maxRows)
+	}
+	t.samples.reserve(int(steps))
+}
 
 func (t *timingTracer) CaptureTxEnd(restGas uint64) {
-	t.cost = append(t.cost, t.remainingGas-int(restGas))
+	t.unlockThread()
+
+	// Nothing is recorded after the transaction, so complete the file
+	if t.checkpoint != nil {
+		t.flushRows(t.settledRows())
+		t.checkpoint.close()
+	}
+	if t.metrics != nil {
+		t.metrics.publish()
+	}
 }
 
+// GetResult returns the recorded steps, or the data recorded up to the
+// interruption along with its reason if the tracer was stopped.
 func (t *timingTracer) GetResult() (json.RawMessage, error) {
-	csvData, err := TimingDataToCSV(t.opcodes, t.timings, t.cost)
-	// Encode the slice of slices to JSON
-	jsonBytes, err := json.Marshal(csvData)
+	// Release the deterministic mode in case the transaction didn't complete
+	t.releaseDeterministic()
+	if t.deterministicErr != nil {
+		return nil, t.deterministicErr
+	}
+	if t.checkpoint != nil {
+		// Flush the last partial batch, a step without settled cost is dropped
+		t.flushRows(t.settledRows())
+		return t.checkpoint.result(t.resultMeta(), t.stopReason())
+	}
+	res, err := t.tableResult()
 	if err != nil {
-		fmt.Println(err)
-		return json.RawMessage(`{}`), err
+		return nil, err
 	}
+	return res, t.stopReason()
+}
 
-	return jsonBytes, nil
+// tableResult encodes the in-memory result in the configured mode.
+func (t *timingTracer) tableResult() (json.RawMessage, error) {
+	if t.summary != nil {
+		buf := new(bytes.Buffer)
+		if err := writeTimingSummaryCSV(buf, t.format, t.summary, t.nanos); err != nil {
+			return nil, err
+		}
+		return marshalTableResult(t.resultMeta(), buf.String())
+	}
+	if t.histogram != nil {
+		buf := new(bytes.Buffer)
+		if err := t.histogram.writeCSV(buf, t.format); err != nil {
+			return nil, err
+		}
+		return marshalTableResult(t.resultMeta(), buf.String())
+	}
+	if t.hotspots != nil {
+		buf := new(bytes.Buffer)
+		if err := writeTimingHotspotsCSV(buf, t.format, t.hotspots, t.nanos); err != nil {
+			return nil, err
+		}
+		return marshalTableResult(t.resultMeta(), buf.String())
+	}
+	n, row := t.keptRows()
+	if t.jsonRows {
+		return marshalRowsResult(t.resultMeta(), t.format.columns, n, func(i int) []string {
+			return t.format.row(row(i), t.nanos)
+		})
+	}
+	buf := new(bytes.Buffer)
+	if err := writeTimingCSV(buf, t.format, n, row, t.nanos); err != nil {
+		return nil, err
+	}
+	return marshalTableResult(t.resultMeta(), buf.String())
+}
+
+// EncodeResult implements tracers.ResultEncoder, streaming the same result as
+// GetResult without building the CSV in memory.
+func (t *timingTracer) EncodeResult(w io.Writer) error {
+	t.releaseDeterministic()
+	if t.deterministicErr != nil {
+		return t.deterministicErr
+	}
+	if t.checkpoint != nil {
+		res, err := t.GetResult()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(res)
+		return err
+	}
+	if t.jsonRows {
+		res, err := t.tableResult()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(res); err != nil {
+			return err
+		}
+		return t.stopReason()
+	}
+	err := encodeTableResult(w, t.resultMeta(), func(w io.Writer) error {
+		if t.summary != nil {
+			return writeTimingSummaryCSV(w, t.format, t.summary, t.nanos)
+		}
+		if t.histogram != nil {
+			return t.histogram.writeCSV(w, t.format)
+		}
+		if t.hotspots != nil {
+			return writeTimingHotspotsCSV(w, t.format, t.hotspots, t.nanos)
+		}
+		n, row := t.keptRows()
+		return writeTimingCSV(w, t.format, n, row, t.nanos)
+	})
+	if err != nil {
+		return err
+	}
+	return t.stopReason()
 }
 
 // Stop terminates execution of the tracer at the first opportune moment.
 func (t *timingTracer) Stop(err error) {
+	t.reason = err
+	t.interrupt.Store(true)
+	t.releaseDeterministic()
 }
 
-func TimingDataToCSV(opcodes []vm.OpCode, timings, cost []int) (string, error) {
-	// Check if all slices have the same length
-	if len(opcodes) != len(timings) || len(timings) != len(cost) {
-		return "", errors.New("all slices must have the same length")
+// stopReason returns the reason tracing was interrupted, if it was.
+func (t *timingTracer) stopReason() error {
+	if !t.interrupt.Load() {
+		return nil
 	}
+	return t.reason
+}
 
-	// Create a buffer to hold the CSV data
+// TimingDataToCSV renders the samples as CSV, the nanos function converting
+// their times to nanoseconds.
+func TimingDataToCSV(format timingFormat, samples []timingSample, nanos func(int) int) (string, error) {
 	buf := &bytes.Buffer{}
-	w := csv.NewWriter(buf)
+	if err := writeTimingCSV(buf, format, len(samples), func(i int) *timingSample { return &samples[i] }, nanos); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeTimingCSV writes n samples as CSV into out, the row function returning
+// the i-th one.
+func writeTimingCSV(out io.Writer, format timingFormat, n int, row func(int) *timingSample, nanos func(int) int) error {
+	w := format.newWriter(out)
 
 	// Write the headers to the CSV
-	err := w.Write([]string{"opcodes", "time", "cost"})
+	err := w.Write(columnNames(format.columns))
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	// Write data to CSV
-	for i := 0; i < len(opcodes); i++ {
-		row := []string{
-			opcodes[i].String(),
-			strconv.Itoa(timings[i]),
-			strconv.Itoa(cost[i]),
-		}
-		err = w.Write(row)
+	for i := 0; i < n; i++ {
+		err = w.Write(format.row(row(i), nanos))
 		if err != nil {
-			return "", err
+			return err
 		}
 	}
 
@@ -150,10 +1254,92 @@ func TimingDataToCSV(opcodes []vm.OpCode, timings, cost []int) (string, error) {
 	w.Flush()
 
 	// Check for any errors during write
-	err = w.Error()
-	if err != nil {
-		return "", err
+	return w.Error()
+}
+
+// row formats a single step as a CSV row, the nanos function converting its
+// times to nanoseconds.
+func (f timingFormat) row(s *timingSample, nanos func(int) int) []string {
+	return []string{
+		opcodeName(s.op),
+		f.formatTime(nanos(s.time)),
+		strconv.Itoa(s.cost),
+		codeContext(s.initCode),
+		strconv.Itoa(s.frameId),
+		strconv.FormatUint(s.pc, 10),
+		strconv.Itoa(int(s.depth)),
+		f.formatTime(nanos(s.childTime)),
+		s.err,
+		nsPerGas(nanos(s.time), s.cost),
+		strconv.FormatUint(s.gas, 10),
+		strconv.Itoa(s.memSize),
+		strconv.Itoa(int(s.stackLen)),
+		timingRowKinds[s.kind],
+		s.calleeHex(),
+		strconv.Itoa(s.inputSize),
+		f.stateTime(s, nanos),
+		f.gcDuringStep(s),
+		s.stepIndex(),
 	}
+}
 
-	return buf.String(), nil
+// stepIndex renders the index of a step among all executed steps, empty for
+// call boundary rows.
+func (s *timingSample) stepIndex() string {
+	if s.kind != rowStep {
+		return ""
+	}
+	return strconv.Itoa(s.index)
+}
+
+// gcDuringStep renders whether a garbage collection cycle completed during a
+// step, empty for call boundary rows or if the steps aren't flagged.
+func (f timingFormat) gcDuringStep(s *timingSample) string {
+	if !f.gc || s.kind != rowStep {
+		return ""
+	}
+	return strconv.FormatBool(s.gc)
+}
+
+// stateTime renders the time a storage step spent accessing the state, empty
+// for all other rows or if not timed.
+func (f timingFormat) stateTime(s *timingSample, nanos func(int) int) string {
+	if !s.stateTimed {
+		return ""
+	}
+	return f.formatTime(nanos(s.stateTime))
+}
+
+// calleeHex renders the callee of a call boundary row, empty for steps.
+func (s *timingSample) calleeHex() string {
+	if s.kind == rowStep {
+		return ""
+	}
+	return s.callee.Hex()
+}
+
+// nsPerGas renders the time a step took per unit of gas it was charged. Steps
+// without a positive cost, like a STOP, render empty.
+func nsPerGas(ns, cost int) string {
+	if cost <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(ns)/float64(cost), 'f', -1, 64)
+}
+
+// formatTime renders a time given in nanoseconds in the unit of the time column.
+func (f timingFormat) formatTime(ns int) string {
+	if f.scale == 1 {
+		return strconv.Itoa(ns)
+	}
+	return strconv.FormatFloat(float64(ns)/float64(f.scale), 'f', -1, 64)
+}
+
+// codeContext returns the label of the code context a step was executed in,
+// separating constructor code from deployed runtime code.
+func codeContext(initCode bool) string {
+	if initCode {
+		return "init"
+	}
+	return "runtime"
 }
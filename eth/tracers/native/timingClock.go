@@ -0,0 +1,93 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	clockMonotonic = "monotonic" // The Go runtime clock
+	clockTSC       = "tsc"       // The CPU timestamp counter, falling back to the runtime clock if unavailable
+	clockCPU       = "cpu"       // The CPU time of the executing thread, falling back to the runtime clock if unavailable
+)
+
+// timingClock reads the timestamps steps are timed with, from the source
+// configured by a tracer's clock option.
+type timingClock struct {
+	clock        string    // Configured timestamp source, empty for the default
+	epoch        time.Time // Reference point of the runtime clock readings
+	tsc          bool      // Whether the readings are timestamp counter ticks
+	cpu          bool      // Whether the readings are CPU time of the tracing thread
+	tscFrequency float64   // Ticks per second of the timestamp counter
+}
+
+// newTimingClock validates the configured timestamp source, which must be
+// empty or one of the clock constants. Unsupported sources fall back to the
+// runtime clock.
+func newTimingClock(clock string) (timingClock, error) {
+	switch clock {
+	case "", clockMonotonic, clockTSC, clockCPU:
+	default:
+		return timingClock{}, fmt.Errorf("unknown clock %q", clock)
+	}
+	c := timingClock{clock: clock, epoch: time.Now()}
+	if clock == clockTSC && tscSupported {
+		c.tsc = true
+		c.tscFrequency, _ = calibrateTSC()
+	}
+	c.cpu = clock == clockCPU && threadCPUSupported
+	return c, nil
+}
+
+// now reads the clock, in nanoseconds since the tracer's creation, in ticks of
+// the timestamp counter or in nanoseconds of CPU time.
+func (c *timingClock) now() int {
+	if c.tsc {
+		return int(readTSC())
+	}
+	if c.cpu {
+		return int(readThreadCPU())
+	}
+	return int(time.Since(c.epoch))
+}
+
+// nanos converts a recorded step time to nanoseconds.
+func (c *timingClock) nanos(elapsed int) int {
+	if !c.tsc {
+		return elapsed
+	}
+	return int(float64(elapsed) * 1e9 / c.tscFrequency)
+}
+
+// annotate adds the timestamp source to the metadata, if one is configured.
+func (c *timingClock) annotate(meta *tableMeta) {
+	if c.clock == "" {
+		return
+	}
+	meta.Clock = clockMonotonic
+	if c.tsc {
+		_, invariant := calibrateTSC()
+		meta.Clock = clockTSC
+		meta.TscFrequency = c.tscFrequency
+		meta.InvariantTsc = &invariant
+	}
+	if c.cpu {
+		meta.Clock = clockCPU
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"errors"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// errDeterministicBusy is returned by a tracer in deterministic mode if
+// another tracer held the mode when tracing started.
+var errDeterministicBusy = errors.New("deterministic mode is held by another tracer")
+
+// deterministicHeld is set while a tracer holds the deterministic mode. As the
+// garbage collector setting is process wide, only one tracer can hold it.
+var deterministicHeld atomic.Bool
+
+// acquireDeterministic disables the garbage collector and locks the tracing
+// goroutine to its OS thread, unless another tracer holds the deterministic
+// mode, in which case the result is failed.
+func (t *timingTracer) acquireDeterministic() {
+	if !deterministicHeld.CompareAndSwap(false, true) {
+		t.deterministicErr = errDeterministicBusy
+		return
+	}
+	t.gcPercent = debug.SetGCPercent(-1)
+	t.holdsDeterministic.Store(true)
+
+	runtime.LockOSThread()
+	t.threadLocked = true
+}
+
+// releaseDeterministic restores the previous garbage collector setting and
+// releases the deterministic mode, if held. It is safe to call concurrently
+// with the tracing goroutine, which unlocks the OS thread itself.
+func (t *timingTracer) releaseDeterministic() {
+	if t.holdsDeterministic.CompareAndSwap(true, false) {
+		debug.SetGCPercent(t.gcPercent)
+		deterministicHeld.Store(false)
+	}
+}
+
+// unlockThread releases the deterministic mode and the OS thread locked by
+// it. It must be called by the tracing goroutine.
+func (t *timingTracer) unlockThread() {
+	t.releaseDeterministic()
+	if t.threadLocked {
+		runtime.UnlockOSThread()
+		t.threadLocked = false
+	}
+}
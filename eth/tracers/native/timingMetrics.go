@@ -0,0 +1,75 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// timingMetricsPrefix is the name prefix of the per-opcode step time timers
+// published into the metrics registry.
+const timingMetricsPrefix = "tracer/timing/"
+
+// timingMetricsBatch is the number of step times buffered per opcode before
+// they are published, bounding the buffers of long transactions.
+const timingMetricsBatch = 1024
+
+// timingMetrics buffers the step times per opcode, to publish them into the
+// metrics registry in batches instead of updating the contended timers on
+// every step.
+type timingMetrics struct {
+	registry metrics.Registry   // Registry the timers are published into, the default if nil
+	timers   [256]metrics.Timer // Timers of the executed opcodes, registered on first use
+	times    [256][]int         // Step times not published yet, in nanoseconds, at most a batch per opcode
+}
+
+// add buffers the time of a step in nanoseconds, publishing the buffered times
+// of the opcode once a batch is full.
+func (m *timingMetrics) add(op vm.OpCode, ns int) {
+	if m.times[op] == nil {
+		m.times[op] = make([]int, 0, timingMetricsBatch)
+	}
+	m.times[op] = append(m.times[op], ns)
+	if len(m.times[op]) == timingMetricsBatch {
+		m.flush(op)
+	}
+}
+
+// flush updates the timer of an opcode with its buffered step times,
+// registering it on first use, and clears the buffer.
+func (m *timingMetrics) flush(op vm.OpCode) {
+	if m.timers[op] == nil {
+		m.timers[op] = metrics.GetOrRegisterTimer(timingMetricsPrefix+opcodeName(op), m.registry)
+	}
+	for _, ns := range m.times[op] {
+		m.timers[op].Update(time.Duration(ns))
+	}
+	m.times[op] = m.times[op][:0]
+}
+
+// publish updates the timer of every executed opcode with the step times
+// buffered since its last batch, at the end of a transaction.
+func (m *timingMetrics) publish() {
+	for op, times := range m.times {
+		if len(times) > 0 {
+			m.flush(vm.OpCode(op))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+// sampleChunkBits is the binary logarithm of the number of rows per chunk.
+const sampleChunkBits = 16
+
+// sampleChunkSize is the number of rows per chunk of the timing tracer's
+// row storage.
+const sampleChunkSize = 1 << sampleChunkBits
+
+// timingRows stores the rows of the timing tracer in fixed-size chunks.
+// Unlike a single slice, growing it never copies the rows already recorded,
+// so a long trace allocates a chunk every sampleChunkSize rows instead of
+// repeatedly reallocating all of them. Only the first chunk grows on demand,
+// keeping short traces small.
+type timingRows struct {
+	chunks [][]timingSample // All chunks but the last are full
+}
+
+// len returns the number of rows.
+func (r *timingRows) len() int {
+	if len(r.chunks) == 0 {
+		return 0
+	}
+	return (len(r.chunks)-1)*sampleChunkSize + len(r.chunks[len(r.chunks)-1])
+}
+
+// reserve preallocates the first chunk for the given number of rows, capped
+// at the chunk size. It has no effect once rows are stored.
+func (r *timingRows) reserve(n int) {
+	if len(r.chunks) > 0 {
+		return
+	}
+	if n > sampleChunkSize {
+		n = sampleChunkSize
+	}
+	r.chunks = [][]timingSample{make([]timingSample, 0, n)}
+}
+
+// append adds a row, returning its index.
+func (r *timingRows) append(sample timingSample) int {
+	n := len(r.chunks)
+	if n == 0 {
+		r.chunks = append(r.chunks, nil)
+		n++
+	} else if len(r.chunks[n-1]) == sampleChunkSize {
+		r.chunks = append(r.chunks, make([]timingSample, 0, sampleChunkSize))
+		n++
+	}
+	if last := r.chunks[n-1]; len(last) == cap(last) {
+		// Only the first chunk can run out of capacity, grow it up to the
+		// chunk size
+		size := 2 * cap(last)
+		if size < 16 {
+			size = 16
+		}
+		if size > sampleChunkSize {
+			size = sampleChunkSize
+		}
+		r.chunks[n-1] = append(make([]timingSample, 0, size), last...)
+	}
+	r.chunks[n-1] = append(r.chunks[n-1], sample)
+	return (n-1)*sampleChunkSize + len(r.chunks[n-1]) - 1
+}
+
+// at returns the row at the given index.
+func (r *timingRows) at(i int) *timingSample {
+	return &r.chunks[i>>sampleChunkBits][i&(sampleChunkSize-1)]
+}
+
+// truncate drops the rows from the given index on, releasing the chunks
+// left empty but the first.
+func (r *timingRows) truncate(n int) {
+	k := n >> sampleChunkBits
+	if k >= len(r.chunks) {
+		return
+	}
+	for i := k + 1; i < len(r.chunks); i++ {
+		r.chunks[i] = nil
+	}
+	r.chunks = r.chunks[:k+1]
+	r.chunks[k] = r.chunks[k][:n&(sampleChunkSize-1)]
+}
+
+// shift drops the first n rows, moving the remaining ones to the front.
+func (r *timingRows) shift(n int) {
+	total := r.len()
+	for i := n; i < total; i++ {
+		*r.at(i - n) = *r.at(i)
+	}
+	r.truncate(total - n)
+}
+
+// compact drops the rows marked as dropped, keeping the order of the others.
+func (r *timingRows) compact() {
+	total, kept := r.len(), 0
+	for i := 0; i < total; i++ {
+		if sample := r.at(i); !sample.dropped {
+			*r.at(kept) = *sample
+			kept++
+		}
+	}
+	r.truncate(kept)
+}
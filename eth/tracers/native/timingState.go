@@ -0,0 +1,63 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// timingStateDB decorates the StateDB of a traced EVM, adding the time spent
+// reading and writing storage slots to the step of the timing tracer that
+// accesses them. All other methods pass through unchanged.
+type timingStateDB struct {
+	vm.StateDB
+	tracer *timingTracer
+}
+
+// GetState implements vm.StateDB, timing the read of a storage slot.
+func (s *timingStateDB) GetState(addr common.Address, key common.Hash) common.Hash {
+	start := s.tracer.now()
+	value := s.StateDB.GetState(addr, key)
+	s.tracer.addStateTime(s.tracer.now() - start)
+	return value
+}
+
+// SetState implements vm.StateDB, timing the write of a storage slot.
+func (s *timingStateDB) SetState(addr common.Address, key common.Hash, value common.Hash) {
+	start := s.tracer.now()
+	s.StateDB.SetState(addr, key, value)
+	s.tracer.addStateTime(s.tracer.now() - start)
+}
+
+// timesState reports whether the state accesses of the opcode's steps are
+// timed, given that the tracer's stateTiming option is enabled.
+func timesState(op vm.OpCode) bool {
+	return op == vm.SLOAD || op == vm.SSTORE
+}
+
+// addStateTime adds the time of a state access to the current step, if it is
+// a timed storage step. Accesses made while charging the gas of a step precede
+// it and are not included.
+func (t *timingTracer) addStateTime(elapsed int) {
+	if len(t.frames) == 0 {
+		return
+	}
+	if step := &t.frames[len(t.frames)-1].step; step.active && timesState(step.op) {
+		step.state += elapsed
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// errCheckpointSummary is returned when checkpointing is combined with the
+// summary, histogram or hotspots mode, which keep no rows to flush.
+var errCheckpointSummary = errors.New("checkpointSamples or outputFile cannot be combined with summary, histogram or hotspots")
+
+// timingAggregate accumulates the steps of a single opcode in summary mode.
+type timingAggregate struct {
+	count int // Number of recorded steps
+	time  int // Summed step time, in the unit of the tracer's clock
+	cost  int // Summed gas cost
+
+	// Running distribution of the step times in nanoseconds, updated with
+	// Welford's online algorithm so that no step time needs to be kept
+	timed int     // Number of steps with a settled time
+	mean  float64 // Mean step time
+	m2    float64 // Summed squared differences from the mean
+	min   int     // Shortest step time
+	max   int     // Longest step time
+}
+
+// addTime adds the settled time of a step, given in the unit of the tracer's
+// clock and in nanoseconds.
+func (a *timingAggregate) addTime(elapsed, ns int) {
+	a.time += elapsed
+	a.timed++
+	if a.timed == 1 || ns < a.min {
+		a.min = ns
+	}
+	if a.timed == 1 || ns > a.max {
+		a.max = ns
+	}
+	delta := float64(ns) - a.mean
+	a.mean += delta / float64(a.timed)
+	a.m2 += delta * (float64(ns) - a.mean)
+}
+
+// stddev returns the population standard deviation of the step times in
+// nanoseconds, zero for a single step.
+func (a *timingAggregate) stddev() float64 {
+	if a.timed == 0 {
+		return 0
+	}
+	return math.Sqrt(a.m2 / float64(a.timed))
+}
+
+// timingSummary aggregates the recorded steps per opcode, keeping the memory
+// use of the timing tracer constant regardless of the trace length.
+type timingSummary [256]timingAggregate
+
+// summaryColumns returns the columns of the summary CSV for the given layout
+// of the raw CSV, whose time column names the unit.
+func (f timingFormat) summaryColumns() []tracers.ColumnInfo {
+	time := f.columns[1]
+	return []tracers.ColumnInfo{
+		{Name: "opcode", Type: columnString},
+		{Name: "count", Type: columnInt},
+		{Name: "totalTime", Type: time.Type, Unit: time.Unit},
+		{Name: "meanTime", Type: time.Type, Unit: time.Unit},
+		{Name: "totalCost", Type: columnInt, Unit: "gas"},
+		{Name: "stddevTime", Type: columnFloat, Unit: time.Unit},
+		{Name: "minTime", Type: time.Type, Unit: time.Unit},
+		{Name: "maxTime", Type: time.Type, Unit: time.Unit},
+	}
+}
+
+// aggregateRow renders the summary columns of an aggregate following the
+// opcode. The distribution columns are empty if no step time was settled.
+func (f timingFormat) aggregateRow(agg *timingAggregate, nanos func(int) int) []string {
+	total := nanos(agg.time)
+	row := []string{
+		strconv.Itoa(agg.count),
+		f.formatTime(total),
+		f.formatTime(total / agg.count),
+		strconv.Itoa(agg.cost),
+		"", "", "",
+	}
+	if agg.timed > 0 {
+		row[4] = strconv.FormatFloat(agg.stddev()/float64(f.scale), 'f', -1, 64)
+		row[5] = f.formatTime(agg.min)
+		row[6] = f.formatTime(agg.max)
+	}
+	return row
+}
+
+// writeTimingSummaryCSV writes one row per executed opcode into out, ordered
+// by opcode. The nanos function converts the summed times to nanoseconds.
+func writeTimingSummaryCSV(out io.Writer, format timingFormat, summary *timingSummary, nanos func(int) int) error {
+	w := format.newWriter(out)
+	if err := w.Write(columnNames(format.summaryColumns())); err != nil {
+		return err
+	}
+	for op, agg := range summary {
+		if agg.count == 0 {
+			continue
+		}
+		row := append([]string{opcodeName(vm.OpCode(op))}, format.aggregateRow(&summary[op], nanos)...)
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// hotspotKey identifies a bytecode location in hotspots mode.
+type hotspotKey struct {
+	code common.Address // Address of the executed code, the library for delegate calls
+	pc   uint64
+	op   vm.OpCode
+}
+
+// timingHotspots aggregates the recorded steps per bytecode location, so that
+// loops collapse into a row per instruction.
+type timingHotspots map[hotspotKey]*timingAggregate
+
+// aggregate returns the aggregate of a location, creating it if new.
+func (h timingHotspots) aggregate(key hotspotKey) *timingAggregate {
+	agg, ok := h[key]
+	if !ok {
+		agg = new(timingAggregate)
+		h[key] = agg
+	}
+	return agg
+}
+
+// hotspotColumns returns the columns of the hotspots CSV for the given layout
+// of the raw CSV, whose time column names the unit.
+func (f timingFormat) hotspotColumns() []tracers.ColumnInfo {
+	return append([]tracers.ColumnInfo{
+		{Name: "codeAddress", Type: columnString},
+		{Name: "pc", Type: columnInt},
+	}, f.summaryColumns()...)
+}
+
+// writeTimingHotspotsCSV writes one row per executed bytecode location into
+// out, ordered by descending total time. The nanos function converts the
+// summed times to nanoseconds.
+func writeTimingHotspotsCSV(out io.Writer, format timingFormat, hotspots timingHotspots, nanos func(int) int) error {
+	keys := make([]hotspotKey, 0, len(hotspots))
+	for key := range hotspots {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := hotspots[keys[i]], hotspots[keys[j]]
+		if a.time != b.time {
+			return a.time > b.time
+		}
+		if keys[i].code != keys[j].code {
+			return bytes.Compare(keys[i].code[:], keys[j].code[:]) < 0
+		}
+		return keys[i].pc < keys[j].pc
+	})
+	w := format.newWriter(out)
+	if err := w.Write(columnNames(format.hotspotColumns())); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		row := append([]string{
+			key.code.Hex(),
+			strconv.FormatUint(key.pc, 10),
+			opcodeName(key.op),
+		}, format.aggregateRow(hotspots[key], nanos)...)
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// timingHistogramConfig configures the histogram mode of the timing tracer.
+type timingHistogramConfig struct {
+	Buckets []int `json:"buckets"` // Inclusive upper bounds of the buckets in nanoseconds, strictly increasing
+}
+
+// timingHistogram counts the step times of every opcode per bucket, keeping the
+// memory use of the timing tracer constant regardless of the trace length.
+type timingHistogram struct {
+	bounds []int      // Inclusive upper bounds of the buckets, in nanoseconds
+	counts [256][]int // Steps per bucket and opcode, the last counting the overflow
+}
+
+// newTimingHistogram validates the bucket bounds of the configured histogram.
+// Nil is returned if no histogram is configured.
+func newTimingHistogram(config *timingHistogramConfig) (*timingHistogram, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if len(config.Buckets) == 0 {
+		return nil, errors.New("histogram without buckets")
+	}
+	for i, bound := range config.Buckets {
+		if bound < 0 || (i > 0 && bound <= config.Buckets[i-1]) {
+			return nil, fmt.Errorf("histogram buckets not strictly increasing at %d", bound)
+		}
+	}
+	return &timingHistogram{bounds: config.Buckets}, nil
+}
+
+// add counts a step time in nanoseconds into its bucket.
+func (h *timingHistogram) add(op vm.OpCode, ns int) {
+	if h.counts[op] == nil {
+		h.counts[op] = make([]int, len(h.bounds)+1)
+	}
+	h.counts[op][sort.SearchInts(h.bounds, ns)]++
+}
+
+// columns returns the columns of the histogram CSV, a count per bucket named
+// after its upper bound in nanoseconds, followed by the overflow count.
+func (h *timingHistogram) columns() []tracers.ColumnInfo {
+	columns := []tracers.ColumnInfo{{Name: "opcode", Type: columnString}}
+	for _, bound := range h.bounds {
+		columns = append(columns, tracers.ColumnInfo{Name: "le_" + strconv.Itoa(bound), Type: columnInt})
+	}
+	return append(columns, tracers.ColumnInfo{Name: "overflow", Type: columnInt})
+}
+
+// writeCSV writes one row of bucket counts per executed opcode into out,
+// ordered by opcode.
+func (h *timingHistogram) writeCSV(out io.Writer, format timingFormat) error {
+	w := format.newWriter(out)
+	if err := w.Write(columnNames(h.columns())); err != nil {
+		return err
+	}
+	row := make([]string, len(h.bounds)+2)
+	for op, counts := range h.counts {
+		if counts == nil {
+			continue
+		}
+		row[0] = opcodeName(vm.OpCode(op))
+		for i, count := range counts {
+			row[i+1] = strconv.Itoa(count)
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// timingPercentiles keeps the step times of every opcode to compute the
+// requested percentiles of their distribution.
+type timingPercentiles struct {
+	ranks   []float64 // Requested percentiles, each in (0, 100]
+	samples [256][]int
+}
+
+// newTimingPercentiles validates the requested percentiles. Nil is returned if
+// none are requested.
+func newTimingPercentiles(ranks []float64) (*timingPercentiles, error) {
+	if len(ranks) == 0 {
+		return nil, nil
+	}
+	for _, rank := range ranks {
+		if rank <= 0 || rank > 100 {
+			return nil, fmt.Errorf("invalid percentile %v", rank)
+		}
+	}
+	return &timingPercentiles{ranks: ranks}, nil
+}
+
+// add records the time of a step.
+func (p *timingPercentiles) add(op vm.OpCode, elapsed int) {
+	p.samples[op] = append(p.samples[op], elapsed)
+}
+
+// result returns the minimum, maximum and requested percentiles of the step
+// times of every executed opcode, keyed by opcode name and then by "min",
+// "max" or "p" followed by the percentile. The values are in the unit of the
+// time column, the nanos function converts the recorded times to nanoseconds.
+func (p *timingPercentiles) result(format timingFormat, nanos func(int) int) map[string]map[string]float64 {
+	res := make(map[string]map[string]float64)
+	for op, samples := range p.samples {
+		if len(samples) == 0 {
+			continue
+		}
+		sorted := append([]int{}, samples...)
+		sort.Ints(sorted)
+
+		value := func(i int) float64 {
+			return float64(nanos(sorted[i])) / float64(format.scale)
+		}
+		stats := map[string]float64{
+			"min": value(0),
+			"max": value(len(sorted) - 1),
+		}
+		for _, rank := range p.ranks {
+			// Nearest-rank method, always yielding a recorded value
+			i := int(math.Ceil(rank/100*float64(len(sorted)))) - 1
+			if i < 0 {
+				i = 0
+			}
+			stats["p"+strconv.FormatFloat(rank, 'f', -1, 64)] = value(i)
+		}
+		res[opcodeName(vm.OpCode(op))] = stats
+	}
+	return res
+}
+
+// slowStep is one of the slowest steps of a trace, as reported in the result.
+type slowStep struct {
+	Opcode string  `json:"opcode"`
+	PC     uint64  `json:"pc"`
+	Depth  int     `json:"depth"`
+	Time   float64 `json:"time"` // Time the step took, in the unit of the time column
+}
+
+// slowStepEntry is a step held by the slowSteps heap, its time in the unit of
+// the tracer's clock.
+type slowStepEntry struct {
+	op    vm.OpCode
+	pc    uint64
+	depth int
+	time  int
+}
+
+// slowSteps retains the n slowest steps of a trace in a min-heap, so only the
+// fastest retained step has to be compared against every new one.
+type slowSteps struct {
+	n     int
+	steps []slowStepEntry
+}
+
+// newSlowSteps returns a collector of the n slowest steps, nil if n is zero.
+func newSlowSteps(n int) (*slowSteps, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid topN %d", n)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return &slowSteps{n: n, steps: make([]slowStepEntry, 0, n)}, nil
+}
+
+func (s *slowSteps) Len() int           { return len(s.steps) }
+func (s *slowSteps) Less(i, j int) bool { return s.steps[i].time < s.steps[j].time }
+func (s *slowSteps) Swap(i, j int)      { s.steps[i], s.steps[j] = s.steps[j], s.steps[i] }
+func (s *slowSteps) Push(x any)         { s.steps = append(s.steps, x.(slowStepEntry)) }
+
+func (s *slowSteps) Pop() any {
+	last := s.steps[len(s.steps)-1]
+	s.steps = s.steps[:len(s.steps)-1]
+	return last
+}
+
+// add offers a step, retaining it if it is among the n slowest seen so far.
+func (s *slowSteps) add(step slowStepEntry) {
+	if len(s.steps) < s.n {
+		heap.Push(s, step)
+		return
+	}
+	if step.time > s.steps[0].time {
+		s.steps[0] = step
+		heap.Fix(s, 0)
+	}
+}
+
+// result returns the retained steps, slowest first. The nanos function converts
+// the recorded times to nanoseconds.
+func (s *slowSteps) result(format timingFormat, nanos func(int) int) []slowStep {
+	sorted := append([]slowStepEntry{}, s.steps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].time > sorted[j].time })
+
+	res := make([]slowStep, len(sorted))
+	for i, step := range sorted {
+		res[i] = slowStep{
+			Opcode: opcodeName(step.op),
+			PC:     step.pc,
+			Depth:  step.depth,
+			Time:   float64(nanos(step.time)) / float64(format.scale),
+		}
+	}
+	return res
+}
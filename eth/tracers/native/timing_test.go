@@ -0,0 +1,1737 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	goruntime "runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	corestate "github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestTimingTracerCaptureStateAllocs(t *testing.T) {
+	testCaptureStateAllocs(t, newTestTracer(t, "timingTracer", ""))
+}
+
+func TestTimingTracerTSCCaptureStateAllocs(t *testing.T) {
+	testCaptureStateAllocs(t, newTestTracer(t, "timingTracer", `{"clock": "tsc"}`))
+}
+
+func TestTimingTracerCPUCaptureStateAllocs(t *testing.T) {
+	testCaptureStateAllocs(t, newTestTracer(t, "timingTracer", `{"clock": "cpu"}`))
+}
+
+func BenchmarkTimingTracerCaptureState(b *testing.B) {
+	benchmarkCaptureState(b, newTestTracer(b, "timingTracer", ""))
+}
+
+func BenchmarkTimingTracerTSCCaptureState(b *testing.B) {
+	benchmarkCaptureState(b, newTestTracer(b, "timingTracer", `{"clock": "tsc"}`))
+}
+
+func BenchmarkTimingTracerCPUCaptureState(b *testing.B) {
+	benchmarkCaptureState(b, newTestTracer(b, "timingTracer", `{"clock": "cpu"}`))
+}
+
+// BenchmarkTimingTracerPrealloc measures the allocations of a million step
+// trace, with and without the samples preallocated from the gas limit.
+func BenchmarkTimingTracerPrealloc(b *testing.B) {
+	for _, prealloc := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prealloc=%t", prealloc), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tracer := newTestTracer(b, "timingTracer", "")
+				gas := uint64(1 << 62)
+				if prealloc {
+					tracer.CaptureTxStart(gas)
+				}
+				tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, gas, nil)
+				captureSteps(tracer, &gas, 1_000_000)
+			}
+		})
+	}
+}
+
+// Tests that the timestamp counter clock reports its source and conversion
+// factor, and yields step times in nanoseconds.
+func TestTimingTracerTSCClock(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"clock": "tsc"}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	if !tscSupported {
+		if result.Clock != clockMonotonic {
+			t.Fatalf("fallback clock mismatch: have %q, want %q", result.Clock, clockMonotonic)
+		}
+		return
+	}
+	if result.Clock != clockTSC || result.TscFrequency <= 0 || result.InvariantTsc == nil {
+		t.Fatalf("invalid clock metadata: %+v", result.tableMeta)
+	}
+	rows, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	for _, row := range rows[1:] {
+		// A cheap step taking over a second means the ticks weren't converted
+		if ns, err := strconv.Atoi(row[1]); err != nil || ns < 0 || ns > 1e9 {
+			t.Fatalf("invalid step time %q", row[1])
+		}
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"clock": "sundial"}`)); err == nil {
+		t.Fatalf("unknown clock accepted")
+	}
+}
+
+// Tests that the time unit and resolution options select the recorded steps
+// and the rendering of the time column.
+func TestTimingTracerUnitResolution(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.PUSH1), 3, byte(vm.POP), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"unit": "us", "resolution": 2}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var blob string
+	if err := json.Unmarshal(res, &blob); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(blob)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if have := rows[0][1]; have != "time_us" {
+		t.Fatalf("time header mismatch: have %q, want %q", have, "time_us")
+	}
+	want := [][]string{{"PUSH1", "3"}, {"ADD", "3"}, {"POP", "2"}}
+	if len(rows)-1 != len(want) {
+		t.Fatalf("row count mismatch: have %d, want %d", len(rows)-1, len(want))
+	}
+	for i, row := range rows[1:] {
+		if row[0] != want[i][0] || row[2] != want[i][1] {
+			t.Errorf("row %d mismatch: have %v, want %v", i, row, want[i])
+		}
+		if us, err := strconv.ParseFloat(row[1], 64); err != nil || us < 0 {
+			t.Errorf("row %d: invalid time %q", i, row[1])
+		}
+	}
+	for _, cfg := range []string{`{"unit": "fortnight"}`, `{"resolution": 0}`, `{"resolution": -1}`} {
+		if _, err := newTimingTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("invalid config %s accepted", cfg)
+		}
+	}
+}
+
+// Tests that the summary mode aggregates the steps per opcode.
+func TestTimingTracerSummary(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.PUSH1), 3, byte(vm.POP), byte(vm.POP), byte(vm.STOP)}
+	tracer := newTestTracer(t, "timingTracer", `{"summary": true}`)
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var blob string
+	if err := json.Unmarshal(res, &blob); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(blob)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if have, want := rows[0], columnNames(tracer.(*timingTracer).Columns()); !reflect.DeepEqual(have, want) {
+		t.Fatalf("header mismatch: have %v, want %v", have, want)
+	}
+	// Opcode, count and total cost; the cost of the final STOP is settled with
+	// the gas the test reports to CaptureTxEnd, so it isn't checked
+	want := [][]string{{"STOP", "1", ""}, {"ADD", "1", "3"}, {"POP", "2", "4"}, {"PUSH1", "3", "9"}}
+	if len(rows)-1 != len(want) {
+		t.Fatalf("row count mismatch: have %d, want %d", len(rows)-1, len(want))
+	}
+	for i, row := range rows[1:] {
+		if row[0] != want[i][0] || row[1] != want[i][1] || (want[i][2] != "" && row[4] != want[i][2]) {
+			t.Errorf("row %d mismatch: have %v, want %v", i, row, want[i])
+		}
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"summary": true, "checkpointSamples": 10}`)); err != errCheckpointSummary {
+		t.Errorf("error mismatch: have %v, want %v", err, errCheckpointSummary)
+	}
+}
+
+// Tests the running distribution of the step times in summary mode.
+func TestTimingAggregateStddev(t *testing.T) {
+	single := timingAggregate{count: 1}
+	single.addTime(42, 42)
+	if single.stddev() != 0 || single.min != 42 || single.max != 42 {
+		t.Errorf("single step mismatch: stddev %v, min %d, max %d", single.stddev(), single.min, single.max)
+	}
+	var agg timingAggregate
+	for _, ns := range []int{2, 4, 4, 4, 5, 5, 7, 9} {
+		agg.addTime(ns, ns)
+	}
+	if agg.mean != 5 || agg.stddev() != 2 || agg.min != 2 || agg.max != 9 {
+		t.Errorf("distribution mismatch: mean %v, stddev %v, min %d, max %d", agg.mean, agg.stddev(), agg.min, agg.max)
+	}
+	// A step without settled time leaves the distribution columns empty
+	row := defaultTimingFormat.aggregateRow(&timingAggregate{count: 1}, func(v int) int { return v })
+	if !reflect.DeepEqual(row[4:], []string{"", "", ""}) {
+		t.Errorf("unsettled distribution mismatch: have %v", row[4:])
+	}
+	row = defaultTimingFormat.aggregateRow(&single, func(v int) int { return v })
+	if !reflect.DeepEqual(row, []string{"1", "42", "42", "0", "0", "42", "42"}) {
+		t.Errorf("single step row mismatch: have %v", row)
+	}
+}
+
+func TestTimingPercentiles(t *testing.T) {
+	p, err := newTimingPercentiles([]float64{50, 95, 99.9})
+	if err != nil {
+		t.Fatalf("failed to create percentiles: %v", err)
+	}
+	for i := 100; i > 0; i-- {
+		p.add(vm.ADD, i)
+	}
+	p.add(vm.SLOAD, 7)
+
+	res := p.result(defaultTimingFormat, func(v int) int { return v })
+	want := map[string]map[string]float64{
+		"ADD":   {"min": 1, "max": 100, "p50": 50, "p95": 95, "p99.9": 100},
+		"SLOAD": {"min": 7, "max": 7, "p50": 7, "p95": 7, "p99.9": 7},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("percentiles mismatch: have %v, want %v", res, want)
+	}
+	for _, ranks := range [][]float64{{0}, {-5}, {100.5}} {
+		if _, err := newTimingPercentiles(ranks); err == nil {
+			t.Errorf("invalid percentiles %v accepted", ranks)
+		}
+	}
+}
+
+// Tests that the requested percentiles are reported next to the CSV.
+func TestTimingTracerPercentiles(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"percentiles": [50, 99]}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	for _, op := range []string{"PUSH1", "ADD", "STOP"} {
+		stats, ok := result.Percentiles[op]
+		if !ok {
+			t.Fatalf("missing percentiles of %s", op)
+		}
+		if stats["min"] > stats["p50"] || stats["p50"] > stats["p99"] || stats["p99"] > stats["max"] {
+			t.Errorf("unordered percentiles of %s: %v", op, stats)
+		}
+	}
+	if result.CSV == "" {
+		t.Errorf("missing CSV")
+	}
+}
+
+// readTimingRows decodes a bare CSV timing result into its rows, header first.
+func readTimingRows(t *testing.T, res json.RawMessage) [][]string {
+	t.Helper()
+
+	rows, err := csv.NewReader(strings.NewReader(tableCSV(t, res))).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	return rows
+}
+
+// Tests that every row carries the program counter of its step.
+func TestTimingTracerPC(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	column := 5
+	if rows[0][column] != "pc" {
+		t.Fatalf("pc header mismatch: have %q", rows[0][column])
+	}
+	var pcs []string
+	for _, row := range rows[1:] {
+		pcs = append(pcs, row[column])
+	}
+	if want := []string{"0", "2", "4", "5"}; !reflect.DeepEqual(pcs, want) {
+		t.Fatalf("pc mismatch: have %v, want %v", pcs, want)
+	}
+}
+
+// Tests that every row carries the call depth of its step.
+func TestTimingTracerDepth(t *testing.T) {
+	callee := common.HexToAddress("0xc0ffee")
+	code := callCode(callee)
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, map[common.Address][]byte{callee: {byte(vm.STOP)}})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	column := 6
+	if rows[0][column] != "depth" {
+		t.Fatalf("depth header mismatch: have %q", rows[0][column])
+	}
+	for _, row := range rows[1:] {
+		want := "1"
+		if row[4] != "0" {
+			want = "2" // The callee's STOP
+		}
+		if row[column] != want {
+			t.Errorf("depth mismatch for %v: want %s", row, want)
+		}
+	}
+}
+
+// Tests that the steps at a call frame boundary are charged their own cost:
+// the CALL without the gas forwarded to the callee, and the callee's last step
+// up to the gas it returns.
+func TestTimingTracerCallCost(t *testing.T) {
+	callee := common.HexToAddress("0xc0ffee")
+	ret := []byte{byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.RETURN)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), callCode(callee), map[common.Address][]byte{callee: ret})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	costs := make(map[string]string)
+	for _, row := range rows[1:] {
+		costs[row[0]] = row[2]
+		if cost, _ := strconv.Atoi(row[2]); cost < 0 {
+			t.Errorf("step %v charged negative cost", row)
+		}
+	}
+	// A cold account access, and the expansion of the memory by a word
+	if costs["CALL"] != "2600" {
+		t.Errorf("CALL cost mismatch: have %s, want 2600", costs["CALL"])
+	}
+	if costs["RETURN"] != "3" {
+		t.Errorf("RETURN cost mismatch: have %s, want 3", costs["RETURN"])
+	}
+}
+
+// Tests that the time a child frame executes is reported separately on the
+// row of the step entering it, rather than in the time of any step.
+func TestTimingTracerChildTime(t *testing.T) {
+	var (
+		callee = common.HexToAddress("0xc0ffee")
+		loop   = []byte{
+			byte(vm.PUSH2), 0x01, 0x00,
+			byte(vm.JUMPDEST),
+			byte(vm.PUSH1), 1, byte(vm.SWAP1), byte(vm.SUB),
+			byte(vm.DUP1), byte(vm.PUSH1), 3, byte(vm.JUMPI),
+			byte(vm.STOP),
+		}
+	)
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), callCode(callee), map[common.Address][]byte{callee: loop})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	column := 7
+	if rows[0][column] != "childTime" {
+		t.Fatalf("childTime header mismatch: have %q", rows[0][column])
+	}
+	var callChildTime, childTimes int
+	for _, row := range rows[1:] {
+		time, _ := strconv.Atoi(row[1])
+		childTime, _ := strconv.Atoi(row[column])
+		switch {
+		case row[0] == "CALL":
+			callChildTime = childTime
+		case childTime != 0:
+			t.Errorf("non-call step %v reports child time", row)
+		}
+		if row[4] != "0" {
+			childTimes += time
+		}
+	}
+	if callChildTime == 0 || callChildTime < childTimes {
+		t.Fatalf("call child time %d doesn't cover the child steps' %d", callChildTime, childTimes)
+	}
+}
+
+// Tests that the calibrated tracer overhead is reported next to the CSV.
+func TestTimingTracerCalibration(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"calibrate": true}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	if result.OverheadNs <= 0 || result.OverheadNs > 1e6 {
+		t.Fatalf("implausible overhead %vns", result.OverheadNs)
+	}
+}
+
+// Tests that transactions executing no or only part of their code produce
+// consistent rows.
+func TestTimingTracerShortTransactions(t *testing.T) {
+	t.Run("no code", func(t *testing.T) {
+		res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), nil, nil)
+		if err != nil {
+			t.Fatalf("failed to retrieve trace result: %v", err)
+		}
+		if rows := readTimingRows(t, res); len(rows) != 1 {
+			t.Fatalf("row count mismatch: have %d, want header only", len(rows))
+		}
+	})
+	t.Run("value transfer", func(t *testing.T) {
+		var (
+			tracer     = newTestTracer(t, "timingTracer", "")
+			statedb, _ = corestate.New(common.Hash{}, corestate.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+			cfg        = &runtime.Config{
+				GasLimit:  21000,
+				State:     statedb,
+				Value:     big.NewInt(1),
+				EVMConfig: vm.Config{Tracer: tracer},
+			}
+		)
+		statedb.AddBalance(cfg.Origin, big.NewInt(1))
+		tracer.CaptureTxStart(cfg.GasLimit)
+		if _, _, err := runtime.Call(common.HexToAddress("0xc0ffee"), nil, cfg); err != nil {
+			t.Fatalf("transfer failed: %v", err)
+		}
+		tracer.CaptureTxEnd(cfg.GasLimit)
+
+		res, err := tracer.GetResult()
+		if err != nil {
+			t.Fatalf("failed to retrieve trace result: %v", err)
+		}
+		if rows := readTimingRows(t, res); len(rows) != 1 {
+			t.Fatalf("row count mismatch: have %d, want header only", len(rows))
+		}
+	})
+	t.Run("out of gas", func(t *testing.T) {
+		code := []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.JUMP)}
+		res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, nil)
+		if err != nil {
+			t.Fatalf("failed to retrieve trace result: %v", err)
+		}
+		rows := readTimingRows(t, res)
+		if len(rows) < 2 {
+			t.Fatalf("no steps recorded")
+		}
+		for i, row := range rows[1 : len(rows)-1] {
+			if want := []string{"JUMPDEST", "PUSH1", "JUMP"}[i%3]; row[0] != want {
+				t.Fatalf("row %d opcode mismatch: have %s, want %s", i, row[0], want)
+			}
+		}
+	})
+}
+
+// Tests that the steps of a frame don't include the time of the frames it
+// entered, across a recursion of frames running the same code.
+func TestTimingTracerRecursion(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH1), 0, // retSize
+		byte(vm.PUSH1), 0, // retOffset
+		byte(vm.PUSH1), 0, // argsSize
+		byte(vm.PUSH1), 0, // argsOffset
+		byte(vm.PUSH1), 0, // value
+		byte(vm.ADDRESS), byte(vm.GAS), byte(vm.CALL), byte(vm.POP), byte(vm.STOP),
+	}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+
+	// Find the call of the outermost frame, whose child time covers the whole
+	// recursion, and the deepest frame reached
+	var recursion, maxDepth int
+	for _, row := range rows[1:] {
+		if row[4] == "0" && row[0] == "CALL" {
+			recursion, _ = strconv.Atoi(row[7])
+		}
+		if depth, _ := strconv.Atoi(row[6]); depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	if maxDepth < 10 {
+		t.Fatalf("recursion too shallow: %d frames", maxDepth)
+	}
+	for _, row := range rows[1:] {
+		if time, _ := strconv.Atoi(row[1]); time >= recursion {
+			t.Errorf("step %v takes longer than the whole recursion (%dns)", row, recursion)
+		}
+	}
+}
+
+// Tests that the error a step fails with is reported in its row.
+func TestTimingTracerErrors(t *testing.T) {
+	tests := []struct {
+		code []byte
+		op   string
+		err  string
+	}{
+		{revertCode, "REVERT", vm.ErrExecutionReverted.Error()},
+		{[]byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.JUMP)}, "", vm.ErrOutOfGas.Error()},
+		{[]byte{byte(vm.ADD)}, "ADD", "stack underflow (0 <=> 2)"},
+	}
+	for i, tt := range tests {
+		res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), tt.code, nil)
+		if err != nil {
+			t.Fatalf("test %d: failed to retrieve trace result: %v", i, err)
+		}
+		rows := readTimingRows(t, res)
+		column := 8
+		last := rows[len(rows)-1]
+		if last[column] != tt.err || (tt.op != "" && last[0] != tt.op) {
+			t.Errorf("test %d: last row mismatch: have %v, want %s failing with %q", i, last, tt.op, tt.err)
+		}
+		for _, row := range rows[1 : len(rows)-1] {
+			if row[column] != "" {
+				t.Errorf("test %d: successful step %v reports error", i, row)
+			}
+		}
+	}
+}
+
+func TestSlowSteps(t *testing.T) {
+	s, err := newSlowSteps(5)
+	if err != nil {
+		t.Fatalf("failed to create collector: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		time := (i * 37) % 100 // Visit every value once, out of order
+		s.add(slowStepEntry{op: vm.ADD, pc: uint64(time), time: time})
+	}
+	var times []float64
+	for _, step := range s.result(defaultTimingFormat, func(v int) int { return v }) {
+		if step.PC != uint64(step.Time) {
+			t.Errorf("step %+v mixed up", step)
+		}
+		times = append(times, step.Time)
+	}
+	if want := []float64{99, 98, 97, 96, 95}; !reflect.DeepEqual(times, want) {
+		t.Fatalf("slowest steps mismatch: have %v, want %v", times, want)
+	}
+	if _, err := newSlowSteps(-1); err == nil {
+		t.Fatalf("negative topN accepted")
+	}
+}
+
+// Tests that the slowest steps are reported next to the CSV.
+func TestTimingTracerTopN(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"topN": 3}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	if len(result.Slowest) != 3 {
+		t.Fatalf("slowest step count mismatch: have %d, want 3", len(result.Slowest))
+	}
+	for i := 1; i < len(result.Slowest); i++ {
+		if result.Slowest[i].Time > result.Slowest[i-1].Time {
+			t.Fatalf("slowest steps not ordered: %+v", result.Slowest)
+		}
+	}
+}
+
+// Tests that the time per gas is derived from the time and cost columns.
+func TestTimingTracerNsPerGas(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	column := 9
+	if rows[0][column] != "nsPerGas" {
+		t.Fatalf("nsPerGas header mismatch: have %q", rows[0][column])
+	}
+	for _, row := range rows[1 : len(rows)-1] {
+		time, _ := strconv.ParseFloat(row[1], 64)
+		cost, _ := strconv.ParseFloat(row[2], 64)
+		if have, _ := strconv.ParseFloat(row[column], 64); have != time/cost {
+			t.Errorf("row %v: time per gas mismatch: have %v, want %v", row, have, time/cost)
+		}
+	}
+	if have := nsPerGas(100, 0); have != "" {
+		t.Errorf("zero cost rendered as %q", have)
+	}
+	if have := nsPerGas(100, -3); have != "" {
+		t.Errorf("negative cost rendered as %q", have)
+	}
+}
+
+// Tests that only the steps of the configured opcodes are recorded.
+func TestTimingTracerOpcodes(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"opcodes": ["ADD", "STOP"]}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)[1:]
+	var ops []string
+	for _, row := range rows {
+		ops = append(ops, row[0])
+	}
+	if want := []string{"ADD", "STOP"}; !reflect.DeepEqual(ops, want) {
+		t.Fatalf("recorded opcodes mismatch: have %v, want %v", ops, want)
+	}
+	// The cost of a step is settled by the next one, even if that is skipped
+	if rows[0][2] != "3" {
+		t.Errorf("ADD cost mismatch: have %s, want 3", rows[0][2])
+	}
+	for _, cfg := range []string{`{"opcodes": ["SHA3"]}`, `{"opcodes": ["sload"]}`} {
+		if _, err := newTimingTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("config %s: expected unknown opcode error", cfg)
+		}
+	}
+}
+
+// Tests that only the steps executing the configured contract are recorded.
+func TestTimingTracerContract(t *testing.T) {
+	var (
+		callee    = common.HexToAddress("0xc0ffee")
+		contracts = map[common.Address][]byte{
+			callee: {byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)},
+		}
+	)
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"contract": "0x0000000000000000000000000000000000c0ffee"}`), callCode(callee), contracts)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)[1:]
+	var ops []string
+	for _, row := range rows {
+		ops = append(ops, row[0])
+		if row[4] != "1" {
+			t.Errorf("step %v recorded outside the callee's frame", row)
+		}
+	}
+	if want := []string{"PUSH1", "POP", "STOP"}; !reflect.DeepEqual(ops, want) {
+		t.Fatalf("recorded opcodes mismatch: have %v, want %v", ops, want)
+	}
+}
+
+// Tests that steps nested deeper than the configured depth are not recorded.
+func TestTimingTracerMaxDepth(t *testing.T) {
+	var (
+		callee    = common.HexToAddress("0xc0ffee")
+		contracts = map[common.Address][]byte{
+			callee: {byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)},
+		}
+	)
+	for maxDepth, want := range []int{0: 1, 1: 2} {
+		cfg := fmt.Sprintf(`{"maxDepth": %d}`, maxDepth)
+		res, err := runTestTracer(t, newTestTracer(t, "timingTracer", cfg), callCode(callee), contracts)
+		if err != nil {
+			t.Fatalf("maxDepth %d: failed to retrieve trace result: %v", maxDepth, err)
+		}
+		deepest := 0
+		for _, row := range readTimingRows(t, res)[1:] {
+			if depth, _ := strconv.Atoi(row[6]); depth > deepest {
+				deepest = depth
+			}
+		}
+		if deepest != want {
+			t.Errorf("maxDepth %d: deepest recorded step mismatch: have %d, want %d", maxDepth, deepest, want)
+		}
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"maxDepth": -1}`)); err == nil {
+		t.Error("expected error for negative maxDepth")
+	}
+}
+
+// Tests that rows are streamed into the output file, with only its location
+// and size returned.
+func TestTimingTracerOutputFile(t *testing.T) {
+	var (
+		path   = filepath.Join(setOutputDir(t), "trace.csv")
+		tracer = newTestTracer(t, "timingTracer", `{"outputFile": "trace.csv"}`).(*timingTracer)
+		code   = []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	)
+	executeTestTracer(t, tracer, code, nil)
+	if tracer.samples.len() != 0 {
+		t.Errorf("streamed tracer holds %d rows in memory", tracer.samples.len())
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	result, rows := readCheckpointResult(t, res)
+	if result.File != path {
+		t.Errorf("output file mismatch: have %s, want %s", result.File, path)
+	}
+	if result.Rows != 5 || len(rows) != 6 {
+		t.Errorf("row count mismatch: have %d rows reported and %d lines, want 5 and 6", result.Rows, len(rows))
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"outputFile": "trace.csv", "checkpointSamples": 10}`)); err == nil {
+		t.Error("expected error combining outputFile and checkpointSamples")
+	}
+	// Errors opening the file are returned with the result
+	tracer = newTestTracer(t, "timingTracer", `{"outputFile": "missing/trace.csv"}`).(*timingTracer)
+	executeTestTracer(t, tracer, code, nil)
+	if _, err := tracer.GetResult(); err == nil {
+		t.Error("expected error creating the output file")
+	}
+}
+
+// Tests that the output file can only be created within the output directory,
+// and never overwrites an existing file.
+func TestTimingTracerOutputFileRestricted(t *testing.T) {
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"outputFile": "trace.csv"}`)); !errors.Is(err, errNoOutputDir) {
+		t.Errorf("output file accepted without an output directory: %v", err)
+	}
+	dir := setOutputDir(t)
+	outside := filepath.Join(t.TempDir(), "trace.csv")
+	for _, name := range []string{outside, "../trace.csv", "sub/../../trace.csv", "."} {
+		if _, err := newTimingTracer(nil, json.RawMessage(fmt.Sprintf(`{"outputFile": %q}`, name))); err == nil {
+			t.Errorf("output file %q outside the output directory accepted", name)
+		}
+	}
+	path := filepath.Join(dir, "existing.csv")
+	if err := os.WriteFile(path, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tracer := newTestTracer(t, "timingTracer", `{"outputFile": "existing.csv"}`)
+	executeTestTracer(t, tracer, []byte{byte(vm.STOP)}, nil)
+	if _, err := tracer.GetResult(); err == nil {
+		t.Error("expected error creating an existing output file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "keep" {
+		t.Errorf("existing file overwritten: %q", data)
+	}
+}
+
+// Tests that the samples are preallocated from the gas limit, within bounds.
+func TestTimingTracerPrealloc(t *testing.T) {
+	for _, tt := range []struct {
+		cfg      string
+		gasLimit uint64
+		want     int
+	}{
+		{"", 21000, 21001},
+		{`{"resolution": 10}`, 21000, 2101},
+		{"", 30_000_000, sampleChunkSize},
+		{`{"summary": true}`, 21000, 0},
+	} {
+		tracer := newTestTracer(t, "timingTracer", tt.cfg).(*timingTracer)
+		tracer.CaptureTxStart(tt.gasLimit)
+		var have int
+		if len(tracer.samples.chunks) > 0 {
+			have = cap(tracer.samples.chunks[0])
+		}
+		if have != tt.want {
+			t.Errorf("config %q, gas limit %d: capacity mismatch: have %d, want %d", tt.cfg, tt.gasLimit, have, tt.want)
+		}
+	}
+}
+
+// Tests that the histogram mode counts the steps per opcode and bucket.
+func TestTimingTracerHistogram(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"histogram": {"buckets": [100, 1000000000000]}}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if want := []string{"opcode", "le_100", "le_1000000000000", "overflow"}; !reflect.DeepEqual(rows[0], want) {
+		t.Fatalf("header mismatch: have %v, want %v", rows[0], want)
+	}
+	counts := make(map[string]int)
+	for _, row := range rows[1:] {
+		for _, cell := range row[1:] {
+			n, _ := strconv.Atoi(cell)
+			counts[row[0]] += n
+		}
+		if row[3] != "0" {
+			t.Errorf("step %s overflows the last bucket", row[0])
+		}
+	}
+	if want := map[string]int{"PUSH1": 2, "ADD": 1, "POP": 1, "STOP": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("step counts mismatch: have %v, want %v", counts, want)
+	}
+	// Bucket bounds are inclusive, anything above the last one overflows
+	h, _ := newTimingHistogram(&timingHistogramConfig{Buckets: []int{100, 500}})
+	for _, ns := range []int{0, 100, 101, 500, 501} {
+		h.add(vm.ADD, ns)
+	}
+	if have, want := h.counts[vm.ADD], []int{2, 2, 1}; !reflect.DeepEqual(have, want) {
+		t.Errorf("bucket counts mismatch: have %v, want %v", have, want)
+	}
+	for _, cfg := range []string{
+		`{"histogram": {}}`,
+		`{"histogram": {"buckets": [500, 100]}}`,
+		`{"histogram": {"buckets": [100, 100]}}`,
+		`{"histogram": {"buckets": [100]}, "summary": true}`,
+		`{"histogram": {"buckets": [100]}, "checkpointSamples": 10}`,
+	} {
+		if _, err := newTimingTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("config %s: expected error", cfg)
+		}
+	}
+}
+
+// Tests that the thread CPU time clock reports its source, falling back to the
+// runtime clock where unsupported.
+func TestTimingTracerCPUClock(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"clock": "cpu"}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	want := clockCPU
+	if !threadCPUSupported {
+		want = clockMonotonic
+	}
+	if result.Clock != want {
+		t.Fatalf("clock mismatch: have %q, want %q", result.Clock, want)
+	}
+	rows, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	for _, row := range rows[1:] {
+		if ns, err := strconv.Atoi(row[1]); err != nil || ns < 0 {
+			t.Fatalf("invalid step time %q", row[1])
+		}
+	}
+}
+
+// Tests that the JSON output holds the same rows as the CSV, with typed values.
+func TestTimingTracerJSONOutput(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"output": "json", "topN": 1}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		Slowest []slowStep      `json:"slowest"`
+		Columns []string        `json:"columns"`
+		Rows    [][]interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result %s: %v", res, err)
+	}
+	if !reflect.DeepEqual(result.Columns, columnNames(timingColumns)) {
+		t.Errorf("columns mismatch: have %v, want %v", result.Columns, columnNames(timingColumns))
+	}
+	if len(result.Slowest) != 1 {
+		t.Errorf("metadata missing from result %s", res)
+	}
+	if len(result.Rows) != 4 {
+		t.Fatalf("row count mismatch: have %d, want 4", len(result.Rows))
+	}
+	for _, row := range result.Rows {
+		for i, value := range row {
+			switch timingColumns[i].Type {
+			case columnString:
+				if _, ok := value.(string); !ok {
+					t.Errorf("column %s: value %v is not a string", timingColumns[i].Name, value)
+				}
+			default:
+				if _, ok := value.(float64); !ok && value != nil {
+					t.Errorf("column %s: value %v is not a number", timingColumns[i].Name, value)
+				}
+			}
+		}
+	}
+	if result.Rows[2][0] != "ADD" || result.Rows[2][2] != 3.0 {
+		t.Errorf("ADD row mismatch: %v", result.Rows[2])
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"output": "json", "summary": true}`)); err == nil {
+		t.Error("expected error combining json output and summary")
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"output": "xml"}`)); err == nil {
+		t.Error("expected error for unknown output")
+	}
+	// Strings needing escapes are encoded like encoding/json does
+	for _, s := range []string{"out of gas", "quote \" and \\ and <tag>", "\x00 and ü"} {
+		want, _ := json.Marshal(s)
+		if have := appendJSONString(nil, s); string(have) != string(want) {
+			t.Errorf("string %q: encoding mismatch: have %s, want %s", s, have, want)
+		}
+	}
+}
+
+// Tests that no steps are recorded after the tracer is stopped, and that the
+// partial result is returned along with the interruption reason.
+func TestTimingTracerStop(t *testing.T) {
+	var (
+		tracer = newTestTracer(t, "timingTracer", "").(*timingTracer)
+		gas    = uint64(1 << 20)
+		reason = errors.New("execution timeout")
+	)
+	tracer.CaptureTxStart(gas)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, gas, nil)
+	captureSteps(tracer, &gas, 40)
+	tracer.Stop(reason)
+	captureSteps(tracer, &gas, 40)
+	tracer.CaptureEnd(nil, 0, nil)
+	tracer.CaptureTxEnd(gas)
+
+	res, err := tracer.GetResult()
+	if err != reason {
+		t.Fatalf("error mismatch: have %v, want %v", err, reason)
+	}
+	if rows := readTimingRows(t, res); len(rows)-1 != 40 {
+		t.Fatalf("row count mismatch: have %d, want 40", len(rows)-1)
+	}
+	if err := tracer.EncodeResult(io.Discard); err != reason {
+		t.Fatalf("encoding error mismatch: have %v, want %v", err, reason)
+	}
+}
+
+// Tests that the transaction context is reported next to the CSV, and left out
+// for dangling calls.
+func TestTimingTracerTxContext(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}
+	ctx := &tracers.Context{
+		BlockHash:   common.HexToHash("0xb10c"),
+		BlockNumber: big.NewInt(17_000_000),
+		TxIndex:     3,
+		TxHash:      common.HexToHash("0x7e"),
+	}
+	tracer, err := tracers.DefaultDirectory.New("timingTracer", ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to create tracer: %v", err)
+	}
+	res, err := runTestTracer(t, tracer, code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result %s: %v", res, err)
+	}
+	if result.TxHash == nil || *result.TxHash != ctx.TxHash || result.BlockNumber == nil || *result.BlockNumber != 17_000_000 || result.TxIndex == nil || *result.TxIndex != 3 {
+		t.Fatalf("transaction context mismatch: %s", res)
+	}
+	if rows, _ := csv.NewReader(strings.NewReader(result.CSV)).ReadAll(); len(rows) != 4 {
+		t.Errorf("row count mismatch: have %d, want 4", len(rows))
+	}
+	// A dangling call, as traced by debug_traceCall, has an empty context
+	for _, ctx := range []*tracers.Context{nil, new(tracers.Context)} {
+		tracer, err := newTimingTracer(ctx, nil)
+		if err != nil {
+			t.Fatalf("failed to create tracer: %v", err)
+		}
+		if res, err := runTestTracer(t, tracer, code, nil); err != nil || res[0] != '"' {
+			t.Errorf("context %v: unexpected metadata in result %s: %v", ctx, res, err)
+		}
+	}
+}
+
+// Tests that every row carries the gas remaining before its step, which the
+// cost of the step is the difference of.
+func TestTimingTracerGasRemaining(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	column := 10
+	if rows[0][column] != "gasRemaining" {
+		t.Fatalf("gasRemaining header mismatch: have %q", rows[0][column])
+	}
+	for i := 1; i < len(rows)-1; i++ {
+		gas, _ := strconv.Atoi(rows[i][column])
+		next, _ := strconv.Atoi(rows[i+1][column])
+		if cost, _ := strconv.Atoi(rows[i][2]); gas-next != cost {
+			t.Errorf("row %d: remaining gas %d to %d doesn't match cost %d", i, gas, next, cost)
+		}
+	}
+}
+
+// Tests that every row carries the memory size before its step.
+func TestTimingTracerMemSize(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0x40, byte(vm.MSTORE), // Expands memory to 0x60 bytes
+		byte(vm.PUSH1), 0, byte(vm.MLOAD), byte(vm.POP), byte(vm.STOP),
+	}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	column := 11
+	if rows[0][column] != "memSize" {
+		t.Fatalf("memSize header mismatch: have %q", rows[0][column])
+	}
+	var sizes []string
+	for _, row := range rows[1:] {
+		sizes = append(sizes, row[column])
+	}
+	if want := []string{"0", "0", "0", "96", "96", "96", "96"}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("memory sizes mismatch: have %v, want %v", sizes, want)
+	}
+}
+
+// Tests that every row carries the stack length before its step.
+func TestTimingTracerStackLen(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	column := 12
+	if rows[0][column] != "stackLen" {
+		t.Fatalf("stackLen header mismatch: have %q", rows[0][column])
+	}
+	var lens []string
+	for _, row := range rows[1:] {
+		lens = append(lens, row[column])
+	}
+	if want := []string{"0", "1", "2", "1", "0"}; !reflect.DeepEqual(lens, want) {
+		t.Errorf("stack lengths mismatch: have %v, want %v", lens, want)
+	}
+}
+
+// Tests that only steps slower than the threshold are kept, while all of them
+// are still counted.
+func TestTimingTracerMinDuration(t *testing.T) {
+	var (
+		callee    = common.HexToAddress("0xc0ffee")
+		contracts = map[common.Address][]byte{
+			callee: {
+				byte(vm.PUSH1), 0x40, byte(vm.JUMPDEST),
+				byte(vm.PUSH1), 1, byte(vm.SWAP1), byte(vm.SUB),
+				byte(vm.DUP1), byte(vm.PUSH1), 2, byte(vm.JUMPI),
+				byte(vm.STOP),
+			},
+		}
+		code = callCode(callee)
+	)
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, contracts)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	steps := len(readTimingRows(t, res)) - 1
+
+	for _, threshold := range []int{50, 1e12} {
+		tracer := newTestTracer(t, "timingTracer", fmt.Sprintf(`{"minDurationNs": %d}`, threshold)).(*timingTracer)
+		executeTestTracer(t, tracer, code, contracts)
+		if threshold == 1e12 && tracer.samples.len() != 0 {
+			t.Errorf("threshold %d: %d dropped rows held in memory", threshold, tracer.samples.len())
+		}
+		res, err := tracer.GetResult()
+		if err != nil {
+			t.Fatalf("threshold %d: failed to retrieve trace result: %v", threshold, err)
+		}
+		var result tableResult
+		if err := json.Unmarshal(res, &result); err != nil {
+			t.Fatalf("threshold %d: failed to unmarshal result: %v", threshold, err)
+		}
+		if result.TotalSteps == nil || *result.TotalSteps != steps || result.TotalTime <= 0 {
+			t.Errorf("threshold %d: totals mismatch: have %v steps in %v ns, want %d steps", threshold, result.TotalSteps, result.TotalTime, steps)
+		}
+		rows, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+		if err != nil {
+			t.Fatalf("threshold %d: invalid CSV: %v", threshold, err)
+		}
+		for _, row := range rows[1:] {
+			if ns, _ := strconv.Atoi(row[1]); ns <= threshold {
+				t.Errorf("threshold %d: kept step %v", threshold, row)
+			}
+		}
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"minDurationNs": -1}`)); err == nil {
+		t.Error("expected error for negative minDurationNs")
+	}
+}
+
+// Tests that the hotspots mode aggregates the steps per bytecode location,
+// attributing delegate called code to the library it belongs to.
+func TestTimingTracerHotspots(t *testing.T) {
+	var (
+		library = common.HexToAddress("0x11b")
+		loop    = []byte{
+			byte(vm.PUSH1), 10, byte(vm.JUMPDEST), // pc 2
+			byte(vm.PUSH1), 1, byte(vm.SWAP1), byte(vm.SUB),
+			byte(vm.DUP1), byte(vm.PUSH1), 2, byte(vm.JUMPI),
+			byte(vm.STOP),
+		}
+		code = []byte{
+			byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+			byte(vm.PUSH20),
+		}
+	)
+	code = append(append(code, library.Bytes()...), byte(vm.GAS), byte(vm.DELEGATECALL), byte(vm.POP))
+
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"hotspots": true}`), code, map[common.Address][]byte{library: loop})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if want := []string{"codeAddress", "pc", "opcode", "count", "totalTime", "meanTime", "totalCost", "stddevTime", "minTime", "maxTime"}; !reflect.DeepEqual(rows[0], want) {
+		t.Fatalf("header mismatch: have %v, want %v", rows[0], want)
+	}
+	var (
+		prev   = -1
+		counts = make(map[string]string)
+	)
+	for _, row := range rows[1:] {
+		counts[row[0]+":"+row[1]+":"+row[2]] = row[3]
+		time, _ := strconv.Atoi(row[4])
+		if prev >= 0 && time > prev {
+			t.Errorf("rows not ordered by total time: %d after %d", time, prev)
+		}
+		prev = time
+	}
+	if have := counts[library.Hex()+":2:JUMPDEST"]; have != "10" {
+		t.Errorf("library loop count mismatch: have %q, want 10", have)
+	}
+	if have := counts[library.Hex()+":11:STOP"]; have != "1" {
+		t.Errorf("library stop count mismatch: have %q, want 1", have)
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"hotspots": true, "summary": true}`)); err == nil {
+		t.Error("expected error combining hotspots and summary")
+	}
+}
+
+// Tests that the step times are published as per-opcode timers at the end of
+// the transaction.
+func TestTimingTracerMetrics(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+
+	var (
+		tracer   = newTestTracer(t, "timingTracer", `{"metrics": true}`).(*timingTracer)
+		registry = metrics.NewRegistry()
+		code     = []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP), byte(vm.STOP)}
+	)
+	tracer.metrics.registry = registry
+	executeTestTracer(t, tracer, code, nil)
+
+	for op, want := range map[string]int64{"PUSH1": 2, "ADD": 1, "POP": 1, "STOP": 1} {
+		timer, ok := registry.Get(timingMetricsPrefix + op).(metrics.Timer)
+		if !ok {
+			t.Errorf("%s: timer not registered", op)
+			continue
+		}
+		if have := timer.Count(); have != want {
+			t.Errorf("%s: timer count mismatch: have %d, want %d", op, have, want)
+		}
+	}
+	if registry.Get(timingMetricsPrefix+"MUL") != nil {
+		t.Error("timer registered for unexecuted opcode")
+	}
+}
+
+// Tests that the buffered step times of an opcode are published once a batch
+// is full, bounding the buffer within a transaction.
+func TestTimingMetricsBatch(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+
+	m := &timingMetrics{registry: metrics.NewRegistry()}
+	for i := 0; i < timingMetricsBatch+1; i++ {
+		m.add(vm.ADD, 10)
+	}
+	timer, ok := m.registry.Get(timingMetricsPrefix + "ADD").(metrics.Timer)
+	if !ok {
+		t.Fatal("timer not registered on a full batch")
+	}
+	if have := timer.Count(); have != timingMetricsBatch {
+		t.Fatalf("timer count mismatch: have %d, want %d", have, timingMetricsBatch)
+	}
+	if have := len(m.times[vm.ADD]); have != 1 {
+		t.Fatalf("buffered time count mismatch: have %d, want 1", have)
+	}
+	m.publish()
+	if have := timer.Count(); have != timingMetricsBatch+1 {
+		t.Fatalf("timer count mismatch: have %d, want %d", have, timingMetricsBatch+1)
+	}
+}
+
+// Tests that call boundary rows are recorded around the steps of a call.
+func TestTimingTracerCalls(t *testing.T) {
+	var (
+		callee    = common.HexToAddress("0xc0ffee")
+		contracts = map[common.Address][]byte{
+			callee: {byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)},
+		}
+	)
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"calls": true}`), callCode(callee), contracts)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if have := rows[0][13:16]; !reflect.DeepEqual(have, []string{"kind", "callee", "inputSize"}) {
+		t.Fatalf("call columns mismatch: have %v", have)
+	}
+	var kinds []string
+	for _, row := range rows[1:] {
+		kinds = append(kinds, row[0]+"/"+row[13])
+	}
+	want := []string{
+		"PUSH1/step", "PUSH1/step", "PUSH1/step", "PUSH1/step", "PUSH1/step", "PUSH20/step", "GAS/step", "CALL/step",
+		"CALL/enter", "PUSH1/step", "POP/step", "STOP/step", "CALL/exit",
+		"POP/step", "STOP/step",
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("rows mismatch:\nhave %v\nwant %v", kinds, want)
+	}
+	enter, exit := rows[9], rows[13]
+	for _, row := range [][]string{enter, exit} {
+		if row[4] != "1" || row[6] != "2" || row[14] != callee.Hex() || row[15] != "0" {
+			t.Errorf("call row %v: frame, depth, callee or input size mismatch", row)
+		}
+	}
+	forwarded, _ := strconv.Atoi(enter[10])
+	used, _ := strconv.Atoi(exit[2])
+	returned, _ := strconv.Atoi(exit[10])
+	if used != 5 || returned != forwarded-used {
+		t.Errorf("call gas mismatch: forwarded %d, used %d, returned %d", forwarded, used, returned)
+	}
+	var childTime int
+	for _, row := range rows[10:13] {
+		time, _ := strconv.Atoi(row[1])
+		childTime += time
+	}
+	if time, _ := strconv.Atoi(exit[1]); time < childTime {
+		t.Errorf("call time %d doesn't cover the child steps' %d", time, childTime)
+	}
+	// The CALL step is still charged its own cost
+	if rows[8][2] == "0" {
+		t.Errorf("CALL step lost its cost: %v", rows[8])
+	}
+}
+
+// Tests that the last step isn't charged the refund of the transaction, which
+// is included in the gas left at its end.
+func TestTimingTracerRefund(t *testing.T) {
+	tracer := newTestTracer(t, "timingTracer", "")
+	applyTestMessage(t, tracer, refundCode, refundStorage)
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var costs []string
+	for _, row := range readTimingRows(t, res)[1:] {
+		costs = append(costs, row[0]+"/"+row[2])
+	}
+	if want := []string{"PUSH1/3", "PUSH1/3", "SSTORE/5000", "STOP/0"}; !reflect.DeepEqual(costs, want) {
+		t.Fatalf("cost mismatch: have %v, want %v", costs, want)
+	}
+}
+
+// createCode returns bytecode deploying the given init code, at most 32 bytes,
+// with CREATE or CREATE2 and discarding the created address.
+func createCode(op vm.OpCode, initCode []byte) []byte {
+	code := append([]byte{byte(vm.PUSH1) + byte(len(initCode)-1)}, initCode...)
+	code = append(code, byte(vm.PUSH1), 0, byte(vm.MSTORE))
+	if op == vm.CREATE2 {
+		code = append(code, byte(vm.PUSH1), 0) // salt
+	}
+	return append(code,
+		byte(vm.PUSH1), byte(len(initCode)), // size
+		byte(vm.PUSH1), byte(32-len(initCode)), // offset
+		byte(vm.PUSH1), 0, // value
+		byte(op), byte(vm.POP),
+	)
+}
+
+// Tests that steps and call boundary rows are tagged with the code context
+// they ran in, constructor code while a frame is being created and runtime
+// code again once it is exited.
+func TestTimingTracerCodeContext(t *testing.T) {
+	var (
+		deploy  = []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.RETURN)}
+		factory = common.HexToAddress("0xfac7")
+	)
+	tests := []struct {
+		name      string
+		code      []byte
+		contracts map[common.Address][]byte
+		want      []string
+	}{
+		{
+			name: "create",
+			code: createCode(vm.CREATE, deploy),
+			want: []string{
+				"PUSH5/step/runtime", "PUSH1/step/runtime", "MSTORE/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "CREATE/step/runtime",
+				"CREATE/enter/init", "PUSH1/step/init", "PUSH1/step/init", "RETURN/step/init",
+				"CREATE/exit/init", "POP/step/runtime", "STOP/step/runtime",
+			},
+		},
+		{
+			name: "create2",
+			code: createCode(vm.CREATE2, deploy),
+			want: []string{
+				"PUSH5/step/runtime", "PUSH1/step/runtime", "MSTORE/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "CREATE2/step/runtime",
+				"CREATE2/enter/init", "PUSH1/step/init", "PUSH1/step/init", "RETURN/step/init",
+				"CREATE2/exit/init", "POP/step/runtime", "STOP/step/runtime",
+			},
+		},
+		{
+			name: "nested create",
+			code: createCode(vm.CREATE, createCode(vm.CREATE, deploy)),
+			want: []string{
+				"PUSH17/step/runtime", "PUSH1/step/runtime", "MSTORE/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "CREATE/step/runtime",
+				"CREATE/enter/init", "PUSH5/step/init", "PUSH1/step/init", "MSTORE/step/init", "PUSH1/step/init", "PUSH1/step/init", "PUSH1/step/init", "CREATE/step/init",
+				"CREATE/enter/init", "PUSH1/step/init", "PUSH1/step/init", "RETURN/step/init",
+				"CREATE/exit/init", "POP/step/init", "STOP/step/init",
+				"CREATE/exit/init", "POP/step/runtime", "STOP/step/runtime",
+			},
+		},
+		{
+			name:      "create in call",
+			code:      callCode(factory),
+			contracts: map[common.Address][]byte{factory: createCode(vm.CREATE, deploy)},
+			want: []string{
+				"PUSH1/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "PUSH20/step/runtime", "GAS/step/runtime", "CALL/step/runtime",
+				"CALL/enter/runtime", "PUSH5/step/runtime", "PUSH1/step/runtime", "MSTORE/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "PUSH1/step/runtime", "CREATE/step/runtime",
+				"CREATE/enter/init", "PUSH1/step/init", "PUSH1/step/init", "RETURN/step/init",
+				"CREATE/exit/init", "POP/step/runtime", "STOP/step/runtime",
+				"CALL/exit/runtime", "POP/step/runtime", "STOP/step/runtime",
+			},
+		},
+	}
+	for _, tt := range tests {
+		res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"calls": true}`), tt.code, tt.contracts)
+		if err != nil {
+			t.Fatalf("%s: failed to retrieve trace result: %v", tt.name, err)
+		}
+		rows := readTimingRows(t, res)
+		if rows[0][3] != "codeCtx" {
+			t.Fatalf("codeCtx header mismatch: have %q", rows[0][3])
+		}
+		var have []string
+		for _, row := range rows[1:] {
+			have = append(have, row[0]+"/"+row[13]+"/"+row[3])
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%s: rows mismatch:\nhave %v\nwant %v", tt.name, have, tt.want)
+		}
+	}
+}
+
+// Tests that precompile calls, which execute no steps, get a row of their own.
+func TestTimingTracerPrecompiles(t *testing.T) {
+	identity := common.BytesToAddress([]byte{4})
+	for _, cfg := range []string{`{"precompiles": true}`, `{"precompiles": true, "calls": true}`} {
+		res, err := runTestTracer(t, newTestTracer(t, "timingTracer", cfg), callCode(identity), nil)
+		if err != nil {
+			t.Fatalf("config %s: failed to retrieve trace result: %v", cfg, err)
+		}
+		rows := readTimingRows(t, res)[1:]
+		var kinds []string
+		for _, row := range rows[7:] {
+			kinds = append(kinds, row[0]+"/"+row[13])
+		}
+		if want := []string{"CALL/step", "CALL/precompile", "POP/step", "STOP/step"}; !reflect.DeepEqual(kinds, want) {
+			t.Fatalf("config %s: rows mismatch: have %v, want %v", cfg, kinds, want)
+		}
+		row := rows[8]
+		if row[14] != identity.Hex() || row[15] != "0" || row[2] != strconv.FormatUint(params.IdentityBaseGas, 10) {
+			t.Errorf("config %s: precompile row mismatch: %v", cfg, row)
+		}
+	}
+}
+
+// Tests that the configured delimiter separates the fields of both the step
+// rows and the aggregated modes.
+func TestTimingTracerDelimiter(t *testing.T) {
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.STOP)}
+	for _, cfg := range []string{
+		`{"delimiter": "\t"}`,
+		`{"delimiter": "\t", "summary": true}`,
+		`{"delimiter": "\t", "histogram": {"buckets": [100]}}`,
+		`{"delimiter": "\t", "hotspots": true}`,
+	} {
+		res, err := runTestTracer(t, newTestTracer(t, "timingTracer", cfg), code, nil)
+		if err != nil {
+			t.Fatalf("config %s: failed to retrieve trace result: %v", cfg, err)
+		}
+		var blob string
+		if err := json.Unmarshal(res, &blob); err != nil {
+			t.Fatalf("config %s: failed to unmarshal result: %v", cfg, err)
+		}
+		reader := csv.NewReader(strings.NewReader(blob))
+		reader.Comma = '\t'
+		rows, err := reader.ReadAll()
+		if err != nil {
+			t.Fatalf("config %s: invalid TSV: %v", cfg, err)
+		}
+		if len(rows) < 2 || len(rows[0]) < 2 {
+			t.Fatalf("config %s: rows not tab separated: %q", cfg, blob)
+		}
+		if strings.Contains(blob, ",") {
+			t.Errorf("config %s: unexpected comma in %q", cfg, blob)
+		}
+	}
+	for _, cfg := range []string{
+		`{"delimiter": "\""}`,
+		`{"delimiter": "\n"}`,
+		`{"delimiter": "\r"}`,
+		`{"delimiter": ";;"}`,
+		`{"delimiter": "\u0000"}`,
+		`{"delimiter": "\t", "output": "json"}`,
+	} {
+		if _, err := newTimingTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("config %s: expected error", cfg)
+		}
+	}
+}
+
+// Tests that with maxRows only the most recent rows are kept, in order, and
+// that the truncation is reported.
+func TestTimingTracerMaxRows(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.POP),
+		byte(vm.PUSH1), 3, byte(vm.POP), byte(vm.STOP),
+	}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"maxRows": 3}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	if !result.Truncated || result.DroppedRows != 4 {
+		t.Errorf("truncation mismatch: have %v/%d, want true/4", result.Truncated, result.DroppedRows)
+	}
+	rows, err := csv.NewReader(strings.NewReader(result.CSV)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	var ops []string
+	for _, row := range rows[1:] {
+		ops = append(ops, row[0])
+		if row[2] == "" {
+			t.Errorf("missing cost of %s", row[0])
+		}
+	}
+	if want := []string{"PUSH1", "POP", "STOP"}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("rows mismatch: have %v, want %v", ops, want)
+	}
+
+	// Without reaching the limit, the result is left unchanged
+	res, err = runTestTracer(t, newTestTracer(t, "timingTracer", `{"maxRows": 100}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	if rows := readTimingRows(t, res); len(rows) != 8 {
+		t.Errorf("row count mismatch: have %d, want 8", len(rows))
+	}
+	for _, cfg := range []string{
+		`{"maxRows": -1}`,
+		`{"maxRows": 10, "summary": true}`,
+		`{"maxRows": 10, "checkpointSamples": 10}`,
+	} {
+		if _, err := newTimingTracer(nil, json.RawMessage(cfg)); err == nil {
+			t.Errorf("config %s: expected error", cfg)
+		}
+	}
+}
+
+// Tests that with stateTiming, SLOAD and SSTORE steps report the time spent
+// accessing the StateDB, and all other rows leave the column empty.
+func TestTimingTracerStateTiming(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+		byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.POP), byte(vm.STOP),
+	}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"stateTiming": true}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if rows[0][16] != "stateTime" {
+		t.Fatalf("header mismatch: have %s", rows[0][16])
+	}
+	for _, row := range rows[1:] {
+		switch row[0] {
+		case "SLOAD", "SSTORE":
+			ns, err := strconv.Atoi(row[16])
+			if err != nil || ns < 0 {
+				t.Errorf("invalid state time of %s: %q", row[0], row[16])
+			}
+			if time, _ := strconv.Atoi(row[1]); ns > time {
+				t.Errorf("state time of %s exceeds its step time: %d > %d", row[0], ns, time)
+			}
+		default:
+			if row[16] != "" {
+				t.Errorf("unexpected state time of %s: %q", row[0], row[16])
+			}
+		}
+	}
+	// Without the option, the column is left empty
+	res, err = runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	for _, row := range readTimingRows(t, res)[1:] {
+		if row[16] != "" {
+			t.Errorf("unexpected state time of %s: %q", row[0], row[16])
+		}
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"stateTiming": true, "summary": true}`)); err == nil {
+		t.Errorf("expected error combining stateTiming with summary")
+	}
+
+	// The decorator is removed once the call ends, passing all other methods through
+	statedb, _ := corestate.New(common.Hash{}, corestate.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	tracer := newTestTracer(t, "timingTracer", `{"stateTiming": true}`)
+	env := vm.NewEVM(vm.BlockContext{}, vm.TxContext{}, statedb, params.TestChainConfig, vm.Config{Tracer: tracer})
+	tracer.CaptureStart(env, common.Address{}, common.Address{}, false, nil, 0, nil)
+	decorated, ok := env.StateDB.(*timingStateDB)
+	if !ok {
+		t.Fatalf("StateDB not decorated: %T", env.StateDB)
+	}
+	decorated.AddBalance(common.Address{1}, big.NewInt(1))
+	if have := statedb.GetBalance(common.Address{1}); have.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("balance mismatch: have %v, want 1", have)
+	}
+	tracer.CaptureEnd(nil, 0, nil)
+	if env.StateDB != vm.StateDB(statedb) {
+		t.Errorf("StateDB not restored: %T", env.StateDB)
+	}
+}
+
+// Tests that with gc, the steps during which a garbage collection cycle
+// completed are flagged, and the column is empty otherwise.
+func TestTimingTracerGC(t *testing.T) {
+	tracer := newTestTracer(t, "timingTracer", `{"gc": true}`)
+	tracer.CaptureTxStart(3)
+	tracer.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 3, nil)
+	tracer.CaptureState(0, vm.JUMPDEST, 3, 1, nil, nil, 1, nil)
+	goruntime.GC()
+	tracer.CaptureState(1, vm.JUMPDEST, 2, 1, nil, nil, 1, nil)
+	tracer.CaptureState(2, vm.STOP, 1, 0, nil, nil, 1, nil)
+	tracer.CaptureEnd(nil, 2, nil)
+	tracer.CaptureTxEnd(1)
+
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if rows[0][17] != "gcDuringStep" {
+		t.Fatalf("header mismatch: have %s", rows[0][17])
+	}
+	var flags []string
+	for _, row := range rows[1:] {
+		flags = append(flags, row[17])
+	}
+	if want := []string{"true", "false", "false"}; !reflect.DeepEqual(flags, want) {
+		t.Errorf("gc flags mismatch: have %v, want %v", flags, want)
+	}
+
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.POP), byte(vm.STOP)}
+	res, err = runTestTracer(t, newTestTracer(t, "timingTracer", ""), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	for _, row := range readTimingRows(t, res)[1:] {
+		if row[17] != "" {
+			t.Errorf("unexpected gc flag of %s: %q", row[0], row[17])
+		}
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"gc": true, "hotspots": true}`)); err == nil {
+		t.Errorf("expected error combining gc with hotspots")
+	}
+}
+
+// Tests that with firstOccurrences only the first steps of every opcode are
+// recorded, and that the step index counts all executed steps.
+func TestTimingTracerFirstOccurrences(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.ADD), byte(vm.PUSH1), 3,
+		byte(vm.ADD), byte(vm.PUSH1), 4, byte(vm.ADD), byte(vm.POP), byte(vm.STOP),
+	}
+	res, err := runTestTracer(t, newTestTracer(t, "timingTracer", `{"firstOccurrences": 2}`), code, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	rows := readTimingRows(t, res)
+	if rows[0][18] != "stepIndex" {
+		t.Fatalf("header mismatch: have %s", rows[0][18])
+	}
+	var have [][2]string
+	for _, row := range rows[1:] {
+		have = append(have, [2]string{row[0], row[18]})
+	}
+	want := [][2]string{{"PUSH1", "0"}, {"PUSH1", "1"}, {"ADD", "2"}, {"ADD", "4"}, {"POP", "7"}, {"STOP", "8"}}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("rows mismatch: have %v, want %v", have, want)
+	}
+	if _, err := newTimingTracer(nil, json.RawMessage(`{"firstOccurrences": -1}`)); err == nil {
+		t.Errorf("expected error for negative firstOccurrences")
+	}
+}
+
+// Tests that the deterministic mode disables the garbage collector while
+// tracing, restores the previous setting whether or not the transaction
+// completes, and can only be held by one tracer at a time.
+func TestTimingTracerDeterministic(t *testing.T) {
+	defer debug.SetGCPercent(debug.SetGCPercent(73))
+
+	gcPercent := func() int {
+		prev := debug.SetGCPercent(-1)
+		debug.SetGCPercent(prev)
+		return prev
+	}
+	first := newTestTracer(t, "timingTracer", `{"deterministic": true}`)
+	first.CaptureTxStart(3)
+	first.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 3, nil)
+	if have := gcPercent(); have != -1 {
+		t.Fatalf("gc percent mismatch while tracing: have %d, want -1", have)
+	}
+	// A second tracer must not activate while the first holds the mode
+	second := newTestTracer(t, "timingTracer", `{"deterministic": true}`)
+	second.CaptureTxStart(3)
+	second.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 3, nil)
+	second.CaptureEnd(nil, 0, nil)
+	second.CaptureTxEnd(3)
+	if _, err := second.GetResult(); !errors.Is(err, errDeterministicBusy) {
+		t.Errorf("second tracer error mismatch: have %v, want %v", err, errDeterministicBusy)
+	}
+	if have := gcPercent(); have != -1 {
+		t.Fatalf("gc percent mismatch after second tracer: have %d, want -1", have)
+	}
+	first.CaptureState(0, vm.STOP, 3, 0, nil, nil, 1, nil)
+	first.CaptureEnd(nil, 0, nil)
+	if have := gcPercent(); have != 73 {
+		t.Errorf("gc percent mismatch after top call: have %d, want 73", have)
+	}
+	if deterministicHeld.Load() {
+		t.Error("deterministic mode still held after top call")
+	}
+	first.CaptureTxEnd(3)
+	if have := gcPercent(); have != 73 {
+		t.Errorf("gc percent mismatch after transaction: have %d, want 73", have)
+	}
+	if _, err := first.GetResult(); err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	// A stopped transaction that never ends must release the mode too
+	stopped := newTestTracer(t, "timingTracer", `{"deterministic": true}`)
+	stopped.CaptureTxStart(3)
+	stopped.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 3, nil)
+	stopped.Stop(errors.New("timeout"))
+	if have := gcPercent(); have != 73 {
+		t.Errorf("gc percent mismatch after stop: have %d, want 73", have)
+	}
+	if deterministicHeld.Load() {
+		t.Errorf("deterministic mode still held after stop")
+	}
+}
+
+// Tests that the chunked row storage keeps the rows in order across chunk
+// boundaries when appending, truncating, shifting and compacting.
+func TestTimingRows(t *testing.T) {
+	var rows timingRows
+	n := 2*sampleChunkSize + 10
+	for i := 0; i < n; i++ {
+		if have := rows.append(timingSample{index: i, dropped: i%3 == 0}); have != i {
+			t.Fatalf("row %d: index mismatch: have %d", i, have)
+		}
+	}
+	if len(rows.chunks) != 3 || cap(rows.chunks[1]) != sampleChunkSize {
+		t.Fatalf("chunk layout mismatch: %d chunks", len(rows.chunks))
+	}
+	rows.truncate(sampleChunkSize + 5)
+	if have := rows.len(); have != sampleChunkSize+5 || len(rows.chunks) != 2 {
+		t.Fatalf("truncated length mismatch: have %d in %d chunks", have, len(rows.chunks))
+	}
+	rows.shift(7)
+	for i := 0; i < rows.len(); i++ {
+		if have := rows.at(i).index; have != i+7 {
+			t.Fatalf("shifted row %d mismatch: have %d", i, have)
+		}
+	}
+	rows.compact()
+	for i := 0; i < rows.len(); i++ {
+		if sample := rows.at(i); sample.dropped || (i > 0 && sample.index <= rows.at(i-1).index) {
+			t.Fatalf("compacted row %d mismatch: %+v", i, sample)
+		}
+	}
+	// The rows 7 to sampleChunkSize+4 remain, of which every third was dropped
+	var want int
+	for i := 7; i < sampleChunkSize+5; i++ {
+		if i%3 != 0 {
+			want++
+		}
+	}
+	if have := rows.len(); have != want {
+		t.Errorf("compacted length mismatch: have %d, want %d", have, want)
+	}
+}
+
+// BenchmarkTimingRows measures the allocations of storing a million rows in a
+// single growing slice, as the samples used to be held, and in chunks.
+func BenchmarkTimingRows(b *testing.B) {
+	const n = 1_000_000
+	b.Run("slice", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var rows []timingSample
+			for j := 0; j < n; j++ {
+				rows = append(rows, timingSample{op: vm.ADD, index: j})
+			}
+		}
+	})
+	b.Run("chunks", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var rows timingRows
+			for j := 0; j < n; j++ {
+				rows.append(timingSample{op: vm.ADD, index: j})
+			}
+		}
+	})
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"sync"
+	"time"
+)
+
+// tscCalibrationTime is the wall clock time the timestamp counter is sampled
+// over to measure its rate.
+const tscCalibrationTime = 10 * time.Millisecond
+
+var (
+	tscOnce      sync.Once
+	tscFrequency float64 // Measured timestamp counter ticks per second
+	tscInvariant bool    // Whether the CPU advertises an invariant counter
+)
+
+// calibrateTSC measures the rate of the timestamp counter against the
+// monotonic clock. The measurement is done once per process.
+func calibrateTSC() (frequency float64, invariant bool) {
+	tscOnce.Do(func() {
+		tscInvariant = invariantTSC()
+
+		start, ticks := time.Now(), readTSC()
+		time.Sleep(tscCalibrationTime)
+		tscFrequency = float64(readTSC()-ticks) / time.Since(start).Seconds()
+	})
+	return tscFrequency, tscInvariant
+}
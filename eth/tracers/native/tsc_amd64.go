@@ -0,0 +1,61 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build amd64
+// +build amd64
+
+package native
+
+// tscSupported is whether the CPU timestamp counter can be read.
+const tscSupported = true
+
+// readTSC returns the current value of the CPU timestamp counter.
+func readTSC() int64
+
+// readTSCP returns the current value of the CPU timestamp counter once all
+// preceding instructions completed, before any following one starts.
+func readTSCP() int64
+
+// pmcSupported is whether performance counters can be read with RDPMC, where
+// the kernel permits it.
+const pmcSupported = true
+
+// readPMC returns the current value of the given performance counter. It
+// faults unless the kernel enabled user space reads of the counters.
+func readPMC(counter uint32) uint64
+
+// cpuid executes the CPUID instruction for the given leaf and subleaf.
+func cpuid(leaf, subleaf uint32) (eax, ebx, ecx, edx uint32)
+
+// invariantTSC reports whether the CPU advertises an invariant timestamp
+// counter, which ticks at a constant rate regardless of frequency scaling and
+// power states.
+func invariantTSC() bool {
+	if maxLeaf, _, _, _ := cpuid(0x80000000, 0); maxLeaf < 0x80000007 {
+		return false
+	}
+	_, _, _, edx := cpuid(0x80000007, 0)
+	return edx&(1<<8) != 0
+}
+
+// rdtscpSupported reports whether the CPU implements the RDTSCP instruction.
+func rdtscpSupported() bool {
+	if maxLeaf, _, _, _ := cpuid(0x80000000, 0); maxLeaf < 0x80000001 {
+		return false
+	}
+	_, _, _, edx := cpuid(0x80000001, 0)
+	return edx&(1<<27) != 0
+}
@@ -0,0 +1,41 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !amd64
+// +build !amd64
+
+package native
+
+// tscSupported is whether the CPU timestamp counter can be read.
+const tscSupported = false
+
+// readTSC is unavailable on this platform.
+func readTSC() int64 { return 0 }
+
+// readTSCP is unavailable on this platform.
+func readTSCP() int64 { return 0 }
+
+// pmcSupported is whether performance counters can be read with RDPMC.
+const pmcSupported = false
+
+// readPMC is unavailable on this platform.
+func readPMC(counter uint32) uint64 { return 0 }
+
+// invariantTSC is unavailable on this platform.
+func invariantTSC() bool { return false }
+
+// rdtscpSupported is unavailable on this platform.
+func rdtscpSupported() bool { return false }
@@ -0,0 +1,89 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	tracers.DefaultDirectory.Register("txSummaryTracer", newTxSummaryTracer, false)
+}
+
+// txSummary is the result of the txSummaryTracer.
+type txSummary struct {
+	Steps   int    `json:"steps"`           // Number of executed opcodes
+	Calls   int    `json:"calls"`           // Number of entered call frames
+	GasUsed uint64 `json:"gasUsed"`         // Gas used by the transaction
+	TimeNs  int64  `json:"timeNs"`          // Wall clock time spent executing the transaction
+	Error   string `json:"error,omitempty"` // Error of the top level call, if any
+}
+
+// txSummaryTracer records a handful of counters per transaction. It keeps no
+// per-step data, making it cheap enough to attach to every transaction of a
+// chain import.
+type txSummaryTracer struct {
+	noopTracer
+	summary  txSummary
+	gasLimit uint64
+	start    time.Time
+}
+
+// newTxSummaryTracer returns a new txSummary tracer.
+func newTxSummaryTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+	return &txSummaryTracer{}, nil
+}
+
+// CaptureTxStart implements the EVMLogger interface, starting the clock.
+func (t *txSummaryTracer) CaptureTxStart(gasLimit uint64) {
+	t.gasLimit = gasLimit
+	t.start = time.Now()
+}
+
+// CaptureTxEnd implements the EVMLogger interface, stopping the clock.
+func (t *txSummaryTracer) CaptureTxEnd(restGas uint64) {
+	t.summary.TimeNs = time.Since(t.start).Nanoseconds()
+	t.summary.GasUsed = t.gasLimit - restGas
+}
+
+// CaptureEnd is called after the top level call finishes.
+func (t *txSummaryTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	if err != nil {
+		t.summary.Error = err.Error()
+	}
+}
+
+// CaptureState implements the EVMLogger interface to trace a single step of VM execution.
+func (t *txSummaryTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	t.summary.Steps++
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *txSummaryTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	t.summary.Calls++
+}
+
+// GetResult returns the counters as a JSON object.
+func (t *txSummaryTracer) GetResult() (json.RawMessage, error) {
+	return json.Marshal(t.summary)
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestTxSummaryTracer(t *testing.T) {
+	callee := common.HexToAddress("0xc0de")
+	res, err := runTestTracer(t, newTestTracer(t, "txSummaryTracer", ""), callCode(callee), map[common.Address][]byte{callee: revertCode})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var summary txSummary
+	if err := json.Unmarshal(res, &summary); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	// 10 steps of the caller, including the implicit STOP, and 3 of the callee
+	if summary.Steps != 13 || summary.Calls != 1 || summary.Error != "" {
+		t.Fatalf("summary mismatch: %+v", summary)
+	}
+}
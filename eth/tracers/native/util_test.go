@@ -0,0 +1,176 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	corestate "github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// newTestTracer instantiates a tracer from the default directory.
+func newTestTracer(t testing.TB, name string, cfg string) tracers.Tracer {
+	t.Helper()
+
+	var config json.RawMessage
+	if cfg != "" {
+		config = json.RawMessage(cfg)
+	}
+	tracer, err := tracers.DefaultDirectory.New(name, new(tracers.Context), config)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", name, err)
+	}
+	return tracer
+}
+
+// runTestTracer executes code with the given tracer attached, with the other
+// contracts deployed beforehand, and returns the tracing result.
+func runTestTracer(t testing.TB, tracer tracers.Tracer, code []byte, contracts map[common.Address][]byte) (json.RawMessage, error) {
+	t.Helper()
+
+	executeTestTracer(t, tracer, code, contracts)
+	return tracer.GetResult()
+}
+
+// executeTestTracer executes code with the given tracer attached, with the
+// other contracts deployed beforehand.
+func executeTestTracer(t testing.TB, tracer tracers.Tracer, code []byte, contracts map[common.Address][]byte) {
+	t.Helper()
+
+	statedb, _ := corestate.New(common.Hash{}, corestate.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	for addr, code := range contracts {
+		statedb.SetCode(addr, code)
+	}
+	address := common.BytesToAddress([]byte("contract"))
+	statedb.SetCode(address, code)
+
+	cfg := &runtime.Config{
+		GasLimit:  1_000_000,
+		State:     statedb,
+		EVMConfig: vm.Config{Tracer: tracer},
+	}
+	tracer.CaptureTxStart(cfg.GasLimit)
+	_, restGas, _ := runtime.Call(address, nil, cfg)
+	tracer.CaptureTxEnd(restGas)
+}
+
+// refundCode clears the storage slot 0, which refundStorage sets, earning the
+// transaction a refund.
+var (
+	refundCode    = []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE), byte(vm.STOP)}
+	refundStorage = map[common.Hash]common.Hash{{}: common.BytesToHash([]byte{1})}
+)
+
+// applyTestMessage applies a transaction calling code, with the given storage,
+// through core.ApplyMessage with the tracer attached. Unlike executeTestTracer,
+// the tracer sees the transaction hooks of block processing, with the gas
+// refund included in the gas left at the end.
+func applyTestMessage(t testing.TB, tracer tracers.Tracer, code []byte, storage map[common.Hash]common.Hash) {
+	t.Helper()
+
+	var (
+		from = common.HexToAddress("0xf00d")
+		to   = common.HexToAddress("0xc0de")
+	)
+	statedb, _ := corestate.New(common.Hash{}, corestate.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.AddBalance(from, big.NewInt(params.Ether))
+	statedb.SetCode(to, code)
+	for key, value := range storage {
+		statedb.SetState(to, key, value)
+	}
+	// Commit the storage, which only then counts as original for refunds
+	statedb.IntermediateRoot(true)
+
+	blockCtx := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		BlockNumber: big.NewInt(1),
+		GasLimit:    10_000_000,
+		BaseFee:     new(big.Int),
+	}
+	msg := &core.Message{
+		From:      from,
+		To:        &to,
+		Value:     new(big.Int),
+		GasLimit:  100_000,
+		GasPrice:  new(big.Int),
+		GasFeeCap: new(big.Int),
+		GasTipCap: new(big.Int),
+	}
+	evm := vm.NewEVM(blockCtx, vm.TxContext{Origin: from, GasPrice: msg.GasPrice}, statedb, params.TestChainConfig, vm.Config{Tracer: tracer})
+	res, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit))
+	if err != nil {
+		t.Fatalf("failed to apply message: %v", err)
+	}
+	if res.Failed() {
+		t.Fatalf("message execution failed: %v", res.Err)
+	}
+}
+
+// setOutputDir sets a temporary directory as the tracer output directory for
+// the duration of the test, returning it.
+func setOutputDir(t testing.TB) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	outputDir = dir
+	t.Cleanup(func() { outputDir = "" })
+	return dir
+}
+
+// callCode returns bytecode calling the given address with all available gas,
+// no input and no value, discarding the call's success flag.
+func callCode(addr common.Address) []byte {
+	code := []byte{
+		byte(vm.PUSH1), 0, // retSize
+		byte(vm.PUSH1), 0, // retOffset
+		byte(vm.PUSH1), 0, // argsSize
+		byte(vm.PUSH1), 0, // argsOffset
+		byte(vm.PUSH1), 0, // value
+		byte(vm.PUSH20),
+	}
+	code = append(code, addr.Bytes()...)
+	return append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.POP))
+}
+
+// revertCode is bytecode reverting without return data.
+var revertCode = []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}
+
+// tableCSV returns the CSV of a tabular tracer's result, which is either a
+// bare JSON string or a tableResult if metadata is reported alongside.
+func tableCSV(t testing.TB, res json.RawMessage) string {
+	t.Helper()
+
+	var blob string
+	if err := json.Unmarshal(res, &blob); err == nil {
+		return blob
+	}
+	var result tableResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	return result.CSV
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"math/big"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	tracers.DefaultDirectory.Register("witnessTracer", newWitnessTracer, false)
+}
+
+const (
+	// witnessAccountBytes is the size accounted for every loaded account: its
+	// address, nonce, balance, storage root and code hash.
+	witnessAccountBytes = common.AddressLength + 8 + 32 + common.HashLength + common.HashLength
+
+	// witnessSlotBytes is the size accounted for every loaded storage slot: its
+	// key and value.
+	witnessSlotBytes = common.HashLength + common.HashLength
+)
+
+// witnessResult is the result of the witnessTracer.
+type witnessResult struct {
+	Accounts     int    `json:"accounts"`     // Distinct accounts loaded
+	Slots        int    `json:"slots"`        // Distinct storage slots loaded
+	Contracts    int    `json:"contracts"`    // Distinct contracts whose code was loaded
+	AccountBytes int    `json:"accountBytes"` // Size of the loaded accounts
+	StorageBytes int    `json:"storageBytes"` // Size of the loaded storage slots
+	CodeBytes    int    `json:"codeBytes"`    // Size of the loaded contract code
+	TotalBytes   int    `json:"totalBytes"`   // Sum of all categories
+	GasUsed      uint64 `json:"gasUsed"`      // Gas used by the transaction
+}
+
+// witnessTracer approximates the size of the state witness a transaction
+// needs to be executed statelessly: the accounts, storage slots and contract
+// code it loads. Repeated accesses are counted once.
+type witnessTracer struct {
+	noopTracer
+	env       *vm.EVM
+	accounts  map[common.Address]struct{}
+	slots     map[common.Address]map[common.Hash]struct{}
+	code      map[common.Address]int // Code size of the contracts whose code was loaded
+	gasLimit  uint64
+	gasUsed   uint64
+	interrupt atomic.Bool // Atomic flag to signal execution interruption
+	reason    error       // Textual reason for the interruption
+}
+
+// newWitnessTracer returns a new witness tracer.
+func newWitnessTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+	return &witnessTracer{
+		accounts: make(map[common.Address]struct{}),
+		slots:    make(map[common.Address]map[common.Hash]struct{}),
+		code:     make(map[common.Address]int),
+	}, nil
+}
+
+// CaptureStart implements the EVMLogger interface to initialize the tracing operation.
+func (t *witnessTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.env = env
+	t.loadAccount(from)
+	t.loadAccount(to)
+	// The initcode of a contract creation is part of the transaction
+	if !create {
+		t.loadCode(to)
+	}
+}
+
+// CaptureState implements the EVMLogger interface to trace a single step of VM execution.
+func (t *witnessTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	// Skip if tracing was interrupted
+	if t.interrupt.Load() {
+		return
+	}
+	// A step failing before it runs, like out of dynamic gas, loaded the state
+	// already in the gas calculation, so it is recorded regardless of err
+	stackData := scope.Stack.Data()
+	stackLen := len(stackData)
+	switch {
+	case stackLen >= 1 && (op == vm.SLOAD || op == vm.SSTORE):
+		t.loadSlot(scope.Contract.Address(), common.Hash(stackData[stackLen-1].Bytes32()))
+	case stackLen >= 1 && op == vm.EXTCODECOPY:
+		addr := common.Address(stackData[stackLen-1].Bytes20())
+		t.loadAccount(addr)
+		t.loadCode(addr)
+	case stackLen >= 1 && (op == vm.EXTCODEHASH || op == vm.EXTCODESIZE || op == vm.BALANCE || op == vm.SELFDESTRUCT):
+		t.loadAccount(common.Address(stackData[stackLen-1].Bytes20()))
+	case stackLen >= 2 && (op == vm.CALL || op == vm.CALLCODE || op == vm.DELEGATECALL || op == vm.STATICCALL):
+		// The callee's code is only loaded once the call enters it
+		t.loadAccount(common.Address(stackData[stackLen-2].Bytes20()))
+	}
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *witnessTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	if t.interrupt.Load() {
+		return
+	}
+	t.loadAccount(to)
+	switch typ {
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+		t.loadCode(to)
+	}
+}
+
+// loadAccount records an account access.
+func (t *witnessTracer) loadAccount(addr common.Address) {
+	t.accounts[addr] = struct{}{}
+}
+
+// loadSlot records a storage slot access.
+func (t *witnessTracer) loadSlot(addr common.Address, slot common.Hash) {
+	slots, ok := t.slots[addr]
+	if !ok {
+		slots = make(map[common.Hash]struct{})
+		t.slots[addr] = slots
+	}
+	slots[slot] = struct{}{}
+}
+
+// loadCode records the size of a contract whose code was loaded.
+func (t *witnessTracer) loadCode(addr common.Address) {
+	if _, ok := t.code[addr]; ok {
+		return
+	}
+	t.code[addr] = t.env.StateDB.GetCodeSize(addr)
+}
+
+// CaptureTxStart implements the EVMLogger interface, recording the gas limit.
+func (t *witnessTracer) CaptureTxStart(gasLimit uint64) {
+	t.gasLimit = gasLimit
+}
+
+// CaptureTxEnd implements the EVMLogger interface, recording the gas used.
+func (t *witnessTracer) CaptureTxEnd(restGas uint64) {
+	t.gasUsed = t.gasLimit - restGas
+}
+
+// GetResult returns the witness size broken down by category.
+func (t *witnessTracer) GetResult() (json.RawMessage, error) {
+	res := witnessResult{
+		Accounts:  len(t.accounts),
+		Contracts: len(t.code),
+		GasUsed:   t.gasUsed,
+	}
+	for _, slots := range t.slots {
+		res.Slots += len(slots)
+	}
+	for _, size := range t.code {
+		res.CodeBytes += size
+	}
+	res.AccountBytes = res.Accounts * witnessAccountBytes
+	res.StorageBytes = res.Slots * witnessSlotBytes
+	res.TotalBytes = res.AccountBytes + res.StorageBytes + res.CodeBytes
+
+	blob, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	return blob, t.reason
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *witnessTracer) Stop(err error) {
+	t.reason = err
+	t.interrupt.Store(true)
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Tests that the witness tracer counts repeated state accesses once.
+func TestWitnessTracer(t *testing.T) {
+	var (
+		callee     = common.HexToAddress("0xc0ffee")
+		calleeCode = []byte{byte(vm.PUSH1), 1, byte(vm.SLOAD), byte(vm.POP), byte(vm.STOP)}
+	)
+	sload := func(slot byte) []byte {
+		return []byte{byte(vm.PUSH1), slot, byte(vm.SLOAD), byte(vm.POP)}
+	}
+	extcodecopy := append([]byte{
+		byte(vm.PUSH1), 5, // size
+		byte(vm.PUSH1), 0, // offset
+		byte(vm.PUSH1), 0, // destOffset
+		byte(vm.PUSH20),
+	}, append(callee.Bytes(), byte(vm.EXTCODECOPY))...)
+
+	var code []byte
+	code = append(code, sload(1)...)
+	code = append(code, sload(1)...)
+	code = append(code, sload(2)...)
+	code = append(code, extcodecopy...)
+	code = append(code, extcodecopy...)
+	code = append(code, callCode(callee)...)
+
+	res, err := runTestTracer(t, newTestTracer(t, "witnessTracer", ""), code, map[common.Address][]byte{callee: calleeCode})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var have witnessResult
+	if err := json.Unmarshal(res, &have); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	// Origin, executed contract and callee; two slots of the contract and one
+	// of the callee; code of both contracts
+	want := witnessResult{
+		Accounts:     3,
+		Slots:        3,
+		Contracts:    2,
+		AccountBytes: 3 * witnessAccountBytes,
+		StorageBytes: 3 * witnessSlotBytes,
+		CodeBytes:    len(code) + len(calleeCode),
+		GasUsed:      9275, // Three SLOADs, two EXTCODECOPYs and the call, cold and warm
+	}
+	want.TotalBytes = want.AccountBytes + want.StorageBytes + want.CodeBytes
+	if have != want {
+		t.Fatalf("result mismatch: have %+v, want %+v", have, want)
+	}
+}
+
+// Tests that the witness tracer counts the state loaded by a step running out
+// of dynamic gas, which fails before it executes.
+func TestWitnessTracerOutOfGas(t *testing.T) {
+	var (
+		callee     = common.HexToAddress("0xc0ffee")
+		calleeCode = []byte{byte(vm.PUSH1), 7, byte(vm.SLOAD), byte(vm.STOP)}
+	)
+	// Call the callee with too little gas for its cold SLOAD
+	code := []byte{
+		byte(vm.PUSH1), 0, // retSize
+		byte(vm.PUSH1), 0, // retOffset
+		byte(vm.PUSH1), 0, // argsSize
+		byte(vm.PUSH1), 0, // argsOffset
+		byte(vm.PUSH1), 0, // value
+		byte(vm.PUSH20),
+	}
+	code = append(code, callee.Bytes()...)
+	code = append(code, byte(vm.PUSH1), 50, byte(vm.CALL), byte(vm.POP))
+
+	res, err := runTestTracer(t, newTestTracer(t, "witnessTracer", ""), code, map[common.Address][]byte{callee: calleeCode})
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var have witnessResult
+	if err := json.Unmarshal(res, &have); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+	if have.Slots != 1 {
+		t.Fatalf("slot count mismatch: have %d, want 1", have.Slots)
+	}
+}
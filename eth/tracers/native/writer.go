@@ -0,0 +1,124 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// traceWriterChunk is the granularity in which file backed trace outputs are
+// grown. Larger chunks mean fewer remaps (or flushes) at the cost of a larger
+// sparse tail that is cut off again on close.
+const traceWriterChunk = 16 * 1024 * 1024
+
+// errMmapUnsupported is returned by newMmapWriter on platforms that lack
+// support for shared file mappings.
+var errMmapUnsupported = errors.New("mmap output not supported on this platform")
+
+// outputDir is the directory the files named in the config of a tracer are
+// created in. Configs are passed in by RPC callers, so file names are refused
+// unless the operator sets a directory with SetOutputDir.
+var outputDir string
+
+// errNoOutputDir is returned when a tracer config names an output file without
+// an output directory set.
+var errNoOutputDir = errors.New("output files are disabled, no tracer output directory configured")
+
+// SetOutputDir sets the directory the tracers create the output files named in
+// their config in. An empty dir refuses such files, the default.
+func SetOutputDir(dir string) {
+	outputDir = dir
+}
+
+// outputPath resolves a file name from a tracer config within the output
+// directory, rejecting names leading out of it.
+func outputPath(name string) (string, error) {
+	if outputDir == "" {
+		return "", errNoOutputDir
+	}
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("output file %q is not within the tracer output directory", name)
+	}
+	return filepath.Join(outputDir, clean), nil
+}
+
+// traceWriter is an append-only sink for file backed tracer output.
+//
+// Data handed to Write is visible to other readers of the file once Write
+// returns, but it is only guaranteed to be durable once Sync returns. If the
+// process crashes before Close, the file may be followed by zero padding up to
+// the next chunk boundary, which readers should strip.
+type traceWriter interface {
+	Write(p []byte) (int, error)
+	Sync() error
+	Close() error
+}
+
+// newTraceWriter creates the named file and returns a writer appending to it.
+// Existing files are never overwritten, creating one fails instead. A memory
+// mapped writer is used where the platform and the
+// filesystem support it, falling back to a buffered file writer otherwise.
+func newTraceWriter(filename string) (traceWriter, error) {
+	if w, err := newMmapWriter(filename, traceWriterChunk); err == nil {
+		return w, nil
+	}
+	return newBufferedWriter(filename)
+}
+
+// bufferedWriter is a traceWriter backed by a regular buffered file.
+type bufferedWriter struct {
+	file *os.File
+	buf  *bufio.Writer
+}
+
+// newBufferedWriter creates the named file, unless it exists, and returns a
+// buffered writer appending to it.
+func newBufferedWriter(filename string) (*bufferedWriter, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedWriter{file: file, buf: bufio.NewWriterSize(file, 1024*1024)}, nil
+}
+
+// Write appends p to the buffer, flushing it to the file when full.
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// Sync flushes the buffer and commits the file contents to stable storage.
+func (w *bufferedWriter) Sync() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Close flushes any buffered data and closes the file.
+func (w *bufferedWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
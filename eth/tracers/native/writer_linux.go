@@ -0,0 +1,121 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package native
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapWriter is a traceWriter appending into a shared memory mapping of the
+// output file. The file is pre-extended in chunks so that appending a row is
+// a plain memory copy, and truncated to the real length on Close.
+//
+// Written data lives in the page cache as soon as it is copied into the
+// mapping, so it survives a crash of the process itself. Only data up to the
+// last Sync (msync) is guaranteed to survive a crash of the machine.
+type mmapWriter struct {
+	file  *os.File
+	data  []byte // Current mapping of the file
+	size  int    // Number of bytes written so far
+	chunk int    // Size by which the file is grown when the mapping is full
+}
+
+// newMmapWriter creates the named file, unless it exists, and maps its first
+// chunk into memory. An error is returned if the filesystem refuses to map
+// the file, in which case callers should fall back to a buffered writer.
+func newMmapWriter(filename string, chunk int) (*mmapWriter, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &mmapWriter{file: file, chunk: chunk}
+	if err := w.grow(chunk); err != nil {
+		file.Close()
+		os.Remove(filename)
+		return nil, err
+	}
+	return w, nil
+}
+
+// grow extends the file by at least n bytes and remaps it. The old mapping is
+// only released once the new one is in place, so a failure leaves the writer
+// with its previous mapping and the data written so far intact.
+func (w *mmapWriter) grow(n int) error {
+	length := len(w.data) + (n+w.chunk-1)/w.chunk*w.chunk
+	if err := w.file.Truncate(int64(length)); err != nil {
+		return err
+	}
+	data, err := unix.Mmap(int(w.file.Fd()), 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if w.data != nil {
+		if err := unix.Munmap(w.data); err != nil {
+			unix.Munmap(data)
+			return err
+		}
+	}
+	w.data = data
+	return nil
+}
+
+// Write appends p to the mapping, growing the file if needed.
+func (w *mmapWriter) Write(p []byte) (int, error) {
+	if w.data == nil {
+		return 0, os.ErrClosed
+	}
+	if w.size+len(p) > len(w.data) {
+		if err := w.grow(w.size + len(p) - len(w.data)); err != nil {
+			return 0, err
+		}
+	}
+	copy(w.data[w.size:], p)
+	w.size += len(p)
+	return len(p), nil
+}
+
+// Sync commits the data written so far to stable storage.
+func (w *mmapWriter) Sync() error {
+	if w.data == nil {
+		return os.ErrClosed
+	}
+	if w.size == 0 {
+		return nil
+	}
+	return unix.Msync(w.data[:w.size], unix.MS_SYNC)
+}
+
+// Close unmaps the file, cuts off the preallocated tail and closes it.
+func (w *mmapWriter) Close() error {
+	if w.data != nil {
+		if err := unix.Munmap(w.data); err != nil {
+			w.file.Close()
+			return err
+		}
+		w.data = nil
+	}
+	if err := w.file.Truncate(int64(w.size)); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
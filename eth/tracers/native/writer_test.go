@@ -0,0 +1,192 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testWriters returns constructors for every traceWriter implementation that
+// is usable on the current platform, growing mmapped files by chunk bytes.
+func testWriters(chunk int) map[string]func(string) (traceWriter, error) {
+	writers := map[string]func(string) (traceWriter, error){
+		"buffered": func(name string) (traceWriter, error) { return newBufferedWriter(name) },
+	}
+	if runtime.GOOS == "linux" {
+		writers["mmap"] = func(name string) (traceWriter, error) { return newMmapWriter(name, chunk) }
+	}
+	return writers
+}
+
+// Tests that rows appended to a trace writer end up in the file verbatim,
+// including when the output outgrows the preallocated chunks.
+func TestTraceWriterRoundtrip(t *testing.T) {
+	for name, ctor := range testWriters(4096) {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trace.csv")
+			w, err := ctor(path)
+			if err != nil {
+				t.Fatalf("failed to create writer: %v", err)
+			}
+			var want bytes.Buffer
+			for i := 0; i < 2000; i++ {
+				row := fmt.Sprintf("PUSH1,%d,3\n", i)
+				want.WriteString(row)
+				if _, err := w.Write([]byte(row)); err != nil {
+					t.Fatalf("failed to write row %d: %v", i, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("failed to close writer: %v", err)
+			}
+			have, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read output: %v", err)
+			}
+			if !bytes.Equal(have, want.Bytes()) {
+				t.Fatalf("output mismatch: have %d bytes, want %d bytes", len(have), want.Len())
+			}
+		})
+	}
+}
+
+// Tests that everything written up to the last Sync is readable from the file
+// even if the writer is never closed, i.e. the process crashed mid-trace.
+func TestTraceWriterSyncedDataSurvives(t *testing.T) {
+	for name, ctor := range testWriters(4096) {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trace.csv")
+			w, err := ctor(path)
+			if err != nil {
+				t.Fatalf("failed to create writer: %v", err)
+			}
+			defer w.Close()
+
+			synced := bytes.Repeat([]byte("SLOAD,2100,2100\n"), 500)
+			if _, err := w.Write(synced); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			if err := w.Sync(); err != nil {
+				t.Fatalf("failed to sync: %v", err)
+			}
+			have, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read output: %v", err)
+			}
+			// The mmap writer leaves zero padding behind the synced data
+			if !bytes.Equal(bytes.TrimRight(have, "\x00"), synced) {
+				t.Fatalf("synced data lost: have %d bytes, want %d bytes", len(bytes.TrimRight(have, "\x00")), len(synced))
+			}
+		})
+	}
+}
+
+// Tests that the mmap writer keeps its mapping, and with it the data written so
+// far, if growing the file fails.
+func TestMmapWriterGrowFailure(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mmap writer not supported on " + runtime.GOOS)
+	}
+	path := filepath.Join(t.TempDir(), "trace.csv")
+	w, err := newMmapWriter(path, 4096)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	synced := bytes.Repeat([]byte("SLOAD,2100,2100\n"), 100)
+	if _, err := w.Write(synced); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	// Close the file under the writer, failing the next remap
+	w.file.Close()
+	if _, err := w.Write(make([]byte, 4096)); err == nil {
+		t.Fatalf("write past the mapping succeeded with the file closed")
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	have, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if !bytes.Equal(bytes.TrimRight(have, "\x00"), synced) {
+		t.Fatalf("synced data lost: have %d bytes, want %d bytes", len(bytes.TrimRight(have, "\x00")), len(synced))
+	}
+}
+
+// writeSyscalls returns the number of write syscalls the process issued, read
+// from /proc/self/io, or false if the count is not available.
+func writeSyscalls() (int, bool) {
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "syscw: ") {
+			n, err := strconv.Atoi(strings.TrimPrefix(line, "syscw: "))
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// BenchmarkTraceWriter appends rows, syncing every syncRows of them like a
+// checkpointing tracer, and reports the write syscalls and syncs (fsync or
+// msync) issued per row alongside the time.
+func BenchmarkTraceWriter(b *testing.B) {
+	const syncRows = 10000
+
+	row := []byte("KECCAK256,1234,36,runtime\n")
+	for name, ctor := range testWriters(traceWriterChunk) {
+		b.Run(name, func(b *testing.B) {
+			w, err := ctor(filepath.Join(b.TempDir(), "trace.csv"))
+			if err != nil {
+				b.Fatalf("failed to create writer: %v", err)
+			}
+			b.SetBytes(int64(len(row)))
+			b.ReportAllocs()
+			writes, countWrites := writeSyscalls()
+			syncs := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.Write(row)
+				if (i+1)%syncRows == 0 {
+					if err := w.Sync(); err != nil {
+						b.Fatalf("failed to sync writer: %v", err)
+					}
+					syncs++
+				}
+			}
+			if err := w.Close(); err != nil {
+				b.Fatalf("failed to close writer: %v", err)
+			}
+			b.StopTimer()
+			if n, ok := writeSyscalls(); ok && countWrites {
+				b.ReportMetric(float64(n-writes)/float64(b.N), "writes/op")
+			}
+			b.ReportMetric(float64(syncs)/float64(b.N), "syncs/op")
+		})
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	// defaultResultTTL is the time an asynchronously encoded trace result is
+	// kept around for retrieval, if the trace config doesn't specify otherwise.
+	defaultResultTTL = 10 * time.Minute
+
+	// maxResultTTL is the longest time a trace result is kept around, longer
+	// ones requested are cut to it.
+	maxResultTTL = time.Hour
+
+	// maxSpooledResults is the number of trace results kept around at once,
+	// bounding the disk space a caller can take up.
+	maxSpooledResults = 16
+)
+
+var (
+	errResultNotFound = errors.New("trace result not found or expired")
+	errInvalidRange   = errors.New("invalid trace result range")
+	errInvalidTTL     = errors.New("trace result TTL must be positive")
+	errSpoolFull      = errors.New("too many trace results spooled, retry once some expired")
+)
+
+// ResultEncoder is an optional interface for tracers that are able to encode
+// their result incrementally into a writer instead of materializing it in
+// memory. The written data must be identical to the GetResult output.
+type ResultEncoder interface {
+	EncodeResult(w io.Writer) error
+}
+
+// ResultHandle is returned by trace calls in async mode, identifying the
+// result being encoded in the background.
+type ResultHandle struct {
+	Handle  string    `json:"handle"`
+	Expires time.Time `json:"expires"`
+}
+
+// ResultChunk is a range of a trace result fetched from the spool.
+type ResultChunk struct {
+	Data   string         `json:"data"`   // Raw bytes of the JSON encoded result in this range
+	Offset hexutil.Uint64 `json:"offset"` // Position of the chunk within the result
+	Size   hexutil.Uint64 `json:"size"`   // Total size of the result
+}
+
+// spooledResult is a trace result encoded to a file in the background.
+type spooledResult struct {
+	lock    sync.RWMutex  // Held for reading while the file is accessed
+	path    string        // Location of the spooled result
+	done    chan struct{} // Closed when encoding has finished
+	size    int64         // Size of the encoded result, valid after done
+	err     error         // Error encountered during encoding, valid after done
+	expired bool          // Whether the file was already removed
+}
+
+// resultSpool keeps trace results that are encoded asynchronously to disk and
+// hands them out by handle until they expire.
+type resultSpool struct {
+	dir     string // Directory to spool results into, empty for the default temp dir
+	lock    sync.Mutex
+	results map[string]*spooledResult
+}
+
+// newResultSpool creates a spool storing its files in dir.
+func newResultSpool(dir string) *resultSpool {
+	return &resultSpool{dir: dir, results: make(map[string]*spooledResult)}
+}
+
+// parseResultTTL parses the time to live of a trace result, the default if
+// nil. It has to be positive and is cut to the maximum.
+func parseResultTTL(ttl *string) (time.Duration, error) {
+	if ttl == nil {
+		return defaultResultTTL, nil
+	}
+	d, err := time.ParseDuration(*ttl)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errInvalidTTL
+	}
+	if d > maxResultTTL {
+		d = maxResultTTL
+	}
+	return d, nil
+}
+
+// add starts encoding the tracer's result in the background and returns the
+// handle it can be retrieved with during the given time to live. If the spool
+// holds the maximum number of results already, the result is refused.
+func (s *resultSpool) add(tracer Tracer, ttl time.Duration) (*ResultHandle, error) {
+	if ttl <= 0 {
+		return nil, errInvalidTTL
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	var (
+		handle = hex.EncodeToString(id[:])
+		result = &spooledResult{done: make(chan struct{})}
+	)
+	// Reserve the slot before creating the file, so concurrent calls can't
+	// exceed the limit
+	s.lock.Lock()
+	if len(s.results) >= maxSpooledResults {
+		s.lock.Unlock()
+		return nil, errSpoolFull
+	}
+	s.results[handle] = result
+	s.lock.Unlock()
+
+	file, err := os.CreateTemp(s.dir, "trace-*.json")
+	if err != nil {
+		s.lock.Lock()
+		delete(s.results, handle)
+		s.lock.Unlock()
+		return nil, err
+	}
+	result.path = file.Name()
+
+	go func() {
+		result.size, result.err = encodeResult(tracer, file)
+		if err := file.Close(); err != nil && result.err == nil {
+			result.err = err
+		}
+		close(result.done)
+	}()
+	time.AfterFunc(ttl, func() { s.expire(handle) })
+
+	return &ResultHandle{Handle: handle, Expires: time.Now().Add(ttl)}, nil
+}
+
+// encodeResult writes the tracer's result into w, incrementally if the tracer
+// supports it, and returns the number of bytes written.
+func encodeResult(tracer Tracer, w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	if enc, ok := tracer.(ResultEncoder); ok {
+		err := enc.EncodeResult(cw)
+		return cw.n, err
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		return 0, err
+	}
+	_, err = cw.Write(res)
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// expire drops a result from the spool and removes its file. Fetches running
+// concurrently are allowed to finish first.
+func (s *resultSpool) expire(handle string) {
+	s.lock.Lock()
+	result, ok := s.results[handle]
+	delete(s.results, handle)
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+	// Wait for the encoder to release the file before removing it
+	<-result.done
+
+	result.lock.Lock()
+	defer result.lock.Unlock()
+	result.expired = true
+	if err := os.Remove(result.path); err != nil && !os.IsNotExist(err) {
+		log.Warn("Failed to remove spooled trace result", "path", result.path, "err", err)
+	}
+}
+
+// fetch waits for the result to be encoded and returns length bytes of it
+// starting at offset. A zero length returns everything past the offset.
+func (s *resultSpool) fetch(ctx context.Context, handle string, offset, length uint64) ([]byte, int64, error) {
+	s.lock.Lock()
+	result, ok := s.results[handle]
+	s.lock.Unlock()
+	if !ok {
+		return nil, 0, errResultNotFound
+	}
+	select {
+	case <-result.done:
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+	if result.err != nil {
+		return nil, 0, fmt.Errorf("encoding trace result failed: %w", result.err)
+	}
+	if offset > uint64(result.size) {
+		return nil, 0, errInvalidRange
+	}
+	if length == 0 || length > uint64(result.size)-offset {
+		length = uint64(result.size) - offset
+	}
+	result.lock.RLock()
+	defer result.lock.RUnlock()
+	if result.expired {
+		return nil, 0, errResultNotFound
+	}
+	file, err := os.Open(result.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, int64(offset)); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	return data, result.size, nil
+}
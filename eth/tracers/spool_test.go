@@ -0,0 +1,197 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// resultTracer is a tracer returning a fixed result.
+type resultTracer struct {
+	vm.EVMLogger
+	result string
+}
+
+func (t *resultTracer) GetResult() (json.RawMessage, error) { return json.RawMessage(t.result), nil }
+func (t *resultTracer) Stop(err error)                      {}
+
+// encodingTracer is a tracer streaming its fixed result.
+type encodingTracer struct {
+	resultTracer
+	err error
+}
+
+func (t *encodingTracer) EncodeResult(w io.Writer) error {
+	if _, err := io.WriteString(w, t.result); err != nil {
+		return err
+	}
+	return t.err
+}
+
+func TestSpoolFetch(t *testing.T) {
+	var (
+		spool  = newResultSpool(t.TempDir())
+		result = `"` + strings.Repeat("0123456789", 1000) + `"`
+	)
+	for _, tracer := range []Tracer{&resultTracer{result: result}, &encodingTracer{resultTracer: resultTracer{result: result}}} {
+		handle, err := spool.add(tracer, time.Minute)
+		if err != nil {
+			t.Fatalf("failed to spool result: %v", err)
+		}
+		data, size, err := spool.fetch(context.Background(), handle.Handle, 0, 0)
+		if err != nil {
+			t.Fatalf("failed to fetch result: %v", err)
+		}
+		if string(data) != result || size != int64(len(result)) {
+			t.Fatalf("result mismatch: have %d bytes, want %d", len(data), len(result))
+		}
+		// Fetch the result in chunks concurrently
+		var (
+			chunk  = uint64(999)
+			chunks = make([][]byte, (uint64(len(result))+chunk-1)/chunk)
+			wg     sync.WaitGroup
+		)
+		for i := range chunks {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				data, _, err := spool.fetch(context.Background(), handle.Handle, uint64(i)*chunk, chunk)
+				if err != nil {
+					t.Errorf("failed to fetch chunk %d: %v", i, err)
+				}
+				chunks[i] = data
+			}(i)
+		}
+		wg.Wait()
+		var joined []byte
+		for _, c := range chunks {
+			joined = append(joined, c...)
+		}
+		if string(joined) != result {
+			t.Fatalf("chunked result mismatch")
+		}
+		if _, _, err := spool.fetch(context.Background(), handle.Handle, uint64(len(result))+1, 0); err != errInvalidRange {
+			t.Fatalf("out of range fetch: have %v, want %v", err, errInvalidRange)
+		}
+	}
+}
+
+func TestSpoolEncodeError(t *testing.T) {
+	var (
+		spool  = newResultSpool(t.TempDir())
+		tracer = &encodingTracer{resultTracer: resultTracer{result: `"partial`}, err: errors.New("boom")}
+	)
+	handle, err := spool.add(tracer, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to spool result: %v", err)
+	}
+	if _, _, err := spool.fetch(context.Background(), handle.Handle, 0, 0); !errors.Is(err, tracer.err) {
+		t.Fatalf("fetch error mismatch: have %v, want %v", err, tracer.err)
+	}
+}
+
+func TestSpoolExpiry(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		spool = newResultSpool(dir)
+	)
+	handle, err := spool.add(&resultTracer{result: `{}`}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to spool result: %v", err)
+	}
+	if _, _, err := spool.fetch(context.Background(), handle.Handle, 0, 0); err != nil {
+		t.Fatalf("failed to fetch result: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, _, err := spool.fetch(context.Background(), handle.Handle, 0, 0); err != errResultNotFound {
+		t.Fatalf("expired fetch: have %v, want %v", err, errResultNotFound)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("spool file not removed: %v", files)
+	}
+	if _, _, err := spool.fetch(context.Background(), "unknown", 0, 0); err != errResultNotFound {
+		t.Fatalf("unknown handle: have %v, want %v", err, errResultNotFound)
+	}
+}
+
+func TestParseResultTTL(t *testing.T) {
+	newString := func(s string) *string { return &s }
+	for _, tt := range []struct {
+		ttl  *string
+		want time.Duration
+		err  bool
+	}{
+		{nil, defaultResultTTL, false},
+		{newString("30s"), 30 * time.Second, false},
+		{newString("48h"), maxResultTTL, false},
+		{newString("0s"), 0, true},
+		{newString("-1m"), 0, true},
+		{newString("soon"), 0, true},
+	} {
+		have, err := parseResultTTL(tt.ttl)
+		if (err != nil) != tt.err {
+			t.Errorf("ttl %v: error mismatch: have %v, want error %v", tt.ttl, err, tt.err)
+			continue
+		}
+		if have != tt.want {
+			t.Errorf("ttl %v: mismatch: have %v, want %v", tt.ttl, have, tt.want)
+		}
+	}
+}
+
+func TestSpoolLimit(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		spool = newResultSpool(dir)
+	)
+	var handles []string
+	for i := 0; i < maxSpooledResults; i++ {
+		handle, err := spool.add(&resultTracer{result: `{}`}, time.Minute)
+		if err != nil {
+			t.Fatalf("result %d: failed to spool: %v", i, err)
+		}
+		handles = append(handles, handle.Handle)
+	}
+	if _, err := spool.add(&resultTracer{result: `{}`}, time.Minute); err != errSpoolFull {
+		t.Fatalf("full spool: have %v, want %v", err, errSpoolFull)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != maxSpooledResults {
+		t.Fatalf("spool file count mismatch: have %d, want %d", len(files), maxSpooledResults)
+	}
+	// An expired result frees its slot
+	spool.expire(handles[0])
+	if _, err := spool.add(&resultTracer{result: `{}`}, time.Minute); err != nil {
+		t.Fatalf("failed to spool after expiry: %v", err)
+	}
+	if _, err := spool.add(&resultTracer{result: `{}`}, 0); err != errInvalidTTL {
+		t.Fatalf("zero ttl: have %v, want %v", err, errInvalidTTL)
+	}
+}
@@ -44,12 +44,31 @@ type Tracer interface {
 	Stop(err error)
 }
 
+// ColumnInfo describes a column of the tabular output produced by a tracer.
+type ColumnInfo struct {
+	Name string `json:"name"`           // Header of the column in the output
+	Type string `json:"type"`           // Type of the values: int, float, string or bool
+	Unit string `json:"unit,omitempty"` // Unit of the values, if any
+}
+
+// ColumnTracer is an optional interface implemented by tracers producing
+// tabular output, allowing consumers to learn the emitted columns for a given
+// configuration before running a trace.
+type ColumnTracer interface {
+	Tracer
+	// Columns returns the columns emitted for the tracer's configuration, in
+	// the order they appear in the output.
+	Columns() []ColumnInfo
+}
+
 type ctorFn func(*Context, json.RawMessage) (Tracer, error)
 type jsCtorFn func(string, *Context, json.RawMessage) (Tracer, error)
+type columnsFn func(json.RawMessage) ([]ColumnInfo, error)
 
 type elem struct {
-	ctor ctorFn
-	isJS bool
+	ctor    ctorFn
+	columns columnsFn // Columns of the tabular output, nil to instantiate the tracer
+	isJS    bool
 }
 
 // DefaultDirectory is the collection of tracers bundled by default.
@@ -69,6 +88,16 @@ func (d *directory) Register(name string, f ctorFn, isJS bool) {
 	d.elems[name] = elem{ctor: f, isJS: isJS}
 }
 
+// RegisterColumns registers a method returning the columns of the named
+// tracer's tabular output for a config. Tracers whose constructor opens
+// hardware counters register one, so that listing their columns doesn't. The
+// tracer itself has to be registered first.
+func (d *directory) RegisterColumns(name string, f columnsFn) {
+	elem := d.elems[name]
+	elem.columns = f
+	d.elems[name] = elem
+}
+
 // RegisterJSEval registers a tracer that is able to parse
 // dynamic user-provided JS code.
 func (d *directory) RegisterJSEval(f jsCtorFn) {
@@ -86,6 +115,28 @@ func (d *directory) New(name string, ctx *Context, cfg json.RawMessage) (Tracer,
 	return d.jsEval(name, ctx, cfg)
 }
 
+// Columns returns the columns of the named tracer's tabular output for the
+// given config, without running a trace. Unless the tracer registered its
+// columns, it is instantiated to ask it.
+func (d *directory) Columns(name string, ctx *Context, cfg json.RawMessage) ([]ColumnInfo, error) {
+	elem, ok := d.elems[name]
+	if !ok {
+		return nil, fmt.Errorf("tracer %q not found", name)
+	}
+	if elem.columns != nil {
+		return elem.columns(cfg)
+	}
+	tracer, err := elem.ctor(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	ct, ok := tracer.(ColumnTracer)
+	if !ok {
+		return nil, fmt.Errorf("tracer %q does not produce tabular output", name)
+	}
+	return ct.Columns(), nil
+}
+
 // IsJS will return true if the given tracer will evaluate
 // JS code. Because code evaluation has high overhead, this
 // info will be used in determining fast and slow code paths.